@@ -0,0 +1,116 @@
+package zeroconf
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// entryAssembly keeps the records of the instances received so far, as
+// they often arrive in separate packets, e.g. from embedded devices. The
+// instances are indexed by host, so that address records arriving after
+// the SRV record update the entries of their host.
+type entryAssembly struct {
+	entries map[string]*ServiceEntry
+	hosts   map[string]map[string]bool // canonical host name -> instance keys
+}
+
+func newEntryAssembly() *entryAssembly {
+	return &entryAssembly{
+		entries: make(map[string]*ServiceEntry),
+		hosts:   make(map[string]map[string]bool),
+	}
+}
+
+func (a *entryAssembly) get(k string) (*ServiceEntry, bool) {
+	e, found := a.entries[k]
+	return e, found
+}
+
+// put stores a copy of the entry.
+func (a *entryAssembly) put(k string, e *ServiceEntry) {
+	a.unindex(k)
+	c := *e
+	a.entries[k] = &c
+	if c.HostName != "" {
+		host := dns.CanonicalName(c.HostName)
+		if a.hosts[host] == nil {
+			a.hosts[host] = make(map[string]bool)
+		}
+		a.hosts[host][k] = true
+	}
+}
+
+func (a *entryAssembly) remove(k string) {
+	a.unindex(k)
+	delete(a.entries, k)
+}
+
+func (a *entryAssembly) unindex(k string) {
+	old, found := a.entries[k]
+	if !found || old.HostName == "" {
+		return
+	}
+	host := dns.CanonicalName(old.HostName)
+	delete(a.hosts[host], k)
+	if len(a.hosts[host]) == 0 {
+		delete(a.hosts, host)
+	}
+}
+
+// expire removes the instances expired at t.
+func (a *entryAssembly) expire(t time.Time) {
+	for k, e := range a.entries {
+		if t.After(e.Expiry) {
+			a.remove(k)
+		}
+	}
+}
+
+// addLateAddrs adds the addresses of the message to the entries of the
+// instances on their hosts. Instances without records in the message are
+// added to entries with their assembled records, so that they are
+// delivered again with the new addresses. Entries with a host of their own
+// had their addresses associated by parseEntries.
+func (a *entryAssembly) addLateAddrs(msg *dns.Msg, entries map[string]*ServiceEntry) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			for k := range a.hosts[dns.CanonicalName(rr.Header().Name)] {
+				e, found := entries[k]
+				if !found {
+					c := *a.entries[k]
+					c.AddrIPv4 = append([]net.IP(nil), c.AddrIPv4...)
+					c.AddrIPv6 = append([]net.IP(nil), c.AddrIPv6...)
+					e = &c
+					entries[k] = e
+				} else if e.HostName != "" {
+					continue
+				}
+				if ip.To4() != nil {
+					e.AddrIPv4 = appendIP(e.AddrIPv4, ip)
+				} else {
+					e.AddrIPv6 = appendIP(e.AddrIPv6, ip)
+				}
+			}
+		}
+	}
+}
+
+func appendIP(ips []net.IP, ip net.IP) []net.IP {
+	for _, other := range ips {
+		if other.Equal(ip) {
+			return ips
+		}
+	}
+	return append(ips, ip)
+}
@@ -0,0 +1,132 @@
+package zeroconf
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// BackpressurePolicy defines how entries are delivered to a consumer which
+// does not keep up with the received updates.
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock waits for the consumer. Meanwhile, no messages are
+	// processed and received messages may be dropped. This is the default.
+	BackpressureBlock BackpressurePolicy = iota
+	// BackpressureDropOldest queues the entries and discards the oldest
+	// queued entry when the queue is full.
+	BackpressureDropOldest
+	// BackpressureCoalesce queues the entries and replaces a queued entry by
+	// a newer update of the same instance.
+	BackpressureCoalesce
+)
+
+// Backpressure configures the delivery of entries to slow consumers and
+// counts the updates discarded. It is passed to Browse, Lookup or
+// NewResolver with the WithBackpressure option.
+type Backpressure struct {
+	policy    BackpressurePolicy
+	queueSize int
+	discarded atomic.Uint64
+}
+
+// NewBackpressure creates a Backpressure with the given policy. The queue
+// size limits the entries queued by BackpressureDropOldest.
+func NewBackpressure(policy BackpressurePolicy, queueSize int) *Backpressure {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	return &Backpressure{policy: policy, queueSize: queueSize}
+}
+
+// Discarded returns the number of updates discarded so far.
+func (b *Backpressure) Discarded() uint64 {
+	return b.discarded.Load()
+}
+
+// WithBackpressure sets the policy for slow consumers of entries.
+func WithBackpressure(b *Backpressure) ClientOption {
+	return func(o *clientOpts) {
+		o.backpressure = b
+	}
+}
+
+type queuedEntry struct {
+	key   string
+	entry *ServiceEntry
+}
+
+// entryQueue decouples the main loop from the consumer of the entries.
+type entryQueue struct {
+	bp      *Backpressure
+	mu      sync.Mutex
+	entries []queuedEntry
+	ready   chan struct{}
+}
+
+// newEntryQueue returns a queue for the policy, or nil if entries are to be
+// delivered directly.
+func newEntryQueue(bp *Backpressure) *entryQueue {
+	if bp == nil || bp.policy == BackpressureBlock {
+		return nil
+	}
+	return &entryQueue{bp: bp, ready: make(chan struct{}, 1)}
+}
+
+// push queues the entry of the instance key without blocking.
+func (q *entryQueue) push(key string, e *ServiceEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	switch q.bp.policy {
+	case BackpressureCoalesce:
+		for i := range q.entries {
+			if q.entries[i].key == key {
+				q.entries[i].entry = e
+				q.bp.discarded.Add(1)
+				return
+			}
+		}
+	case BackpressureDropOldest:
+		if len(q.entries) >= q.bp.queueSize {
+			q.entries = q.entries[1:]
+			q.bp.discarded.Add(1)
+		}
+	}
+	q.entries = append(q.entries, queuedEntry{key: key, entry: e})
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *entryQueue) pop() (*ServiceEntry, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) == 0 {
+		return nil, false
+	}
+	e := q.entries[0].entry
+	q.entries = q.entries[1:]
+	return e, true
+}
+
+// forward sends the queued entries to out until the context is canceled.
+func (q *entryQueue) forward(ctx context.Context, out chan<- *ServiceEntry) {
+	for {
+		e, ok := q.pop()
+		if !ok {
+			select {
+			case <-q.ready:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case out <- e:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package zeroconf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxLabelLength = 63  // RFC 1035 section 2.3.4
+	maxTXTString   = 255 // RFC 6763 section 6.1
+)
+
+// ServiceBuilder builds a validated ServiceEntry to be registered with
+// RegisterEntry or Server.RegisterEntry, e.g.
+//
+//	entry, err := zeroconf.NewService("My printer", "_ipp._tcp").
+//		Port(631).
+//		TXT(map[string]string{"rp": "printers/1"}).
+//		Subtypes("_universal").
+//		Build()
+//
+// The first invalid field is reported by Build.
+type ServiceBuilder struct {
+	instance string
+	service  string
+	domain   string
+	host     string
+	port     int
+	priority int
+	weight   int
+	text     []string
+	textSets [][]string
+	subtypes []string
+	err      error
+}
+
+// NewService starts building a service instance of the given type. Subtypes
+// may be appended to the type separated by commas, as in Register. A trailing
+// domain is stripped from the type, with a logged warning.
+func NewService(instance, service string) *ServiceBuilder {
+	service, subtypes := parseSubtypes(normalizeServiceType(service, nil))
+	return &ServiceBuilder{
+		instance: instance,
+		service:  service,
+		subtypes: subtypes,
+		domain:   "local.",
+	}
+}
+
+// Domain sets the domain, "local." by default.
+func (b *ServiceBuilder) Domain(domain string) *ServiceBuilder {
+	if domain != "" {
+		b.domain = domain
+	}
+	return b
+}
+
+// Host sets the host name of the service. By default, the host name of the
+// system is used.
+func (b *ServiceBuilder) Host(host string) *ServiceBuilder {
+	b.host = host
+	return b
+}
+
+// Port sets the port of the service.
+func (b *ServiceBuilder) Port(port int) *ServiceBuilder {
+	b.port = port
+	return b
+}
+
+// TXT adds the key/value pairs to the TXT record, sorted by key. An empty
+// value publishes the key as a boolean attribute.
+func (b *ServiceBuilder) TXT(pairs map[string]string) *ServiceBuilder {
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if b.err == nil {
+			b.err = validateTXTKey(k)
+		}
+		txt := k
+		if v := pairs[k]; v != "" {
+			txt = k + "=" + v
+		}
+		if len(txt) > maxTXTString && b.err == nil {
+			b.err = fmt.Errorf("TXT string for key %q exceeds %d bytes", k, maxTXTString)
+		}
+		b.text = append(b.text, txt)
+	}
+	return b
+}
+
+// Text adds raw strings to the TXT record. Strings longer than 255 bytes are
+// split, as in Register.
+func (b *ServiceBuilder) Text(text ...string) *ServiceBuilder {
+	b.text = append(b.text, text...)
+	return b
+}
+
+// Priority sets the priority and weight of the SRV record, both zero by
+// default. Clients prefer lower priorities and, among the same priority,
+// higher weights, see OrderEntries.
+func (b *ServiceBuilder) Priority(priority, weight int) *ServiceBuilder {
+	b.priority = priority
+	b.weight = weight
+	return b
+}
+
+// TextSet adds a further TXT record with the strings, for protocols which
+// publish several TXT records under one instance name.
+func (b *ServiceBuilder) TextSet(text ...string) *ServiceBuilder {
+	b.textSets = append(b.textSets, append([]string(nil), text...))
+	return b
+}
+
+// Subtypes adds subtypes the service is announced for.
+func (b *ServiceBuilder) Subtypes(subtypes ...string) *ServiceBuilder {
+	b.subtypes = append(b.subtypes, subtypes...)
+	return b
+}
+
+// Build validates the fields and returns the entry.
+func (b *ServiceBuilder) Build() (*ServiceEntry, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.instance == "" {
+		return nil, fmt.Errorf("missing service instance name")
+	}
+	if !utf8.ValidString(b.instance) {
+		return nil, fmt.Errorf("service instance name is not valid UTF-8")
+	}
+	if len(b.instance) > maxLabelLength {
+		return nil, fmt.Errorf("service instance name exceeds %d bytes", maxLabelLength)
+	}
+	if err := validateServiceType(b.service); err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(trimDot(b.service), serviceTypeEnumeration) {
+		return nil, fmt.Errorf("service type %s is reserved for enumeration", serviceTypeEnumeration)
+	}
+	for _, subtype := range b.subtypes {
+		if err := validateLabels("subtype", subtype); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateLabels("domain", b.domain); err != nil {
+		return nil, err
+	}
+	if b.port < 1 || b.port > 65535 {
+		if b.port == 0 {
+			return nil, fmt.Errorf("missing port")
+		}
+		return nil, fmt.Errorf("invalid port %d", b.port)
+	}
+	if b.priority < 0 || b.priority > 65535 {
+		return nil, fmt.Errorf("invalid priority %d", b.priority)
+	}
+	if b.weight < 0 || b.weight > 65535 {
+		return nil, fmt.Errorf("invalid weight %d", b.weight)
+	}
+
+	service := strings.Join(append([]string{b.service}, b.subtypes...), ",")
+	entry := newServiceEntry(b.instance, service, b.domain)
+	entry.HostName = b.host
+	entry.Port = b.port
+	entry.Priority = b.priority
+	entry.Weight = b.weight
+	entry.Text = b.text
+	entry.TextSets = b.textSets
+	return entry, nil
+}
+
+// validateLabels checks the length of each label of a domain name.
+func validateLabels(what, name string) error {
+	for _, label := range strings.Split(trimDot(name), ".") {
+		if label == "" {
+			return fmt.Errorf("%s %q contains an empty label", what, name)
+		}
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("%s %q has a label exceeding %d bytes", what, name, maxLabelLength)
+		}
+	}
+	return nil
+}
+
+// validateTXTKey checks a TXT key as specified by RFC 6763 section 6.4.
+func validateTXTKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("empty TXT key")
+	}
+	if strings.Contains(key, "=") {
+		return fmt.Errorf("TXT key %q contains '='", key)
+	}
+	for _, c := range key {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Errorf("TXT key %q contains non-printable characters", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package zeroconf
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrInstanceAbsent is returned by Resolver.Lookup for an instance which
+// recently turned out not to exist, see NegativeCache.
+var ErrInstanceAbsent = errors.New("instance is absent")
+
+// absentAfter is the time a lookup waits without any record of the instance
+// before the instance is considered absent.
+const absentAfter = 3 * time.Second
+
+// NegativeCache makes a Resolver remember instances which do not exist for
+// ttl, so that repeated lookups of a vanished device fail fast with
+// ErrInstanceAbsent instead of waiting for their timeout. An instance is
+// absent if a responder asserts so with an NSEC record without SRV, or if a
+// lookup receives no record of it for three seconds. Any record of the
+// instance received later, e.g. an announcement, ends the negative entry, as
+// does FlushCache. Non-positive durations disable the negative cache, which
+// is the default.
+func NegativeCache(ttl time.Duration) ClientOption {
+	return func(o *clientOpts) {
+		o.negativeTTL = ttl
+	}
+}
+
+// entryCache keeps the entries delivered by the lookups of a Resolver per
+// service type, so that they can be listed without querying.
+type entryCache struct {
+	mu       sync.Mutex
+	services map[string]map[string]*ServiceEntry
+	// Expiry of the negative entries by canonical instance name
+	absent map[string]time.Time
+}
+
+func newEntryCache() *entryCache {
+	return &entryCache{
+		services: make(map[string]map[string]*ServiceEntry),
+		absent:   make(map[string]time.Time),
+	}
+}
+
+// put stores an entry of the service. A nil cache ignores the entry.
+func (c *entryCache) put(e *ServiceEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	service := cacheKey(e.Service)
+	if c.services[service] == nil {
+		c.services[service] = make(map[string]*ServiceEntry)
+	}
+	name := dns.CanonicalName(e.ServiceInstanceName())
+	c.services[service][name] = e
+	delete(c.absent, name)
+}
+
+// remove drops an entry of the service, e.g. after a goodbye.
+func (c *entryCache) remove(e *ServiceEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.services[cacheKey(e.Service)], dns.CanonicalName(e.ServiceInstanceName()))
+}
+
+// entries returns the unexpired entries of the service.
+func (c *entryCache) entries(service string, now time.Time) []*ServiceEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	instances := c.services[cacheKey(service)]
+	entries := make([]*ServiceEntry, 0, len(instances))
+	for k, e := range instances {
+		if !e.Expiry.After(now) {
+			delete(instances, k)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// hostAddrs returns the addresses of the host of an unexpired entry, if any.
+func (c *entryCache) hostAddrs(host string, now time.Time) []net.IP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, instances := range c.services {
+		for _, e := range instances {
+			if e.Expiry.After(now) && e.HostName != "" && equalNames(e.HostName, host) {
+				if ips := append(append([]net.IP(nil), e.AddrIPv4...), e.AddrIPv6...); len(ips) > 0 {
+					return ips
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// putAbsent stores a negative entry for the instance until the expiry. An
+// authoritative assertion drops a cached entry of the instance, otherwise an
+// unexpired entry means the instance exists and it is kept. A nil cache
+// ignores the instance.
+func (c *entryCache) putAbsent(service, instance string, expiry time.Time, authoritative bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := dns.CanonicalName(instance)
+	instances := c.services[cacheKey(service)]
+	if e, found := instances[name]; found {
+		if !authoritative && e.Expiry.After(time.Now()) {
+			return
+		}
+		delete(instances, name)
+	}
+	c.absent[name] = expiry
+}
+
+// isAbsent tells whether the instance has an unexpired negative entry.
+func (c *entryCache) isAbsent(instance string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := dns.CanonicalName(instance)
+	expiry, found := c.absent[name]
+	if found && !expiry.After(now) {
+		delete(c.absent, name)
+		return false
+	}
+	return found
+}
+
+// absentInstance returns the TTL of an NSEC record in the message asserting
+// that the instance has no SRV record, i.e. does not exist.
+func absentInstance(msg *dns.Msg, instance string) (uint32, bool) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			nsec, ok := rr.(*dns.NSEC)
+			if !ok || nsec.Hdr.Ttl == 0 || !equalNames(nsec.Hdr.Name, instance) {
+				continue
+			}
+			for _, t := range nsec.TypeBitMap {
+				if t == dns.TypeSRV {
+					return 0, false
+				}
+			}
+			return nsec.Hdr.Ttl, true
+		}
+	}
+	return 0, false
+}
+
+func (c *entryCache) flush() {
+	c.mu.Lock()
+	c.services = make(map[string]map[string]*ServiceEntry)
+	c.absent = make(map[string]time.Time)
+	c.mu.Unlock()
+}
+
+func cacheKey(service string) string {
+	return dns.CanonicalName(trimDot(service))
+}
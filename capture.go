@@ -0,0 +1,247 @@
+package zeroconf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// pcapng block types, options and link type, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+const (
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterfaceDesc  = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1A2B3C4D
+	pcapngLinkTypeRaw    = 101 // Raw IPv4 or IPv6 packets
+	pcapngOptEnd         = 0
+	pcapngOptIfName      = 2
+	pcapngOptEPBFlags    = 2
+	pcapngFlagInbound    = 1
+	pcapngFlagOutbound   = 2
+)
+
+// Sizes and fields of the reconstructed IP and UDP headers.
+const (
+	captureIPv4HeaderSize = 20
+	captureIPv6HeaderSize = 40
+	captureUDPHeaderSize  = 8
+	captureProtocolUDP    = 17
+	captureHopLimit       = 255 // RFC 6762 section 11
+)
+
+// Capture writes the mDNS packets sent and received by clients and servers
+// to a pcapng file, which can be opened with Wireshark and attached to bug
+// reports. Each packet is recorded with a timestamp, its direction and the
+// interface it was sent or received on. As the packets are recorded above
+// the socket, the IP and UDP headers are reconstructed: the source address of
+// sent packets is unspecified and the destination of received packets is
+// the multicast group.
+//
+// A Capture may be shared by several clients and servers, see WithCapture
+// and ServerCapture. Writing stops at the first error, reported by Err.
+type Capture struct {
+	mu     sync.Mutex
+	w      io.Writer
+	ifaces map[int]uint32 // interface index -> pcapng interface ID
+	err    error
+}
+
+// NewCapture writes the pcapng section header to w and returns a Capture
+// writing the packets to it. Writes to w are serialized; closing it is up to
+// the caller once the clients and servers using the capture are done.
+func NewCapture(w io.Writer) (*Capture, error) {
+	c := &Capture{w: w, ifaces: make(map[int]uint32)}
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:], 1) // major version
+	binary.LittleEndian.PutUint16(body[6:], 0) // minor version
+	binary.LittleEndian.PutUint64(body[8:], ^uint64(0))
+	if err := c.writeBlock(pcapngSectionHeader, body); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// WithCapture records the packets of a client to the capture.
+func WithCapture(c *Capture) ClientOption {
+	return func(o *clientOpts) {
+		o.capture = c
+	}
+}
+
+// Err returns the error which stopped the capture, if any.
+func (c *Capture) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// received records a packet received on the interface from the address. A
+// nil capture ignores it.
+func (c *Capture) received(buf []byte, ifIndex int, from net.Addr) {
+	if c == nil {
+		return
+	}
+	src, _ := from.(*net.UDPAddr)
+	if src == nil {
+		return
+	}
+	dst := ipv4Addr
+	if src.IP.To4() == nil {
+		dst = ipv6Addr
+	}
+	c.record(buf, ifIndex, src, dst, pcapngFlagInbound)
+}
+
+// sent records a packet sent on the interface to the address. A nil capture
+// ignores it.
+func (c *Capture) sent(buf []byte, ifIndex int, to *net.UDPAddr) {
+	if c == nil {
+		return
+	}
+	src := &net.UDPAddr{IP: net.IPv4zero, Port: ipv4Addr.Port}
+	if to.IP.To4() == nil {
+		src.IP = net.IPv6unspecified
+	}
+	c.record(buf, ifIndex, src, to, pcapngFlagOutbound)
+}
+
+func (c *Capture) record(payload []byte, ifIndex int, src, dst *net.UDPAddr, flags uint32) {
+	now := time.Now()
+	packet := capturePacket(payload, src, dst)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	id, found := c.ifaces[ifIndex]
+	if !found {
+		id = uint32(len(c.ifaces))
+		if err := c.writeInterface(ifIndex); err != nil {
+			c.err = err
+			return
+		}
+		c.ifaces[ifIndex] = id
+	}
+
+	body := make([]byte, 20, 20+len(packet)+12)
+	usec := uint64(now.UnixMicro())
+	binary.LittleEndian.PutUint32(body[0:], id)
+	binary.LittleEndian.PutUint32(body[4:], uint32(usec>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(usec))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(packet)))
+	body = appendPadded(body, packet)
+	flagValue := make([]byte, 4)
+	binary.LittleEndian.PutUint32(flagValue, flags)
+	body = appendOption(body, pcapngOptEPBFlags, flagValue)
+	body = appendOption(body, pcapngOptEnd, nil)
+	c.err = c.writeBlock(pcapngEnhancedPacket, body)
+}
+
+// writeInterface writes the description of an interface. The caller holds
+// mu.
+func (c *Capture) writeInterface(ifIndex int) error {
+	name := "unknown"
+	if ifIndex != 0 {
+		name = fmt.Sprintf("if%d", ifIndex)
+		if iface, err := net.InterfaceByIndex(ifIndex); err == nil {
+			name = iface.Name
+		}
+	}
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:], pcapngLinkTypeRaw)
+	// A snapshot length of 0 means no limit.
+	body = appendOption(body, pcapngOptIfName, []byte(name))
+	body = appendOption(body, pcapngOptEnd, nil)
+	return c.writeBlock(pcapngInterfaceDesc, body)
+}
+
+// writeBlock writes a block with the body, which is padded to 32 bits.
+func (c *Capture) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	block := make([]byte, 8, length)
+	binary.LittleEndian.PutUint32(block[0:], blockType)
+	binary.LittleEndian.PutUint32(block[4:], length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	_, err := c.w.Write(block)
+	return err
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return appendPadded(b, value)
+}
+
+func appendPadded(b, data []byte) []byte {
+	b = append(b, data...)
+	for i := len(data); i%4 != 0; i++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// capturePacket wraps the payload in IP and UDP headers.
+func capturePacket(payload []byte, src, dst *net.UDPAddr) []byte {
+	udpLength := captureUDPHeaderSize + len(payload)
+	udp := make([]byte, captureUDPHeaderSize, udpLength)
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLength))
+	udp = append(udp, payload...)
+
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		ip := make([]byte, captureIPv4HeaderSize, captureIPv4HeaderSize+udpLength)
+		ip[0] = 0x45 // version 4, 5 words
+		binary.BigEndian.PutUint16(ip[2:], uint16(captureIPv4HeaderSize+udpLength))
+		ip[8] = captureHopLimit
+		ip[9] = captureProtocolUDP
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], ^checksum(0, ip))
+		// The UDP checksum is optional for IPv4 and left zero.
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, captureIPv6HeaderSize, captureIPv6HeaderSize+udpLength)
+	ip[0] = 0x60 // version 6
+	binary.BigEndian.PutUint16(ip[4:], uint16(udpLength))
+	ip[6] = captureProtocolUDP
+	ip[7] = captureHopLimit
+	copy(ip[8:], src.IP.To16())
+	copy(ip[24:], dst.IP.To16())
+	// The UDP checksum is mandatory for IPv6, it covers a pseudo header of
+	// the addresses, length and protocol.
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(pseudo, ip[8:40]...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(udpLength))
+	pseudo = binary.BigEndian.AppendUint32(pseudo, captureProtocolUDP)
+	sum := ^checksum(checksum(0, pseudo), udp)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return append(ip, udp...)
+}
+
+// checksum adds the data to the ones' complement sum of 16 bit words.
+func checksum(sum uint16, data []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(data); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		s += uint32(data[len(data)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
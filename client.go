@@ -2,12 +2,13 @@ package zeroconf
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"runtime"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -28,18 +29,78 @@ const (
 	IPv4AndIPv6        = IPv4 | IPv6 // default option
 )
 
-var initialQueryInterval = 4 * time.Second
+// initialQueryInterval and cleanupFreq are the defaults of the QueryInterval
+// and CleanupInterval options. Changing them affects clients created
+// afterwards only; they are kept for tests, use the options instead.
+var (
+	initialQueryInterval = 4 * time.Second
+	cleanupFreq          = 10 * time.Second
+)
 
 // Client structure encapsulates both IPv4/IPv6 UDP connections.
 type client struct {
-	ipv4conn *ipv4.PacketConn
-	ipv6conn *ipv6.PacketConn
-	ifaces   []net.Interface
+	ipv4conn        *ipv4.PacketConn
+	ipv6conn        *ipv6.PacketConn
+	ifaces          []net.Interface
+	ifacesLock      sync.Mutex
+	listIfaces      func() []net.Interface
+	control         *BrowseControl
+	periodic        bool
+	strictHeaders   bool
+	ednsSize        uint16
+	prefixes        []*net.IPNet
+	searchDomains   []string
+	eagerResolve    bool
+	expected        []string
+	updateThrottle  time.Duration
+	refreshWindow   time.Duration
+	limiter         *QueryLimiter
+	backpressure    *Backpressure
+	queryInterval   time.Duration
+	cleanupFreq     time.Duration
+	capture         *Capture
+	sourceLimit     *sourceLimit
+	flushGuard      *flushGuard
+	onSendError     func(iface net.Interface, err error)
+	negativeTTL     time.Duration
+	onUnknownRecord func(rr dns.RR, from net.Addr)
+	reportNotFound  bool
+	silent          bool
+	link            *linkConditions
+	typeWarning     func(given, normalized string)
 }
 
 type clientOpts struct {
-	listenOn IPType
-	ifaces   []net.Interface
+	listenOn        IPType
+	ifaces          []net.Interface
+	strictHeaders   bool
+	ednsSize        uint16
+	pointToPoint    bool
+	loopback        bool
+	dscp            *uint8
+	control         *BrowseControl
+	periodic        bool
+	prefixes        []*net.IPNet
+	searchDomains   []string
+	eagerResolve    bool
+	expected        []string
+	updateThrottle  time.Duration
+	refreshWindow   *time.Duration
+	limiter         *QueryLimiter
+	backpressure    *Backpressure
+	queryInterval   time.Duration
+	cleanupFreq     time.Duration
+	capture         *Capture
+	sourceLimit     *sourceLimit
+	flushGuard      *flushGuard
+	onSendError     func(iface net.Interface, err error)
+	negativeTTL     time.Duration
+	onUnknownRecord func(rr dns.RR, from net.Addr)
+	reportNotFound  bool
+	promiscuous     bool
+	silent          bool
+	link            *linkConditions
+	typeWarning     func(given, normalized string)
 }
 
 // ClientOption fills the option struct to configure intefaces, etc.
@@ -63,44 +124,248 @@ func SelectIfaces(ifaces []net.Interface) ClientOption {
 	}
 }
 
+// SelectPointToPoint includes point-to-point interfaces without multicast
+// flag, e.g. PPP or WireGuard links, when no interfaces are selected
+// explicitly.
+func SelectPointToPoint() ClientOption {
+	return func(o *clientOpts) {
+		o.pointToPoint = true
+	}
+}
+
+// SelectLoopback restricts the client to the loopback interface. Together
+// with the LoopbackOnly server option, this allows end-to-end tests on
+// machines without a usable network.
+func SelectLoopback() ClientOption {
+	return func(o *clientOpts) {
+		o.loopback = true
+	}
+}
+
+// QueryDSCP marks outgoing queries with the given DSCP value (0-63), so
+// that mDNS traffic can be prioritized according to QoS policies.
+func QueryDSCP(dscp uint8) ClientOption {
+	return func(o *clientOpts) {
+		o.dscp = &dscp
+	}
+}
+
+// WithBrowseControl allows to pause and resume the browse or lookup with the
+// given control.
+func WithBrowseControl(ctl *BrowseControl) ClientOption {
+	return func(o *clientOpts) {
+		o.control = ctl
+	}
+}
+
+// PeriodicQuery enables the query scheduler of browses: queries are
+// repeated with exponential back-off, starting at the QueryInterval and
+// capped at one minute. After a network change, the schedule starts over.
+// Without this option, a browse sends a single query, plus one after each
+// network change. Lookups are not affected, they retransmit their query
+// until answered, see resolveQueries.
+func PeriodicQuery() ClientOption {
+	return func(o *clientOpts) {
+		o.periodic = true
+	}
+}
+
+// AcceptPrefixes only reports entries with addresses within the given
+// prefixes, e.g. to scope discovery to a lab network on a host which is
+// also attached to a corporate network. Addresses outside the prefixes are
+// removed from the reported entries, and entries without any remaining
+// address are dropped.
+func AcceptPrefixes(prefixes ...*net.IPNet) ClientOption {
+	return func(o *clientOpts) {
+		o.prefixes = append(o.prefixes, prefixes...)
+	}
+}
+
+// OnSendError sets a function called for each failed write of a query on an
+// interface, including failures to select the interface, e.g. to count them
+// or to report interfaces which need attention.
+func OnSendError(fn func(iface net.Interface, err error)) ClientOption {
+	return func(o *clientOpts) {
+		o.onSendError = fn
+	}
+}
+
+// OnUnknownRecord sets a function called for each received record of a type
+// the client does not interpret, i.e. other than PTR, SRV, TXT, A and AAAA,
+// e.g. NSEC, the EDNS0 OPT record, HINFO or vendor types, with the address it
+// was received from. It lets applications use protocol extensions the
+// package does not know. The function is called from the receiving
+// goroutines, possibly concurrently, and must not block or modify the record.
+func OnUnknownRecord(fn func(rr dns.RR, from net.Addr)) ClientOption {
+	return func(o *clientOpts) {
+		o.onUnknownRecord = fn
+	}
+}
+
+// ErrNotFound is returned by Lookup with the ReportNotFound option if no
+// record of the instance was received until the deadline of the context.
+var ErrNotFound = errors.New("instance not found")
+
+// ReportNotFound makes Lookup and Resolver.Lookup return ErrNotFound when the
+// deadline of their context passes without any record of the instance, e.g.
+// as the device is offline. A lookup which received some records, even if
+// they did not resolve the instance completely, returns nil as before, and
+// so does a lookup whose context is canceled.
+func ReportNotFound() ClientOption {
+	return func(o *clientOpts) {
+		o.reportNotFound = true
+	}
+}
+
+// Promiscuous makes Browse listen passively: it sends no queries and
+// delivers every service instance observed on the link in the browsed
+// domain, whatever its type, as seen in the responses to the queries of
+// other hosts and in announcements. The browsed service type is ignored and
+// may be empty, the type of an entry is given by its Service field. It is
+// meant for network inventory tools which watch the mDNS traffic without
+// adding to it. Instances announced by a PTR record alone are delivered
+// without host name and port until their SRV record is seen. Lookup and
+// NewResolver reject the option.
+func Promiscuous() ClientOption {
+	return func(o *clientOpts) {
+		o.promiscuous = true
+	}
+}
+
+// Silent makes the client never transmit a query, e.g. for privacy on
+// sensitive networks. Browses and lookups rely on the announcements of
+// services and on the responses to the queries of other hosts, so
+// instances are found only when they announce themselves or are asked for
+// by someone else. Unlike Promiscuous, only the instances of the browsed
+// type are delivered.
+func Silent() ClientOption {
+	return func(o *clientOpts) {
+		o.silent = true
+	}
+}
+
+// EagerResolve speeds up browsing on slow devices. Browse queries also ask
+// for the SRV and TXT records of the given expected instances, and for
+// instances announced by a PTR record alone, SRV and TXT questions are sent
+// right away instead of waiting for the next query.
+func EagerResolve(instances ...string) ClientOption {
+	return func(o *clientOpts) {
+		o.eagerResolve = true
+		o.expected = append(o.expected, instances...)
+	}
+}
+
+// UpdateThrottle limits the delivery of changed entries to one update per
+// entry and interval. Intermediate changes are dropped, the latest one is
+// delivered once the interval has passed. Changes between an incomplete and a
+// complete entry are always delivered right away.
+func UpdateThrottle(interval time.Duration) ClientOption {
+	return func(o *clientOpts) {
+		o.updateThrottle = interval
+	}
+}
+
+// RefreshWindow sets the time before expiry of a delivered entry, in which
+// the entry is delivered again when it is refreshed without changes. The
+// default is one minute. Zero delivers every received update, changed or
+// not.
+func RefreshWindow(window time.Duration) ClientOption {
+	return func(o *clientOpts) {
+		o.refreshWindow = &window
+	}
+}
+
+// QueryInterval sets the initial interval of the query scheduler, 4 seconds
+// by default. See PeriodicQuery.
+func QueryInterval(interval time.Duration) ClientOption {
+	return func(o *clientOpts) {
+		if interval > 0 {
+			o.queryInterval = interval
+		}
+	}
+}
+
+// CleanupInterval sets how often expired entries are removed from the
+// bookkeeping of delivered entries, 10 seconds by default.
+func CleanupInterval(interval time.Duration) ClientOption {
+	return func(o *clientOpts) {
+		if interval > 0 {
+			o.cleanupFreq = interval
+		}
+	}
+}
+
+// StrictHeaders makes the client ignore received messages which are not
+// authoritative responses (QR=1, AA=1), as required by RFC 6762 section 18.
+// Without this option, answers are also taken from other hosts' queries.
+func StrictHeaders() ClientOption {
+	return func(o *clientOpts) {
+		o.strictHeaders = true
+	}
+}
+
+// EDNS0 adds an EDNS0 OPT record to outgoing queries, advertising the given
+// UDP payload size to responders. This reduces truncated responses of
+// record-heavy services.
+func EDNS0(udpSize uint16) ClientOption {
+	return func(o *clientOpts) {
+		o.ednsSize = udpSize
+	}
+}
+
 // Browse for all services of a given type in a given domain.
 // Received entries are sent on the entries channel.
 // It blocks until the context is canceled (or an error occurs).
 func Browse(ctx context.Context, service, domain string, entries chan<- *ServiceEntry, opts ...ClientOption) error {
-	cl, err := newClient(applyOpts(opts...))
+	conf := applyOpts(opts...)
+	if conf.promiscuous {
+		// The type is ignored, see Promiscuous.
+		service = ""
+	} else {
+		service = normalizeServiceType(service, conf.typeWarning)
+		if err := ValidateServiceType(service); err != nil {
+			return err
+		}
+	}
+	cl, err := newClient(conf)
 	if err != nil {
 		return err
 	}
-	params := defaultParams(service)
-	if domain != "" {
-		params.Domain = domain
-	}
-	params.Entries = entries
-	params.isBrowsing = true
+	params := newLookupParams("", service, domain, true, entries)
+	params.promiscuous = conf.promiscuous
 	return cl.run(ctx, params)
 }
 
 // Lookup a specific service by its name and type in a given domain.
 // Received entries are sent on the entries channel.
-// It blocks until the context is canceled (or an error occurs).
+// It blocks until the context is canceled (or an error occurs), see
+// ReportNotFound for telling an absent instance from an incomplete one.
 func Lookup(ctx context.Context, instance, service, domain string, entries chan<- *ServiceEntry, opts ...ClientOption) error {
-	cl, err := newClient(applyOpts(opts...))
-	if err != nil {
+	conf := applyOpts(opts...)
+	service = normalizeServiceType(service, conf.typeWarning)
+	if err := ValidateServiceType(service); err != nil {
 		return err
 	}
-	params := defaultParams(service)
-	params.Instance = instance
-	if domain != "" {
-		params.Domain = domain
+	if conf.promiscuous {
+		return errPromiscuous
+	}
+	cl, err := newClient(conf)
+	if err != nil {
+		return err
 	}
-	params.Entries = entries
+	params := newLookupParams(instance, service, domain, false, entries)
 	return cl.run(ctx, params)
 }
 
+// errPromiscuous is returned for the Promiscuous option outside of Browse.
+var errPromiscuous = errors.New("promiscuous listening is supported by Browse only")
+
 func applyOpts(options ...ClientOption) clientOpts {
 	// Apply default configuration and load supplied options.
 	var conf = clientOpts{
-		listenOn: IPv4AndIPv6,
+		listenOn:      IPv4AndIPv6,
+		queryInterval: initialQueryInterval,
+		cleanupFreq:   cleanupFreq,
 	}
 	for _, o := range options {
 		if o != nil {
@@ -112,10 +377,14 @@ func applyOpts(options ...ClientOption) clientOpts {
 
 func (c *client) run(ctx context.Context, params *lookupParams) error {
 	ctx, cancel := context.WithCancel(ctx)
+	// start listening for responses
+	msgCh := make(chan *dns.Msg, 32)
+	c.listen(ctx, msgCh)
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		c.mainloop(ctx, params)
+		c.mainloop(ctx, params, msgCh)
+		c.shutdown()
 	}()
 
 	// If previous probe was ok, it should be fine now. In case of an error later on,
@@ -128,35 +397,50 @@ func (c *client) run(ctx context.Context, params *lookupParams) error {
 		return err
 	*/
 
-	// Do a single query
-	err := c.query(params)
-
-	if err != nil {
-		cancel()
-		return err
+	// Do the first query
+	if waitFirstQuery(ctx) {
+		if err := c.query(params); err != nil {
+			cancel()
+			return err
+		}
 	}
+	c.schedule(ctx, params)
+
+	// Follow interface changes, e.g. a Wi-Fi reconnect, and query again on
+	// the new interfaces.
+	go watchInterfaces(ctx, c.listIfaces, func(ifaces []net.Interface) {
+		if ctx.Err() != nil {
+			return
+		}
+		c.interfacesChanged(ifaces, params)
+	})
 
 	<-ctx.Done()
 	cancel()
-	return nil
+	return c.lookupResult(ctx, params)
 }
 
-// defaultParams returns a default set of QueryParams.
-func defaultParams(service string) *lookupParams {
-	return newLookupParams("", service, "local", false, make(chan *ServiceEntry))
+// lookupResult returns ErrNotFound for a lookup which has ended at its
+// deadline without any record of the instance, if enabled.
+func (c *client) lookupResult(ctx context.Context, params *lookupParams) error {
+	if c.reportNotFound && !params.isBrowsing && errors.Is(ctx.Err(), context.DeadlineExceeded) && !params.answered.Load() {
+		return ErrNotFound
+	}
+	return nil
 }
 
 // Client structure constructor
 func newClient(opts clientOpts) (*client, error) {
+	listIfaces := selectedInterfaces(opts.ifaces, opts.loopback, opts.pointToPoint)
 	ifaces := opts.ifaces
-	if len(ifaces) == 0 {
-		ifaces = listMulticastInterfaces()
+	if opts.loopback || len(ifaces) == 0 {
+		ifaces = listIfaces()
 	}
 	// IPv4 interfaces
 	var ipv4conn *ipv4.PacketConn
 	if (opts.listenOn & IPv4) > 0 {
 		var err error
-		ipv4conn, err = joinUdp4Multicast(ifaces)
+		ipv4conn, _, err = joinUdp4Multicast(ifaces)
 		if err != nil {
 			return nil, err
 		}
@@ -165,129 +449,211 @@ func newClient(opts clientOpts) (*client, error) {
 	var ipv6conn *ipv6.PacketConn
 	if (opts.listenOn & IPv6) > 0 {
 		var err error
-		ipv6conn, err = joinUdp6Multicast(ifaces)
+		ipv6conn, _, err = joinUdp6Multicast(ifaces)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	if opts.dscp != nil {
+		setDSCP(ipv4conn, ipv6conn, *opts.dscp)
+	}
+	refreshWindow := defaultRefreshWindow
+	if opts.refreshWindow != nil {
+		refreshWindow = *opts.refreshWindow
+	}
+	searchDomains := opts.searchDomains
+	if len(searchDomains) == 0 {
+		searchDomains = defaultSearchDomains
+	}
+
 	return &client{
-		ipv4conn: ipv4conn,
-		ipv6conn: ipv6conn,
-		ifaces:   ifaces,
+		ipv4conn:        ipv4conn,
+		ipv6conn:        ipv6conn,
+		ifaces:          ifaces,
+		listIfaces:      listIfaces,
+		control:         opts.control,
+		periodic:        opts.periodic,
+		strictHeaders:   opts.strictHeaders,
+		ednsSize:        opts.ednsSize,
+		prefixes:        opts.prefixes,
+		searchDomains:   searchDomains,
+		eagerResolve:    opts.eagerResolve,
+		expected:        opts.expected,
+		updateThrottle:  opts.updateThrottle,
+		refreshWindow:   refreshWindow,
+		limiter:         opts.limiter,
+		backpressure:    opts.backpressure,
+		queryInterval:   opts.queryInterval,
+		cleanupFreq:     opts.cleanupFreq,
+		capture:         opts.capture,
+		sourceLimit:     opts.sourceLimit,
+		flushGuard:      opts.flushGuard,
+		onSendError:     opts.onSendError,
+		negativeTTL:     opts.negativeTTL,
+		onUnknownRecord: opts.onUnknownRecord,
+		reportNotFound:  opts.reportNotFound,
+		silent:          opts.silent,
+		link:            opts.link,
+		typeWarning:     opts.typeWarning,
 	}, nil
 }
 
-var cleanupFreq = 10 * time.Second
-
-// Start listeners and waits for the shutdown signal from exit channel
-func (c *client) mainloop(ctx context.Context, params *lookupParams) {
-	// start listening for responses
-	msgCh := make(chan *dns.Msg, 32)
+// listen starts the receiving routines, which send the received messages to
+// msgCh until the context is canceled or the connections are closed.
+func (c *client) listen(ctx context.Context, msgCh chan *dns.Msg) {
 	if c.ipv4conn != nil {
 		go c.recv(ctx, c.ipv4conn, msgCh)
 	}
 	if c.ipv6conn != nil {
 		go c.recv(ctx, c.ipv6conn, msgCh)
 	}
+}
 
+// Processes the messages received on msgCh for a lookup and waits for the
+// shutdown signal from the context.
+func (c *client) mainloop(ctx context.Context, params *lookupParams, msgCh <-chan *dns.Msg) {
 	// Iterate through channels from listeners goroutines
 	var entries map[string]*ServiceEntry
-	sentEntries := make(map[string]*ServiceEntry)
+	sentEntries := make(map[string]*delivery)
+	// Records of the instances received so far
+	assembled := newEntryAssembly()
+	// Entries received while paused
+	pausedEntries := make(map[string]*ServiceEntry)
+	// Instances asked for SRV and TXT records by eager resolution
+	resolving := make(map[string]bool)
+	// Changed entries held back by the update throttle
+	throttled := make(map[string]*ServiceEntry)
+	var throttleTimer <-chan time.Time
 
-	ticker := time.NewTicker(cleanupFreq)
+	// Entries are queued for slow consumers according to the backpressure
+	// policy.
+	send := func(_ string, e *ServiceEntry) { params.Entries <- e }
+	var forwarded chan struct{}
+	if q := newEntryQueue(c.backpressure); q != nil {
+		forwarded = make(chan struct{})
+		go func() {
+			q.forward(ctx, params.Entries)
+			close(forwarded)
+		}()
+		send = q.push
+	}
+
+	deliver := func(k string, e *ServiceEntry, now time.Time) {
+		send(k, e)
+		sentEntries[k] = newDelivery(e, now)
+		params.cache.put(e)
+		if !params.isBrowsing && entryResolved(e) {
+			params.disableProbing()
+		}
+	}
+
+	// A lookup receiving no record of the instance records it as absent,
+	// see NegativeCache.
+	negative := c.negativeTTL > 0 && !params.isBrowsing && params.Instance != "" && params.cache != nil
+	var absentTimer <-chan time.Time
+	if negative {
+		t := time.NewTimer(absentAfter)
+		defer t.Stop()
+		absentTimer = t.C
+	}
+
+	resumed, stopListening := c.control.listen()
+	defer stopListening()
+
+	ticker := time.NewTicker(c.cleanupFreq)
 	defer ticker.Stop()
 	for {
 		var now time.Time
 		select {
 		case <-ctx.Done():
 			// Context expired. Notify subscriber that we are done here.
+			if forwarded != nil {
+				<-forwarded
+			}
 			params.done()
-			c.shutdown()
 			return
 		case t := <-ticker.C:
-			for k, e := range sentEntries {
-				if t.After(e.Expiry) {
+			for k, d := range sentEntries {
+				if t.After(d.entry.Expiry) {
 					delete(sentEntries, k)
 				}
 			}
+			assembled.expire(t)
+			c.sourceLimit.expire(t)
+			continue
+		case <-params.flushCache:
+			// The network changed, deliver the entries again.
+			sentEntries = make(map[string]*delivery)
+			assembled = newEntryAssembly()
+			resolving = make(map[string]bool)
+			continue
+		case t := <-throttleTimer:
+			throttleTimer = nil
+			for k, e := range throttled {
+				if !e.Expiry.After(t) {
+					delete(throttled, k)
+				} else if d, found := sentEntries[k]; !found || !t.Before(d.at.Add(c.updateThrottle)) {
+					delete(throttled, k)
+					deliver(k, e, t)
+				}
+			}
+			if len(throttled) > 0 {
+				throttleTimer = time.After(c.updateThrottle)
+			}
+			continue
+		case t := <-absentTimer:
+			absentTimer = nil
+			if !c.control.Paused() {
+				params.cache.putAbsent(params.Service, params.ServiceInstanceName(), t.Add(c.negativeTTL), false)
+			}
+			continue
+		case <-resumed:
+			now = time.Now()
+			for k, e := range pausedEntries {
+				if e.Expiry.After(now) {
+					deliver(k, e, now)
+				}
+			}
+			pausedEntries = make(map[string]*ServiceEntry)
+			if err := c.query(params); err != nil {
+				log.Printf("[WARN] mdns: Failed to query after resume: %v", err)
+			}
 			continue
 		case msg := <-msgCh:
 			now = time.Now()
-			entries = make(map[string]*ServiceEntry)
-			sections := append(msg.Answer, msg.Ns...)
-			sections = append(sections, msg.Extra...)
-
-			for _, answer := range sections {
-				header := answer.Header()
+			entries = parseEntries(params, msg, now)
+			if len(entries) > 0 {
+				params.answered.Store(true)
+			}
+			assembled.addLateAddrs(msg, entries)
+			if negative {
+				if ttl, found := absentInstance(msg, params.canonicalInstanceName); found {
+					expiry := now.Add(min(time.Duration(ttl)*time.Second, c.negativeTTL))
+					params.cache.putAbsent(params.Service, params.ServiceInstanceName(), expiry, true)
+					absentTimer = nil
+				} else if e := entries[params.canonicalInstanceName]; e != nil && e.Expiry.After(now) {
+					absentTimer = nil
+				}
+			}
+		}
 
-				switch rr := answer.(type) {
-				case *dns.PTR:
-					if params.ServiceName() != rr.Hdr.Name {
-						continue
-					}
-					if params.ServiceInstanceName() != "" && params.ServiceInstanceName() != rr.Ptr {
-						continue
-					}
-					if _, found := entries[rr.Ptr]; !found {
-						entries[rr.Ptr] = newServiceEntry(
-							trimDot(strings.Replace(rr.Ptr, rr.Hdr.Name, "", -1)),
-							params.Service,
-							params.Domain)
-					}
-					entries[rr.Ptr].Expiry = now.Add(time.Duration(rr.Hdr.Ttl) * time.Second)
-					// Cache Flush takes most significant bit of class. If that's set class gets 32768 added
-					entries[rr.Ptr].CacheFlush = header.Class > 32768
-				case *dns.SRV:
-					if params.ServiceInstanceName() != "" && params.ServiceInstanceName() != rr.Hdr.Name {
-						continue
-					} else if !strings.HasSuffix(rr.Hdr.Name, params.ServiceName()) {
-						continue
-					}
-					if _, found := entries[rr.Hdr.Name]; !found {
-						entries[rr.Hdr.Name] = newServiceEntry(
-							trimDot(strings.Replace(rr.Hdr.Name, params.ServiceName(), "", 1)),
-							params.Service,
-							params.Domain)
-					}
-					entries[rr.Hdr.Name].HostName = rr.Target
-					entries[rr.Hdr.Name].Port = int(rr.Port)
-					entries[rr.Hdr.Name].Expiry = now.Add(time.Duration(rr.Hdr.Ttl) * time.Second)
-					// Cache Flush takes most significant bit of class. If that's set class gets 32768 added
-					entries[rr.Hdr.Name].CacheFlush = header.Class > 32768
-				case *dns.TXT:
-					if params.ServiceInstanceName() != "" && params.ServiceInstanceName() != rr.Hdr.Name {
-						continue
-					} else if !strings.HasSuffix(rr.Hdr.Name, params.ServiceName()) {
-						continue
-					}
-					if _, found := entries[rr.Hdr.Name]; !found {
-						entries[rr.Hdr.Name] = newServiceEntry(
-							trimDot(strings.Replace(rr.Hdr.Name, params.ServiceName(), "", 1)),
-							params.Service,
-							params.Domain)
-					}
-					entries[rr.Hdr.Name].Text = rr.Txt
-					entries[rr.Hdr.Name].Expiry = now.Add(time.Duration(rr.Hdr.Ttl) * time.Second)
-					// Cache Flush takes most significant bit of class. If that's set class gets 32768 added
-					entries[rr.Hdr.Name].CacheFlush = header.Class > 32768
+		if c.eagerResolve && params.isBrowsing && !params.promiscuous {
+			var names []string
+			for k, e := range entries {
+				if e.HostName == "" && !resolving[k] {
+					resolving[k] = true
+					names = append(names, k)
 				}
 			}
-			// Associate IPs in a second round as other fields should be filled by now.
-			for _, answer := range sections {
-				switch rr := answer.(type) {
-				case *dns.A:
-					for k, e := range entries {
-						if e.HostName == rr.Hdr.Name {
-							entries[k].AddrIPv4 = append(entries[k].AddrIPv4, rr.A)
-						}
-					}
-				case *dns.AAAA:
-					for k, e := range entries {
-						if e.HostName == rr.Hdr.Name {
-							entries[k].AddrIPv6 = append(entries[k].AddrIPv6, rr.AAAA)
-						}
-					}
+			if len(names) > 0 {
+				m := c.resolveQuestions(new(dns.Msg), names)
+				m.RecursionDesired = false
+				if c.ednsSize > 0 {
+					m.SetEdns0(c.ednsSize, false)
+				}
+				if err := c.sendQuery(m); err != nil {
+					log.Printf("[WARN] mdns: Failed to query instances: %v", err)
 				}
 			}
 		}
@@ -297,15 +663,45 @@ func (c *client) mainloop(ctx context.Context, params *lookupParams) {
 				if !e.Expiry.After(now) {
 					delete(entries, k)
 					delete(sentEntries, k)
+					assembled.remove(k)
+					delete(throttled, k)
+					params.cache.remove(e)
+					if params.removed != nil {
+						params.removed(e)
+					}
 					continue
 				}
 
-				if entry, found := sentEntries[k]; found {
-					// Only sent entry update if it expires in less than 1 minute
-					if !e.Expiry.After(entry.Expiry.Add(-1*time.Minute)) && !e.CacheFlush {
+				if a, found := assembled.get(k); found {
+					mergeEntry(e, a)
+				}
+				prev, found := sentEntries[k]
+				if found {
+					mergeEntry(e, prev.entry)
+				}
+				assembled.put(k, e)
+				if !c.acceptAddrs(e) {
+					continue
+				}
+
+				if found {
+					sameState := entryComplete(e) == entryComplete(prev.entry)
+					if entryHash(e) == prev.hash && sameState {
+						// Only deliver an unchanged entry again if the
+						// delivered one is about to expire.
+						if c.refreshWindow > 0 && prev.entry.Expiry.After(now.Add(c.refreshWindow)) {
+							continue
+						}
+					} else if sameState && c.updateThrottle > 0 && now.Before(prev.at.Add(c.updateThrottle)) {
+						// Deliver the latest change once the throttle allows.
+						throttled[k] = e
+						if throttleTimer == nil {
+							throttleTimer = time.After(prev.at.Add(c.updateThrottle).Sub(now))
+						}
 						continue
 					}
 				}
+				delete(throttled, k)
 
 				// If this is an DNS-SD query do not throw PTR away.
 				// It is expected to have only PTR for enumeration
@@ -318,19 +714,84 @@ func (c *client) mainloop(ctx context.Context, params *lookupParams) {
 						}
 					}
 				*/
+				if c.control.Paused() {
+					pausedEntries[k] = e
+					continue
+				}
 				// Submit entry to subscriber and cache it.
 				// This is also a point to possibly stop probing actively for a
 				// service entry.
-				params.Entries <- e
-				sentEntries[k] = e
-				if !params.isBrowsing {
-					params.disableProbing()
-				}
+				deliver(k, e, now)
 			}
 		}
 	}
 }
 
+// interfacesChanged rejoins the multicast groups after an interface change,
+// drops the delivered entries of the lookups and queries again, either
+// through the query scheduler or directly, unless the lookups are paused.
+func (c *client) interfacesChanged(ifaces []net.Interface, params ...*lookupParams) {
+	c.rejoin(ifaces)
+	for _, p := range params {
+		p.networkChanged()
+		if c.scheduled(p) || c.control.Paused() {
+			// The query scheduler takes care.
+			continue
+		}
+		if err := c.query(p); err != nil {
+			log.Printf("[WARN] mdns: Failed to query after interface change: %v", err)
+		}
+	}
+}
+
+// schedule starts the retransmission of the query of a lookup, or the query
+// scheduler of a browse if enabled.
+func (c *client) schedule(ctx context.Context, params *lookupParams) {
+	query := c.periodicQuery
+	if params.promiscuous || c.silent {
+		return
+	} else if !params.isBrowsing {
+		query = c.resolveQueries
+	} else if !c.periodic {
+		return
+	}
+	go func() {
+		if err := query(ctx, params); err != nil && ctx.Err() == nil {
+			log.Printf("[WARN] mdns: Failed to query: %v", err)
+		}
+	}()
+}
+
+// scheduled reports whether the queries of a lookup are repeated by a
+// scheduler, which also queries again after a network change.
+func (c *client) scheduled(params *lookupParams) bool {
+	return c.periodic || !params.isBrowsing
+}
+
+// rejoin joins the multicast groups on the given interfaces, which replace
+// the interfaces queries are sent on. Memberships are lost when an interface
+// goes down, so existing interfaces are joined again as well.
+func (c *client) rejoin(ifaces []net.Interface) {
+	for i := range ifaces {
+		if c.ipv4conn != nil {
+			_ = c.ipv4conn.JoinGroup(&ifaces[i], &net.UDPAddr{IP: mdnsGroupIPv4})
+		}
+		if c.ipv6conn != nil {
+			_ = c.ipv6conn.JoinGroup(&ifaces[i], &net.UDPAddr{IP: mdnsGroupIPv6})
+		}
+	}
+	c.ifacesLock.Lock()
+	c.ifaces = ifaces
+	c.ifacesLock.Unlock()
+}
+
+// interfaces returns the interfaces queries are sent on.
+func (c *client) interfaces() []net.Interface {
+	c.ifacesLock.Lock()
+	defer c.ifacesLock.Unlock()
+	return c.ifaces
+}
+
 // Shutdown client will close currently open connections and channel implicitly.
 func (c *client) shutdown() {
 	if c.ipv4conn != nil {
@@ -344,17 +805,25 @@ func (c *client) shutdown() {
 // Data receiving routine reads from connection, unpacks packets into dns.Msg
 // structures and sends them to a given msgCh channel
 func (c *client) recv(ctx context.Context, l interface{}, msgCh chan *dns.Msg) {
-	var readFrom func([]byte) (n int, src net.Addr, err error)
+	var readFrom func([]byte) (n int, ifIndex int, src net.Addr, err error)
 
 	switch pConn := l.(type) {
 	case *ipv6.PacketConn:
-		readFrom = func(b []byte) (n int, src net.Addr, err error) {
-			n, _, src, err = pConn.ReadFrom(b)
+		readFrom = func(b []byte) (n int, ifIndex int, src net.Addr, err error) {
+			var cm *ipv6.ControlMessage
+			n, cm, src, err = pConn.ReadFrom(b)
+			if cm != nil {
+				ifIndex = cm.IfIndex
+			}
 			return
 		}
 	case *ipv4.PacketConn:
-		readFrom = func(b []byte) (n int, src net.Addr, err error) {
-			n, _, src, err = pConn.ReadFrom(b)
+		readFrom = func(b []byte) (n int, ifIndex int, src net.Addr, err error) {
+			var cm *ipv4.ControlMessage
+			n, cm, src, err = pConn.ReadFrom(b)
+			if cm != nil {
+				ifIndex = cm.IfIndex
+			}
 			return
 		}
 
@@ -362,6 +831,10 @@ func (c *client) recv(ctx context.Context, l interface{}, msgCh chan *dns.Msg) {
 		return
 	}
 
+	assembly := newResponseAssembly(func(msg *dns.Msg) {
+		c.link.deliver(ctx, msg, msgCh)
+	})
+
 	buf := make([]byte, 65536)
 	var fatalErr error
 	for {
@@ -373,81 +846,237 @@ func (c *client) recv(ctx context.Context, l interface{}, msgCh chan *dns.Msg) {
 			return
 		}
 
-		n, _, err := readFrom(buf)
+		n, ifIndex, src, err := readFrom(buf)
 		if err != nil {
 			fatalErr = err
 			continue
 		}
+		c.capture.received(buf[:n], ifIndex, src)
 		msg := new(dns.Msg)
 		if err := msg.Unpack(buf[:n]); err != nil {
 			// log.Printf("[WARN] mdns: Failed to unpack packet: %v", err)
 			continue
 		}
-		select {
-		case msgCh <- msg:
-			// Submit decoded DNS message and continue.
-			//log.Printf("New msg sent to channel: %v\n", msg)
-		case <-ctx.Done():
+		if !c.validHeader(msg) {
+			continue
+		}
+		c.sourceLimit.filter(msg, src, time.Now())
+		c.flushGuard.filter(msg, src, time.Now())
+		c.reportUnknown(msg, src)
+		if msg = assembly.add(msg, src); msg == nil {
+			continue
+		}
+		// Submit decoded DNS message and continue.
+		if !c.link.deliver(ctx, msg, msgCh) {
 			// Abort.
 			return
 		}
 	}
 }
 
-// periodicQuery sens multiple probes until a valid response is received by
-// the main processing loop or some timeout/cancel fires.
+// validHeader checks the header of a received message. From RFC6762
+//
+//	In both multicast query and multicast response messages, the OPCODE
+//	MUST be zero on transmission (only standard queries are currently
+//	supported over multicast).  Multicast DNS messages received with an
+//	OPCODE other than zero MUST be silently ignored.
+//
+// The same applies to a non-zero RCODE. In strict mode, messages which are
+// not authoritative responses are ignored as well.
+func (c *client) validHeader(msg *dns.Msg) bool {
+	if msg.Opcode != dns.OpcodeQuery || msg.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	if c.strictHeaders && (!msg.Response || !msg.Authoritative) {
+		return false
+	}
+	return true
+}
+
+// reportUnknown passes the records of the message the client does not
+// interpret to the OnUnknownRecord function, if any.
+func (c *client) reportUnknown(msg *dns.Msg, from net.Addr) {
+	if c.onUnknownRecord == nil {
+		return
+	}
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			switch rr.(type) {
+			case *dns.PTR, *dns.SRV, *dns.TXT, *dns.A, *dns.AAAA:
+				continue
+			}
+			c.onUnknownRecord(rr, from)
+		}
+	}
+}
+
+// acceptAddrs removes the addresses of the entry outside the accepted
+// prefixes and reports whether any address remains. Without accepted
+// prefixes, all entries are accepted.
+func (c *client) acceptAddrs(e *ServiceEntry) bool {
+	if len(c.prefixes) == 0 {
+		return true
+	}
+	keep := func(ip net.IP) bool {
+		for _, p := range c.prefixes {
+			if p.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	e.AddrIPv4 = filterAddrs(e.AddrIPv4, keep)
+	e.AddrIPv6 = filterAddrs(e.AddrIPv6, keep)
+	return len(e.AddrIPv4) > 0 || len(e.AddrIPv6) > 0
+}
+
+// periodicQuery repeats the query of a browse with exponential back-off after
+// the first query, until the context is done. A network change restarts the
+// schedule. Lookups are retransmitted by resolveQueries instead.
 // TODO: move error reporting to shutdown function as periodicQuery is called from
 // go routine context.
 func (c *client) periodicQuery(ctx context.Context, params *lookupParams) error {
-	// Do the first query immediately.
-	if err := c.query(params); err != nil {
-		return err
-	}
-
 	const maxInterval = 60 * time.Second
-	interval := initialQueryInterval
+	interval := c.queryInterval
 	timer := time.NewTimer(interval)
 	defer timer.Stop()
 	for {
 		select {
 		case <-timer.C:
-			// Wait for next iteration.
-		case <-params.stopProbing:
-			// Chan is closed (or happened in the past).
-			// Done here. Received a matching mDNS entry.
-			return nil
+			// Exponential increase of the interval with jitter: the new
+			// interval will be between 2x and 2.5x the old interval, as RFC
+			// 6762 section 5.2 requires at least doubling intervals, capped at
+			// maxInterval.
+			next := 2*interval + queryJitter(interval/2)
+			if next > maxInterval {
+				next = maxInterval
+			}
+			interval = next
+		case <-params.restart:
+			// The network changed, start over.
+			if !timer.Stop() {
+				<-timer.C
+			}
+			interval = c.queryInterval
 		case <-ctx.Done():
-			if params.isBrowsing {
-				return nil
+			return nil
+		}
+
+		if !c.control.Paused() {
+			if err := c.query(params); err != nil {
+				return err
 			}
+		}
+		timer.Reset(interval)
+	}
+}
+
+// Retransmission intervals of the query of a lookup. RFC 6762 section 5.2
+// requires at least one second between the first two queries, then at least
+// doubling intervals.
+const (
+	resolveInterval    = time.Second
+	maxResolveInterval = 60 * time.Second
+)
+
+// resolveQueries retransmits the SRV and TXT query of a lookup after the
+// first query at about 1, 2, 4... seconds, until the main loop delivers a
+// resolved entry of the instance or the context is done. Unlike browses, whose
+// records are announced by the responders, a lookup depends on its own
+// queries being answered. A network change starts over, also after the
+// instance has been resolved, as the main loop forgets the entries then.
+func (c *client) resolveQueries(ctx context.Context, params *lookupParams) error {
+	interval := resolveInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	stopProbing := params.probingStopped()
+	for {
+		select {
+		case <-timer.C:
+		case <-stopProbing:
+			stopProbing = nil
+			if !timer.Stop() {
+				<-timer.C
+			}
+			continue
+		case <-params.restart:
+			interval = resolveInterval
+			if !timer.Stop() && stopProbing != nil {
+				<-timer.C
+			}
+			// Query right away, the interval applies to retransmissions.
+			stopProbing = params.probingStopped()
+			if !c.control.Paused() {
+				if err := c.query(params); err != nil {
+					return err
+				}
+			}
+			timer.Reset(interval)
+			continue
+		case <-ctx.Done():
 			return ctx.Err()
 		}
 
-		if err := c.query(params); err != nil {
-			return err
+		if !c.control.Paused() {
+			if err := c.query(params); err != nil {
+				return err
+			}
 		}
-		// Exponential increase of the interval with jitter:
-		// the new interval will be between 1.5x and 2.5x the old interval, capped at maxInterval.
-		if interval != maxInterval {
-			interval += time.Duration(rand.Int63n(interval.Nanoseconds())) + interval/2
-			if interval > maxInterval {
-				interval = maxInterval
+		if interval < maxResolveInterval {
+			interval *= 2
+			if interval > maxResolveInterval {
+				interval = maxResolveInterval
 			}
 		}
-		timer.Reset(interval)
+		// Lookups started together, e.g. by several hosts after a power
+		// failure, don't retransmit in sync.
+		timer.Reset(interval + queryJitter(maxFirstQueryDelay))
+	}
+}
+
+// Random delay of the first query of a lookup, RFC 6762 section 5.2.
+const (
+	minFirstQueryDelay = 20 * time.Millisecond
+	maxFirstQueryDelay = 120 * time.Millisecond
+)
+
+// waitFirstQuery delays the first query of a lookup by a random 20-120 ms,
+// so that hosts starting at the same time don't query at once and the
+// responses to one query can satisfy the lookups of others. It reports
+// false if the context is done first.
+func waitFirstQuery(ctx context.Context) bool {
+	timer := time.NewTimer(minFirstQueryDelay + queryJitter(maxFirstQueryDelay-minFirstQueryDelay))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
+// queryJitter returns a random duration below max.
+func queryJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
 // Performs the actual query by service name (browse) or service instance name (lookup),
 // start response listeners goroutines and loops over the entries channel.
 func (c *client) query(params *lookupParams) error {
+	if params.promiscuous {
+		// Listening passively, see Promiscuous.
+		return nil
+	}
 	var serviceName, serviceInstanceName string
 	serviceName = fmt.Sprintf("%s.%s.", trimDot(params.Service), trimDot(params.Domain))
 
 	// send the query
 	m := new(dns.Msg)
 	if params.Instance != "" { // service instance name lookup
-		serviceInstanceName = fmt.Sprintf("%s.%s", params.Instance, serviceName)
+		serviceInstanceName = params.ServiceInstanceName()
 		m.Question = []dns.Question{
 			{Name: serviceInstanceName, Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
 			{Name: serviceInstanceName, Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
@@ -458,65 +1087,221 @@ func (c *client) query(params *lookupParams) error {
 	} else { // service name browse
 		m.SetQuestion(serviceName, dns.TypePTR)
 	}
+	if params.Instance == "" && len(c.expected) > 0 {
+		names := make([]string, 0, len(c.expected))
+		for _, instance := range c.expected {
+			names = append(names, fmt.Sprintf("%s.%s", escapeLabel(instance), serviceName))
+		}
+		c.resolveQuestions(m, names)
+	}
 	m.RecursionDesired = false
+	if c.ednsSize > 0 {
+		m.SetEdns0(c.ednsSize, false)
+	}
 	return c.sendQuery(m)
 }
 
+// resolveQuestions adds SRV and TXT questions for the service instance names
+// to the message and returns it.
+func (c *client) resolveQuestions(m *dns.Msg, names []string) *dns.Msg {
+	for _, name := range names {
+		m.Question = append(m.Question,
+			dns.Question{Name: name, Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
+			dns.Question{Name: name, Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	}
+	return m
+}
+
 // Pack the dns.Msg and write to available connections (multicast)
 func (c *client) sendQuery(msg *dns.Msg) error {
+	if c.silent || c.link.dropQuery() {
+		return nil
+	}
 	buf, err := msg.Pack()
 	if err != nil {
 		return err
 	}
+	c.limiter.wait()
+	ifaces := c.interfaces()
 	if c.ipv4conn != nil {
-		// See https://pkg.go.dev/golang.org/x/net/ipv4#pkg-note-BUG
-		// As of Golang 1.18.4
-		// On Windows, the ControlMessage for ReadFrom and WriteTo methods of PacketConn is not implemented.
-		var wcm ipv4.ControlMessage
-		for ifi := range c.ifaces {
-			switch runtime.GOOS {
-			case "darwin", "ios", "linux":
-				wcm.IfIndex = c.ifaces[ifi].Index
-			case "windows":
-				if c.ifaces[ifi].Name == "Teredo Tunneling Pseudo-Interface" {
-					//log.Println("Skipping Teredo interface on windows")
-				} else {
-					if err := c.ipv4conn.SetMulticastInterface(&c.ifaces[ifi]); err != nil {
-						log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", c.ifaces[ifi].Name, err)
-					}
-				}
-			default:
-				if err := c.ipv4conn.SetMulticastInterface(&c.ifaces[ifi]); err != nil {
-					log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", c.ifaces[ifi].Name, err)
-				}
+		c.multicastQuery(buf, ifaces, ipv4Addr, ipv4GroupConn{c.ipv4conn})
+	}
+	if c.ipv6conn != nil {
+		c.multicastQuery(buf, ifaces, ipv6Addr, ipv6GroupConn{c.ipv6conn})
+	}
+	return nil
+}
+
+// multicastQuery writes a packet to the group on each interface, see
+// selectInterface. If switching the multicast interface fails, the packet is
+// sent on the default multicast interface instead, once per query. Failures
+// are reported to the OnSendError hook.
+func (c *client) multicastQuery(buf []byte, ifaces []net.Interface, group *net.UDPAddr, conn groupConn) {
+	fallback := false
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if runtime.GOOS == "windows" && iface.Name == "Teredo Tunneling Pseudo-Interface" {
+			continue
+		}
+		ifIndex, err := selectInterface(conn, iface)
+		if err != nil {
+			log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", iface.Name, err)
+			c.sendFailed(*iface, err)
+			if fallback {
+				continue
+			}
+			fallback = true
+			if err := conn.SetMulticastInterface(nil); err != nil {
+				continue
 			}
-			c.ipv4conn.WriteTo(buf, &wcm, ipv4Addr)
 		}
+		if err := conn.writeTo(buf, ifIndex, group); err != nil {
+			c.sendFailed(*iface, err)
+			continue
+		}
+		c.capture.sent(buf, iface.Index, group)
 	}
-	if c.ipv6conn != nil {
-		// See https://pkg.go.dev/golang.org/x/net/ipv6#pkg-note-BUG
-		// As of Golang 1.18.4
-		// On Windows, the ControlMessage for ReadFrom and WriteTo methods of PacketConn is not implemented.
-		var wcm ipv6.ControlMessage
-		for ifi := range c.ifaces {
-			switch runtime.GOOS {
-			case "darwin", "ios", "linux":
-				wcm.IfIndex = c.ifaces[ifi].Index
-			case "windows":
-				if c.ifaces[ifi].Name == "Teredo Tunneling Pseudo-Interface" {
-					//log.Println("Skipping Teredo interface on windows")
-				} else {
-					if err := c.ipv4conn.SetMulticastInterface(&c.ifaces[ifi]); err != nil {
-						log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", c.ifaces[ifi].Name, err)
-					}
+}
+
+// sendFailed reports a failed send on an interface to the OnSendError hook.
+func (c *client) sendFailed(iface net.Interface, err error) {
+	if c.onSendError != nil {
+		c.onSendError(iface, err)
+	}
+}
+
+// parseEntries extracts the entries of the lookup from a received message.
+// Entries are keyed by their canonical service instance name.
+func parseEntries(params *lookupParams, msg *dns.Msg, now time.Time) map[string]*ServiceEntry {
+	entries := make(map[string]*ServiceEntry)
+	// The message may be shared with other lookups, don't modify it.
+	sections := make([]dns.RR, 0, len(msg.Answer)+len(msg.Ns)+len(msg.Extra))
+	sections = append(sections, msg.Answer...)
+	sections = append(sections, msg.Ns...)
+	sections = append(sections, msg.Extra...)
+
+	entry := func(name, service string) *ServiceEntry {
+		k := dns.CanonicalName(name)
+		e, found := entries[k]
+		if !found {
+			instance, ok := SplitInstanceName(name, service)
+			if !ok {
+				// E.g. a service type found by browsing the enumeration
+				instance = trimDot(trimNameSuffix(name, service))
+			}
+			serviceType, domain := params.Service, params.Domain
+			if params.promiscuous {
+				serviceType, domain, _ = splitServiceName(service)
+			}
+			e = newServiceEntry(instance, serviceType, domain)
+			entries[k] = e
+		}
+		return e
+	}
+	// A promiscuous browse takes the instances of any service of its domain,
+	// see Promiscuous.
+	observed := func(service string) bool {
+		_, domain, ok := splitServiceName(service)
+		return ok && equalNames(domain, params.Domain)
+	}
+	// instanceService returns the service name of an SRV or TXT record, if
+	// the record belongs to the lookup.
+	instanceService := func(name string) (string, bool) {
+		if params.promiscuous {
+			idx := dns.Split(name)
+			if len(idx) < 2 || !observed(name[idx[1]:]) {
+				return "", false
+			}
+			return name[idx[1]:], true
+		}
+		if params.canonicalInstanceName != "" && !matchName(params.canonicalInstanceName, name) {
+			return "", false
+		}
+		return params.ServiceName(), hasNameSuffix(name, params.ServiceName())
+	}
+
+	for _, answer := range sections {
+		header := answer.Header()
+		var e *ServiceEntry
+
+		switch rr := answer.(type) {
+		case *dns.PTR:
+			if params.promiscuous {
+				if !observed(rr.Hdr.Name) {
+					continue
 				}
-			default:
-				if err := c.ipv6conn.SetMulticastInterface(&c.ifaces[ifi]); err != nil {
-					log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", c.ifaces[ifi].Name, err)
+			} else if !matchName(params.canonicalName, rr.Hdr.Name) {
+				continue
+			}
+			if params.canonicalInstanceName != "" && !matchName(params.canonicalInstanceName, rr.Ptr) {
+				continue
+			}
+			e = entry(rr.Ptr, rr.Hdr.Name)
+		case *dns.SRV:
+			service, ok := instanceService(rr.Hdr.Name)
+			if !ok {
+				continue
+			}
+			e = entry(rr.Hdr.Name, service)
+			// An instance may have several SRV records, the first one is
+			// delivered as HostName and Port and the others as Targets.
+			target := SRVRecord{HostName: rr.Target, Port: int(rr.Port), Priority: int(rr.Priority), Weight: int(rr.Weight)}
+			switch {
+			case e.HostName == "":
+				e.HostName = target.HostName
+				e.Port = target.Port
+				e.Priority = target.Priority
+				e.Weight = target.Weight
+			case !containsTarget(e.SRVRecords(), target):
+				e.Targets = append(e.Targets, target)
+			}
+		case *dns.TXT:
+			service, ok := instanceService(rr.Hdr.Name)
+			if !ok {
+				continue
+			}
+			e = entry(rr.Hdr.Name, service)
+			// An instance may have several TXT records, the first one is
+			// delivered as Text and the others as TextSets. An empty record
+			// is delivered as empty, not nil Text, which means no TXT record
+			// was received.
+			switch {
+			case e.Text == nil:
+				e.Text = rr.Txt
+				if e.Text == nil {
+					e.Text = []string{}
 				}
+			case !equalText(e.Text, rr.Txt) && !containsText(e.TextSets, rr.Txt):
+				e.TextSets = append(e.TextSets, rr.Txt)
 			}
-			c.ipv6conn.WriteTo(buf, &wcm, ipv6Addr)
+		default:
+			continue
 		}
+		e.Expiry = now.Add(time.Duration(header.Ttl) * time.Second)
+		// Cache Flush takes most significant bit of class. If that's set class gets 32768 added
+		e.CacheFlush = header.Class > 32768
 	}
-	return nil
+
+	// Associate IPs in a second round as other fields should be filled by now.
+	// Entries are indexed by host, as large responses carry many hosts.
+	byHost := make(map[string][]*ServiceEntry)
+	for _, e := range entries {
+		if e.HostName != "" {
+			host := dns.CanonicalName(e.HostName)
+			byHost[host] = append(byHost[host], e)
+		}
+	}
+	for _, answer := range sections {
+		switch rr := answer.(type) {
+		case *dns.A:
+			for _, e := range byHost[dns.CanonicalName(rr.Hdr.Name)] {
+				e.AddrIPv4 = append(e.AddrIPv4, rr.A)
+			}
+		case *dns.AAAA:
+			for _, e := range byHost[dns.CanonicalName(rr.Hdr.Name)] {
+				e.AddrIPv6 = append(e.AddrIPv6, rr.AAAA)
+			}
+		}
+	}
+	return entries
 }
@@ -0,0 +1,639 @@
+package zeroconf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// largeResponse builds a message with n instances on n hosts, as seen when
+// browsing busy service types on a campus network.
+func largeResponse(n int) *dns.Msg {
+	msg := new(dns.Msg)
+	for i := 0; i < n; i++ {
+		instance := fmt.Sprintf("device-%d._googlecast._tcp.local.", i)
+		host := fmt.Sprintf("host-%d.local.", i)
+		msg.Answer = append(msg.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: "_googlecast._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 120},
+			Ptr: instance,
+		})
+		msg.Extra = append(msg.Extra,
+			&dns.SRV{
+				Hdr:    dns.RR_Header{Name: instance, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120},
+				Target: host,
+				Port:   8009,
+			},
+			&dns.TXT{
+				Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 120},
+				Txt: []string{"id=" + instance},
+			},
+			&dns.A{
+				Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+				A:   net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)),
+			})
+	}
+	return msg
+}
+
+func TestParseEntriesLargeResponse(t *testing.T) {
+	params := newLookupParams("", "_googlecast._tcp", "local", true, nil)
+	entries := parseEntries(params, largeResponse(1000), time.Now())
+	if len(entries) != 1000 {
+		t.Fatalf("Expected 1000 entries, but got %d", len(entries))
+	}
+	for _, e := range entries {
+		if len(e.AddrIPv4) != 1 || e.Port != 8009 || len(e.Text) != 1 {
+			t.Fatalf("Incomplete entry %+v", e)
+		}
+	}
+}
+
+func BenchmarkParseEntries(b *testing.B) {
+	for _, n := range []int{10, 1000, 5000} {
+		msg := largeResponse(n)
+		params := newLookupParams("", "_googlecast._tcp", "local", true, nil)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				parseEntries(params, msg, time.Now())
+			}
+		})
+	}
+}
+
+// receiveAllocBudget caps the allocations of unpacking a response with one
+// instance and parsing its entry. Lower it when an optimization lands.
+const receiveAllocBudget = 55
+
+func TestReceiveAllocs(t *testing.T) {
+	buf, err := largeResponse(1).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := newLookupParams("", "_googlecast._tcp", "local", true, nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf); err != nil {
+			t.Fatal(err)
+		}
+		parseEntries(params, msg, time.Now())
+	})
+	if allocs > receiveAllocBudget {
+		t.Fatalf("Receiving an entry takes %.0f allocations, the budget is %d", allocs, receiveAllocBudget)
+	}
+}
+
+// BenchmarkDeliverEntry measures a received response from unpacking to the
+// delivery of its entry by the main loop of a browse.
+func BenchmarkDeliverEntry(b *testing.B) {
+	buf, err := largeResponse(1).Pack()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &client{cleanupFreq: cleanupFreq}
+	entries := make(chan *ServiceEntry)
+	msgCh := make(chan *dns.Msg)
+	params := newLookupParams("", "_googlecast._tcp", "local", true, entries)
+	go c.mainloop(ctx, params, msgCh)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf); err != nil {
+			b.Fatal(err)
+		}
+		// Without refresh window, unchanged entries are delivered again.
+		msgCh <- msg
+		<-entries
+	}
+}
+
+func TestSplitInstanceName(t *testing.T) {
+	tests := []struct {
+		name, service, instance string
+		ok                      bool
+	}{
+		{"printer._ipp._tcp.local.", "_ipp._tcp.local.", "printer", true},
+		{"My\\ Printer._IPP._tcp.local.", "_ipp._tcp.local.", "My Printer", true},
+		{"x_ipp._tcp.local._ipp._tcp.local.", "_ipp._tcp.local.", "", false},
+		{"x\\.local\\._ipp\\._tcp._ipp._tcp.local.", "_ipp._tcp.local.", "x.local._ipp._tcp", true},
+		{"foo_ipp._tcp.local.", "_ipp._tcp.local.", "", false},
+		{"Caf\\195\\169._http._tcp.local.", "_http._tcp.local.", "Café", true},
+		{"a\\\\b._http._tcp.local.", "_http._tcp.local.", "a\\b", true},
+		{"_http._tcp.local.", "_http._tcp.local.", "", false},
+	}
+	for _, test := range tests {
+		instance, ok := SplitInstanceName(test.name, test.service)
+		if instance != test.instance || ok != test.ok {
+			t.Errorf("SplitInstanceName(%q, %q) = %q, %v, expected %q, %v", test.name, test.service, instance, ok, test.instance, test.ok)
+		}
+		if ok && !equalNames(escapeLabel(instance)+"."+test.service, test.name) {
+			t.Errorf("Expected %q to escape back to %q", instance, test.name)
+		}
+	}
+}
+
+func TestParseEntriesInstanceContainingService(t *testing.T) {
+	instance := "Lab _http._tcp.local. printer"
+	params := newLookupParams(instance, "_http._tcp", "local", false, nil)
+	name := params.ServiceInstanceName()
+	msg := received(t, &dns.Msg{
+		Answer: []dns.RR{&dns.SRV{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120},
+			Target: "lab.local.",
+			Port:   80,
+		}},
+	})
+	entries := parseEntries(params, msg, time.Now())
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, but got %d", len(entries))
+	}
+	for _, e := range entries {
+		if e.Instance != instance || e.ServiceInstanceName() != name {
+			t.Fatalf("Expected instance %q, but got %q", instance, e.Instance)
+		}
+	}
+}
+
+// received returns the message as received, with the names in presentation
+// format.
+func received(t *testing.T, msg *dns.Msg) *dns.Msg {
+	buf, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestParseEntriesInternationalNames(t *testing.T) {
+	for _, instance := range []string{"📺 Wohnzimmer", "リビングのテレビ", "Принтер в офисе", "Jürgen’s iPhone"} {
+		params := newLookupParams(instance, "_airplay._tcp", "local", false, nil)
+		host := "Jürgens-MacBook-Pro.local."
+		msg := received(t, &dns.Msg{
+			Answer: []dns.RR{&dns.SRV{
+				Hdr:    dns.RR_Header{Name: params.ServiceInstanceName(), Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120},
+				Target: host,
+				Port:   7000,
+			}},
+			Extra: []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+				A:   net.IPv4(192, 168, 1, 2),
+			}},
+		})
+		entries := parseEntries(params, msg, time.Now())
+		if len(entries) != 1 {
+			t.Fatalf("Expected 1 entry for %q, but got %d", instance, len(entries))
+		}
+		for _, e := range entries {
+			if e.Instance != instance {
+				t.Errorf("Expected instance %q, but got %q", instance, e.Instance)
+			}
+			if !equalNames(e.HostName, presentationName(host)) || len(e.AddrIPv4) != 1 {
+				t.Errorf("Expected host %q with an address, but got %q %v", host, e.HostName, e.AddrIPv4)
+			}
+		}
+	}
+}
+
+func TestHostIDNA(t *testing.T) {
+	tests := []struct{ unicode, ascii string }{
+		{"bücher.example.", "xn--bcher-kva.example."},
+		{"テレビ.local.", "xn--ddk0a0e.local."},
+		{"📺-wohnzimmer.example.com", "xn---wohnzimmer-tc96j.example.com"},
+		{"printer.example.", "printer.example."},
+	}
+	for _, test := range tests {
+		ascii, err := HostToASCII(test.unicode)
+		if err != nil || ascii != test.ascii {
+			t.Errorf("HostToASCII(%q) = %q, %v, expected %q", test.unicode, ascii, err, test.ascii)
+		}
+		// Received names are escaped.
+		if ascii, err := HostToASCII(presentationName(test.unicode)); err != nil || ascii != test.ascii {
+			t.Errorf("HostToASCII(%q) = %q, %v, expected %q", presentationName(test.unicode), ascii, err, test.ascii)
+		}
+		unicode, err := HostToUnicode(test.ascii)
+		if err != nil || unicode != test.unicode {
+			t.Errorf("HostToUnicode(%q) = %q, %v, expected %q", test.ascii, unicode, err, test.unicode)
+		}
+	}
+}
+
+func TestGuardCacheFlush(t *testing.T) {
+	instance := "printer._ipp._tcp.local."
+	srv := func(port uint16, class uint16, ttl uint32) *dns.Msg {
+		return &dns.Msg{Answer: []dns.RR{&dns.SRV{
+			Hdr:    dns.RR_Header{Name: instance, Rrtype: dns.TypeSRV, Class: class, Ttl: ttl},
+			Target: "printer.local.",
+			Port:   port,
+		}}}
+	}
+	owner := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 5353}
+	forger := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 66), Port: 5353}
+	flush := uint16(dns.ClassINET | qClassCacheFlush)
+	now := time.Now()
+
+	for _, requireOwner := range []bool{false, true} {
+		var opts clientOpts
+		GuardCacheFlush(requireOwner)(&opts)
+		g := opts.flushGuard
+
+		msg := srv(631, flush, 120)
+		if g.filter(msg, owner, now); len(msg.Answer) != 1 {
+			t.Fatalf("Expected the first source to own the name")
+		}
+		msg = srv(9100, flush, 120)
+		if g.filter(msg, forger, now); len(msg.Answer) != 0 {
+			t.Fatalf("Expected the forged flush record to be dropped")
+		}
+		msg = srv(9100, dns.ClassINET, 120)
+		g.filter(msg, forger, now)
+		if kept := len(msg.Answer) == 1; kept == requireOwner {
+			t.Fatalf("Expected the shared record to be kept unless requiring the owner, requireOwner %v", requireOwner)
+		}
+		msg = srv(631, dns.ClassINET, 0)
+		if g.filter(msg, forger, now); len(msg.Answer) != 0 {
+			t.Fatalf("Expected the forged goodbye to be dropped, requireOwner %v", requireOwner)
+		}
+		msg = srv(9100, flush, 120)
+		if g.filter(msg, forger, now.Add(121*time.Second)); len(msg.Answer) != 1 {
+			t.Fatalf("Expected the name to be free once the records expired")
+		}
+		msg = srv(9100, dns.ClassINET, 0)
+		if g.filter(msg, forger, now.Add(121*time.Second)); len(msg.Answer) != 1 {
+			t.Fatalf("Expected the goodbye of the owner to be passed")
+		}
+		msg = srv(631, flush, 120)
+		if g.filter(msg, owner, now.Add(121*time.Second)); len(msg.Answer) != 1 {
+			t.Fatalf("Expected the name to be free after the goodbye of its owner")
+		}
+	}
+}
+
+func TestSourceRecordLimit(t *testing.T) {
+	source := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 66), Port: 5353}
+	other := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 5353}
+	ptr := func(i int, ttl uint32) dns.RR {
+		return &dns.PTR{
+			Hdr: dns.RR_Header{Name: "_ipp._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+			Ptr: fmt.Sprintf("printer-%d._ipp._tcp.local.", i),
+		}
+	}
+	now := time.Now()
+	tests := []struct {
+		name    string
+		from    *net.UDPAddr
+		records []dns.RR
+		after   time.Duration
+		kept    int
+	}{
+		{name: "within the limit", from: source, records: []dns.RR{ptr(0, 120), ptr(1, 120)}, kept: 2},
+		{name: "exceeding the limit", from: source, records: []dns.RR{ptr(2, 120), ptr(3, 120)}, kept: 1},
+		{name: "refreshed records", from: source, records: []dns.RR{ptr(0, 120), ptr(1, 120), ptr(2, 120)}, kept: 3},
+		{name: "other source", from: other, records: []dns.RR{ptr(3, 120), ptr(4, 120)}, kept: 2},
+		{name: "goodbye frees a record", from: source, records: []dns.RR{ptr(0, 0), ptr(3, 120)}, kept: 2},
+		{name: "expired records", from: source, records: []dns.RR{ptr(4, 120), ptr(5, 120), ptr(6, 120)}, after: 121 * time.Second, kept: 3},
+	}
+	var dropped int
+	var opts clientOpts
+	SourceRecordLimit(3, func(ip net.IP, n int) {
+		if !ip.Equal(source.IP) {
+			t.Fatalf("Expected records of %s to be dropped only, but got %s", source.IP, ip)
+		}
+		dropped += n
+	})(&opts)
+	for _, tt := range tests {
+		msg := &dns.Msg{Answer: tt.records}
+		opts.sourceLimit.filter(msg, tt.from, now.Add(tt.after))
+		if len(msg.Answer) != tt.kept {
+			t.Fatalf("%s: Expected %d records to be kept, but got %d", tt.name, tt.kept, len(msg.Answer))
+		}
+	}
+	if dropped != 1 {
+		t.Fatalf("Expected 1 dropped record to be reported, but got %d", dropped)
+	}
+	opts.sourceLimit.expire(now.Add(121 * time.Second))
+	if n := len(opts.sourceLimit.sources); n != 1 {
+		t.Fatalf("Expected 1 source with unexpired records to remain, but got %d", n)
+	}
+	opts.sourceLimit.expire(now.Add(242 * time.Second))
+	if n := len(opts.sourceLimit.sources); n != 0 {
+		t.Fatalf("Expected the sources without records to be removed, but got %d", n)
+	}
+}
+
+func TestResponseAssembly(t *testing.T) {
+	responder := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 5353}
+	other := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 21), Port: 5353}
+	response := func(truncated bool, n int) *dns.Msg {
+		msg := largeResponse(n)
+		msg.Response = true
+		msg.Truncated = truncated
+		return msg
+	}
+	tests := []struct {
+		name    string
+		packets []*dns.Msg
+		sources []*net.UDPAddr
+		merged  []int // number of answers of the messages handled at once
+	}{
+		{
+			name:    "complete response",
+			packets: []*dns.Msg{response(false, 2)},
+			sources: []*net.UDPAddr{responder},
+			merged:  []int{2},
+		},
+		{
+			name:    "truncated response with continuations",
+			packets: []*dns.Msg{response(true, 2), response(true, 3), response(false, 1)},
+			sources: []*net.UDPAddr{responder, responder, responder},
+			merged:  []int{6},
+		},
+		{
+			name:    "other source",
+			packets: []*dns.Msg{response(true, 2), response(false, 3), response(false, 1)},
+			sources: []*net.UDPAddr{responder, other, responder},
+			merged:  []int{3, 3},
+		},
+		{
+			name:    "query",
+			packets: []*dns.Msg{{MsgHdr: dns.MsgHdr{Truncated: true}, Answer: largeResponse(1).Answer}},
+			sources: []*net.UDPAddr{responder},
+			merged:  []int{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newResponseAssembly(func(*dns.Msg) { t.Fatalf("Expected no message to be flushed") })
+			var merged []int
+			for i, msg := range tt.packets {
+				if m := a.add(msg, tt.sources[i]); m != nil {
+					if m.Response && m.Truncated {
+						t.Fatalf("Expected the merged response not to be truncated")
+					}
+					merged = append(merged, len(m.Answer))
+				}
+			}
+			if fmt.Sprint(merged) != fmt.Sprint(tt.merged) {
+				t.Fatalf("Expected messages with %v answers, but got %v", tt.merged, merged)
+			}
+		})
+	}
+
+	t.Run("missing continuation", func(t *testing.T) {
+		flushed := make(chan *dns.Msg, 1)
+		a := newResponseAssembly(func(m *dns.Msg) { flushed <- m })
+		if a.add(response(true, 2), responder) != nil {
+			t.Fatalf("Expected the truncated response to be held back")
+		}
+		select {
+		case m := <-flushed:
+			if len(m.Answer) != 2 {
+				t.Fatalf("Expected the held response, but got %d answers", len(m.Answer))
+			}
+		case <-time.After(2 * truncatedResponseWindow):
+			t.Fatalf("Expected the held response to be flushed after the window")
+		}
+	})
+}
+
+func TestAssembleAcrossPackets(t *testing.T) {
+	const (
+		service  = "_ipp._tcp.local."
+		instance = "printer._ipp._tcp.local."
+		host     = "printer.local."
+	)
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: 120}
+	}
+	ptr := &dns.PTR{Hdr: hdr(service, dns.TypePTR), Ptr: instance}
+	srv := &dns.SRV{Hdr: hdr(instance, dns.TypeSRV), Target: host, Port: 631}
+	txt := &dns.TXT{Hdr: hdr(instance, dns.TypeTXT), Txt: []string{"rp=ipp/print"}}
+	a := &dns.A{Hdr: hdr(host, dns.TypeA), A: net.IPv4(192, 168, 1, 20)}
+	tests := []struct {
+		name    string
+		packets [][]dns.RR
+	}{
+		{name: "one packet", packets: [][]dns.RR{{ptr, srv, txt, a}}},
+		{name: "record per packet", packets: [][]dns.RR{{ptr}, {srv}, {txt}, {a}}},
+		{name: "late address", packets: [][]dns.RR{{ptr, srv, txt}, {a}}},
+		{name: "late pointer", packets: [][]dns.RR{{srv, txt, a}, {ptr}}},
+	}
+	c, err := newClient(applyOpts(SelectLoopback(), SelectIPTraffic(IPv4)))
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	defer c.shutdown()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			entries := make(chan *ServiceEntry, 16)
+			params := newLookupParams("", "_ipp._tcp", "local", true, entries)
+			msgCh := make(chan *dns.Msg, len(tt.packets))
+			for _, rrs := range tt.packets {
+				msgCh <- received(t, &dns.Msg{MsgHdr: dns.MsgHdr{Response: true}, Answer: rrs})
+			}
+			go c.mainloop(ctx, params, msgCh)
+			for e := range entries {
+				if e.Port == 631 && len(e.Text) == 1 && len(e.AddrIPv4) == 1 {
+					return
+				}
+			}
+			t.Fatalf("Expected the records to be assembled to a complete entry")
+		})
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	const instance = "printer._ipp._tcp.local."
+	nsec := func(ttl uint32, types ...uint16) *dns.Msg {
+		return &dns.Msg{Extra: []dns.RR{&dns.NSEC{
+			Hdr:        dns.RR_Header{Name: instance, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+			NextDomain: instance,
+			TypeBitMap: types,
+		}}}
+	}
+	tests := []struct {
+		name   string
+		msg    *dns.Msg
+		absent bool
+	}{
+		{name: "no srv record", msg: nsec(120, dns.TypeTXT), absent: true},
+		{name: "srv record", msg: nsec(120, dns.TypeSRV, dns.TypeTXT)},
+		{name: "goodbye", msg: nsec(0, dns.TypeTXT)},
+		{name: "no nsec record", msg: new(dns.Msg)},
+	}
+	for _, tt := range tests {
+		if _, absent := absentInstance(tt.msg, instance); absent != tt.absent {
+			t.Fatalf("%s: Expected absent %v", tt.name, tt.absent)
+		}
+	}
+
+	now := time.Now()
+	cache := newEntryCache()
+	e := newServiceEntry("printer", "_ipp._tcp", "local.")
+	e.Expiry = now.Add(time.Minute)
+	cache.put(e)
+	if cache.putAbsent("_ipp._tcp", instance, now.Add(time.Minute), false); cache.isAbsent(instance, now) {
+		t.Fatalf("Expected an unanswered lookup to keep a cached instance")
+	}
+	if cache.putAbsent("_ipp._tcp", instance, now.Add(time.Minute), true); !cache.isAbsent(instance, now) {
+		t.Fatalf("Expected an assertion to mark the instance absent")
+	}
+	if len(cache.entries("_ipp._tcp", now)) != 0 {
+		t.Fatalf("Expected the absent instance to be dropped from the cache")
+	}
+	if cache.isAbsent(instance, now.Add(time.Minute)) {
+		t.Fatalf("Expected the negative entry to expire")
+	}
+	cache.putAbsent("_ipp._tcp", instance, now.Add(time.Minute), true)
+	if cache.put(e); cache.isAbsent(instance, now) {
+		t.Fatalf("Expected a received record to end the negative entry")
+	}
+}
+
+func TestResolverNegativeCache(t *testing.T) {
+	resolver, err := NewResolver(SelectLoopback(), SelectIPTraffic(IPv4), NegativeCache(time.Minute))
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	defer resolver.Close()
+	lookup := func(timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return resolver.Lookup(ctx, "absent", "_ipp._tcp", "local.", make(chan *ServiceEntry, 1))
+	}
+	if err := lookup(absentAfter + time.Second); err != nil {
+		t.Fatalf("Expected the first lookup to time out, but got %v", err)
+	}
+	start := time.Now()
+	if err := lookup(time.Second); !errors.Is(err, ErrInstanceAbsent) {
+		t.Fatalf("Expected the instance to be known absent, but got %v", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("Expected the lookup of an absent instance to fail fast")
+	}
+	resolver.FlushCache()
+	if err := lookup(100 * time.Millisecond); err != nil {
+		t.Fatalf("Expected the flush to end the negative entry, but got %v", err)
+	}
+}
+
+func TestConnLoopback(t *testing.T) {
+	ifaces := listLoopbackInterfaces()
+	if len(ifaces) == 0 {
+		t.Skip("no loopback interface")
+	}
+	conn, err := ListenMulticast(IPv4, ifaces)
+	if err != nil {
+		t.Skipf("Failed to join the group on the loopback interface: %v", err)
+	}
+	defer conn.Close()
+
+	// receive reads the packets until the given message arrives.
+	receive := func(t *testing.T, id uint16) Packet {
+		t.Helper()
+		timeout := time.AfterFunc(3*time.Second, func() { conn.Close() })
+		defer timeout.Stop()
+		for {
+			p, err := conn.ReadPacket()
+			if err != nil {
+				t.Fatalf("Expected message %d to be received, but got %v", id, err)
+			}
+			msg := new(dns.Msg)
+			if msg.Unpack(p.Data) == nil && msg.Id == id {
+				return p
+			}
+		}
+	}
+	pack := func(t *testing.T, id uint16) []byte {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion(mdnsName+"."+mdnsService+"."+mdnsDomain, dns.TypeSRV)
+		msg.Id = id
+		buf, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+
+	if err := conn.WriteMulticast(pack(t, 1), ifaces[0].Index); err != nil {
+		t.Fatalf("Expected the multicast to be sent, but got %v", err)
+	}
+	if p := receive(t, 1); p.From == nil || p.IfIndex == 0 {
+		t.Fatalf("Expected the source and interface of the packet, but got %+v", p)
+	}
+	if err := conn.WriteTo(pack(t, 2), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: ipv4Addr.Port}, 0); err != nil {
+		t.Fatalf("Expected the unicast packet to be sent, but got %v", err)
+	}
+	if p := receive(t, 2); !p.From.IP.IsLoopback() {
+		t.Fatalf("Expected the packet from the loopback address, but got %v", p.From)
+	}
+	if err := conn.WriteMulticast(pack(t, 3), -1); err == nil {
+		t.Fatalf("Expected no multicast on an interface without the group")
+	}
+
+	conn.Close()
+	if _, err := conn.ReadPacket(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Expected net.ErrClosed after closing, but got %v", err)
+	}
+}
+
+func TestPromiscuousRejected(t *testing.T) {
+	entries := make(chan *ServiceEntry)
+	if err := Lookup(context.Background(), mdnsName, mdnsService, mdnsDomain, entries, Promiscuous()); !errors.Is(err, errPromiscuous) {
+		t.Fatalf("Expected a promiscuous lookup to be rejected, but got %v", err)
+	}
+	if _, err := NewResolver(Promiscuous()); !errors.Is(err, errPromiscuous) {
+		t.Fatalf("Expected a promiscuous resolver to be rejected, but got %v", err)
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	report := Diagnose(ctx)
+	if report.IPv4Error != nil {
+		t.Skipf("no usable IPv4 multicast: %v", report.IPv4Error)
+	}
+	for _, e := range report.SendErrors {
+		if strings.HasPrefix(e, "udp4 ") {
+			t.Fatalf("Expected the query to be sent on the IPv4 interfaces, but got %s", e)
+		}
+	}
+	if !report.IPv4Loopback {
+		t.Fatalf("Expected the own IPv4 query to be received, report:\n%s", report)
+	}
+}
+
+func TestQueryLimiterRate(t *testing.T) {
+	for _, rate := range []float64{0, -1} {
+		if _, err := NewQueryLimiter(rate, 1); err == nil {
+			t.Fatalf("Expected rate %v to be rejected", rate)
+		}
+	}
+	l, err := NewQueryLimiter(20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		l.wait()
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("Expected the queries after the burst to be spaced, but they took %v", elapsed)
+	}
+}
@@ -0,0 +1,123 @@
+package zeroconf
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// Conflict describes the rename of a service instance whose name was
+// already in use on the network.
+type Conflict struct {
+	OldName string   // Service instance name probed for
+	NewName string   // Service instance name probed for instead
+	Peer    net.Addr // Address of the responder holding the name
+}
+
+// OnConflict sets a function called whenever a service is renamed because
+// another responder answered for its instance name while it was probed. It
+// is called from a background goroutine and should return quickly.
+//
+// Only instance names are defended; conflicts of the host name are not
+// detected yet.
+func OnConflict(fn func(Conflict)) ServerOption {
+	return func(o *serverOpts) {
+		o.onConflict = fn
+	}
+}
+
+// checkConflicts notifies the services being probed whose instance name a
+// response of another responder carries a different SRV record for, RFC6762
+// section 8.1. Identical records are no conflict.
+func (s *Server) checkConflicts(msg *dns.Msg, from net.Addr) {
+	if !msg.Response {
+		return
+	}
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		for _, r := range s.registrationsFor(dns.CanonicalName(srv.Hdr.Name), 0) {
+			e := r.entry()
+			if !r.progress.probing() || e.canonicalInstanceName != dns.CanonicalName(srv.Hdr.Name) {
+				continue
+			}
+			if int(srv.Port) == e.Port && equalNames(srv.Target, e.HostName) {
+				continue
+			}
+			select {
+			case r.conflict <- from:
+			default:
+			}
+		}
+	}
+}
+
+// defends reports whether the question of a probe is for the instance name
+// of a service which is no longer probed itself, RFC6762 section 8.1.
+func (s *Server) defends(q dns.Question, ifIndex int) bool {
+	name := dns.CanonicalName(q.Name)
+	for _, r := range s.registrationsFor(name, ifIndex) {
+		if r.entry().canonicalInstanceName == name && !r.progress.probing() {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveConflict replaces a service whose instance name is taken by one
+// with the next free name, which is probed instead. It is called by the
+// probe of the service, which holds a reference of refCount, so it must not
+// wait for shutdownLock.
+func (s *Server) resolveConflict(r *registration, peer net.Addr) {
+	select {
+	case <-s.shouldShutdown:
+		return
+	default:
+	}
+
+	old := r.entry()
+	e := *old
+	e.Instance = nextInstanceName(old.Instance)
+	e.serviceInstanceName = fmt.Sprintf("%s.%s", escapeLabel(e.Instance), e.ServiceName())
+	e.canonicalInstanceName = dns.CanonicalName(e.serviceInstanceName)
+	renamed := newRegistration(&e)
+	renamed.ifaces = r.ifaces
+
+	s.servicesLock.Lock()
+	replaced := s.replaceRegistration(r, renamed)
+	s.servicesLock.Unlock()
+	if !replaced {
+		return
+	}
+
+	log.Printf("[WARN] mdns: service name %s is in use by %v, renamed to %s", old.ServiceInstanceName(), peer, e.ServiceInstanceName())
+	if s.onConflict != nil {
+		s.onConflict(Conflict{
+			OldName: old.ServiceInstanceName(),
+			NewName: e.ServiceInstanceName(),
+			Peer:    peer,
+		})
+	}
+	s.refCount.Add(1)
+	go s.probe(renamed)
+}
+
+var instanceNumber = regexp.MustCompile(`^(.*) \((\d+)\)$`)
+
+// nextInstanceName numbers an instance name, "My Printer" becomes
+// "My Printer (2)" and "My Printer (2)" becomes "My Printer (3)", as
+// suggested by RFC6762 section 9.
+func nextInstanceName(name string) string {
+	if m := instanceNumber.FindStringSubmatch(name); m != nil {
+		if n, err := strconv.Atoi(m[2]); err == nil {
+			return fmt.Sprintf("%s (%d)", m[1], n+1)
+		}
+	}
+	return name + " (2)"
+}
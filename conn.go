@@ -0,0 +1,266 @@
+package zeroconf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Conn is the socket layer of the clients and servers of this package, for
+// applications implementing their own mDNS behavior: it binds the mDNS port,
+// joins the multicast groups on a set of interfaces, sends packets to the
+// groups on a given interface and reads packets with their source and the
+// interface they were received on. Messages are not parsed or answered; use
+// the dns package to pack and unpack them.
+type Conn struct {
+	ipv4conn *ipv4.PacketConn
+	ipv6conn *ipv6.PacketConn
+
+	mu     sync.Mutex // guards the joined interfaces and the multicast interface setting
+	ifaces map[int]net.Interface
+
+	packets   chan Packet
+	readers   sync.WaitGroup
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Packet is a packet read by Conn.ReadPacket.
+type Packet struct {
+	Data    []byte
+	From    *net.UDPAddr
+	IfIndex int // Interface the packet was received on, 0 if unknown
+}
+
+// ListenMulticast binds the mDNS port for the given IP types and joins the
+// multicast groups on the interfaces, or on all multicast interfaces if none
+// are given. It fails if no group could be joined.
+func ListenMulticast(t IPType, ifaces []net.Interface) (*Conn, error) {
+	if len(ifaces) == 0 {
+		ifaces = listMulticastInterfaces(false)
+	}
+	c := &Conn{
+		ifaces:  make(map[int]net.Interface),
+		packets: make(chan Packet, 32),
+		closed:  make(chan struct{}),
+	}
+	var errs []error
+	if t&IPv4 > 0 {
+		conn, joined, err := joinUdp4Multicast(ifaces)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			c.ipv4conn = conn
+			c.addInterfaces(joined)
+		}
+	}
+	if t&IPv6 > 0 {
+		conn, joined, err := joinUdp6Multicast(ifaces)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			c.ipv6conn = conn
+			c.addInterfaces(joined)
+		}
+	}
+	if c.ipv4conn == nil && c.ipv6conn == nil {
+		if len(errs) == 0 {
+			return nil, fmt.Errorf("no ip type selected")
+		}
+		return nil, errors.Join(errs...)
+	}
+
+	if c.ipv4conn != nil {
+		c.readers.Add(1)
+		go c.read(func(b []byte) (int, int, net.Addr, error) {
+			n, cm, from, err := c.ipv4conn.ReadFrom(b)
+			if cm != nil {
+				return n, cm.IfIndex, from, err
+			}
+			return n, 0, from, err
+		})
+	}
+	if c.ipv6conn != nil {
+		c.readers.Add(1)
+		go c.read(func(b []byte) (int, int, net.Addr, error) {
+			n, cm, from, err := c.ipv6conn.ReadFrom(b)
+			if cm != nil {
+				return n, cm.IfIndex, from, err
+			}
+			return n, 0, from, err
+		})
+	}
+	go func() {
+		c.readers.Wait()
+		close(c.packets)
+	}()
+	return c, nil
+}
+
+// addInterfaces records joined interfaces. The caller holds mu unless the
+// connection is not in use yet.
+func (c *Conn) addInterfaces(ifaces []net.Interface) {
+	for _, iface := range ifaces {
+		c.ifaces[iface.Index] = iface
+	}
+}
+
+// JoinGroups joins the multicast groups on further interfaces, or again on
+// interfaces which went down and up, as memberships are lost then. Packets
+// sent to all interfaces are sent on them from now on. It fails if a group
+// could be joined on none of them.
+func (c *Conn) JoinGroups(ifaces []net.Interface) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var joined []net.Interface
+	var errs []error
+	for i := range ifaces {
+		ok := false
+		if c.ipv4conn != nil {
+			if err := c.ipv4conn.JoinGroup(&ifaces[i], &net.UDPAddr{IP: mdnsGroupIPv4}); err == nil {
+				ok = true
+			} else {
+				errs = append(errs, fmt.Errorf("udp4 %s: %w", ifaces[i].Name, err))
+			}
+		}
+		if c.ipv6conn != nil {
+			if err := c.ipv6conn.JoinGroup(&ifaces[i], &net.UDPAddr{IP: mdnsGroupIPv6}); err == nil {
+				ok = true
+			} else {
+				errs = append(errs, fmt.Errorf("udp6 %s: %w", ifaces[i].Name, err))
+			}
+		}
+		if ok {
+			joined = append(joined, ifaces[i])
+		}
+	}
+	c.addInterfaces(joined)
+	if len(joined) == 0 && len(ifaces) > 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// Interfaces returns the interfaces a group was joined on, ordered by index.
+func (c *Conn) Interfaces() []net.Interface {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ifaces := make([]net.Interface, 0, len(c.ifaces))
+	for _, iface := range c.ifaces {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Slice(ifaces, func(i, j int) bool { return ifaces[i].Index < ifaces[j].Index })
+	return ifaces
+}
+
+// WriteMulticast sends a packet to the mDNS groups on the interface, or on
+// all joined interfaces if ifIndex is 0. Platforms with per-packet interface
+// selection set the interface in the control message; on the others, e.g.
+// Windows, the multicast interface of the connection is switched for the
+// packet. The errors of the interfaces are joined.
+func (c *Conn) WriteMulticast(buf []byte, ifIndex int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ifaces []net.Interface
+	if ifIndex != 0 {
+		iface, ok := c.ifaces[ifIndex]
+		if !ok {
+			return fmt.Errorf("no group joined on interface %d", ifIndex)
+		}
+		ifaces = []net.Interface{iface}
+	} else {
+		for _, iface := range c.ifaces {
+			ifaces = append(ifaces, iface)
+		}
+	}
+
+	var errs []error
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if c.ipv4conn != nil {
+			if err := writeOn(ipv4GroupConn{c.ipv4conn}, buf, iface, ipv4Addr); err != nil {
+				errs = append(errs, fmt.Errorf("udp4 %s: %w", iface.Name, err))
+			}
+		}
+		if c.ipv6conn != nil {
+			if err := writeOn(ipv6GroupConn{c.ipv6conn}, buf, iface, ipv6Addr); err != nil {
+				errs = append(errs, fmt.Errorf("udp6 %s: %w", iface.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WriteTo sends a packet to a unicast address, e.g. a response to a query
+// asking for one, on the interface given by ifIndex, or as routed if it is
+// 0.
+func (c *Conn) WriteTo(buf []byte, to *net.UDPAddr, ifIndex int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var iface *net.Interface
+	if ifIndex != 0 {
+		if known, ok := c.ifaces[ifIndex]; ok {
+			iface = &known
+		}
+	}
+	if to.IP.To4() != nil {
+		if c.ipv4conn == nil {
+			return fmt.Errorf("not listening on ipv4")
+		}
+		return writeOn(ipv4GroupConn{c.ipv4conn}, buf, iface, to)
+	}
+	if c.ipv6conn == nil {
+		return fmt.Errorf("not listening on ipv6")
+	}
+	return writeOn(ipv6GroupConn{c.ipv6conn}, buf, iface, to)
+}
+
+// ReadPacket returns the next packet received on any of the joined
+// interfaces, including the packets sent by this host, which are looped
+// back. It blocks until a packet arrives and returns net.ErrClosed once the
+// connection is closed.
+func (c *Conn) ReadPacket() (Packet, error) {
+	p, ok := <-c.packets
+	if !ok {
+		return Packet{}, net.ErrClosed
+	}
+	return p, nil
+}
+
+func (c *Conn) read(readFrom func([]byte) (int, int, net.Addr, error)) {
+	defer c.readers.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, ifIndex, from, err := readFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		addr, _ := from.(*net.UDPAddr)
+		select {
+		case c.packets <- Packet{Data: append([]byte(nil), buf[:n]...), From: addr, IfIndex: ifIndex}:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Close closes the sockets. Pending ReadPacket calls return net.ErrClosed.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	var errs []error
+	if c.ipv4conn != nil {
+		errs = append(errs, c.ipv4conn.Close())
+	}
+	if c.ipv6conn != nil {
+		errs = append(errs, c.ipv6conn.Close())
+	}
+	return errors.Join(errs...)
+}
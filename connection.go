@@ -2,8 +2,10 @@ package zeroconf
 
 import (
 	"fmt"
+	"log"
 	"net"
 
+	"github.com/kdanielm/zeroconf/internal/bridge"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 )
@@ -35,10 +37,12 @@ var (
 	}
 )
 
-func joinUdp6Multicast(interfaces []net.Interface) (*ipv6.PacketConn, error) {
+// joinUdp6Multicast binds the mDNS port and joins the multicast group on
+// the given interfaces. It returns the connection and the interfaces joined.
+func joinUdp6Multicast(interfaces []net.Interface) (*ipv6.PacketConn, []net.Interface, error) {
 	udpConn, err := net.ListenUDP("udp6", mdnsWildcardAddrIPv6)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Join multicast groups to receive announcements
@@ -46,32 +50,35 @@ func joinUdp6Multicast(interfaces []net.Interface) (*ipv6.PacketConn, error) {
 	pkConn.SetControlMessage(ipv6.FlagInterface, true)
 
 	if len(interfaces) == 0 {
-		interfaces = listMulticastInterfaces()
+		interfaces = listMulticastInterfaces(false)
 	}
 	// log.Println("Using multicast interfaces: ", interfaces)
 
-	var failedJoins int
+	var joined []net.Interface
 	for _, iface := range interfaces {
 		if err := pkConn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv6}); err != nil {
 			// log.Println("Udp6 JoinGroup failed for iface ", iface)
-			failedJoins++
+			continue
 		}
+		joined = append(joined, iface)
 	}
-	if failedJoins == len(interfaces) {
+	if len(joined) == 0 {
 		pkConn.Close()
-		return nil, fmt.Errorf("udp6: failed to join any of these interfaces: %v", interfaces)
+		return nil, nil, fmt.Errorf("udp6: failed to join any of these interfaces: %v", interfaces)
 	}
 
 	_ = pkConn.SetMulticastHopLimit(255)
 
-	return pkConn, nil
+	return pkConn, joined, nil
 }
 
-func joinUdp4Multicast(interfaces []net.Interface) (*ipv4.PacketConn, error) {
+// joinUdp4Multicast binds the mDNS port and joins the multicast group on
+// the given interfaces. It returns the connection and the interfaces joined.
+func joinUdp4Multicast(interfaces []net.Interface) (*ipv4.PacketConn, []net.Interface, error) {
 	udpConn, err := net.ListenUDP("udp4", mdnsWildcardAddrIPv4)
 	if err != nil {
 		// log.Printf("[ERR] bonjour: Failed to bind to udp4 mutlicast: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Join multicast groups to receive announcements
@@ -79,41 +86,64 @@ func joinUdp4Multicast(interfaces []net.Interface) (*ipv4.PacketConn, error) {
 	pkConn.SetControlMessage(ipv4.FlagInterface, true)
 
 	if len(interfaces) == 0 {
-		interfaces = listMulticastInterfaces()
+		interfaces = listMulticastInterfaces(false)
 	}
 	// log.Println("Using multicast interfaces: ", interfaces)
 
-	var failedJoins int
+	var joined []net.Interface
 	for _, iface := range interfaces {
 		if err := pkConn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv4}); err != nil {
 			// log.Println("Udp4 JoinGroup failed for iface ", iface)
-			failedJoins++
+			continue
 		}
+		joined = append(joined, iface)
 	}
-	if failedJoins == len(interfaces) {
+	if len(joined) == 0 {
 		pkConn.Close()
-		return nil, fmt.Errorf("udp4: failed to join any of these interfaces: %v", interfaces)
+		return nil, nil, fmt.Errorf("udp4: failed to join any of these interfaces: %v", interfaces)
 	}
 
 	_ = pkConn.SetMulticastTTL(255)
 
-	return pkConn, nil
+	return pkConn, joined, nil
+}
+
+// listMulticastInterfaces returns the interfaces which are up and support
+// multicast. Point-to-point links (PPP, WireGuard, ...) often do not
+// advertise multicast support but may still carry it, so they can be included
+// as well.
+func listMulticastInterfaces(includePointToPoint bool) []net.Interface {
+	return bridge.MulticastInterfaces(includePointToPoint)
 }
 
-func listMulticastInterfaces() []net.Interface {
+// listLoopbackInterfaces returns the loopback interfaces which are up.
+func listLoopbackInterfaces() []net.Interface {
 	var interfaces []net.Interface
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return nil
 	}
 	for _, ifi := range ifaces {
-		if (ifi.Flags & net.FlagUp) == 0 {
-			continue
-		}
-		if (ifi.Flags & net.FlagMulticast) > 0 {
+		if (ifi.Flags&net.FlagUp) > 0 && (ifi.Flags&net.FlagLoopback) > 0 {
 			interfaces = append(interfaces, ifi)
 		}
 	}
-
 	return interfaces
 }
+
+// setDSCP marks outgoing packets of the connections with the given DSCP value
+// (0-63) in the IPv4 TOS and IPv6 traffic class fields. Failures are logged,
+// as the packets are still sent unmarked.
+func setDSCP(ipv4conn *ipv4.PacketConn, ipv6conn *ipv6.PacketConn, dscp uint8) {
+	tos := int(dscp&0x3f) << 2
+	if ipv4conn != nil {
+		if err := ipv4conn.SetTOS(tos); err != nil {
+			log.Printf("[WARN] mdns: Failed to set IPv4 TOS: %v", err)
+		}
+	}
+	if ipv6conn != nil {
+		if err := ipv6conn.SetTrafficClass(tos); err != nil {
+			log.Printf("[WARN] mdns: Failed to set IPv6 traffic class: %v", err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package zeroconf
+
+import "sync"
+
+// BrowseControl pauses and resumes a running Browse or Lookup, e.g. while an
+// application is in the background. While paused, no queries are sent and
+// received entries are not delivered, but kept. On Resume, the kept entries
+// which are still valid are delivered right away, followed by a new query.
+type BrowseControl struct {
+	mu        sync.Mutex
+	paused    bool
+	listeners map[chan struct{}]struct{}
+}
+
+// NewBrowseControl creates a BrowseControl to be passed to Browse, Lookup or
+// NewResolver with the WithBrowseControl option.
+func NewBrowseControl() *BrowseControl {
+	return &BrowseControl{
+		listeners: make(map[chan struct{}]struct{}),
+	}
+}
+
+// Pause stops querying and the delivery of entries.
+func (b *BrowseControl) Pause() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.paused = true
+}
+
+// Resume delivers the entries kept while paused and queries again.
+func (b *BrowseControl) Resume() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.paused {
+		return
+	}
+	b.paused = false
+	for ch := range b.listeners {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Paused reports whether the browse is paused.
+func (b *BrowseControl) Paused() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.paused
+}
+
+// listen returns a channel signaling each Resume and a function to stop
+// listening. A nil control never resumes.
+func (b *BrowseControl) listen() (<-chan struct{}, func()) {
+	if b == nil {
+		return nil, func() {}
+	}
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	b.listeners[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.listeners, ch)
+		b.mu.Unlock()
+	}
+}
@@ -0,0 +1,154 @@
+package zeroconf
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DebugString describes a message for logging in the style of dns-sd, one
+// line per question and record, e.g.
+//
+//	response id=0 flags=aa
+//	  answer     _ipp._tcp.local. 4500 PTR My\ Printer._ipp._tcp.local.
+//	  additional My\ Printer._ipp._tcp.local. 120 flush SRV 0 0 631 printer.local.
+//
+// The top bit of the class is annotated with its mDNS meaning: QU marks
+// questions asking for a unicast response and QM the others, flush marks
+// records with the cache-flush bit set, RFC 6762 section 18.12 and 18.13.
+func DebugString(msg *dns.Msg) string {
+	var b strings.Builder
+	if msg.Response {
+		b.WriteString("response")
+	} else {
+		b.WriteString("query")
+	}
+	fmt.Fprintf(&b, " id=%d", msg.Id)
+	var flags []string
+	if msg.Authoritative {
+		flags = append(flags, "aa")
+	}
+	if msg.Truncated {
+		flags = append(flags, "tc")
+	}
+	if len(flags) > 0 {
+		fmt.Fprintf(&b, " flags=%s", strings.Join(flags, " "))
+	}
+	if msg.Opcode != dns.OpcodeQuery {
+		fmt.Fprintf(&b, " opcode=%s", dns.OpcodeToString[msg.Opcode])
+	}
+	if msg.Rcode != dns.RcodeSuccess {
+		fmt.Fprintf(&b, " rcode=%s", dns.RcodeToString[msg.Rcode])
+	}
+
+	for _, q := range msg.Question {
+		mode := "QM"
+		if isUnicastQuestion(q) {
+			mode = "QU"
+		}
+		fmt.Fprintf(&b, "\n  question   %s %s %s", q.Name, dns.TypeToString[q.Qtype], mode)
+		if class := q.Qclass &^ qClassCacheFlush; class != dns.ClassINET {
+			fmt.Fprintf(&b, " %s", dns.Class(class))
+		}
+	}
+	sections := []struct {
+		name string
+		rrs  []dns.RR
+	}{{"answer", msg.Answer}, {"authority", msg.Ns}, {"additional", msg.Extra}}
+	for _, section := range sections {
+		for _, rr := range section.rrs {
+			fmt.Fprintf(&b, "\n  %-10s %s", section.name, debugRecord(rr))
+		}
+	}
+	return b.String()
+}
+
+// debugRecord describes a record as name, TTL, cache-flush bit, type and
+// data.
+func debugRecord(rr dns.RR) string {
+	hdr := rr.Header()
+	if opt, ok := rr.(*dns.OPT); ok {
+		// The class and TTL of the EDNS0 record carry its options.
+		return fmt.Sprintf("OPT udp=%d do=%v", opt.UDPSize(), opt.Do())
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %d", hdr.Name, hdr.Ttl)
+	if hdr.Class&qClassCacheFlush != 0 {
+		b.WriteString(" flush")
+	}
+	if class := hdr.Class &^ qClassCacheFlush; class != dns.ClassINET {
+		fmt.Fprintf(&b, " %s", dns.Class(class))
+	}
+	fmt.Fprintf(&b, " %s", dns.TypeToString[hdr.Rrtype])
+	// The data follows the header in the presentation format.
+	if data := strings.TrimPrefix(rr.String(), hdr.String()); data != "" {
+		fmt.Fprintf(&b, " %s", data)
+	}
+	return b.String()
+}
+
+// DebugString describes the entry for logging in several lines in the
+// style of dns-sd -L, e.g.
+//
+//	My\ Printer._ipp._tcp.local. can be reached at printer.local.:631
+//	  addresses 192.168.1.20 fe80::1
+//	  txt rp=printers/1 ty=Laser
+//	  expires in 1h14m59s, cache flush
+//
+// Unlike String, all TXT strings, SRV targets and TXT sets are listed.
+func (s *ServiceEntry) DebugString() string {
+	var b strings.Builder
+	name := s.ServiceInstanceName()
+	if name == "" {
+		name = s.ServiceName()
+	}
+	b.WriteString(name)
+	for i, target := range s.SRVRecords() {
+		if i == 0 {
+			b.WriteString(" can be reached at ")
+		} else {
+			b.WriteString("\n  or at ")
+		}
+		b.WriteString(net.JoinHostPort(target.HostName, strconv.Itoa(target.Port)))
+		if target.Priority != 0 || target.Weight != 0 {
+			fmt.Fprintf(&b, " (priority %d, weight %d)", target.Priority, target.Weight)
+		}
+	}
+	if len(s.Subtypes) > 0 {
+		fmt.Fprintf(&b, "\n  subtypes %s", strings.Join(s.Subtypes, " "))
+	}
+	addrs := make([]string, 0, len(s.AddrIPv4)+len(s.AddrIPv6))
+	for _, ip := range s.AddrIPv4 {
+		addrs = append(addrs, ip.String())
+	}
+	for _, ip := range s.AddrIPv6 {
+		addrs = append(addrs, ip.String())
+	}
+	if len(addrs) > 0 {
+		fmt.Fprintf(&b, "\n  addresses %s", strings.Join(addrs, " "))
+	}
+	if s.Text != nil {
+		fmt.Fprintf(&b, "\n  txt %s", strings.Join(s.Text, " "))
+	}
+	for _, set := range s.TextSets {
+		fmt.Fprintf(&b, "\n  txt %s", strings.Join(set, " "))
+	}
+	var notes []string
+	if !s.Expiry.IsZero() {
+		notes = append(notes, fmt.Sprintf("expires in %s", time.Until(s.Expiry).Round(time.Second)))
+	}
+	if s.CacheFlush {
+		notes = append(notes, "cache flush")
+	}
+	if s.Cached {
+		notes = append(notes, "cached")
+	}
+	if len(notes) > 0 {
+		fmt.Fprintf(&b, "\n  %s", strings.Join(notes, ", "))
+	}
+	return b.String()
+}
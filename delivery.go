@@ -0,0 +1,130 @@
+package zeroconf
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultRefreshWindow is the time before expiry of a delivered entry, in
+// which an unchanged entry is delivered again with the refreshed expiry.
+const defaultRefreshWindow = time.Minute
+
+// delivery records an entry delivered to the subscriber.
+type delivery struct {
+	entry *ServiceEntry
+	hash  uint64
+	at    time.Time
+}
+
+func newDelivery(e *ServiceEntry, now time.Time) *delivery {
+	return &delivery{entry: e, hash: entryHash(e), at: now}
+}
+
+// entryHash fingerprints the content of an entry: the SRV and TXT data and
+// the addresses, regardless of their order.
+func entryHash(e *ServiceEntry) uint64 {
+	h := fnv.New64a()
+	write := func(s string) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	write(dns.CanonicalName(e.HostName))
+	write(strconv.Itoa(e.Port))
+	write(strconv.Itoa(e.Priority))
+	write(strconv.Itoa(e.Weight))
+	for _, t := range e.Targets {
+		write(dns.CanonicalName(t.HostName))
+		write(strconv.Itoa(t.Port))
+		write(strconv.Itoa(t.Priority))
+		write(strconv.Itoa(t.Weight))
+	}
+	write(strconv.Itoa(len(e.Text)))
+	for _, txt := range e.Text {
+		write(txt)
+	}
+	for _, set := range e.TextSets {
+		write(strconv.Itoa(len(set)))
+		for _, txt := range set {
+			write(txt)
+		}
+	}
+	addrs := make([]string, 0, len(e.AddrIPv4)+len(e.AddrIPv6))
+	for _, ip := range e.AddrIPv4 {
+		addrs = append(addrs, ip.String())
+	}
+	for _, ip := range e.AddrIPv6 {
+		addrs = append(addrs, ip.String())
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		write(addr)
+	}
+	return h.Sum64()
+}
+
+func equalText(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsText(sets [][]string, txt []string) bool {
+	for _, set := range sets {
+		if equalText(set, txt) {
+			return true
+		}
+	}
+	return false
+}
+
+// entryComplete reports whether the entry is resolved, i.e. has a host and
+// at least one address.
+func entryComplete(e *ServiceEntry) bool {
+	return e.HostName != "" && (len(e.AddrIPv4) > 0 || len(e.AddrIPv6) > 0)
+}
+
+// entryResolved reports whether a lookup has all it asked for: the SRV and
+// TXT records of the instance and an address of its host.
+func entryResolved(e *ServiceEntry) bool {
+	return entryComplete(e) && e.Text != nil
+}
+
+// mergeEntry fills the data missing in a received entry from the entry
+// delivered before, as a message often carries only some of the records.
+func mergeEntry(e, prev *ServiceEntry) {
+	if e.HostName == "" {
+		e.HostName = prev.HostName
+		e.Port = prev.Port
+		e.Priority = prev.Priority
+		e.Weight = prev.Weight
+		e.Targets = prev.Targets
+	}
+	if e.Text == nil {
+		e.Text = prev.Text
+		e.TextSets = prev.TextSets
+	}
+	if len(e.AddrIPv4) == 0 && len(e.AddrIPv6) == 0 && equalNames(e.HostName, prev.HostName) {
+		e.AddrIPv4 = prev.AddrIPv4
+		e.AddrIPv6 = prev.AddrIPv6
+	}
+}
+
+// containsTarget reports whether the SRV target is one of the targets.
+func containsTarget(targets []SRVRecord, t SRVRecord) bool {
+	for _, u := range targets {
+		if equalNames(u.HostName, t.HostName) && u.Port == t.Port && u.Priority == t.Priority && u.Weight == t.Weight {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package zeroconf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// diagnoseTimeout is the time Diagnose waits for its own query and for
+// answers unless the context expires earlier.
+const diagnoseTimeout = 2 * time.Second
+
+// DiagnosticReport is the result of Diagnose.
+type DiagnosticReport struct {
+	IPv4Error      error    // Error binding the mDNS port or joining the IPv4 group
+	IPv6Error      error    // Error binding the mDNS port or joining the IPv6 group
+	IPv4Interfaces []string // Interfaces joined to the IPv4 multicast group
+	IPv6Interfaces []string // Interfaces joined to the IPv6 multicast group
+	IPv4Loopback   bool     // Our own IPv4 query was received back
+	IPv6Loopback   bool     // Our own IPv6 query was received back
+	HostName       string   // Host name queried, as a server would register it
+	Responders     []string // Addresses of responders answering for the host name
+	// SendErrors lists the interfaces the query could not be sent on, e.g.
+	// because the platform failed to select them, with the errors. The
+	// results above miss the responders of those links.
+	SendErrors []string
+}
+
+// String summarizes the report in a few lines for support requests.
+func (r *DiagnosticReport) String() string {
+	var b strings.Builder
+	status := func(proto string, err error, ifaces []string, loopback bool) {
+		if err != nil {
+			fmt.Fprintf(&b, "%s: %v\n", proto, err)
+			return
+		}
+		fmt.Fprintf(&b, "%s: joined [%s], own query received: %v\n", proto, strings.Join(ifaces, " "), loopback)
+	}
+	status("ipv4", r.IPv4Error, r.IPv4Interfaces, r.IPv4Loopback)
+	status("ipv6", r.IPv6Error, r.IPv6Interfaces, r.IPv6Loopback)
+	for _, e := range r.SendErrors {
+		fmt.Fprintf(&b, "query not sent on %s\n", e)
+	}
+	if len(r.Responders) == 0 {
+		fmt.Fprintf(&b, "no responder answers for %s", r.HostName)
+	} else {
+		fmt.Fprintf(&b, "responders answering for %s: %s", r.HostName, strings.Join(r.Responders, " "))
+	}
+	return b.String()
+}
+
+// Diagnose checks whether mDNS works on this host: it binds the mDNS port,
+// joins the multicast groups on all multicast interfaces and sends a query
+// for the host name a server would register. The report tells which
+// interfaces were joined, whether the query was looped back, i.e. the host
+// receives its own multicast packets, and which responders answer for the
+// host name, e.g. avahi or another server holding the name. It waits up to
+// two seconds, or until the context is done.
+func Diagnose(ctx context.Context) *DiagnosticReport {
+	report := &DiagnosticReport{}
+	if host, err := os.Hostname(); err == nil {
+		report.HostName = fmt.Sprintf("%s.local.", trimDot(host))
+	}
+
+	ifaces := listMulticastInterfaces(false)
+	ipv4conn, ipv4ifaces, err4 := joinUdp4Multicast(ifaces)
+	report.IPv4Error = err4
+	report.IPv4Interfaces = interfaceNames(ipv4ifaces)
+	ipv6conn, ipv6ifaces, err6 := joinUdp6Multicast(ifaces)
+	report.IPv6Error = err6
+	report.IPv6Interfaces = interfaceNames(ipv6ifaces)
+	if err4 != nil && err6 != nil || report.HostName == "" {
+		return report
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion(report.HostName, dns.TypeANY)
+	query.Id = dns.Id()
+	query.RecursionDesired = false
+	buf, err := query.Pack()
+	if err != nil {
+		return report
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, diagnoseTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	responders := make(map[string]bool)
+	handle := func(packet []byte, from net.Addr, loopback *bool) {
+		var msg dns.Msg
+		if err := msg.Unpack(packet); err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !msg.Response {
+			if msg.Id == query.Id && len(msg.Question) == 1 && equalNames(msg.Question[0].Name, report.HostName) {
+				*loopback = true
+			}
+			return
+		}
+		for _, rr := range append(msg.Answer, msg.Extra...) {
+			if equalNames(rr.Header().Name, report.HostName) {
+				if addr, ok := from.(*net.UDPAddr); ok {
+					responders[addr.IP.String()] = true
+				}
+				break
+			}
+		}
+	}
+
+	// send writes the query on each interface. The connections are used by
+	// Diagnose alone, so switching their multicast interface needs no lock.
+	send := func(conn groupConn, proto string, ifaces []net.Interface, group *net.UDPAddr) {
+		for i := range ifaces {
+			if err := writeOn(conn, buf, &ifaces[i], group); err != nil {
+				mu.Lock()
+				report.SendErrors = append(report.SendErrors, fmt.Sprintf("%s %s: %v", proto, ifaces[i].Name, err))
+				mu.Unlock()
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	if ipv4conn != nil {
+		defer ipv4conn.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			packet := make([]byte, 65536)
+			for {
+				n, _, from, err := ipv4conn.ReadFrom(packet)
+				if err != nil {
+					return
+				}
+				handle(packet[:n], from, &report.IPv4Loopback)
+			}
+		}()
+		send(ipv4GroupConn{ipv4conn}, "udp4", ipv4ifaces, ipv4Addr)
+	}
+	if ipv6conn != nil {
+		defer ipv6conn.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			packet := make([]byte, 65536)
+			for {
+				n, _, from, err := ipv6conn.ReadFrom(packet)
+				if err != nil {
+					return
+				}
+				handle(packet[:n], from, &report.IPv6Loopback)
+			}
+		}()
+		send(ipv6GroupConn{ipv6conn}, "udp6", ipv6ifaces, ipv6Addr)
+	}
+
+	<-ctx.Done()
+	if ipv4conn != nil {
+		ipv4conn.Close()
+	}
+	if ipv6conn != nil {
+		ipv6conn.Close()
+	}
+	wg.Wait()
+
+	for addr := range responders {
+		report.Responders = append(report.Responders, addr)
+	}
+	sort.Strings(report.Responders)
+	return report
+}
@@ -0,0 +1,73 @@
+package zeroconf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DialFunc is the signature of net.Dialer.DialContext, as used by
+// http.Transport.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// WrapDialer returns a dial function which resolves host names in the local
+// domain with mDNS and dials the resolved addresses with dial until one
+// connects. Other addresses are passed on to dial unchanged. If dial is nil,
+// a zero net.Dialer is used. For example
+//
+//	transport := &http.Transport{DialContext: r.WrapDialer(nil)}
+//
+// lets an HTTP client reach "http://printer.local/" where the system
+// resolver does not support mDNS, as in many containers.
+func (n *NetResolver) WrapDialer(dial DialFunc) DialFunc {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || !isLocalName(host) {
+			return dial(ctx, network, address)
+		}
+		ips, err := n.lookupIP(ctx, host)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		var errs []error
+		for _, ip := range dialOrder(network, ips) {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if len(errs) == 0 {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("no %s address for host %s", network, host)}
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// dialOrder returns the addresses suitable for the network, IPv4 addresses
+// first: resolved link-local IPv6 addresses lack the zone needed to dial them.
+func dialOrder(network string, ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return v4
+	case strings.HasSuffix(network, "6"):
+		return v6
+	}
+	return append(v4, v6...)
+}
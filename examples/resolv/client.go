@@ -13,6 +13,7 @@ var (
 	service  = flag.String("service", "_workstation._tcp", "Set the service category to look for devices.")
 	domain   = flag.String("domain", "local", "Set the search domain. For local networks, default is fine.")
 	waitTime = flag.Int("wait", 10, "Duration in [s] to run discovery.")
+	debug    = flag.Bool("debug", false, "Print all details of the entries.")
 )
 
 func main() {
@@ -21,7 +22,11 @@ func main() {
 	entries := make(chan *zeroconf.ServiceEntry)
 	go func(results <-chan *zeroconf.ServiceEntry) {
 		for entry := range results {
-			log.Println(entry)
+			if *debug {
+				log.Println(entry.DebugString())
+			} else {
+				log.Println(entry)
+			}
 		}
 		log.Println("No more entries.")
 	}(entries)
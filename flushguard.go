@@ -0,0 +1,134 @@
+package zeroconf
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxFlushOwners bounds the names tracked by GuardCacheFlush. When it is
+// reached, names owned by no one yet are not guarded.
+const maxFlushOwners = 4096
+
+// GuardCacheFlush protects the entries of the client against trivially
+// forged records on hostile networks. The source address which first sent
+// the SRV, TXT or address records of a name owns the name until its records
+// expire or are withdrawn with a goodbye; records of the name with the
+// cache-flush bit set, which replace the cached ones, and goodbyes, which
+// remove them, are ignored from other sources. If requireOwner is set, all
+// records of the name from other sources are ignored, as are goodbyes for
+// the pointers to owned instances. Owners are kept per IP version, as
+// responders send over both. A service moving to another address is picked
+// up once the records of the old one expire or are withdrawn.
+func GuardCacheFlush(requireOwner bool) ClientOption {
+	return func(o *clientOpts) {
+		o.flushGuard = &flushGuard{requireOwner: requireOwner, owners: make(map[ownedName]*nameOwner)}
+	}
+}
+
+// flushGuard tracks the owners of the names received by a client. It is
+// shared by the receiving routines of a client. A nil guard passes all
+// records.
+type flushGuard struct {
+	requireOwner bool
+
+	mu     sync.Mutex
+	owners map[ownedName]*nameOwner
+}
+
+type ownedName struct {
+	name string
+	ipv6 bool
+}
+
+type nameOwner struct {
+	source string
+	expiry time.Time
+}
+
+// filter removes the records of the message the source does not own.
+func (g *flushGuard) filter(msg *dns.Msg, src net.Addr, now time.Time) {
+	if g == nil {
+		return
+	}
+	addr, ok := src.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	source := addr.IP.String()
+	ipv6 := addr.IP.To4() == nil
+	keep := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			if g.accept(rr, source, ipv6, now) {
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	msg.Answer = keep(msg.Answer)
+	msg.Ns = keep(msg.Ns)
+	msg.Extra = keep(msg.Extra)
+}
+
+// accept reports whether the record is passed, taking or refreshing the
+// ownership of its name for the source. The caller holds mu.
+func (g *flushGuard) accept(rr dns.RR, source string, ipv6 bool, now time.Time) bool {
+	hdr := rr.Header()
+	switch rr := rr.(type) {
+	case *dns.SRV, *dns.TXT, *dns.A, *dns.AAAA:
+	case *dns.PTR:
+		// Pointers are shared, only their goodbyes remove an instance.
+		if !g.requireOwner || hdr.Ttl > 0 {
+			return true
+		}
+		owner := g.owners[ownedName{name: dns.CanonicalName(rr.Ptr), ipv6: ipv6}]
+		return owner == nil || !owner.expiry.After(now) || owner.source == source
+	default:
+		return true
+	}
+
+	key := ownedName{name: dns.CanonicalName(hdr.Name), ipv6: ipv6}
+	owner := g.owners[key]
+	if owner != nil && !owner.expiry.After(now) {
+		delete(g.owners, key)
+		owner = nil
+	}
+	switch {
+	case owner == nil:
+		if hdr.Ttl == 0 {
+			return true
+		}
+		if len(g.owners) >= maxFlushOwners {
+			g.expire(now)
+			if len(g.owners) >= maxFlushOwners {
+				return true
+			}
+		}
+		g.owners[key] = &nameOwner{source: source, expiry: now.Add(time.Duration(hdr.Ttl) * time.Second)}
+		return true
+	case owner.source == source:
+		if hdr.Ttl == 0 {
+			delete(g.owners, key)
+		} else if expiry := now.Add(time.Duration(hdr.Ttl) * time.Second); expiry.After(owner.expiry) {
+			owner.expiry = expiry
+		}
+		return true
+	default:
+		// Only the owner replaces or withdraws the records of the name.
+		return !g.requireOwner && hdr.Class&qClassCacheFlush == 0 && hdr.Ttl > 0
+	}
+}
+
+// expire drops the owners whose records expired. The caller holds mu.
+func (g *flushGuard) expire(now time.Time) {
+	for k, owner := range g.owners {
+		if !owner.expiry.After(now) {
+			delete(g.owners, k)
+		}
+	}
+}
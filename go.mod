@@ -8,4 +8,7 @@ require (
 	golang.org/x/net v0.0.0-20210423184538-5f58ad60dda6
 )
 
-require golang.org/x/sys v0.0.0-20210426080607-c94f62235c83 // indirect
+require (
+	golang.org/x/sys v0.0.0-20210426080607-c94f62235c83 // indirect
+	golang.org/x/text v0.3.6 // indirect
+)
@@ -0,0 +1,115 @@
+package zeroconf
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// CacheGoodbye packs the goodbye packets of the services whenever they
+// change, so that GoodbyeOnPanic sends them without composing messages in a
+// crashing process. Otherwise peers keep the records of a crashed publisher
+// until their TTL expires.
+func CacheGoodbye() ServerOption {
+	return func(o *serverOpts) {
+		o.cacheGoodbye = true
+	}
+}
+
+// GoodbyeOnPanic sends the goodbye packets of the services if the calling
+// goroutine panics, and panics again. Deferred at the start of main or of the
+// goroutine running the service, e.g.
+//
+//	server, err := zeroconf.Register(..., zeroconf.CacheGoodbye())
+//	...
+//	defer server.GoodbyeOnPanic()
+//
+// it keeps peers from showing the service after a crash. Panics of other
+// goroutines are not caught, as Go offers no hook for them. Sending is best
+// effort: the packets are written directly to the sockets, errors are
+// ignored.
+func (s *Server) GoodbyeOnPanic() {
+	v := recover()
+	if v == nil {
+		return
+	}
+	s.sendGoodbyePackets()
+	panic(v)
+}
+
+// goodbyePacket is the goodbye of a service with the interfaces it is
+// visible on, nil if on all.
+type goodbyePacket struct {
+	buf    []byte
+	ifaces map[int]bool
+}
+
+// visibleOn reports whether the service of the goodbye is published on the
+// interface, see registration.visibleOn.
+func (p goodbyePacket) visibleOn(ifIndex int) bool {
+	return p.ifaces == nil || p.ifaces[ifIndex]
+}
+
+// refreshGoodbye packs the goodbye packets of the current services if the
+// CacheGoodbye option is set. The caller holds servicesLock unless the server
+// is not started yet.
+func (s *Server) refreshGoodbye() {
+	if !s.cacheGoodbye {
+		return
+	}
+	packets := s.packGoodbye()
+	s.goodbyePackets.Store(&packets)
+}
+
+func (s *Server) packGoodbye() []goodbyePacket {
+	var packets []goodbyePacket
+	for _, r := range s.registrations() {
+		resp := newResponse()
+		resp.Answer = []dns.RR{}
+		resp.Extra = []dns.RR{}
+		s.composeLookupAnswers(r.entry(), resp, 0, 0, true)
+		if buf, err := resp.Pack(); err == nil {
+			packets = append(packets, goodbyePacket{buf: buf, ifaces: r.ifaces})
+		}
+	}
+	return packets
+}
+
+// sendGoodbyePackets writes the cached goodbye packets, or packs them if
+// none are cached, on the joined interfaces the services are visible on, see
+// AllowSources.
+func (s *Server) sendGoodbyePackets() {
+	if s.private {
+		return
+	}
+	var packets []goodbyePacket
+	if cached := s.goodbyePackets.Load(); cached != nil {
+		packets = *cached
+	} else {
+		packets = s.packGoodbye()
+	}
+	if !controlMessageIfIndex() {
+		// The multicast interface is shared with the senders.
+		s.switchLock.Lock()
+		defer s.switchLock.Unlock()
+	}
+	send := func(conn groupConn, ifaces []net.Interface, group *net.UDPAddr) {
+		for i := range ifaces {
+			iface := &ifaces[i]
+			if !s.multicastsOn(iface.Index) {
+				continue
+			}
+			for _, p := range packets {
+				if p.visibleOn(iface.Index) {
+					writeOn(conn, p.buf, iface, group)
+				}
+			}
+		}
+	}
+	if s.ipv4conn != nil {
+		send(ipv4GroupConn{s.ipv4conn}, s.ipv4ifaces, ipv4Addr)
+	}
+	if s.ipv6conn != nil {
+		send(ipv6GroupConn{s.ipv6conn}, s.ipv6ifaces, ipv6Addr)
+	}
+}
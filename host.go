@@ -0,0 +1,165 @@
+package zeroconf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// hostQueryTimeout is the time to wait for an answer to a host query before
+// the next search domain is tried.
+const hostQueryTimeout = time.Second
+
+// defaultSearchDomains is the search list used for bare host names.
+var defaultSearchDomains = []string{"local."}
+
+// SearchDomains sets the domains tried in order by ResolveHost for bare host
+// names, e.g. "local." followed by "home.arpa." in mixed mDNS and routed
+// DNS-SD environments. The default is "local." only.
+func SearchDomains(domains ...string) ClientOption {
+	return func(o *clientOpts) {
+		o.searchDomains = domains
+	}
+}
+
+// ResolveHost resolves the IPv4 and IPv6 addresses of a host. Names
+// containing a dot are queried as given, bare host names are qualified with
+// the search domains in order until one of them resolves.
+func ResolveHost(ctx context.Context, host string, opts ...ClientOption) ([]net.IP, error) {
+	c, err := newClient(applyOpts(opts...))
+	if err != nil {
+		return nil, err
+	}
+	defer c.shutdown()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	msgCh := make(chan *dns.Msg, 32)
+	c.listen(ctx, msgCh)
+	return c.resolveHost(ctx, host, msgCh)
+}
+
+// ResolveHost resolves the IPv4 and IPv6 addresses of a host, see the
+// function of the same name. The addresses of the host of an entry cached by
+// the resolver are returned without querying.
+func (r *Resolver) ResolveHost(ctx context.Context, host string) ([]net.IP, error) {
+	now := time.Now()
+	for _, name := range r.c.hostNames(host) {
+		if ips := r.cache.hostAddrs(name, now); len(ips) > 0 {
+			return ips, nil
+		}
+	}
+	ctx, msgs, unsubscribe := r.subscribe(ctx)
+	defer unsubscribe()
+	return r.c.resolveHost(ctx, host, msgs)
+}
+
+// subscribe registers a subscription for the received messages without
+// lookup params. The returned context is canceled when the resolver is
+// closed or unsubscribe is called.
+func (r *Resolver) subscribe(ctx context.Context) (context.Context, <-chan *dns.Msg, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &subscription{
+		ctx:  ctx,
+		msgs: make(chan *dns.Msg, 32),
+	}
+	r.subsLock.Lock()
+	r.subs[sub] = struct{}{}
+	r.subsLock.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-r.ctx.Done():
+			cancel()
+		}
+	}()
+	return ctx, sub.msgs, func() {
+		r.subsLock.Lock()
+		delete(r.subs, sub)
+		r.subsLock.Unlock()
+		cancel()
+	}
+}
+
+// hostNames returns the names to query for the host in order.
+func (c *client) hostNames(host string) []string {
+	host = trimDot(host)
+	if len(dns.SplitDomainName(host)) > 1 {
+		return []string{presentationName(dns.Fqdn(host))}
+	}
+	names := make([]string, 0, len(c.searchDomains))
+	for _, domain := range c.searchDomains {
+		names = append(names, presentationName(fmt.Sprintf("%s.%s.", host, trimDot(domain))))
+	}
+	return names
+}
+
+// resolveHost queries the names of the host in order and returns the
+// addresses of the first name answered.
+func (c *client) resolveHost(ctx context.Context, host string, msgCh <-chan *dns.Msg) ([]net.IP, error) {
+	for _, name := range c.hostNames(host) {
+		m := new(dns.Msg)
+		m.Question = []dns.Question{
+			{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			{Name: name, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+		}
+		m.RecursionDesired = false
+		if err := c.sendQuery(m); err != nil {
+			return nil, err
+		}
+		ips, err := waitHostAddrs(ctx, name, msgCh)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) > 0 {
+			return ips, nil
+		}
+	}
+	return nil, &hostNotFoundError{host: host}
+}
+
+// hostNotFoundError is returned if none of the names of a host is answered.
+type hostNotFoundError struct {
+	host string
+}
+
+func (e *hostNotFoundError) Error() string {
+	return "could not resolve host " + e.host
+}
+
+// waitHostAddrs waits for a message with addresses of the name. It returns
+// no addresses on timeout.
+func waitHostAddrs(ctx context.Context, name string, msgCh <-chan *dns.Msg) ([]net.IP, error) {
+	timer := time.NewTimer(hostQueryTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return nil, nil
+		case msg := <-msgCh:
+			var ips []net.IP
+			for _, section := range [][]dns.RR{msg.Answer, msg.Extra} {
+				for _, rr := range section {
+					if !equalNames(rr.Header().Name, name) {
+						continue
+					}
+					switch rr := rr.(type) {
+					case *dns.A:
+						ips = append(ips, rr.A)
+					case *dns.AAAA:
+						ips = append(ips, rr.AAAA)
+					}
+				}
+			}
+			if len(ips) > 0 {
+				return ips, nil
+			}
+		}
+	}
+}
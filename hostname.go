@@ -0,0 +1,79 @@
+package zeroconf
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// hostnameMonitorInterval is the interval in which the system's hostname is
+// polled for changes.
+const hostnameMonitorInterval = 5 * time.Second
+
+// WatchHostname makes a server follow changes of the system's hostname, e.g.
+// when a device is renamed on first boot. On a change, goodbye packets are
+// sent for the records under the old host name and the services are probed
+// and announced again under the new one. It only applies to services
+// registered without a host name, see Register.
+func WatchHostname() ServerOption {
+	return func(o *serverOpts) {
+		o.watchHostname = true
+	}
+}
+
+// watchHostname polls the system's hostname until the server shuts down. It
+// is not tracked by refCount, as rename waits for a concurrent Shutdown.
+func (s *Server) watchHostname() {
+	last, _ := os.Hostname()
+	ticker := time.NewTicker(hostnameMonitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.shouldShutdown:
+			return
+		case <-ticker.C:
+		}
+		name, err := os.Hostname()
+		if err != nil || name == "" || name == last {
+			continue
+		}
+		last = name
+		s.rename(presentationName(fmt.Sprintf("%s.%s.", trimDot(name), trimDot(s.hostDomain))))
+	}
+}
+
+// rename moves the services of the server to the host name.
+func (s *Server) rename(host string) {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if s.isShutdown {
+		return
+	}
+
+	s.servicesLock.Lock()
+	regs := s.withdraw()
+	if s.host != nil {
+		h := *s.host
+		h.HostName = host
+		s.host = &h
+	}
+	renamed := make([]*registration, 0, len(regs))
+	for _, old := range regs {
+		e := *old.entry()
+		e.HostName = host
+		r := newRegistration(&e)
+		r.ifaces = old.ifaces
+		s.addRegistration(r)
+		renamed = append(renamed, r)
+	}
+	s.servicesLock.Unlock()
+
+	if err := s.goodbye(regs); err != nil {
+		log.Printf("[WARN] mdns: failed to unregister the old host name: %v", err)
+	}
+	for _, r := range renamed {
+		s.refCount.Add(1)
+		go s.probe(r)
+	}
+}
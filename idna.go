@@ -0,0 +1,44 @@
+package zeroconf
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+)
+
+// Multicast DNS names are UTF-8, RFC 6762 section 16, while unicast DNS
+// expects internationalized names in their ASCII form with punycode labels,
+// RFC 5891. The conversions below bridge the two.
+
+// HostToASCII converts an internationalized host name, as used with mDNS, to
+// its ASCII form for unicast DNS, e.g. "bücher.example." to
+// "xn--bcher-kva.example.". Labels are mapped to lower case as for a lookup.
+// The name may be in the presentation format of received names.
+func HostToASCII(host string) (string, error) {
+	return idna.Lookup.ToASCII(unescapeName(host))
+}
+
+// HostToUnicode converts the punycode labels of a host name to UTF-8, e.g.
+// "xn--ddk0a0e.local." to "テレビ.local.", which is how the host is named in
+// mDNS.
+func HostToUnicode(host string) (string, error) {
+	return idna.Lookup.ToUnicode(unescapeName(host))
+}
+
+// unescapeName unescapes the labels of a domain name in presentation format.
+// An escaped dot within a label is kept escaped.
+func unescapeName(name string) string {
+	if strings.IndexByte(name, '\\') < 0 {
+		return name
+	}
+	labels := dns.SplitDomainName(name)
+	for i, label := range labels {
+		labels[i] = strings.ReplaceAll(unescapeLabel(label), ".", `\.`)
+	}
+	unescaped := strings.Join(labels, ".")
+	if strings.HasSuffix(name, ".") {
+		unescaped += "."
+	}
+	return unescaped
+}
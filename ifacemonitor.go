@@ -0,0 +1,73 @@
+package zeroconf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ifaceMonitorInterval is the interval in which the interface table is polled
+// for changes.
+const ifaceMonitorInterval = 5 * time.Second
+
+// watchInterfaces polls the interfaces returned by list and calls onChange
+// with the new set whenever an interface comes up, goes down or changes its
+// addresses. It blocks until the context is canceled.
+func watchInterfaces(ctx context.Context, list func() []net.Interface, onChange func([]net.Interface)) {
+	last := interfacesSignature(list())
+	ticker := time.NewTicker(ifaceMonitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ifaces := list()
+		if sig := interfacesSignature(ifaces); sig != last {
+			last = sig
+			onChange(ifaces)
+		}
+	}
+}
+
+// interfacesSignature summarizes the state of the interfaces relevant for
+// mDNS: index, name, flags and addresses.
+func interfacesSignature(ifaces []net.Interface) string {
+	var b strings.Builder
+	for _, iface := range ifaces {
+		fmt.Fprintf(&b, "%d/%s/%v", iface.Index, iface.Name, iface.Flags)
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			b.WriteString("/" + addr.String())
+		}
+		b.WriteByte(';')
+	}
+	return b.String()
+}
+
+// selectedInterfaces returns a function listing the current state of the
+// interfaces selected by the options. Explicitly selected interfaces are
+// looked up by name, as their index changes when they are recreated.
+func selectedInterfaces(selected []net.Interface, loopback, pointToPoint bool) func() []net.Interface {
+	switch {
+	case loopback:
+		return listLoopbackInterfaces
+	case len(selected) > 0:
+		return func() []net.Interface {
+			var ifaces []net.Interface
+			for _, s := range selected {
+				if iface, err := net.InterfaceByName(s.Name); err == nil && iface.Flags&net.FlagUp > 0 {
+					ifaces = append(ifaces, *iface)
+				}
+			}
+			return ifaces
+		}
+	default:
+		return func() []net.Interface {
+			return listMulticastInterfaces(pointToPoint)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package zeroconf
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ifaceTableMaxAge is the age after which the interface table is read again.
+const ifaceTableMaxAge = 10 * time.Second
+
+type ifaceAddrs struct {
+	v4, v6 []net.IP
+}
+
+// ifaceTable caches the addresses of the interfaces, so that composing a
+// response does not cost a syscall. It is read again once it is older than
+// ifaceTableMaxAge.
+type ifaceTable struct {
+	mu      sync.RWMutex
+	addrs   map[int]ifaceAddrs
+	updated time.Time
+}
+
+// lookup returns the addresses of the interface.
+func (t *ifaceTable) lookup(ifIndex int) (v4, v6 []net.IP) {
+	t.mu.RLock()
+	a := t.addrs[ifIndex]
+	stale := time.Since(t.updated) > ifaceTableMaxAge
+	t.mu.RUnlock()
+	if stale {
+		t.refresh()
+		t.mu.RLock()
+		a = t.addrs[ifIndex]
+		t.mu.RUnlock()
+	}
+	return a.v4, a.v6
+}
+
+// refresh reads the interface table.
+func (t *ifaceTable) refresh() {
+	ifaces, err := net.Interfaces()
+	addrs := make(map[int]ifaceAddrs, len(ifaces))
+	for i := range ifaces {
+		v4, v6 := addrsForInterface(&ifaces[i], false)
+		addrs[ifaces[i].Index] = ifaceAddrs{v4: v4, v6: v6}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.updated = time.Now()
+	if err == nil {
+		t.addrs = addrs
+	}
+}
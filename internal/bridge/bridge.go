@@ -0,0 +1,54 @@
+// Package bridge holds the helpers shared by the packages mirroring the
+// services of a zeroconf.Server to other discovery protocols, and by
+// zeroconf itself.
+package bridge
+
+import (
+	"crypto/sha1"
+	"net"
+	"strings"
+)
+
+// GroupIPv4 is the IPv4 multicast group of SSDP and WS-Discovery, which
+// differ by port only.
+var GroupIPv4 = net.IPv4(239, 255, 255, 250)
+
+// MulticastInterfaces returns the interfaces which are up and support
+// multicast, and point-to-point interfaces if includePointToPoint is set.
+func MulticastInterfaces(includePointToPoint bool) []net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var result []net.Interface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if iface.Flags&net.FlagMulticast != 0 || includePointToPoint && iface.Flags&net.FlagPointToPoint != 0 {
+			result = append(result, iface)
+		}
+	}
+	return result
+}
+
+// NameUUID derives a stable UUID from a service instance name, regardless
+// of its case, so that clients recognize the service across restarts. It
+// has the layout of a version 5 UUID of RFC 4122.
+func NameUUID(name string) []byte {
+	sum := sha1.Sum([]byte(strings.ToLower(name)))
+	sum[6] = sum[6]&0x0f | 0x50 // version 5
+	sum[8] = sum[8]&0x3f | 0x80 // RFC 4122 variant
+	return sum[:16]
+}
+
+// Path returns the value of the "path" TXT key if it is an absolute path,
+// "/" otherwise, see http://www.dns-sd.org/txtrecords.html#http.
+func Path(text []string) string {
+	for _, txt := range text {
+		if k, v, _ := strings.Cut(txt, "="); strings.EqualFold(k, "path") && strings.HasPrefix(v, "/") {
+			return v
+		}
+	}
+	return "/"
+}
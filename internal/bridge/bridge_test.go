@@ -0,0 +1,30 @@
+package bridge
+
+import "testing"
+
+func TestNameUUID(t *testing.T) {
+	u := NameUUID("Printer._ipp._tcp.local.")
+	if len(u) != 16 || u[6]>>4 != 5 || u[8]>>6 != 2 {
+		t.Fatalf("Expected a version 5 UUID, but got %x", u)
+	}
+	if string(NameUUID("printer._IPP._tcp.local.")) != string(u) {
+		t.Fatalf("Expected the UUID to ignore the case of the name")
+	}
+}
+
+func TestPath(t *testing.T) {
+	tests := []struct {
+		text []string
+		want string
+	}{
+		{nil, "/"},
+		{[]string{"Path=/status"}, "/status"},
+		{[]string{"path=status", "path=/b"}, "/b"},
+		{[]string{"paths=/a"}, "/"},
+	}
+	for _, tt := range tests {
+		if got := Path(tt.text); got != tt.want {
+			t.Fatalf("Expected %v to give %q, but got %q", tt.text, tt.want, got)
+		}
+	}
+}
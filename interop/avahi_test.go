@@ -0,0 +1,45 @@
+//go:build interop
+
+package interop
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAvahiBrowsesService(t *testing.T) {
+	requireTool(t, "avahi-browse")
+	register(t, "zeroconf-avahi", 8080, []string{"side=zeroconf"})
+
+	// Resolved services are printed as
+	// =;eth0;IPv4;zeroconf-avahi;_zcinterop._tcp;local;host.local;172.18.0.2;8080;"side=zeroconf"
+	out := output(t, 10*time.Second, "avahi-browse", "--resolve", "--parsable", "--terminate", service)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, ";")
+		if len(fields) < 10 || fields[0] != "=" || fields[3] != "zeroconf-avahi" {
+			continue
+		}
+		if fields[8] != "8080" {
+			t.Fatalf("Expected port 8080, but got %s", fields[8])
+		}
+		if !strings.Contains(fields[9], `"side=zeroconf"`) {
+			t.Fatalf("Expected TXT side=zeroconf, but got %s", fields[9])
+		}
+		return
+	}
+	t.Fatalf("avahi-browse did not resolve the service")
+}
+
+func TestBrowseAvahiService(t *testing.T) {
+	requireTool(t, "avahi-publish")
+	start(t, "avahi-publish", "--service", "avahi-zeroconf", service, "8081", "side=avahi")
+
+	e := browse(t, "avahi-zeroconf", 10*time.Second)
+	if e.Port != 8081 {
+		t.Fatalf("Expected port 8081, but got %d", e.Port)
+	}
+	if !hasText(e, "side=avahi") {
+		t.Fatalf("Expected TXT side=avahi, but got %v", e.Text)
+	}
+}
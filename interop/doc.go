@@ -0,0 +1,11 @@
+// Package interop holds integration tests checking that services registered
+// with zeroconf are found by Avahi and mDNSResponder, and the other way
+// around. The tests are built with the interop tag and expect the daemon
+// and command line tools of the other stack to run on the same host, which
+// the containers of docker-compose.yml provide:
+//
+//	docker compose -f interop/docker-compose.yml run --rm avahi
+//	docker compose -f interop/docker-compose.yml run --rm mdnsresponder
+//
+// Tests for a stack whose tools are not installed are skipped.
+package interop
@@ -0,0 +1,106 @@
+//go:build interop
+
+package interop
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kdanielm/zeroconf"
+)
+
+const (
+	service = "_zcinterop._tcp"
+	domain  = "local."
+)
+
+// requireTool skips the test unless the command line tool of the other
+// stack is installed.
+func requireTool(t *testing.T, name string) {
+	t.Helper()
+	if _, err := exec.LookPath(name); err != nil {
+		t.Skipf("%s not installed", name)
+	}
+}
+
+// output runs a tool of the other stack until it exits or the timeout
+// passes, as the browsing tools run until they are killed, and returns what
+// it printed.
+func output(t *testing.T, timeout time.Duration, name string, args ...string) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil && ctx.Err() == nil {
+		t.Fatalf("%s failed: %v\n%s", name, err, out.String())
+	}
+	t.Logf("%s %s:\n%s", name, strings.Join(args, " "), out.String())
+	return out.String()
+}
+
+// start runs a tool of the other stack in the background until the test
+// ends.
+func start(t *testing.T, name string, args ...string) {
+	t.Helper()
+	cmd := exec.Command(name, args...)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start %s: %v", name, err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+}
+
+// register publishes an instance with zeroconf until the test ends.
+func register(t *testing.T, instance string, port int, text []string) {
+	t.Helper()
+	server, err := zeroconf.Register(instance, service, domain, port, text, nil)
+	if err != nil {
+		t.Fatalf("error while registering mdns service: %s", err)
+	}
+	t.Cleanup(server.Shutdown)
+	select {
+	case <-server.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("service was not announced")
+	}
+}
+
+// browse returns the first resolved entry of the instance found by zeroconf
+// within the timeout.
+func browse(t *testing.T, instance string, timeout time.Duration) *zeroconf.ServiceEntry {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	entries := make(chan *zeroconf.ServiceEntry, 16)
+	go func() {
+		if err := zeroconf.Browse(ctx, service, domain, entries); err != nil {
+			t.Errorf("Expected browse success, but got %v", err)
+		}
+	}()
+	for e := range entries {
+		if e.Instance == instance && e.Port != 0 && len(e.AddrIPv4)+len(e.AddrIPv6) > 0 {
+			cancel()
+			return e
+		}
+	}
+	t.Fatalf("instance %q not found", instance)
+	return nil
+}
+
+func hasText(e *zeroconf.ServiceEntry, txt string) bool {
+	for _, t := range e.Text {
+		if t == txt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+//go:build interop
+
+package interop
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDNSSDResolvesService(t *testing.T) {
+	requireTool(t, "dns-sd")
+	register(t, "zeroconf-dnssd", 8082, []string{"side=zeroconf"})
+
+	// The resolved service is printed as
+	// ... zeroconf-dnssd._zcinterop._tcp.local. can be reached at host.local.:8082 (interface 2)
+	//  side=zeroconf
+	out := output(t, 5*time.Second, "dns-sd", "-L", "zeroconf-dnssd", service, "local")
+	if !strings.Contains(out, "can be reached at") {
+		t.Fatalf("dns-sd did not resolve the service")
+	}
+	if !strings.Contains(out, ":8082 ") {
+		t.Fatalf("Expected port 8082")
+	}
+	if !strings.Contains(out, "side=zeroconf") {
+		t.Fatalf("Expected TXT side=zeroconf")
+	}
+}
+
+func TestBrowseDNSSDService(t *testing.T) {
+	requireTool(t, "dns-sd")
+	start(t, "dns-sd", "-R", "dnssd-zeroconf", service, "local", "8083", "side=mdnsresponder")
+
+	e := browse(t, "dnssd-zeroconf", 10*time.Second)
+	if e.Port != 8083 {
+		t.Fatalf("Expected port 8083, but got %d", e.Port)
+	}
+	if !hasText(e, "side=mdnsresponder") {
+		t.Fatalf("Expected TXT side=mdnsresponder, but got %v", e.Text)
+	}
+}
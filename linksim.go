@@ -0,0 +1,99 @@
+package zeroconf
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// linkConditions simulates a lossy link, e.g. a busy Wi-Fi, between a client
+// and the network, so that tests can check the retransmission and duplicate
+// handling of lookups over the loopback interface. Queries are dropped at
+// the Loss rate; received messages are dropped at the Loss rate, delivered
+// twice at the Duplicate rate, held back until the next message at the
+// Reorder rate and delayed by Delay plus up to Jitter. The random choices
+// follow the seed, see newLinkConditions. A nil link passes everything.
+type linkConditions struct {
+	Loss      float64
+	Duplicate float64
+	Reorder   float64
+	Delay     time.Duration
+	Jitter    time.Duration
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	held *dns.Msg
+}
+
+func newLinkConditions(seed int64) *linkConditions {
+	return &linkConditions{rand: rand.New(rand.NewSource(seed))}
+}
+
+// withLinkConditions makes a client send and receive through the simulated
+// link.
+func withLinkConditions(l *linkConditions) ClientOption {
+	return func(o *clientOpts) {
+		o.link = l
+	}
+}
+
+// dropQuery reports whether a query is lost.
+func (l *linkConditions) dropQuery() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rand.Float64() < l.Loss
+}
+
+// deliver hands a received message to msgCh as impaired by the link. It
+// reports false once the context is done.
+func (l *linkConditions) deliver(ctx context.Context, msg *dns.Msg, msgCh chan<- *dns.Msg) bool {
+	if l == nil {
+		return sendMsgs(ctx, msgCh, msg)
+	}
+	l.mu.Lock()
+	if l.rand.Float64() < l.Loss {
+		l.mu.Unlock()
+		return ctx.Err() == nil
+	}
+	msgs := []*dns.Msg{msg}
+	if l.rand.Float64() < l.Duplicate {
+		// Lookups don't modify received messages, they may be shared.
+		msgs = append(msgs, msg)
+	}
+	switch {
+	case l.held != nil:
+		msgs = append(msgs, l.held)
+		l.held = nil
+	case l.rand.Float64() < l.Reorder:
+		l.held, msgs = msgs[0], msgs[1:]
+	}
+	delay := l.Delay
+	if l.Jitter > 0 {
+		delay += time.Duration(l.rand.Int63n(int64(l.Jitter)))
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return sendMsgs(ctx, msgCh, msgs...)
+	}
+	time.AfterFunc(delay, func() { sendMsgs(ctx, msgCh, msgs...) })
+	return ctx.Err() == nil
+}
+
+// sendMsgs sends the messages to msgCh unless the context is done first.
+func sendMsgs(ctx context.Context, msgCh chan<- *dns.Msg, msgs ...*dns.Msg) bool {
+	for _, msg := range msgs {
+		select {
+		case msgCh <- msg:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package zeroconf
+
+import (
+	"fmt"
+	"net"
+)
+
+// RegisterListener registers a service on the port of a listener, e.g. one
+// listening on port 0 and bound to a port chosen by the system. See Register
+// for the other parameters. If the application rebinds to another port, it
+// passes the new listener to SetListener.
+func RegisterListener(instance, service, domain string, l net.Listener, text []string, ifaces []net.Interface, opts ...ServerOption) (*Server, error) {
+	port, err := listenerPort(l)
+	if err != nil {
+		return nil, err
+	}
+	return Register(instance, service, domain, port, text, ifaces, opts...)
+}
+
+// SetListener updates the port of the service to the one of the listener,
+// see SetPort.
+func (s *Server) SetListener(l net.Listener) error {
+	port, err := listenerPort(l)
+	if err != nil {
+		return err
+	}
+	return s.SetPort(port)
+}
+
+// SetPort updates the port of the SRV record of the service the server was
+// created with and announces the changed record, so that clients connect to
+// the new port. It has no effect if the port is unchanged.
+func (s *Server) SetPort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	s.servicesLock.Lock()
+	r := s.primary()
+	if r == nil {
+		s.servicesLock.Unlock()
+		return fmt.Errorf("no service registered")
+	}
+	if r.entry().Port == port {
+		s.servicesLock.Unlock()
+		return nil
+	}
+	r.update(func(e *ServiceEntry) { e.Port = port })
+	s.refreshGoodbye()
+	s.servicesLock.Unlock()
+	s.announce(r)
+	return nil
+}
+
+// listenerPort returns the TCP or UDP port a listener is bound to.
+func listenerPort(l net.Listener) (int, error) {
+	if l == nil {
+		return 0, fmt.Errorf("missing listener")
+	}
+	switch addr := l.Addr().(type) {
+	case *net.TCPAddr:
+		return addr.Port, nil
+	case *net.UDPAddr:
+		return addr.Port, nil
+	}
+	return 0, fmt.Errorf("listener address %s has no port", l.Addr())
+}
@@ -0,0 +1,84 @@
+package zeroconf
+
+import (
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+)
+
+// ownPacketWindow is the time frame in which a packet received from one of
+// our own addresses is matched against the packets we sent recently.
+const ownPacketWindow = 2 * time.Second
+
+// packetFilter remembers fingerprints of recently sent packets so that our
+// own multicast traffic, looped back by the kernel, can be recognized and
+// skipped by the receive routines.
+type packetFilter struct {
+	mu    sync.Mutex
+	sent  map[uint64]time.Time
+	local []net.IP
+}
+
+func newPacketFilter(ifaces []net.Interface) *packetFilter {
+	f := &packetFilter{
+		sent: make(map[uint64]time.Time),
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				f.local = append(f.local, ipnet.IP)
+			}
+		}
+	}
+	return f
+}
+
+func fingerprint(packet []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(packet)
+	return h.Sum64()
+}
+
+// add records a packet which is about to be sent.
+func (f *packetFilter) add(packet []byte) {
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k, t := range f.sent {
+		if now.Sub(t) > ownPacketWindow {
+			delete(f.sent, k)
+		}
+	}
+	f.sent[fingerprint(packet)] = now
+}
+
+// isOwn reports whether the packet was sent by us. Besides matching the
+// fingerprint, the source has to be one of our interface addresses, so that
+// identical packets of other hosts (e.g. conflicting probes) still pass.
+func (f *packetFilter) isOwn(packet []byte, from net.Addr) bool {
+	addr, ok := from.(*net.UDPAddr)
+	if !ok || !f.isLocal(addr.IP) {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, found := f.sent[fingerprint(packet)]
+	return found && time.Since(t) <= ownPacketWindow
+}
+
+func (f *packetFilter) isLocal(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, local := range f.local {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
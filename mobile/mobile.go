@@ -0,0 +1,269 @@
+// Package mobile is a facade of zeroconf for bindings generated with
+// gomobile. It only uses types gomobile can bind, reports entries to callback
+// interfaces instead of channels and has explicit Start and Stop methods.
+//
+// On Android, multicast packets are only received while a
+// WifiManager.MulticastLock is held. Pass an implementation acquiring it to
+// SetMulticastLock before starting a Browser or Publisher.
+package mobile
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/kdanielm/zeroconf"
+)
+
+// MulticastLock is implemented by the application to hold the platform lock
+// needed to receive multicast packets, e.g. the WifiManager.MulticastLock on
+// Android. It is acquired while a Browser or Publisher runs.
+type MulticastLock interface {
+	Acquire()
+	Release()
+}
+
+var (
+	lockMu    sync.Mutex
+	lock      MulticastLock
+	lockCount int
+)
+
+// SetMulticastLock sets the lock held while browsing or publishing. It must
+// be called before the first Start.
+func SetMulticastLock(l MulticastLock) {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	lock = l
+}
+
+func acquireLock() {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	if lockCount == 0 && lock != nil {
+		lock.Acquire()
+	}
+	lockCount++
+}
+
+func releaseLock() {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	lockCount--
+	if lockCount == 0 && lock != nil {
+		lock.Release()
+	}
+}
+
+// browse is zeroconf.Browse, replaced by tests.
+var browse = zeroconf.Browse
+
+// Service is a service found by a Browser.
+type Service struct {
+	Instance string
+	Type     string
+	Domain   string
+	HostName string
+	Port     int
+
+	text  []string
+	addrs []string
+}
+
+func newService(e *zeroconf.ServiceEntry) *Service {
+	s := &Service{
+		Instance: e.Instance,
+		Type:     e.Service,
+		Domain:   e.Domain,
+		HostName: e.HostName,
+		Port:     e.Port,
+		text:     e.Text,
+	}
+	for _, ip := range e.AddrIPv4 {
+		s.addrs = append(s.addrs, ip.String())
+	}
+	for _, ip := range e.AddrIPv6 {
+		s.addrs = append(s.addrs, ip.String())
+	}
+	return s
+}
+
+// TextCount returns the number of TXT strings.
+func (s *Service) TextCount() int {
+	return len(s.text)
+}
+
+// Text returns the TXT string at index i, or "" if out of range.
+func (s *Service) Text(i int) string {
+	if i < 0 || i >= len(s.text) {
+		return ""
+	}
+	return s.text[i]
+}
+
+// AddressCount returns the number of addresses, IPv4 addresses first.
+func (s *Service) AddressCount() int {
+	return len(s.addrs)
+}
+
+// Address returns the address at index i, or "" if out of range.
+func (s *Service) Address(i int) string {
+	if i < 0 || i >= len(s.addrs) {
+		return ""
+	}
+	return s.addrs[i]
+}
+
+// BrowseListener receives the results of a Browser. Its methods are called
+// from a background goroutine.
+type BrowseListener interface {
+	// OnService is called for each new or changed service.
+	OnService(s *Service)
+	// OnError is called if browsing fails after it has started.
+	OnError(message string)
+}
+
+// Browser browses for the services of a type.
+type Browser struct {
+	service  string
+	domain   string
+	listener BrowseListener
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewBrowser returns a browser for the service type, e.g. "_http._tcp", in
+// the domain, "local." if empty.
+func NewBrowser(service, domain string, listener BrowseListener) *Browser {
+	return &Browser{service: service, domain: domain, listener: listener}
+}
+
+// Start starts browsing. It fails if the browser is running already or the
+// service type is invalid.
+func (b *Browser) Start() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cancel != nil {
+		return fmt.Errorf("browser is already running")
+	}
+	if err := zeroconf.ValidateServiceType(b.service); err != nil {
+		return err
+	}
+	acquireLock()
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	b.done = make(chan struct{})
+
+	entries := make(chan *zeroconf.ServiceEntry)
+	stop := make(chan struct{})
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for {
+			select {
+			case e, ok := <-entries:
+				if !ok {
+					return
+				}
+				b.listener.OnService(newService(e))
+			case <-stop:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer close(b.done)
+		defer releaseLock()
+		if err := browse(ctx, b.service, b.domain, entries); err != nil {
+			// The entries are not closed if browsing did not start.
+			close(stop)
+			b.listener.OnError(err.Error())
+		}
+		<-forwarded
+	}()
+	return nil
+}
+
+// Stop stops browsing and waits until the listener is no longer called. It
+// must not be called from the listener.
+func (b *Browser) Stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cancel == nil {
+		return
+	}
+	b.cancel()
+	<-b.done
+	b.cancel = nil
+}
+
+// Publisher publishes a service.
+type Publisher struct {
+	instance string
+	service  string
+	domain   string
+	port     int
+
+	mu     sync.Mutex
+	text   []string
+	server *zeroconf.Server
+}
+
+// NewPublisher returns a publisher of a service instance of the type in the
+// domain, "local." if empty.
+func NewPublisher(instance, service, domain string, port int) *Publisher {
+	return &Publisher{instance: instance, service: service, domain: domain, port: port}
+}
+
+// AddText adds a string, usually "key=value", to the TXT record. The record
+// of a running publisher is announced again.
+func (p *Publisher) AddText(text string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.text = append(p.text, text)
+	if p.server != nil {
+		p.server.SetText(append([]string(nil), p.text...))
+	}
+}
+
+// ClearText removes all strings from the TXT record. The record of a running
+// publisher is announced again.
+func (p *Publisher) ClearText() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.text = nil
+	if p.server != nil {
+		p.server.SetText(nil)
+	}
+}
+
+// Start publishes the service on all interfaces.
+func (p *Publisher) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.server != nil {
+		return fmt.Errorf("publisher is already running")
+	}
+	acquireLock()
+	server, err := zeroconf.Register(p.instance, p.service, p.domain, p.port, append([]string(nil), p.text...), nil)
+	if err != nil {
+		releaseLock()
+		return err
+	}
+	p.server = server
+	return nil
+}
+
+// Stop unpublishes the service.
+func (p *Publisher) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.server == nil {
+		return
+	}
+	p.server.Shutdown()
+	p.server = nil
+	releaseLock()
+}
@@ -0,0 +1,131 @@
+package mobile
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kdanielm/zeroconf"
+)
+
+type countingLock struct {
+	mu       sync.Mutex
+	held     bool
+	acquired int
+}
+
+func (l *countingLock) Acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held = true
+	l.acquired++
+}
+
+func (l *countingLock) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held = false
+}
+
+func (l *countingLock) isHeld() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held
+}
+
+type recordingListener struct {
+	services chan *Service
+	errors   chan string
+}
+
+func newRecordingListener() *recordingListener {
+	return &recordingListener{services: make(chan *Service, 16), errors: make(chan string, 16)}
+}
+
+func (l *recordingListener) OnService(s *Service)   { l.services <- s }
+func (l *recordingListener) OnError(message string) { l.errors <- message }
+
+func TestBrowserStartFailure(t *testing.T) {
+	lock := &countingLock{}
+	SetMulticastLock(lock)
+	t.Cleanup(func() { SetMulticastLock(nil) })
+	browse = func(ctx context.Context, service, domain string, entries chan<- *zeroconf.ServiceEntry, opts ...zeroconf.ClientOption) error {
+		return errors.New("no multicast interface")
+	}
+	t.Cleanup(func() { browse = zeroconf.Browse })
+
+	listener := newRecordingListener()
+	b := NewBrowser("_test._tcp", "", listener)
+	if err := b.Start(); err != nil {
+		t.Fatalf("Expected start success, but got %v", err)
+	}
+	select {
+	case msg := <-listener.errors:
+		if msg != "no multicast interface" {
+			t.Fatalf("Expected the browse error, but got %q", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the browse error to be reported")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		b.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected Stop to return after a failed browse")
+	}
+	if lock.isHeld() {
+		t.Fatalf("Expected the multicast lock to be released")
+	}
+	if err := b.Start(); err != nil {
+		t.Fatalf("Expected restart after a failed browse, but got %v", err)
+	}
+	b.Stop()
+}
+
+func TestRoundTrip(t *testing.T) {
+	p := NewPublisher("mobile-test", "_mobiletest._tcp", "", 8080)
+	p.AddText("v=1")
+	if err := p.Start(); err != nil {
+		t.Skipf("no usable network: %v", err)
+	}
+	defer p.Stop()
+
+	listener := newRecordingListener()
+	b := NewBrowser("_mobiletest._tcp", "", listener)
+	if err := b.Start(); err != nil {
+		t.Fatalf("Expected start success, but got %v", err)
+	}
+	defer b.Stop()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case s := <-listener.services:
+			if s.Instance != "mobile-test" {
+				continue
+			}
+			if s.Port != 8080 || s.TextCount() != 1 || s.Text(0) != "v=1" || s.Text(1) != "" {
+				t.Fatalf("Expected the published service, but got %+v", s)
+			}
+			if s.AddressCount() == 0 {
+				// Answered on an interface without published addresses,
+				// e.g. the loopback interface.
+				continue
+			}
+			if s.Address(s.AddressCount()) != "" {
+				t.Fatalf("Expected %d addresses of the service, but got more", s.AddressCount())
+			}
+			return
+		case msg := <-listener.errors:
+			t.Fatalf("Expected no browse error, but got %s", msg)
+		case <-timeout:
+			t.Fatalf("Expected the published service to be found")
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package zeroconf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// NetResolver offers the lookups of net.Resolver for names in the "local."
+// domain, resolved with mDNS. Other names are passed on to Fallback, so that
+// code written against net.Resolver can use it in its place.
+type NetResolver struct {
+	// Fallback resolves names outside the local domain. If nil,
+	// net.DefaultResolver is used.
+	Fallback *net.Resolver
+	// IDNA converts internationalized names passed to Fallback to their
+	// punycode form, see HostToASCII, and the punycode labels of local names
+	// to UTF-8, as mDNS names are UTF-8. Names which fail to convert are
+	// used as given.
+	IDNA bool
+
+	r *Resolver
+}
+
+// NewNetResolver creates a NetResolver listening on the interfaces configured
+// by the options. It has to be closed after use.
+func NewNetResolver(opts ...ClientOption) (*NetResolver, error) {
+	r, err := NewResolver(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &NetResolver{r: r}, nil
+}
+
+// Close closes the connections of the resolver.
+func (n *NetResolver) Close() {
+	n.r.Close()
+}
+
+// name converts a name passed to a lookup if IDNA is set.
+func (n *NetResolver) name(name string) string {
+	if !n.IDNA {
+		return name
+	}
+	convert := HostToASCII
+	if isLocalName(name) {
+		convert = HostToUnicode
+	}
+	if converted, err := convert(name); err == nil {
+		return converted
+	}
+	return name
+}
+
+func (n *NetResolver) fallback() *net.Resolver {
+	if n.Fallback != nil {
+		return n.Fallback
+	}
+	return net.DefaultResolver
+}
+
+// LookupHost looks up the addresses of the host, see net.Resolver.LookupHost.
+func (n *NetResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	host = n.name(host)
+	if !isLocalName(host) {
+		return n.fallback().LookupHost(ctx, host)
+	}
+	ips, err := n.lookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	return addrs, nil
+}
+
+// LookupIPAddr looks up the addresses of the host, see
+// net.Resolver.LookupIPAddr.
+func (n *NetResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host = n.name(host)
+	if !isLocalName(host) {
+		return n.fallback().LookupIPAddr(ctx, host)
+	}
+	ips, err := n.lookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, nil
+}
+
+// LookupSRV looks up the SRV records of a service, see
+// net.Resolver.LookupSRV. In the local domain, the instances of the service
+// type _service._proto.name are browsed for a second and the records of the
+// resolved instances are returned. If service and proto are empty, the SRV
+// record of the instance name is queried directly.
+func (n *NetResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	name = n.name(name)
+	if !isLocalName(name) {
+		return n.fallback().LookupSRV(ctx, service, proto, name)
+	}
+	if service == "" && proto == "" {
+		cname := dns.Fqdn(name)
+		rrs, err := n.query(ctx, cname, dns.TypeSRV)
+		if err != nil {
+			return "", nil, err
+		}
+		var srvs []*net.SRV
+		for _, rr := range rrs {
+			srv := rr.(*dns.SRV)
+			srvs = append(srvs, &net.SRV{Target: srv.Target, Port: srv.Port, Priority: srv.Priority, Weight: srv.Weight})
+		}
+		return cname, srvs, nil
+	}
+
+	serviceType := "_" + service + "._" + proto
+	cname := dns.Fqdn(serviceType + "." + trimDot(name))
+	entries, err := n.browse(ctx, serviceType, name)
+	if err != nil {
+		return "", nil, lookupError(ctx, cname, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", nil, lookupError(ctx, cname, err)
+	}
+	var srvs []*net.SRV
+	for _, e := range entries {
+		if e.HostName != "" && e.Port != 0 {
+			srvs = append(srvs, &net.SRV{Target: dns.Fqdn(e.HostName), Port: uint16(e.Port)})
+		}
+	}
+	if len(srvs) == 0 {
+		return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+	}
+	sort.Slice(srvs, func(i, j int) bool {
+		if srvs[i].Target != srvs[j].Target {
+			return srvs[i].Target < srvs[j].Target
+		}
+		return srvs[i].Port < srvs[j].Port
+	})
+	return cname, srvs, nil
+}
+
+// LookupTXT looks up the TXT record of a service instance name, see
+// net.Resolver.LookupTXT.
+func (n *NetResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	name = n.name(name)
+	if !isLocalName(name) {
+		return n.fallback().LookupTXT(ctx, name)
+	}
+	rrs, err := n.query(ctx, dns.Fqdn(name), dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	var txt []string
+	for _, rr := range rrs {
+		txt = append(txt, rr.(*dns.TXT).Txt...)
+	}
+	return txt, nil
+}
+
+func (n *NetResolver) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ips, err := n.r.ResolveHost(ctx, host)
+	if err != nil {
+		return nil, lookupError(ctx, host, err)
+	}
+	return ips, nil
+}
+
+// query queries the records of the type for the name and returns the records
+// of the first answer.
+func (n *NetResolver) query(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	name = presentationName(name)
+	ctx, msgs, unsubscribe := n.r.subscribe(ctx)
+	defer unsubscribe()
+
+	m := new(dns.Msg)
+	m.Question = []dns.Question{{Name: name, Qtype: qtype, Qclass: dns.ClassINET}}
+	m.RecursionDesired = false
+	if err := n.r.c.sendQuery(m); err != nil {
+		return nil, lookupError(ctx, name, err)
+	}
+
+	timer := time.NewTimer(hostQueryTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, lookupError(ctx, name, ctx.Err())
+		case <-timer.C:
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		case msg := <-msgs:
+			var rrs []dns.RR
+			for _, section := range [][]dns.RR{msg.Answer, msg.Extra} {
+				for _, rr := range section {
+					if rr.Header().Rrtype == qtype && equalNames(rr.Header().Name, name) {
+						rrs = append(rrs, rr)
+					}
+				}
+			}
+			if len(rrs) > 0 {
+				return rrs, nil
+			}
+		}
+	}
+}
+
+// browse collects the entries of the service type received within
+// hostQueryTimeout.
+func (n *NetResolver) browse(ctx context.Context, service, domain string) ([]*ServiceEntry, error) {
+	// Browse does not close the entries if the type is invalid.
+	if err := ValidateServiceType(service); err != nil {
+		return nil, err
+	}
+	browseCtx, cancel := context.WithTimeout(ctx, hostQueryTimeout)
+	defer cancel()
+	entries := make(chan *ServiceEntry)
+	found := make(map[string]*ServiceEntry)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range entries {
+			found[dns.CanonicalName(e.ServiceInstanceName())] = e
+		}
+	}()
+	err := n.r.Browse(browseCtx, service, domain, entries)
+	<-done
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*ServiceEntry, 0, len(found))
+	for _, e := range found {
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// lookupError converts an error of a lookup of the name to a *net.DNSError,
+// as returned by net.Resolver.
+func lookupError(ctx context.Context, name string, err error) error {
+	var notFound *hostNotFoundError
+	switch {
+	case errors.As(err, &notFound):
+		return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	case ctx.Err() != nil:
+		return &net.DNSError{Err: ctx.Err().Error(), Name: name, IsTimeout: errors.Is(ctx.Err(), context.DeadlineExceeded)}
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr
+	}
+	return &net.DNSError{Err: err.Error(), Name: name}
+}
+
+// isLocalName reports whether the name is in the "local." domain resolved
+// with mDNS.
+func isLocalName(name string) bool {
+	name = strings.ToLower(trimDot(name))
+	return name == "local" || strings.HasSuffix(name, ".local")
+}
@@ -0,0 +1,218 @@
+package zeroconf
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// PresenceChange is the kind of a PresenceEvent.
+type PresenceChange int
+
+// Changes of the presence of a watched instance.
+const (
+	// PresenceOnline is reported when the instance is resolved, at first or
+	// after it was offline.
+	PresenceOnline PresenceChange = iota
+	// PresenceOffline is reported when the instance sends a goodbye or its
+	// records expire without being confirmed.
+	PresenceOffline
+	// PresenceAddressChanged is reported when the host, port or addresses of
+	// an online instance change.
+	PresenceAddressChanged
+)
+
+func (c PresenceChange) String() string {
+	switch c {
+	case PresenceOnline:
+		return "online"
+	case PresenceOffline:
+		return "offline"
+	case PresenceAddressChanged:
+		return "address changed"
+	}
+	return fmt.Sprintf("PresenceChange(%d)", int(c))
+}
+
+// PresenceEvent reports a change of the presence of a watched instance.
+type PresenceEvent struct {
+	Change PresenceChange
+	// Entry is the current entry of the instance, or the last one received
+	// for PresenceOffline.
+	Entry *ServiceEntry
+	Time  time.Time
+}
+
+// reconfirmPercents are the fractions of the TTL at which the records of a
+// watched instance are queried again before they expire, RFC 6762 section
+// 5.2.
+var reconfirmPercents = []int{80, 85, 90, 95}
+
+// WatchInstance monitors the presence of a known service instance, e.g. to
+// tell whether a printer is up. It looks up the instance, queries for its
+// records again at 80% to 95% of their TTL and reports an event for each
+// change: the instance coming online, going offline after a goodbye or when
+// its records expire unconfirmed, and changes of its address. While the
+// instance is offline, it is queried with the retransmission schedule of
+// Lookup. The events channel is closed when the context is done.
+func WatchInstance(ctx context.Context, instance, service, domain string, opts ...ClientOption) (<-chan PresenceEvent, error) {
+	// Every confirmation has to reach the watcher, not only changes.
+	conf := applyOpts(append(opts[:len(opts):len(opts)], RefreshWindow(0))...)
+	service = normalizeServiceType(service, conf.typeWarning)
+	if err := ValidateServiceType(service); err != nil {
+		return nil, err
+	}
+	if instance == "" {
+		return nil, fmt.Errorf("missing service instance name")
+	}
+	c, err := newClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(chan *ServiceEntry, 8)
+	params := newLookupParams(instance, service, domain, false, entries)
+	// Goodbyes are passed as expired entries on the same channel, so that
+	// they keep their order with the entries received before.
+	params.removed = func(e *ServiceEntry) {
+		select {
+		case entries <- e:
+		case <-ctx.Done():
+		}
+	}
+	events := make(chan PresenceEvent)
+	go func() {
+		if err := c.run(ctx, params); err != nil {
+			log.Printf("[WARN] mdns: Failed to watch %s: %v", params.ServiceInstanceName(), err)
+		}
+	}()
+	go c.watch(ctx, params, entries, events)
+	return events, nil
+}
+
+// watch turns the entries of a lookup into presence events, until the
+// entries channel is closed. Expired entries are goodbyes.
+func (c *client) watch(ctx context.Context, params *lookupParams, entries <-chan *ServiceEntry, events chan<- PresenceEvent) {
+	defer close(events)
+	var current *ServiceEntry
+	// Times of the pending confirmation queries, followed by the expiry
+	var checks []time.Time
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+
+	emit := func(change PresenceChange, e *ServiceEntry, now time.Time) {
+		select {
+		case events <- PresenceEvent{Change: change, Entry: e, Time: now}:
+		case <-ctx.Done():
+		}
+	}
+	schedule := func(now time.Time) {
+		timer.Stop()
+		select {
+		case <-timer.C:
+		default:
+		}
+		if len(checks) > 0 {
+			timer.Reset(checks[0].Sub(now))
+		}
+	}
+	offline := func(now time.Time) {
+		emit(PresenceOffline, current, now)
+		current = nil
+		checks = nil
+		schedule(now)
+		// Query until the instance is back.
+		params.resumeProbing()
+		params.restartQueries()
+	}
+
+	for {
+		select {
+		case e, ok := <-entries:
+			if !ok {
+				return
+			}
+			now := time.Now()
+			if !e.Expiry.After(now) {
+				if current != nil {
+					offline(now)
+				}
+				continue
+			}
+			if !entryComplete(e) {
+				continue
+			}
+			switch {
+			case current == nil:
+				emit(PresenceOnline, e, now)
+			case !sameLocation(current, e):
+				emit(PresenceAddressChanged, e, now)
+			}
+			current = e
+			checks = reconfirmTimes(now, e.Expiry)
+			schedule(now)
+		case now := <-timer.C:
+			if len(checks) == 0 {
+				continue
+			}
+			checks = checks[1:]
+			if len(checks) == 0 {
+				offline(now)
+				continue
+			}
+			if !c.control.Paused() {
+				if err := c.query(params); err != nil {
+					log.Printf("[WARN] mdns: Failed to confirm %s: %v", params.ServiceInstanceName(), err)
+				}
+			}
+			schedule(now)
+		}
+	}
+}
+
+// reconfirmTimes returns the times to query for records received now, which
+// expire at expiry, followed by the expiry. Each query is delayed by up to 2%
+// of the TTL at random, so that the queriers of a network spread out.
+func reconfirmTimes(now, expiry time.Time) []time.Time {
+	ttl := expiry.Sub(now)
+	times := make([]time.Time, 0, len(reconfirmPercents)+1)
+	for _, percent := range reconfirmPercents {
+		jitter := time.Duration(rand.Int63n(int64(ttl)/50 + 1))
+		times = append(times, now.Add(ttl*time.Duration(percent)/100+jitter))
+	}
+	return append(times, expiry)
+}
+
+// sameLocation reports whether two entries of an instance have the same
+// host, port and addresses.
+func sameLocation(a, b *ServiceEntry) bool {
+	if !equalNames(a.HostName, b.HostName) || a.Port != b.Port {
+		return false
+	}
+	addrs := func(e *ServiceEntry) []string {
+		s := make([]string, 0, len(e.AddrIPv4)+len(e.AddrIPv6))
+		for _, ip := range e.AddrIPv4 {
+			s = append(s, ip.String())
+		}
+		for _, ip := range e.AddrIPv6 {
+			s = append(s, ip.String())
+		}
+		sort.Strings(s)
+		return s
+	}
+	x, y := addrs(a), addrs(b)
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
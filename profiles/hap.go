@@ -0,0 +1,292 @@
+package profiles
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kdanielm/zeroconf"
+)
+
+// HAPType is the service type of HomeKit accessories.
+const HAPType = "_hap._tcp"
+
+// maxHAPConfigNumber is the range of the configuration number, after which
+// it wraps to 1.
+const maxHAPConfigNumber = 65535
+
+// HAPCategory is the category identifier ("ci") of a HomeKit accessory.
+type HAPCategory int
+
+// Categories of HomeKit accessories.
+const (
+	HAPOther           HAPCategory = 1
+	HAPBridge          HAPCategory = 2
+	HAPFan             HAPCategory = 3
+	HAPGarageDoor      HAPCategory = 4
+	HAPLightbulb       HAPCategory = 5
+	HAPDoorLock        HAPCategory = 6
+	HAPOutlet          HAPCategory = 7
+	HAPSwitch          HAPCategory = 8
+	HAPThermostat      HAPCategory = 9
+	HAPSensor          HAPCategory = 10
+	HAPSecuritySystem  HAPCategory = 11
+	HAPDoor            HAPCategory = 12
+	HAPWindow          HAPCategory = 13
+	HAPWindowCovering  HAPCategory = 14
+	HAPProgrammable    HAPCategory = 15
+	HAPIPCamera        HAPCategory = 17
+	HAPVideoDoorbell   HAPCategory = 18
+	HAPAirPurifier     HAPCategory = 19
+	HAPHeater          HAPCategory = 20
+	HAPAirConditioner  HAPCategory = 21
+	HAPHumidifier      HAPCategory = 22
+	HAPDehumidifier    HAPCategory = 23
+	HAPSprinkler       HAPCategory = 28
+	HAPFaucet          HAPCategory = 29
+	HAPShowerHead      HAPCategory = 30
+	HAPTelevision      HAPCategory = 31
+	HAPTargetRemote    HAPCategory = 32
+	maxHAPCategoryCode HAPCategory = 32
+)
+
+// HAPStatus holds the status flags ("sf") of a HomeKit accessory.
+type HAPStatus int
+
+// Status flags of a HomeKit accessory.
+const (
+	HAPNotPaired     HAPStatus = 1 << iota // Accessory has not been paired with a controller
+	HAPNotConfigured                       // Accessory has not been configured to join a Wi-Fi network
+	HAPProblem                             // A problem has been detected on the accessory
+)
+
+// HAPFeatures holds the feature flags ("ff") of a HomeKit accessory.
+type HAPFeatures int
+
+// Feature flags of a HomeKit accessory.
+const (
+	HAPHardwareAuth HAPFeatures = 1 << iota // Supports Apple authentication coprocessor
+	HAPSoftwareAuth                         // Supports software authentication
+)
+
+// HAP manages the TXT record of a HomeKit accessory advertised as _hap._tcp.
+// Once registered, every change of a field is announced with the cache flush
+// bit, so that controllers replace the record they have cached. A new HAP
+// is unpaired, with configuration number 1.
+type HAP struct {
+	mu        sync.Mutex
+	server    *zeroconf.Server
+	deviceID  string
+	model     string
+	category  HAPCategory
+	features  HAPFeatures
+	config    int
+	status    HAPStatus
+	setupHash string
+}
+
+// NewHAP returns the advertisement of an accessory. The device ID has the
+// form of a MAC address, e.g. "3C:33:1B:21:B3:00", and must not change for
+// the lifetime of the accessory's pairings.
+func NewHAP(deviceID, model string, category HAPCategory) (*HAP, error) {
+	id, err := parseHAPDeviceID(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if model == "" {
+		return nil, fmt.Errorf("missing hap model name")
+	}
+	if category < 1 || category > maxHAPCategoryCode {
+		return nil, fmt.Errorf("invalid hap category %d", category)
+	}
+	return &HAP{
+		deviceID: id,
+		model:    model,
+		category: category,
+		config:   1,
+		status:   HAPNotPaired,
+	}, nil
+}
+
+// Register publishes the accessory on a new server. See zeroconf.Register
+// for the interfaces and options.
+func (h *HAP) Register(instance string, port int, ifaces []net.Interface, opts ...zeroconf.ServerOption) (*zeroconf.Server, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.server != nil {
+		return nil, fmt.Errorf("hap accessory is already registered")
+	}
+	entry, err := zeroconf.NewService(instance, HAPType).Port(port).TXT(h.pairs()).Build()
+	if err != nil {
+		return nil, err
+	}
+	server, err := zeroconf.RegisterEntry(entry, ifaces, opts...)
+	if err != nil {
+		return nil, err
+	}
+	h.server = server
+	return server, nil
+}
+
+// Text returns the current TXT record.
+func (h *HAP) Text() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return txtStrings(h.pairs())
+}
+
+// ConfigNumber returns the current configuration number ("c#").
+func (h *HAP) ConfigNumber() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.config
+}
+
+// SetConfigNumber sets the configuration number ("c#"), which must be in the
+// range 1 to 65535.
+func (h *HAP) SetConfigNumber(n int) error {
+	if n < 1 || n > maxHAPConfigNumber {
+		return fmt.Errorf("hap configuration number %d out of range 1-%d", n, maxHAPConfigNumber)
+	}
+	h.change(func() { h.config = n })
+	return nil
+}
+
+// BumpConfigNumber increments the configuration number, as required when an
+// accessory, service or characteristic is added or removed, or after a
+// firmware update. It wraps to 1 after 65535.
+func (h *HAP) BumpConfigNumber() {
+	h.change(func() {
+		h.config++
+		if h.config > maxHAPConfigNumber {
+			h.config = 1
+		}
+	})
+}
+
+// SetPaired clears or sets the HAPNotPaired status flag.
+func (h *HAP) SetPaired(paired bool) {
+	h.change(func() {
+		if paired {
+			h.status &^= HAPNotPaired
+		} else {
+			h.status |= HAPNotPaired
+		}
+	})
+}
+
+// SetStatus replaces the status flags ("sf").
+func (h *HAP) SetStatus(status HAPStatus) error {
+	if status < 0 || status > HAPNotPaired|HAPNotConfigured|HAPProblem {
+		return fmt.Errorf("invalid hap status flags %#x", int(status))
+	}
+	h.change(func() { h.status = status })
+	return nil
+}
+
+// SetFeatures replaces the feature flags ("ff").
+func (h *HAP) SetFeatures(features HAPFeatures) error {
+	if features < 0 || features > HAPHardwareAuth|HAPSoftwareAuth {
+		return fmt.Errorf("invalid hap feature flags %#x", int(features))
+	}
+	h.change(func() { h.features = features })
+	return nil
+}
+
+// SetSetupHash sets the setup hash ("sh"), the base64 encoded hash of the
+// setup ID and device ID. An empty hash removes the key.
+func (h *HAP) SetSetupHash(hash string) {
+	h.change(func() { h.setupHash = hash })
+}
+
+// change applies fn and announces the TXT record if it changed.
+func (h *HAP) change(fn func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	before := txtStrings(h.pairs())
+	fn()
+	after := txtStrings(h.pairs())
+	if h.server == nil || strings.Join(before, "\x00") == strings.Join(after, "\x00") {
+		return
+	}
+	h.server.SetText(after)
+}
+
+// pairs returns the TXT keys of the current state. The caller holds mu.
+func (h *HAP) pairs() map[string]string {
+	pairs := map[string]string{
+		"c#": strconv.Itoa(h.config),
+		"ff": strconv.Itoa(int(h.features)),
+		"id": h.deviceID,
+		"md": h.model,
+		"pv": "1.1",
+		"s#": "1",
+		"sf": strconv.Itoa(int(h.status)),
+		"ci": strconv.Itoa(int(h.category)),
+	}
+	setIf(pairs, "sh", h.setupHash)
+	return pairs
+}
+
+// HAPRecord is the decoded TXT record of a HomeKit accessory.
+type HAPRecord struct {
+	DeviceID     string
+	Model        string
+	Category     HAPCategory
+	ConfigNumber int
+	StateNumber  int
+	Features     HAPFeatures
+	Status       HAPStatus
+	SetupHash    string
+}
+
+// Paired reports whether the accessory has been paired with a controller.
+func (r HAPRecord) Paired() bool {
+	return r.Status&HAPNotPaired == 0
+}
+
+// ParseHAP decodes the TXT record of a HomeKit accessory. Malformed numbers
+// are decoded as 0.
+func ParseHAP(txt []string) HAPRecord {
+	pairs := ParseTXT(txt)
+	number := func(key string) int {
+		n, _ := strconv.Atoi(pairs[key])
+		return n
+	}
+	return HAPRecord{
+		DeviceID:     pairs["id"],
+		Model:        pairs["md"],
+		Category:     HAPCategory(number("ci")),
+		ConfigNumber: number("c#"),
+		StateNumber:  number("s#"),
+		Features:     HAPFeatures(number("ff")),
+		Status:       HAPStatus(number("sf")),
+		SetupHash:    pairs["sh"],
+	}
+}
+
+// parseHAPDeviceID checks the device ID and returns it in upper case.
+func parseHAPDeviceID(id string) (string, error) {
+	hw, err := net.ParseMAC(id)
+	if err != nil || len(hw) != 6 || strings.Count(id, ":") != 5 {
+		return "", fmt.Errorf("hap device id %q must have the form XX:XX:XX:XX:XX:XX", id)
+	}
+	return strings.ToUpper(hw.String()), nil
+}
+
+// txtStrings encodes the pairs sorted by key. Values must not be empty.
+func txtStrings(pairs map[string]string) []string {
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	txt := make([]string, 0, len(keys))
+	for _, k := range keys {
+		txt = append(txt, k+"="+pairs[k])
+	}
+	return txt
+}
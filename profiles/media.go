@@ -0,0 +1,170 @@
+package profiles
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/kdanielm/zeroconf"
+)
+
+// Service types of media receivers.
+const (
+	ChromecastType = "_googlecast._tcp"
+	AirPlayType    = "_airplay._tcp"
+	RAOPType       = "_raop._tcp"
+)
+
+// Chromecast is a Google Cast receiver.
+type Chromecast struct {
+	Entry        *zeroconf.ServiceEntry // Entry the fields are decoded from
+	ID           string                 // Device UUID without dashes, "id"
+	FriendlyName string                 // Name shown to users, "fn"
+	Model        string                 // Model name, "md"
+	Version      string                 // Protocol version, "ve"
+	IconPath     string                 // Path of the device icon, "ic"
+	Capabilities int                    // Capability bit mask, "ca"
+	Status       string                 // Status text of the running application, "rs"
+}
+
+// ParseChromecast decodes an entry of the _googlecast._tcp type. If the TXT
+// record lacks a friendly name, the instance name is used.
+func ParseChromecast(e *zeroconf.ServiceEntry) Chromecast {
+	pairs := ParseTXT(e.Text)
+	c := Chromecast{
+		Entry:        e,
+		ID:           pairs["id"],
+		FriendlyName: pairs["fn"],
+		Model:        pairs["md"],
+		Version:      pairs["ve"],
+		IconPath:     pairs["ic"],
+		Status:       pairs["rs"],
+	}
+	c.Capabilities, _ = strconv.Atoi(pairs["ca"])
+	if c.FriendlyName == "" {
+		c.FriendlyName = e.Instance
+	}
+	return c
+}
+
+// AirPlay is an AirPlay video or screen mirroring receiver.
+type AirPlay struct {
+	Entry         *zeroconf.ServiceEntry // Entry the fields are decoded from
+	Name          string                 // Instance name
+	DeviceID      string                 // MAC address style device ID, "deviceid"
+	Model         string                 // Model name, e.g. "AppleTV5,3", "model"
+	Features      uint64                 // Feature bit mask, "features"
+	SourceVersion string                 // Server version, "srcvers"
+	PublicKey     string                 // Hex encoded public key, "pk"
+}
+
+// ParseAirPlay decodes an entry of the _airplay._tcp type.
+func ParseAirPlay(e *zeroconf.ServiceEntry) AirPlay {
+	pairs := ParseTXT(e.Text)
+	return AirPlay{
+		Entry:         e,
+		Name:          e.Instance,
+		DeviceID:      pairs["deviceid"],
+		Model:         pairs["model"],
+		Features:      parseAirPlayFeatures(pairs["features"]),
+		SourceVersion: pairs["srcvers"],
+		PublicKey:     pairs["pk"],
+	}
+}
+
+// RAOP is an AirPlay audio (Remote Audio Output Protocol) receiver. Its
+// instance name is the device ID and the name joined with "@", e.g.
+// "A1B2C3D4E5F6@Living Room".
+type RAOP struct {
+	Entry         *zeroconf.ServiceEntry // Entry the fields are decoded from
+	Name          string                 // Name part of the instance name
+	DeviceID      string                 // Device ID part of the instance name
+	Model         string                 // Model name, "am"
+	Features      uint64                 // Feature bit mask, "ft" or "sf"
+	ServerVersion string                 // Server version, "vs"
+}
+
+// ParseRAOP decodes an entry of the _raop._tcp type.
+func ParseRAOP(e *zeroconf.ServiceEntry) RAOP {
+	pairs := ParseTXT(e.Text)
+	r := RAOP{
+		Entry:         e,
+		Name:          e.Instance,
+		Model:         pairs["am"],
+		ServerVersion: pairs["vs"],
+	}
+	if id, name, found := strings.Cut(e.Instance, "@"); found {
+		r.DeviceID, r.Name = id, name
+	}
+	if ft, found := pairs["ft"]; found {
+		r.Features = parseAirPlayFeatures(ft)
+	} else {
+		r.Features = parseAirPlayFeatures(pairs["sf"])
+	}
+	return r
+}
+
+// parseAirPlayFeatures decodes a feature bit mask given as a hex number, or
+// as the low and high 32 bits separated by a comma, e.g. "0x5A7FFFF7,0x1E".
+// A malformed mask is decoded as 0.
+func parseAirPlayFeatures(value string) uint64 {
+	parse := func(s string) (uint64, bool) {
+		s = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(s), "0x"), "0X")
+		n, err := strconv.ParseUint(s, 16, 64)
+		return n, err == nil
+	}
+	low, high, split := strings.Cut(value, ",")
+	lo, ok := parse(low)
+	if !ok {
+		return 0
+	}
+	if !split {
+		return lo
+	}
+	hi, ok := parse(high)
+	if !ok || lo > 0xffffffff || hi > 0xffffffff {
+		return 0
+	}
+	return hi<<32 | lo
+}
+
+// Browse browses the local domain for services of the given type and sends
+// the entries decoded by decode to results, e.g.
+//
+//	casts := make(chan profiles.Chromecast)
+//	go profiles.Browse(ctx, profiles.ChromecastType, profiles.ParseChromecast, casts)
+//
+// It blocks until the context is canceled and closes results once browsing
+// stops.
+func Browse[T any](ctx context.Context, service string, decode func(*zeroconf.ServiceEntry) T, results chan<- T, opts ...zeroconf.ClientOption) error {
+	entries := make(chan *zeroconf.ServiceEntry)
+	stop := make(chan struct{})
+	go func() {
+		defer close(results)
+		for {
+			select {
+			case e, ok := <-entries:
+				if !ok {
+					return
+				}
+				select {
+				case results <- decode(e):
+				case <-ctx.Done():
+					return
+				case <-stop:
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+	err := zeroconf.Browse(ctx, service, "local.", entries, opts...)
+	if err != nil {
+		// The entries are not closed if browsing did not start.
+		close(stop)
+	}
+	return err
+}
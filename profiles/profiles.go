@@ -0,0 +1,164 @@
+package profiles
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kdanielm/zeroconf"
+)
+
+// Service types of the profiles.
+const (
+	HTTPType        = "_http._tcp"
+	IPPType         = "_ipp._tcp"
+	SSHType         = "_ssh._tcp"
+	WorkstationType = "_workstation._tcp"
+)
+
+// Conventional ports of the profiles.
+const (
+	HTTPPort        = 80
+	IPPPort         = 631
+	SSHPort         = 22
+	WorkstationPort = 9
+)
+
+// HTTP describes a web server, see http://www.dns-sd.org/txtrecords.html#http.
+type HTTP struct {
+	Path     string // Path of the page, "/" if empty
+	Username string // Optional user name for authentication
+	Password string // Optional password, published in clear text
+}
+
+// Validate checks that the path is absolute.
+func (h HTTP) Validate() error {
+	if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+		return fmt.Errorf("http path %q must start with a slash", h.Path)
+	}
+	return nil
+}
+
+// Service returns a builder for the web server. A port of 0 selects the
+// conventional port. Invalid fields are reported with the returned error.
+func (h HTTP) Service(instance string, port int) (*zeroconf.ServiceBuilder, error) {
+	if err := h.Validate(); err != nil {
+		return nil, err
+	}
+	if port == 0 {
+		port = HTTPPort
+	}
+	txt := make(map[string]string)
+	setIf(txt, "path", h.Path)
+	setIf(txt, "u", h.Username)
+	setIf(txt, "p", h.Password)
+	return zeroconf.NewService(instance, HTTPType).Port(port).TXT(txt), nil
+}
+
+// ParseHTTP decodes the TXT record of a web server.
+func ParseHTTP(txt []string) HTTP {
+	pairs := ParseTXT(txt)
+	return HTTP{Path: pairs["path"], Username: pairs["u"], Password: pairs["p"]}
+}
+
+// Printer describes an IPP printer as specified by the Bonjour Printing
+// Specification.
+type Printer struct {
+	ResourcePath string   // Queue name without leading slash, "rp"
+	Type         string   // Make and model, "ty"
+	Note         string   // Location, "note"
+	Product      string   // PPD product name in parentheses, "product"
+	AdminURL     string   // Configuration page, "adminurl"
+	PDLs         []string // Supported document formats (MIME types), "pdl"
+	UUID         string   // Printer UUID, "UUID"
+	Color        bool     // "Color"
+	Duplex       bool     // "Duplex"
+}
+
+// Validate checks the fields against the conventions of the specification.
+func (p Printer) Validate() error {
+	if strings.HasPrefix(p.ResourcePath, "/") {
+		return fmt.Errorf("printer resource path %q must not start with a slash", p.ResourcePath)
+	}
+	if p.Product != "" && !(strings.HasPrefix(p.Product, "(") && strings.HasSuffix(p.Product, ")")) {
+		return fmt.Errorf("printer product %q must be enclosed in parentheses", p.Product)
+	}
+	for _, pdl := range p.PDLs {
+		if !strings.Contains(pdl, "/") || strings.Contains(pdl, ",") {
+			return fmt.Errorf("printer document format %q is not a MIME type", pdl)
+		}
+	}
+	return nil
+}
+
+// Service returns a builder for the printer. A port of 0 selects the
+// conventional port. Invalid fields are reported with the returned error.
+func (p Printer) Service(instance string, port int) (*zeroconf.ServiceBuilder, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if port == 0 {
+		port = IPPPort
+	}
+	txt := map[string]string{
+		"txtvers": "1",
+		"qtotal":  "1",
+		"Color":   flag(p.Color),
+		"Duplex":  flag(p.Duplex),
+	}
+	setIf(txt, "rp", p.ResourcePath)
+	setIf(txt, "ty", p.Type)
+	setIf(txt, "note", p.Note)
+	setIf(txt, "product", p.Product)
+	setIf(txt, "adminurl", p.AdminURL)
+	setIf(txt, "pdl", strings.Join(p.PDLs, ","))
+	setIf(txt, "UUID", p.UUID)
+	return zeroconf.NewService(instance, IPPType).Port(port).TXT(txt), nil
+}
+
+// ParsePrinter decodes the TXT record of an IPP printer.
+func ParsePrinter(txt []string) Printer {
+	pairs := ParseTXT(txt)
+	p := Printer{
+		ResourcePath: pairs["rp"],
+		Type:         pairs["ty"],
+		Note:         pairs["note"],
+		Product:      pairs["product"],
+		AdminURL:     pairs["adminurl"],
+		UUID:         pairs["uuid"],
+		Color:        parseFlag(pairs["color"]),
+		Duplex:       parseFlag(pairs["duplex"]),
+	}
+	if pdl := pairs["pdl"]; pdl != "" {
+		p.PDLs = strings.Split(pdl, ",")
+	}
+	return p
+}
+
+// SSH returns a builder for an SSH server, which has no TXT keys. A port of 0
+// selects the conventional port.
+func SSH(instance string, port int) *zeroconf.ServiceBuilder {
+	if port == 0 {
+		port = SSHPort
+	}
+	return zeroconf.NewService(instance, SSHType).Port(port)
+}
+
+// Workstation returns a builder for the workstation service, by convention
+// named after the host and its hardware address, e.g. "myhost [00:11:22:33:44:55]".
+// It is used by Avahi to list hosts and has no TXT keys.
+func Workstation(host, mac string) *zeroconf.ServiceBuilder {
+	instance := host
+	if mac != "" {
+		instance = fmt.Sprintf("%s [%s]", host, mac)
+	}
+	return zeroconf.NewService(instance, WorkstationType).Port(WorkstationPort)
+}
+
+// ParseWorkstation splits the instance name of a workstation service into
+// the host name and the hardware address, if present.
+func ParseWorkstation(instance string) (host, mac string) {
+	if i := strings.LastIndex(instance, " ["); i >= 0 && strings.HasSuffix(instance, "]") {
+		return instance[:i], instance[i+2 : len(instance)-1]
+	}
+	return instance, ""
+}
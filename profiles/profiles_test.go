@@ -0,0 +1,270 @@
+package profiles
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kdanielm/zeroconf"
+)
+
+func TestParseTXT(t *testing.T) {
+	got := ParseTXT([]string{"Path=/a", "path=/b", "flag", "=value", "empty=", "k=v=w"})
+	want := map[string]string{"path": "/a", "flag": "", "empty": "", "k": "v=w"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v, but got %v", want, got)
+	}
+}
+
+func TestProfileRoundTrip(t *testing.T) {
+	printer := Printer{
+		ResourcePath: "ipp/print",
+		Type:         "Acme Laser",
+		Product:      "(Laser)",
+		PDLs:         []string{"application/pdf", "image/urf"},
+		UUID:         "0d1e",
+		Color:        true,
+	}
+	tests := []struct {
+		name    string
+		service func() (*zeroconf.ServiceBuilder, error)
+		parse   func(txt []string) any
+		want    any
+		port    int
+	}{
+		{
+			name: "http",
+			service: func() (*zeroconf.ServiceBuilder, error) {
+				return HTTP{Path: "/status", Username: "admin"}.Service("web", 0)
+			},
+			parse: func(txt []string) any { return ParseHTTP(txt) },
+			want:  HTTP{Path: "/status", Username: "admin"},
+			port:  HTTPPort,
+		},
+		{
+			name:    "printer",
+			service: func() (*zeroconf.ServiceBuilder, error) { return printer.Service("office", 8631) },
+			parse:   func(txt []string) any { return ParsePrinter(txt) },
+			want:    printer,
+			port:    8631,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.service()
+			if err != nil {
+				t.Fatalf("Expected a valid service, but got %v", err)
+			}
+			e, err := b.Build()
+			if err != nil {
+				t.Fatalf("Expected a valid service, but got %v", err)
+			}
+			if e.Port != tt.port {
+				t.Fatalf("Expected port %d, but got %d", tt.port, e.Port)
+			}
+			if got := tt.parse(e.Text); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Expected %+v, but got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestProfileValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile interface{ Validate() error }
+		valid   bool
+	}{
+		{name: "http path", profile: HTTP{Path: "/"}, valid: true},
+		{name: "relative http path", profile: HTTP{Path: "index.html"}},
+		{name: "printer", profile: Printer{ResourcePath: "ipp/print", Product: "(Laser)", PDLs: []string{"application/pdf"}}, valid: true},
+		{name: "absolute resource path", profile: Printer{ResourcePath: "/ipp/print"}},
+		{name: "product without parentheses", profile: Printer{Product: "Laser"}},
+		{name: "document format list", profile: Printer{PDLs: []string{"application/pdf,image/urf"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.profile.Validate(); (err == nil) != tt.valid {
+				t.Fatalf("Expected valid %v, but got %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestParseWorkstation(t *testing.T) {
+	tests := []struct {
+		instance, host, mac string
+	}{
+		{"myhost [00:11:22:33:44:55]", "myhost", "00:11:22:33:44:55"},
+		{"myhost", "myhost", ""},
+		{"my [host]x", "my [host]x", ""},
+	}
+	for _, tt := range tests {
+		host, mac := ParseWorkstation(tt.instance)
+		if host != tt.host || mac != tt.mac {
+			t.Fatalf("Expected %q to be split into %q and %q, but got %q and %q", tt.instance, tt.host, tt.mac, host, mac)
+		}
+	}
+	if e, err := Workstation("myhost", "00:11:22:33:44:55").Build(); err != nil || e.Instance != "myhost [00:11:22:33:44:55]" {
+		t.Fatalf("Expected the workstation instance, but got %v, %v", e, err)
+	}
+}
+
+func TestNewHAP(t *testing.T) {
+	tests := []struct {
+		name     string
+		deviceID string
+		model    string
+		category HAPCategory
+		valid    bool
+	}{
+		{name: "valid", deviceID: "3c:33:1b:21:b3:00", model: "Lamp1,1", category: HAPLightbulb, valid: true},
+		{name: "short device id", deviceID: "3C:33:1B:21:B3", model: "Lamp1,1", category: HAPLightbulb},
+		{name: "dashed device id", deviceID: "3C-33-1B-21-B3-00", model: "Lamp1,1", category: HAPLightbulb},
+		{name: "missing model", deviceID: "3C:33:1B:21:B3:00", category: HAPLightbulb},
+		{name: "unknown category", deviceID: "3C:33:1B:21:B3:00", model: "Lamp1,1", category: maxHAPCategoryCode + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHAP(tt.deviceID, tt.model, tt.category)
+			if (err == nil) != tt.valid {
+				t.Fatalf("Expected valid %v, but got %v", tt.valid, err)
+			}
+			if h != nil && ParseHAP(h.Text()).DeviceID != "3C:33:1B:21:B3:00" {
+				t.Fatalf("Expected the device id in upper case, but got %v", h.Text())
+			}
+		})
+	}
+}
+
+func TestHAPConfigNumber(t *testing.T) {
+	h, err := NewHAP("3C:33:1B:21:B3:00", "Lamp1,1", HAPLightbulb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetConfigNumber(0); err == nil {
+		t.Fatalf("Expected configuration number 0 to be rejected")
+	}
+	if err := h.SetConfigNumber(maxHAPConfigNumber); err != nil {
+		t.Fatal(err)
+	}
+	h.BumpConfigNumber()
+	if n := ParseHAP(h.Text()).ConfigNumber; n != 1 {
+		t.Fatalf("Expected the configuration number to wrap to 1, but got %d", n)
+	}
+}
+
+func TestHAPRoundTrip(t *testing.T) {
+	h, err := NewHAP("3C:33:1B:21:B3:00", "Lamp1,1", HAPLightbulb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := h.Register("Lamp", 51826, nil, zeroconf.LoopbackOnly())
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	<-server.Ready()
+
+	lookup := func() HAPRecord {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		entries := make(chan *zeroconf.ServiceEntry, 16)
+		go zeroconf.Lookup(ctx, "Lamp", HAPType, "local.", entries, zeroconf.SelectLoopback())
+		for e := range entries {
+			return ParseHAP(e.Text)
+		}
+		t.Fatalf("Expected the accessory to be found")
+		return HAPRecord{}
+	}
+	want := HAPRecord{DeviceID: "3C:33:1B:21:B3:00", Model: "Lamp1,1", Category: HAPLightbulb, ConfigNumber: 1, StateNumber: 1, Status: HAPNotPaired}
+	if got := lookup(); got != want {
+		t.Fatalf("Expected %+v, but got %+v", want, got)
+	}
+	h.SetPaired(true)
+	if got := lookup(); !got.Paired() {
+		t.Fatalf("Expected the accessory to be paired, but got %+v", got)
+	}
+}
+
+func TestParseAirPlayFeatures(t *testing.T) {
+	tests := []struct {
+		value string
+		want  uint64
+	}{
+		{"0x5A7FFFF7", 0x5A7FFFF7},
+		{"0x5A7FFFF7,0x1E", 0x1E5A7FFFF7},
+		{"5a7ffff7, 0X1e", 0x1E5A7FFFF7},
+		{"", 0},
+		{"0x1,zz", 0},
+		{"0x100000000,0x1", 0},
+	}
+	for _, tt := range tests {
+		if got := parseAirPlayFeatures(tt.value); got != tt.want {
+			t.Fatalf("Expected %q to be decoded as %#x, but got %#x", tt.value, tt.want, got)
+		}
+	}
+}
+
+func TestParseMediaReceivers(t *testing.T) {
+	cast := ParseChromecast(&zeroconf.ServiceEntry{
+		ServiceRecord: zeroconf.ServiceRecord{Instance: "Chromecast-0d1e"},
+		Text:          []string{"id=0d1e", "md=Chromecast", "ca=4101", "ve=05"},
+	})
+	if cast.FriendlyName != "Chromecast-0d1e" || cast.Capabilities != 4101 || cast.Model != "Chromecast" {
+		t.Fatalf("Expected the Chromecast fields, but got %+v", cast)
+	}
+	raop := ParseRAOP(&zeroconf.ServiceEntry{
+		ServiceRecord: zeroconf.ServiceRecord{Instance: "A1B2C3D4E5F6@Living Room"},
+		Text:          []string{"am=AudioAccessory5,1", "sf=0x4"},
+	})
+	if raop.DeviceID != "A1B2C3D4E5F6" || raop.Name != "Living Room" || raop.Features != 4 {
+		t.Fatalf("Expected the RAOP fields, but got %+v", raop)
+	}
+	airplay := ParseAirPlay(&zeroconf.ServiceEntry{
+		ServiceRecord: zeroconf.ServiceRecord{Instance: "Apple TV"},
+		Text:          []string{"deviceid=A1:B2:C3:D4:E5:F6", "features=0x5A7FFFF7,0x1E", "model=AppleTV5,3"},
+	})
+	if airplay.Name != "Apple TV" || airplay.Features != 0x1E5A7FFFF7 || airplay.Model != "AppleTV5,3" {
+		t.Fatalf("Expected the AirPlay fields, but got %+v", airplay)
+	}
+}
+
+func TestBrowse(t *testing.T) {
+	server, err := zeroconf.Register("Chromecast-0d1e", ChromecastType, "local.", 8009, []string{"id=0d1e", "fn=Kitchen"}, nil, zeroconf.LoopbackOnly())
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	casts := make(chan Chromecast)
+	browsed := make(chan error, 1)
+	go func() { browsed <- Browse(ctx, ChromecastType, ParseChromecast, casts, zeroconf.SelectLoopback()) }()
+	cast, ok := <-casts
+	if !ok {
+		t.Fatalf("Expected the Chromecast to be found")
+	}
+	if cast.FriendlyName != "Kitchen" || cast.ID != "0d1e" || cast.Entry.Port != 8009 {
+		t.Fatalf("Expected the decoded Chromecast, but got %+v", cast)
+	}
+	cancel()
+	for range casts {
+	}
+	if err := <-browsed; err != nil {
+		t.Fatalf("Expected the browse to end without error, but got %v", err)
+	}
+}
+
+func TestBrowseInvalidType(t *testing.T) {
+	results := make(chan Chromecast)
+	if err := Browse(context.Background(), "googlecast", ParseChromecast, results); err == nil {
+		t.Fatalf("Expected an invalid service type to be rejected")
+	}
+	if _, ok := <-results; ok {
+		t.Fatalf("Expected the results to be closed")
+	}
+}
@@ -0,0 +1,48 @@
+// Package profiles provides typed helpers for common DNS-SD service types.
+// Each profile knows the conventional port and TXT keys of its type, builds
+// validated services for publishing and decodes the TXT records of received
+// entries.
+package profiles
+
+import "strings"
+
+// ParseTXT decodes key/value TXT strings as specified by RFC 6763 section
+// 6.4: keys are case-insensitive and returned in lower case, only the first
+// occurrence of a key counts, and keys without "=" have an empty value.
+func ParseTXT(txt []string) map[string]string {
+	pairs := make(map[string]string, len(txt))
+	for _, s := range txt {
+		key, value, _ := strings.Cut(s, "=")
+		if key == "" {
+			continue
+		}
+		key = strings.ToLower(key)
+		if _, found := pairs[key]; !found {
+			pairs[key] = value
+		}
+	}
+	return pairs
+}
+
+// setIf adds the pair if the value is not empty.
+func setIf(pairs map[string]string, key, value string) {
+	if value != "" {
+		pairs[key] = value
+	}
+}
+
+// flag encodes a boolean TXT value the way most DNS-SD services do.
+func flag(b bool) string {
+	if b {
+		return "T"
+	}
+	return "F"
+}
+
+func parseFlag(value string) bool {
+	switch strings.ToLower(value) {
+	case "t", "true", "1", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package zeroconf
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxQueriers bounds the hosts kept by TrackQueriers. When it is reached,
+// the host seen least recently is dropped.
+const maxQueriers = 1024
+
+// Querier is a host which queried the services of a server, see
+// TrackQueriers.
+type Querier struct {
+	Addr      net.IP    // Source address of the queries
+	FirstSeen time.Time // Time of the first query
+	LastSeen  time.Time // Time of the latest query
+	Queries   int       // Number of queries received
+}
+
+// TrackQueriers makes the server keep the hosts which queried its services
+// within the given window, see Server.Queriers, e.g. for usage telemetry or
+// to derive access policies. A query counts if one of its questions asks
+// for a name the services are answered for, e.g. their service type,
+// instance or host name, whether or not it is answered; probes and queries
+// from ignored sources are not counted. Hosts are told apart by address,
+// not port, and up to 1024 are kept. Non-positive windows are ignored.
+func TrackQueriers(window time.Duration) ServerOption {
+	return func(o *serverOpts) {
+		if window > 0 {
+			o.queriers = newQuerierTracker(window)
+		}
+	}
+}
+
+// Queriers returns the hosts seen by the TrackQueriers option within its
+// window, most recently seen first, or nil without it.
+func (s *Server) Queriers() []Querier {
+	return s.queriers.list(time.Now())
+}
+
+// querierTracker records the queriers of a server. A nil tracker records
+// nothing.
+type querierTracker struct {
+	mu     sync.Mutex
+	window time.Duration
+	hosts  map[string]*Querier
+}
+
+func newQuerierTracker(window time.Duration) *querierTracker {
+	return &querierTracker{window: window, hosts: make(map[string]*Querier)}
+}
+
+// observe records a query of the server's services from the address.
+func (t *querierTracker) observe(from net.Addr, now time.Time) {
+	if t == nil {
+		return
+	}
+	addr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	key := addr.IP.String()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, found := t.hosts[key]
+	if !found {
+		t.expire(now)
+		if len(t.hosts) >= maxQueriers {
+			t.evict()
+		}
+		q = &Querier{Addr: append(net.IP(nil), addr.IP...), FirstSeen: now}
+		t.hosts[key] = q
+	}
+	q.LastSeen = now
+	q.Queries++
+}
+
+// expire drops the hosts not seen within the window. The caller holds mu.
+func (t *querierTracker) expire(now time.Time) {
+	for k, q := range t.hosts {
+		if now.Sub(q.LastSeen) > t.window {
+			delete(t.hosts, k)
+		}
+	}
+}
+
+// evict drops the host seen least recently. The caller holds mu.
+func (t *querierTracker) evict() {
+	var oldest string
+	for k, q := range t.hosts {
+		if oldest == "" || q.LastSeen.Before(t.hosts[oldest].LastSeen) {
+			oldest = k
+		}
+	}
+	delete(t.hosts, oldest)
+}
+
+func (t *querierTracker) list(now time.Time) []Querier {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(now)
+	list := make([]Querier, 0, len(t.hosts))
+	for _, q := range t.hosts {
+		list = append(list, *q)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastSeen.After(list[j].LastSeen)
+	})
+	return list
+}
+
+// queriesServices reports whether a question of the query asks for a name
+// of the services visible on the interface.
+func (s *Server) queriesServices(query *dns.Msg, ifIndex int) bool {
+	for _, q := range query.Question {
+		if len(s.registrationsFor(dns.CanonicalName(q.Name), ifIndex)) > 0 {
+			return true
+		}
+	}
+	return false
+}
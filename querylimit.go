@@ -0,0 +1,43 @@
+package zeroconf
+
+import (
+	"fmt"
+	"time"
+)
+
+// QueryLimiter spaces the queries of all Browse, Lookup and Resolver calls
+// sharing it, so that starting many of them at once does not cause a burst
+// of multicast traffic, which may trip the storm control of switches.
+// Queries exceeding the rate are delayed, not dropped.
+type QueryLimiter struct {
+	bucket *tokenBucket
+}
+
+// NewQueryLimiter creates a QueryLimiter allowing perSecond queries on
+// average with bursts of up to burst queries. It is passed to the calls with
+// the WithQueryLimiter option. Non-positive rates are rejected, as they
+// would never let a query through after the burst.
+func NewQueryLimiter(perSecond float64, burst int) (*QueryLimiter, error) {
+	if !(perSecond > 0) {
+		return nil, fmt.Errorf("invalid query rate %v", perSecond)
+	}
+	return &QueryLimiter{bucket: newTokenBucket(perSecond, burst)}, nil
+}
+
+// WithQueryLimiter spaces the outgoing queries with the given limiter.
+func WithQueryLimiter(l *QueryLimiter) ClientOption {
+	return func(o *clientOpts) {
+		o.limiter = l
+	}
+}
+
+// wait blocks until the next query may be sent. A nil limiter does not
+// block.
+func (l *QueryLimiter) wait() {
+	if l == nil {
+		return
+	}
+	if d := l.bucket.reserve(); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,129 @@
+package zeroconf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryLogEntry is a message received or sent by a server, see QueryLog.
+type QueryLogEntry struct {
+	Time     time.Time
+	Sent     bool     // Sent by the server, received otherwise
+	Response bool     // A response, a query otherwise
+	Records  []string // Name and type of the questions of a query or the answers of a response
+	Addr     net.Addr // Source of a received or destination of a unicast message, nil if multicast
+	IfIndex  int      // Interface index, 0 if unknown or all interfaces
+	Err      error    // Error sending the message
+}
+
+// String describes the entry in one line, e.g.
+//
+//	10:04:05.123 recv query from 192.168.1.20:5353 on if2: _ipp._tcp.local. PTR
+func (e QueryLogEntry) String() string {
+	var b strings.Builder
+	b.WriteString(e.Time.Format("15:04:05.000"))
+	if e.Sent {
+		b.WriteString(" sent")
+	} else {
+		b.WriteString(" recv")
+	}
+	if e.Response {
+		b.WriteString(" response")
+	} else {
+		b.WriteString(" query")
+	}
+	if e.Addr != nil {
+		if e.Sent {
+			fmt.Fprintf(&b, " to %s", e.Addr)
+		} else {
+			fmt.Fprintf(&b, " from %s", e.Addr)
+		}
+	}
+	if e.IfIndex != 0 {
+		fmt.Fprintf(&b, " on if%d", e.IfIndex)
+	}
+	fmt.Fprintf(&b, ": %s", strings.Join(e.Records, ", "))
+	if e.Err != nil {
+		fmt.Fprintf(&b, " (%v)", e.Err)
+	}
+	return b.String()
+}
+
+// QueryLog keeps the last size messages received and sent by a server in
+// memory, see Server.RecentQueries. It helps to find out why a service is
+// not discovered without capturing packets. Non-positive sizes are ignored.
+func QueryLog(size int) ServerOption {
+	return func(o *serverOpts) {
+		if size > 0 {
+			o.queryLog = newQueryLog(size)
+		}
+	}
+}
+
+// RecentQueries returns the messages kept by the QueryLog option, oldest
+// first, or nil without it.
+func (s *Server) RecentQueries() []QueryLogEntry {
+	return s.queryLog.entries()
+}
+
+// queryLog is a fixed-size ring of messages. A nil log records nothing.
+type queryLog struct {
+	mu   sync.Mutex
+	ring []QueryLogEntry
+	next int
+	full bool
+}
+
+func newQueryLog(size int) *queryLog {
+	return &queryLog{ring: make([]QueryLogEntry, size)}
+}
+
+// add records a message. Sent messages are recorded with the error of
+// sending them.
+func (l *queryLog) add(msg *dns.Msg, sent bool, addr net.Addr, ifIndex int, err error) {
+	if l == nil {
+		return
+	}
+	e := QueryLogEntry{
+		Time:     time.Now(),
+		Sent:     sent,
+		Response: msg.Response,
+		Addr:     addr,
+		IfIndex:  ifIndex,
+		Err:      err,
+	}
+	if msg.Response {
+		for _, rr := range msg.Answer {
+			e.Records = append(e.Records, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+		}
+	} else {
+		for _, q := range msg.Question {
+			e.Records = append(e.Records, q.Name+" "+dns.TypeToString[q.Qtype])
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ring[l.next] = e
+	l.next = (l.next + 1) % len(l.ring)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+func (l *queryLog) entries() []QueryLogEntry {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]QueryLogEntry(nil), l.ring[:l.next]...)
+	}
+	return append(append([]QueryLogEntry(nil), l.ring[l.next:]...), l.ring[:l.next]...)
+}
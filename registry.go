@@ -0,0 +1,312 @@
+package zeroconf
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// registration is a service published by a Server. A registration restricted
+// to a set of interfaces is neither answered nor announced on the other
+// interfaces of the server.
+type registration struct {
+	current   atomic.Pointer[ServiceEntry]
+	ifaces    map[int]bool // nil if visible on all interfaces
+	progress  serviceProgress
+	withdrawn chan struct{} // closed once the service is unregistered
+	conflict  chan net.Addr // peers answering for the name while probing
+	updates   atomic.Uint64 // changes announced, see Server.announceUpdate
+	retrying  sync.Map      // retryKeys with a pending announcement retry
+}
+
+func newRegistration(entry *ServiceEntry) *registration {
+	r := &registration{
+		withdrawn: make(chan struct{}),
+		conflict:  make(chan net.Addr, 1),
+	}
+	r.current.Store(entry)
+	return r
+}
+
+// entry returns the current snapshot of the service. Snapshots are never
+// modified; updates store a modified copy, so that concurrent query
+// handlers read a consistent entry without locking.
+func (r *registration) entry() *ServiceEntry {
+	return r.current.Load()
+}
+
+// update applies fn to a copy of the current entry and publishes the copy.
+// Updates are serialized by the caller.
+func (r *registration) update(fn func(e *ServiceEntry)) {
+	e := *r.entry()
+	fn(&e)
+	r.current.Store(&e)
+}
+
+// serviceSet is an immutable snapshot of the services of a server and the
+// index of their names.
+type serviceSet struct {
+	list  []*registration
+	index map[string][]*registration // canonical name -> services
+}
+
+// visibleOn reports whether the service may be answered on the interface.
+// Restricted services are never answered if the interface is unknown (0), as
+// the response might end up on any interface.
+func (r *registration) visibleOn(ifIndex int) bool {
+	if r.ifaces == nil {
+		return true
+	}
+	return r.ifaces[ifIndex]
+}
+
+// RegisterService publishes an additional service on a running server. The
+// service shares the host name and addresses of the service the server was
+// created with. It is only answered and announced on the given interfaces,
+// which must be a subset of the interfaces the server listens on. If ifaces is
+// empty, the service is visible on all of them.
+func (s *Server) RegisterService(instance, service, domain string, port int, text []string, ifaces []net.Interface) error {
+	service = normalizeServiceType(service, s.typeWarning)
+	entry, err := NewService(instance, service).Domain(domain).Port(port).Text(text...).Build()
+	if err != nil {
+		return err
+	}
+	return s.RegisterEntry(entry, ifaces)
+}
+
+// RegisterEntry publishes an additional service built with NewService on a
+// running server, see RegisterService. A host name of the entry is replaced
+// by the one of the server.
+func (s *Server) RegisterEntry(entry *ServiceEntry, ifaces []net.Interface) error {
+	if entry == nil {
+		return fmt.Errorf("missing service entry")
+	}
+
+	r := newRegistration(entry)
+	if len(ifaces) > 0 {
+		r.ifaces = make(map[int]bool)
+		for _, iface := range ifaces {
+			if !s.listensOn(iface.Index) {
+				return fmt.Errorf("server does not listen on interface %s", iface.Name)
+			}
+			r.ifaces[iface.Index] = true
+		}
+	}
+
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if s.isShutdown {
+		return fmt.Errorf("server is shut down")
+	}
+
+	s.servicesLock.Lock()
+	if s.primary() == nil {
+		s.servicesLock.Unlock()
+		return fmt.Errorf("no service registered")
+	}
+	for _, other := range s.registrations() {
+		if equalNames(other.entry().ServiceInstanceName(), entry.ServiceInstanceName()) {
+			s.servicesLock.Unlock()
+			return fmt.Errorf("service instance %s already registered", entry.ServiceInstanceName())
+		}
+	}
+	useHost(entry, s.primary().entry())
+	s.addRegistration(r)
+	s.servicesLock.Unlock()
+
+	s.refCount.Add(1)
+	go s.probe(r)
+	return nil
+}
+
+// Unregister sends goodbye packets for all services of the server and stops
+// answering for them. Unlike Shutdown, the sockets are kept open, so that
+// Reregister can publish a service again right away, e.g. for a service
+// which restarts frequently.
+func (s *Server) Unregister() error {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if s.isShutdown {
+		return fmt.Errorf("server is shut down")
+	}
+
+	s.servicesLock.Lock()
+	regs := s.withdraw()
+	s.servicesLock.Unlock()
+	return s.goodbye(regs)
+}
+
+// Reregister publishes the entry as the service of the server, which is
+// probed and announced as after Register. The services registered before,
+// if any, are unregistered first. The host name and addresses of the entry
+// are replaced by those of the server.
+func (s *Server) Reregister(entry *ServiceEntry) error {
+	if entry == nil {
+		return fmt.Errorf("missing service entry")
+	}
+
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if s.isShutdown {
+		return fmt.Errorf("server is shut down")
+	}
+
+	s.servicesLock.Lock()
+	regs := s.withdraw()
+	useHost(entry, s.host)
+	r := newRegistration(entry)
+	s.addRegistration(r)
+	s.servicesLock.Unlock()
+
+	if err := s.goodbye(regs); err != nil {
+		log.Printf("[WARN] mdns: failed to unregister: %v", err)
+	}
+	s.refCount.Add(1)
+	go s.probe(r)
+	return nil
+}
+
+// withdraw removes all services, stopping their probes and announcements,
+// and returns them. The host of the primary service is kept for Reregister.
+// The caller holds servicesLock.
+func (s *Server) withdraw() []*registration {
+	regs := s.registrations()
+	if len(regs) > 0 {
+		s.host = regs[0].entry()
+	}
+	for _, r := range regs {
+		close(r.withdrawn)
+	}
+	s.services.Store(&serviceSet{index: make(map[string][]*registration)})
+	s.refreshGoodbye()
+	return regs
+}
+
+// useHost sets the host name and addresses of the entry to those of host.
+func useHost(entry, host *ServiceEntry) {
+	entry.HostName = host.HostName
+	entry.AddrIPv4 = host.AddrIPv4
+	entry.AddrIPv6 = host.AddrIPv6
+}
+
+// registrations returns the services published by the server.
+func (s *Server) registrations() []*registration {
+	if set := s.services.Load(); set != nil {
+		return set.list
+	}
+	return nil
+}
+
+// addRegistration adds a service and indexes the names it is answered for,
+// publishing a new snapshot of the services. The caller holds servicesLock
+// unless the server is not started yet.
+func (s *Server) addRegistration(r *registration) {
+	next := &serviceSet{index: make(map[string][]*registration)}
+	if set := s.services.Load(); set != nil {
+		next.list = append(next.list, set.list...)
+		for name, regs := range set.index {
+			next.index[name] = append([]*registration(nil), regs...)
+		}
+	}
+	next.list = append(next.list, r)
+	for _, name := range r.names() {
+		next.index[name] = append(next.index[name], r)
+	}
+	s.services.Store(next)
+	s.refreshGoodbye()
+}
+
+// replaceRegistration replaces a service by another one at its position,
+// stopping its probes and announcements. It reports false if the service is
+// no longer registered. The caller holds servicesLock.
+func (s *Server) replaceRegistration(old, r *registration) bool {
+	next := &serviceSet{index: make(map[string][]*registration)}
+	found := false
+	for _, other := range s.registrations() {
+		if other == old {
+			other = r
+			found = true
+		}
+		next.list = append(next.list, other)
+		for _, name := range other.names() {
+			next.index[name] = append(next.index[name], other)
+		}
+	}
+	if !found {
+		return false
+	}
+	close(old.withdrawn)
+	s.services.Store(next)
+	s.refreshGoodbye()
+	return true
+}
+
+// names returns the canonical names the service is answered for: the service
+// type enumeration, service, instance, host and subtype names.
+func (r *registration) names() []string {
+	e := r.entry()
+	candidates := []string{e.canonicalTypeName, e.canonicalName, e.canonicalInstanceName}
+	if e.HostName != "" {
+		candidates = append(candidates, dns.CanonicalName(e.HostName))
+	}
+	candidates = append(candidates, e.canonicalSubtypes...)
+	names := make([]string, 0, len(candidates))
+	seen := make(map[string]bool)
+	for _, name := range candidates {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// registrationsFor returns the services which are answered for the canonical
+// name and may be answered on the interface.
+func (s *Server) registrationsFor(name string, ifIndex int) []*registration {
+	set := s.services.Load()
+	if set == nil {
+		return nil
+	}
+	var regs []*registration
+	for _, r := range set.index[name] {
+		if r.visibleOn(ifIndex) {
+			regs = append(regs, r)
+		}
+	}
+	return regs
+}
+
+// visibleRegistrations returns the services which may be answered on the
+// interface.
+func (s *Server) visibleRegistrations(ifIndex int) []*registration {
+	var regs []*registration
+	for _, r := range s.registrations() {
+		if r.visibleOn(ifIndex) {
+			regs = append(regs, r)
+		}
+	}
+	return regs
+}
+
+// primary returns the service the server was created with, or the one
+// published by Reregister. It is nil while the server is unregistered.
+func (s *Server) primary() *registration {
+	if regs := s.registrations(); len(regs) > 0 {
+		return regs[0]
+	}
+	return nil
+}
+
+func (s *Server) listensOn(ifIndex int) bool {
+	for _, iface := range s.ifaces {
+		if iface.Index == ifIndex {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+package zeroconf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Resolver shares one set of sockets and a single receive loop among
+// concurrent Browse and Lookup calls. Each received message is matched
+// against all active lookups, which saves resources and avoids port
+// contention when many lookups run at once.
+type Resolver struct {
+	c      *client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	subsLock sync.Mutex
+	subs     map[*subscription]struct{}
+	cache    *entryCache
+}
+
+// subscription is an active lookup or host resolution of a Resolver.
+type subscription struct {
+	ctx    context.Context
+	params *lookupParams
+	msgs   chan *dns.Msg
+}
+
+// NewResolver creates a Resolver listening on the interfaces configured by
+// the options. It has to be closed after use.
+func NewResolver(opts ...ClientOption) (*Resolver, error) {
+	conf := applyOpts(opts...)
+	if conf.promiscuous {
+		return nil, errPromiscuous
+	}
+	c, err := newClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Resolver{
+		c:      c,
+		ctx:    ctx,
+		cancel: cancel,
+		subs:   make(map[*subscription]struct{}),
+		cache:  newEntryCache(),
+	}
+	msgCh := make(chan *dns.Msg, 32)
+	c.listen(ctx, msgCh)
+	go r.dispatch(msgCh)
+	go watchInterfaces(ctx, c.listIfaces, func(ifaces []net.Interface) {
+		if ctx.Err() != nil {
+			return
+		}
+		c.interfacesChanged(ifaces, r.activeParams()...)
+	})
+	return r, nil
+}
+
+// Browse for all services of a given type in a given domain.
+// Received entries are sent on the entries channel, preceded by the cached
+// entries of the service type, which are marked as cached.
+// It blocks until the context is canceled, the resolver is closed or an
+// error occurs.
+func (r *Resolver) Browse(ctx context.Context, service, domain string, entries chan<- *ServiceEntry) error {
+	params := newLookupParams("", normalizeServiceType(service, r.c.typeWarning), domain, true, entries)
+	return r.run(ctx, params)
+}
+
+// BrowseConfig describes a browse for Resolver.BrowseWith. New settings are
+// added as fields, the zero value of which keeps the previous behavior.
+type BrowseConfig struct {
+	// Type is the service type, e.g. "_http._tcp".
+	Type string
+	// Domain defaults to "local".
+	Domain string
+	// Subtypes restricts the browse to the instances of a subtype. As with
+	// Browse, the first subtype is queried.
+	Subtypes []string
+	// Entries receives the entries found. It is closed when the browse ends.
+	Entries chan<- *ServiceEntry
+}
+
+// BrowseWith browses for services as configured. It blocks like Browse.
+func (r *Resolver) BrowseWith(ctx context.Context, cfg BrowseConfig) error {
+	if cfg.Type == "" {
+		return fmt.Errorf("missing service type")
+	}
+	if cfg.Entries == nil {
+		return fmt.Errorf("missing entries channel")
+	}
+	service := strings.Join(append([]string{normalizeServiceType(cfg.Type, r.c.typeWarning)}, cfg.Subtypes...), ",")
+	params := newLookupParams("", service, cfg.Domain, true, cfg.Entries)
+	return r.run(ctx, params)
+}
+
+// Lookup a specific service by its name and type in a given domain.
+// Received entries are sent on the entries channel, preceded by the cached
+// entry, if any.
+// It blocks until the context is canceled, the resolver is closed or an
+// error occurs. With NegativeCache, the lookup of an instance found absent
+// recently closes the entries channel and returns ErrInstanceAbsent at once.
+func (r *Resolver) Lookup(ctx context.Context, instance, service, domain string, entries chan<- *ServiceEntry) error {
+	params := newLookupParams(instance, normalizeServiceType(service, r.c.typeWarning), domain, false, entries)
+	return r.run(ctx, params)
+}
+
+// Close stops all lookups and closes the connections.
+func (r *Resolver) Close() {
+	r.cancel()
+	r.c.shutdown()
+}
+
+// FlushCache drops the cached entries, including the instances known to be
+// absent. Active lookups deliver the entries received from now on again, as
+// if they were new.
+func (r *Resolver) FlushCache() {
+	r.cache.flush()
+	for _, p := range r.activeParams() {
+		p.forget()
+	}
+}
+
+// Requery queries again for the active lookups of the service type, e.g.
+// after a known network event, and restarts their query schedule.
+func (r *Resolver) Requery(service string) error {
+	for _, p := range r.activeParams() {
+		if !equalNames(p.Service, service) {
+			continue
+		}
+		if r.c.scheduled(p) {
+			p.restartQueries()
+			continue
+		}
+		if err := r.c.query(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CachedEntries returns the unexpired entries of the service type delivered
+// by the lookups of the resolver, also after the lookups have finished.
+func (r *Resolver) CachedEntries(service string) []*ServiceEntry {
+	return r.cache.entries(service, time.Now())
+}
+
+func (r *Resolver) run(ctx context.Context, params *lookupParams) error {
+	if err := ValidateServiceType(params.Service); err != nil {
+		return err
+	}
+	if r.c.negativeTTL > 0 && params.Instance != "" && r.cache.isAbsent(params.ServiceInstanceName(), time.Now()) {
+		params.done()
+		return ErrInstanceAbsent
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	params.cache = r.cache
+	sub := &subscription{
+		ctx:    ctx,
+		params: params,
+		msgs:   make(chan *dns.Msg, 32),
+	}
+	r.subsLock.Lock()
+	r.subs[sub] = struct{}{}
+	r.subsLock.Unlock()
+	go func() {
+		r.deliverCached(ctx, params)
+		r.c.mainloop(ctx, params, sub.msgs)
+		r.subsLock.Lock()
+		delete(r.subs, sub)
+		r.subsLock.Unlock()
+	}()
+
+	if waitFirstQuery(ctx) {
+		if err := r.c.query(params); err != nil {
+			return err
+		}
+	}
+	r.c.schedule(ctx, params)
+
+	select {
+	case <-ctx.Done():
+		return r.c.lookupResult(ctx, params)
+	case <-r.ctx.Done():
+	}
+	return nil
+}
+
+// deliverCached delivers copies of the cached entries matching the lookup,
+// marked as cached, before the lookup delivers the entries received.
+func (r *Resolver) deliverCached(ctx context.Context, params *lookupParams) {
+	// The cache does not know the subtypes of the entries.
+	if len(params.Subtypes) > 0 {
+		return
+	}
+	for _, e := range r.cache.entries(params.Service, time.Now()) {
+		if !equalNames(e.Domain, params.Domain) {
+			continue
+		}
+		if params.Instance != "" && !equalNames(e.ServiceInstanceName(), params.ServiceInstanceName()) {
+			continue
+		}
+		cached := *e
+		cached.Cached = true
+		params.answered.Store(true)
+		select {
+		case params.Entries <- &cached:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dispatch hands each received message to all active lookups. A lookup
+// falling behind does not hold up the others: once its buffer is full, its
+// oldest message is dropped, as the retransmitted queries and announcements
+// make up for lost packets.
+func (r *Resolver) dispatch(msgCh <-chan *dns.Msg) {
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case msg := <-msgCh:
+			r.subsLock.Lock()
+			subs := make([]*subscription, 0, len(r.subs))
+			for sub := range r.subs {
+				subs = append(subs, sub)
+			}
+			r.subsLock.Unlock()
+			for _, sub := range subs {
+				sub.deliver(msg)
+			}
+		}
+	}
+}
+
+// deliver passes the message to the lookup without blocking, dropping the
+// oldest buffered message if the buffer is full.
+func (sub *subscription) deliver(msg *dns.Msg) {
+	for {
+		select {
+		case sub.msgs <- msg:
+			return
+		default:
+		}
+		select {
+		case <-sub.msgs:
+		default:
+		}
+	}
+}
+
+func (r *Resolver) activeParams() []*lookupParams {
+	r.subsLock.Lock()
+	defer r.subsLock.Unlock()
+	params := make([]*lookupParams, 0, len(r.subs))
+	for sub := range r.subs {
+		// Host resolutions have no lookup params.
+		if sub.params != nil {
+			params = append(params, sub.params)
+		}
+	}
+	return params
+}
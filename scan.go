@@ -0,0 +1,201 @@
+package zeroconf
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Device is a host found by Scan with the services it advertises.
+type Device struct {
+	HostName string          // Host name of the first service found
+	AddrIPv4 []net.IP        // IPv4 addresses of the services
+	AddrIPv6 []net.IP        // IPv6 addresses of the services
+	Services []*ServiceEntry // Services of the host, sorted by type and instance
+}
+
+// ServiceTypes returns the distinct service types advertised by the device,
+// sorted.
+func (d *Device) ServiceTypes() []string {
+	var types []string
+	seen := make(map[string]bool)
+	for _, e := range d.Services {
+		if k := cacheKey(e.Service); !seen[k] {
+			seen[k] = true
+			types = append(types, e.Service)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Scan browses for the given service types in the local domain until the
+// context is done, e.g. for a few seconds, and returns the resolved services
+// grouped by device, as network scanners show them. Services announced
+// under the same host name, or sharing an address, belong to one device.
+// Without types, the service types are enumerated first and all of them are
+// browsed. Services which said goodbye or expired during the scan are left
+// out, as are services whose host could not be resolved.
+func Scan(ctx context.Context, types []string, opts ...ClientOption) ([]*Device, error) {
+	warn := applyOpts(opts...).typeWarning
+	services := make([]string, 0, len(types))
+	for _, service := range types {
+		service = normalizeServiceType(service, warn)
+		if err := ValidateServiceType(service); err != nil {
+			return nil, err
+		}
+		services = append(services, service)
+	}
+	// Resolve the instances announced by a PTR record alone right away.
+	r, err := NewResolver(append(opts[:len(opts):len(opts)], EagerResolve())...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var mu sync.Mutex
+	browsed := make(map[string]string)
+	var wg sync.WaitGroup
+	browse := func(service string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, found := browsed[cacheKey(service)]; found {
+			return
+		}
+		browsed[cacheKey(service)] = service
+		entries := make(chan *ServiceEntry, 32)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			// The resolver caches the entries.
+			for range entries {
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			_ = r.Browse(ctx, service, "local.", entries)
+		}()
+	}
+	for _, service := range services {
+		browse(service)
+	}
+	if len(services) == 0 {
+		found := make(chan *ServiceEntry, 32)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range found {
+				if service := enumeratedType(e); service != "" {
+					browse(service)
+				}
+			}
+		}()
+		if err := r.Browse(ctx, serviceTypeEnumeration, "local.", found); err != nil {
+			return nil, err
+		}
+	}
+	<-ctx.Done()
+	wg.Wait()
+
+	var entries []*ServiceEntry
+	now := time.Now()
+	for _, service := range browsed {
+		for _, e := range r.CachedEntries(service) {
+			if e.HostName != "" && e.Expiry.After(now) {
+				entries = append(entries, e)
+			}
+		}
+	}
+	return groupDevices(entries), nil
+}
+
+// enumeratedType returns the service type of an entry found by browsing the
+// service type enumeration, whose instance is the type and domain, or "" if
+// it is not a valid type.
+func enumeratedType(e *ServiceEntry) string {
+	labels := dns.SplitDomainName(e.Instance)
+	if len(labels) < 2 {
+		return ""
+	}
+	service := strings.Join(labels[:2], ".")
+	if ValidateServiceType(service) != nil {
+		return ""
+	}
+	return service
+}
+
+// groupDevices groups the entries by host name and shared addresses.
+func groupDevices(entries []*ServiceEntry) []*Device {
+	less := func(a, b *ServiceEntry) bool {
+		if x, y := cacheKey(a.Service), cacheKey(b.Service); x != y {
+			return x < y
+		}
+		return dns.CanonicalName(a.ServiceInstanceName()) < dns.CanonicalName(b.ServiceInstanceName())
+	}
+	sort.Slice(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+
+	var devices []*Device
+	// Host names and addresses of each device
+	var hosts, addrs []map[string]bool
+	for _, e := range entries {
+		host := dns.CanonicalName(e.HostName)
+		ips := append(append([]net.IP(nil), e.AddrIPv4...), e.AddrIPv6...)
+		// The entry may join several devices, which are merged.
+		var matches []int
+		for i := range devices {
+			if hosts[i][host] {
+				matches = append(matches, i)
+				continue
+			}
+			for _, ip := range ips {
+				if addrs[i][ip.String()] {
+					matches = append(matches, i)
+					break
+				}
+			}
+		}
+		if len(matches) == 0 {
+			devices = append(devices, &Device{HostName: e.HostName})
+			hosts = append(hosts, make(map[string]bool))
+			addrs = append(addrs, make(map[string]bool))
+			matches = []int{len(devices) - 1}
+		}
+		d, first := devices[matches[0]], matches[0]
+		for k := len(matches) - 1; k > 0; k-- {
+			i := matches[k]
+			d.Services = append(d.Services, devices[i].Services...)
+			d.AddrIPv4 = appendUnique(d.AddrIPv4, devices[i].AddrIPv4, addrs[first])
+			d.AddrIPv6 = appendUnique(d.AddrIPv6, devices[i].AddrIPv6, addrs[first])
+			for h := range hosts[i] {
+				hosts[first][h] = true
+			}
+			devices = append(devices[:i], devices[i+1:]...)
+			hosts = append(hosts[:i], hosts[i+1:]...)
+			addrs = append(addrs[:i], addrs[i+1:]...)
+		}
+		hosts[first][host] = true
+		d.Services = append(d.Services, e)
+		d.AddrIPv4 = appendUnique(d.AddrIPv4, e.AddrIPv4, addrs[first])
+		d.AddrIPv6 = appendUnique(d.AddrIPv6, e.AddrIPv6, addrs[first])
+	}
+	for _, d := range devices {
+		sort.Slice(d.Services, func(i, j int) bool { return less(d.Services[i], d.Services[j]) })
+	}
+	return devices
+}
+
+// appendUnique appends the addresses not in seen and adds them to it.
+func appendUnique(dst, ips []net.IP, seen map[string]bool) []net.IP {
+	for _, ip := range ips {
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			dst = append(dst, ip)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,249 @@
+package zeroconf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// maxSendBatch limits the packets written by a sender at once.
+const maxSendBatch = 16
+
+// sendRequest is a packet to be multicast on an interface.
+type sendRequest struct {
+	buf    []byte
+	ipType IPType // protocols to send it with, if joined
+	result chan sendResult
+}
+
+// sendResult is the outcome of a sendRequest. A packet written with one of
+// the protocols is sent, even if the other one failed.
+type sendResult struct {
+	sent bool
+	err  error
+}
+
+// protocolError is the failure to send a packet with one protocol.
+type protocolError struct {
+	ipType IPType
+	err    error
+}
+
+func (e *protocolError) Error() string {
+	if e.ipType == IPv6 {
+		return "udp6: " + e.err.Error()
+	}
+	return "udp4: " + e.err.Error()
+}
+
+func (e *protocolError) Unwrap() error { return e.err }
+
+// ifaceSender multicasts the packets of one interface. Packets queued while
+// the sender is busy are written in one batch, so that the multicast
+// interface of the connections is switched once per batch on platforms
+// without per-packet interface selection.
+type ifaceSender struct {
+	s      *Server
+	iface  net.Interface
+	v4, v6 bool // joined the multicast group of the protocol
+	queue  chan sendRequest
+}
+
+// controlMessageIfIndex reports whether the platform selects the outgoing
+// interface per packet with a control message.
+func controlMessageIfIndex() bool {
+	switch runtime.GOOS {
+	case "darwin", "ios", "linux":
+		return true
+	}
+	return false
+}
+
+// groupConn is a connection of either protocol, so that the client, the
+// server and Conn share the code selecting the outgoing interface.
+type groupConn interface {
+	SetMulticastInterface(iface *net.Interface) error
+	// writeTo sends a packet, on the interface given by ifIndex in the
+	// control message unless it is 0.
+	writeTo(buf []byte, ifIndex int, to net.Addr) error
+}
+
+type ipv4GroupConn struct{ *ipv4.PacketConn }
+
+func (c ipv4GroupConn) writeTo(buf []byte, ifIndex int, to net.Addr) error {
+	var cm *ipv4.ControlMessage
+	if ifIndex != 0 {
+		cm = &ipv4.ControlMessage{IfIndex: ifIndex}
+	}
+	_, err := c.WriteTo(buf, cm, to)
+	return err
+}
+
+type ipv6GroupConn struct{ *ipv6.PacketConn }
+
+func (c ipv6GroupConn) writeTo(buf []byte, ifIndex int, to net.Addr) error {
+	var cm *ipv6.ControlMessage
+	if ifIndex != 0 {
+		cm = &ipv6.ControlMessage{IfIndex: ifIndex}
+	}
+	_, err := c.WriteTo(buf, cm, to)
+	return err
+}
+
+// selectInterface selects the interface of the packets written next on the
+// connection. Platforms with per-packet interface selection set the returned
+// index in the control message; on the others, e.g. Windows, where control
+// messages are not implemented
+// (https://pkg.go.dev/golang.org/x/net/ipv4#pkg-note-BUG), the multicast
+// interface of the connection is switched, and the caller serializes the
+// writes sharing the setting.
+func selectInterface(c groupConn, iface *net.Interface) (int, error) {
+	if controlMessageIfIndex() {
+		return iface.Index, nil
+	}
+	return 0, c.SetMulticastInterface(iface)
+}
+
+// writeOn sends a packet on the interface, or as routed if it is nil.
+func writeOn(c groupConn, buf []byte, iface *net.Interface, to net.Addr) error {
+	ifIndex := 0
+	if iface != nil {
+		var err error
+		if ifIndex, err = selectInterface(c, iface); err != nil {
+			return err
+		}
+	}
+	return c.writeTo(buf, ifIndex, to)
+}
+
+// startSenders starts a sender for each interface of the server. The senders
+// stop when the server is done.
+func (s *Server) startSenders() {
+	joined := func(ifaces []net.Interface, index int) bool {
+		for _, iface := range ifaces {
+			if iface.Index == index {
+				return true
+			}
+		}
+		return false
+	}
+	s.senders = make(map[int]*ifaceSender, len(s.ifaces))
+	for _, iface := range s.ifaces {
+		sender := &ifaceSender{
+			s:     s,
+			iface: iface,
+			v4:    s.ipv4conn != nil && joined(s.ipv4ifaces, iface.Index),
+			v6:    s.ipv6conn != nil && joined(s.ipv6ifaces, iface.Index),
+			queue: make(chan sendRequest, maxSendBatch),
+		}
+		s.senders[iface.Index] = sender
+		go sender.run()
+	}
+}
+
+// send queues the packet for the given protocols and waits until it is
+// written. It reports whether the packet was sent with any protocol, and the
+// errors of the protocols it failed on, see protocolError.
+func (w *ifaceSender) send(buf []byte, ipType IPType) (bool, error) {
+	req := sendRequest{buf: buf, ipType: ipType, result: make(chan sendResult, 1)}
+	select {
+	case w.queue <- req:
+	case <-w.s.done:
+		return false, fmt.Errorf("server is shut down")
+	}
+	select {
+	case res := <-req.result:
+		return res.sent, res.err
+	case <-w.s.done:
+		return false, fmt.Errorf("server is shut down")
+	}
+}
+
+func (w *ifaceSender) run() {
+	batch := make([]sendRequest, 0, maxSendBatch)
+	for {
+		select {
+		case <-w.s.done:
+			return
+		case req := <-w.queue:
+			batch = append(batch[:0], req)
+		}
+	collect:
+		for len(batch) < maxSendBatch {
+			select {
+			case req := <-w.queue:
+				batch = append(batch, req)
+			default:
+				break collect
+			}
+		}
+		w.write(batch)
+	}
+}
+
+// write sends the batch on both connections and reports the errors of each
+// packet to its sender.
+func (w *ifaceSender) write(batch []sendRequest) {
+	s := w.s
+	if w.iface.Name == "Teredo Tunneling Pseudo-Interface" && runtime.GOOS == "windows" {
+		// Skipped on purpose, which is no failure.
+		for _, req := range batch {
+			req.result <- sendResult{sent: true}
+		}
+		return
+	}
+	if !controlMessageIfIndex() {
+		// The multicast interface is a setting of the connections shared by
+		// all senders.
+		s.switchLock.Lock()
+		defer s.switchLock.Unlock()
+	}
+	// The interface is selected once for the batch. If switching fails, the
+	// packets are sent on the default multicast interface.
+	var index4, index6 int
+	if w.v4 {
+		var err error
+		if index4, err = selectInterface(ipv4GroupConn{s.ipv4conn}, &w.iface); err != nil {
+			log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", w.iface.Name, err)
+			s.sendFailed(w.iface.Index, fmt.Errorf("udp4: %w", err))
+		}
+	}
+	if w.v6 {
+		var err error
+		if index6, err = selectInterface(ipv6GroupConn{s.ipv6conn}, &w.iface); err != nil {
+			log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", w.iface.Name, err)
+			s.sendFailed(w.iface.Index, fmt.Errorf("udp6: %w", err))
+		}
+	}
+	for _, req := range batch {
+		var res sendResult
+		var errs []error
+		if w.v4 && req.ipType&IPv4 != 0 {
+			if err := (ipv4GroupConn{s.ipv4conn}).writeTo(req.buf, index4, ipv4Addr); err != nil {
+				err = &protocolError{IPv4, err}
+				s.sendFailed(w.iface.Index, err)
+				errs = append(errs, err)
+			} else {
+				res.sent = true
+				s.capture.sent(req.buf, w.iface.Index, ipv4Addr)
+			}
+		}
+		if w.v6 && req.ipType&IPv6 != 0 {
+			if err := (ipv6GroupConn{s.ipv6conn}).writeTo(req.buf, index6, ipv6Addr); err != nil {
+				err = &protocolError{IPv6, err}
+				s.sendFailed(w.iface.Index, err)
+				errs = append(errs, err)
+			} else {
+				res.sent = true
+				s.capture.sent(req.buf, w.iface.Index, ipv6Addr)
+			}
+		}
+		res.err = errors.Join(errs...)
+		req.result <- res
+	}
+}
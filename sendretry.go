@@ -0,0 +1,110 @@
+package zeroconf
+
+import (
+	"errors"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxSendRetries bounds the retries of an announcement which failed
+	// with a transient error.
+	maxSendRetries = 5
+	// sendRetryBackoff is the delay before the first retry, doubled for
+	// each further one.
+	sendRetryBackoff = 250 * time.Millisecond
+)
+
+// transientErrnos are the errors of sends failing because the network is not
+// usable yet, as seen for a few seconds after resuming from sleep, when
+// routes and addresses are restored: the network or host is unreachable,
+// the interface is down or the socket buffers are exhausted. Windows reports
+// them with its own WSAE codes, which the syscall package does not define.
+var transientErrnos = []syscall.Errno{
+	syscall.ENETUNREACH, syscall.EHOSTUNREACH, syscall.ENETDOWN, syscall.ENOBUFS,
+	10051, 10065, 10050, 10055, // WSAENETUNREACH, WSAEHOSTUNREACH, WSAENETDOWN, WSAENOBUFS
+}
+
+// transientSendError reports whether a send failed for a transient reason,
+// see transientErrnos.
+func transientSendError(err error) bool {
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// transientProtocols returns the protocols a send failed with for a
+// transient reason, from the protocolErrors joined in err.
+func transientProtocols(err error) IPType {
+	var t IPType
+	switch e := err.(type) {
+	case *protocolError:
+		if transientSendError(e.err) {
+			t |= e.ipType
+		}
+	case interface{ Unwrap() []error }:
+		for _, err := range e.Unwrap() {
+			t |= transientProtocols(err)
+		}
+	case interface{ Unwrap() error }:
+		t |= transientProtocols(e.Unwrap())
+	}
+	return t
+}
+
+// retryKey identifies a pending announcement retry of a service.
+type retryKey struct {
+	ifIndex int
+	ipType  IPType
+}
+
+// retryAnnouncement announces the service on the interface again with one
+// protocol, with exponential backoff, after the announcement failed with it
+// because of a transient error. Retries stop once one is sent, fails for
+// another reason, or the service is withdrawn or the server shut down. Only
+// one retry is pending per service, interface and protocol; later failures
+// are covered by it.
+func (s *Server) retryAnnouncement(r *registration, intf net.Interface, ipType IPType) {
+	key := retryKey{intf.Index, ipType}
+	if _, pending := r.retrying.LoadOrStore(key, true); pending {
+		return
+	}
+	s.refCount.Add(1)
+	go func() {
+		defer s.refCount.Done()
+		defer r.retrying.Delete(key)
+		timer := time.NewTimer(sendRetryBackoff)
+		defer timer.Stop()
+		backoff := sendRetryBackoff
+		for i := 0; i < maxSendRetries; i++ {
+			if i > 0 {
+				backoff *= 2
+				timer.Reset(backoff)
+			}
+			select {
+			case <-timer.C:
+			case <-s.shouldShutdown:
+				return
+			case <-r.withdrawn:
+				return
+			}
+			var err error
+			if !s.announceLate(r, func() { err = s.announceOn(r, intf, ipType) }) {
+				return
+			}
+			if !errors.Is(err, errNotSent) {
+				s.markReady(r)
+				return
+			}
+			if transientProtocols(err) == 0 {
+				return
+			}
+		}
+		log.Printf("[ERR] zeroconf: gave up announcing %s on %s after %d retries", r.entry().ServiceInstanceName(), intf.Name, maxSendRetries)
+	}()
+}
@@ -1,14 +1,14 @@
 package zeroconf
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"os"
-	"runtime"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -19,18 +19,61 @@ import (
 const (
 	// Number of Multicast responses sent for a query message (default: 1 < x < 9)
 	multicastRepetitions = 2
+	// Maximum size of a multicast DNS message, excluding IP and UDP headers
+	// (RFC6762 section 17).
+	maxMessageSize = 9000
+	// Number of probes and their interval, RFC6762 section 8.1
+	defaultProbeCount    = 3
+	defaultProbeInterval = 250 * time.Millisecond
+	// Maximum TTL of records in responses to legacy unicast queries
+	// (RFC6762 section 6.7).
+	legacyTTL = 10
 )
 
+// defaultTTL is the TTL of service records unless set with the TTL option.
+// Changing it affects servers created afterwards only; it is kept for tests,
+// use the TTL option instead.
 var defaultTTL uint32 = 3200
 
+// RFC6762 Section 10 says A/AAAA records SHOULD use TTL of 120s, to account
+// for network interface and IP address changes.
+const defaultAddrTTL uint32 = 120
+
 type serverOpts struct {
-	ttl uint32
+	ttl           uint32
+	addrTTL       uint32
+	restrictANY   bool
+	private       bool
+	requireQU     bool
+	srvTarget     string
+	addrFilter    func(net.IP) bool
+	rateLimit     *tokenBucket
+	pointToPoint  bool
+	loopback      bool
+	dscp          *uint8
+	capture       *Capture
+	probeCount    int
+	probeInterval time.Duration
+	watchHostname bool
+	watchSleep    bool
+	queryLog      *queryLog
+	queriers      *querierTracker
+	onConflict    func(Conflict)
+	onSendError   func(iface net.Interface, err error)
+	cacheGoodbye  bool
+	textProvider  func(e *ServiceEntry, from net.Addr, ifIndex int) []string
+	allowSources  []*net.IPNet
+	denySources   []*net.IPNet
+	typeWarning   func(given, normalized string)
 }
 
 func applyServerOpts(options ...ServerOption) serverOpts {
 	// Apply default configuration and load supplied options.
 	var conf = serverOpts{
-		ttl: defaultTTL,
+		ttl:           defaultTTL,
+		addrTTL:       defaultAddrTTL,
+		probeCount:    defaultProbeCount,
+		probeInterval: defaultProbeInterval,
 	}
 	for _, o := range options {
 		if o != nil {
@@ -43,34 +86,183 @@ func applyServerOpts(options ...ServerOption) serverOpts {
 // ServerOption fills the option struct.
 type ServerOption func(*serverOpts)
 
-// TTL sets the TTL for DNS replies.
+// TTL sets the TTL of the service records, i.e. the PTR, SRV and TXT records
+// and NSEC records of the instance name, 3200 seconds by default. Address
+// records have their own TTL, see AddrTTL, so that fleets with dynamic
+// services may use e.g. TTL(120) for all records, or any other split.
 func TTL(ttl uint32) ServerOption {
 	return func(o *serverOpts) {
 		o.ttl = ttl
 	}
 }
 
-// Register a service by given arguments. This call will take the system's hostname
-// and lookup IP by that hostname.
-func Register(instance, service, domain string, port int, text []string, ifaces []net.Interface, opts ...ServerOption) (*Server, error) {
-	entry := newServiceEntry(instance, service, domain)
-	entry.Port = port
-	entry.Text = text
+// AddrTTL sets the TTL of the host records, i.e. the A and AAAA records and
+// the NSEC record of the host name, which defaults to 120 seconds as
+// recommended by RFC6762 section 10. Hosts with very stable addressing may
+// use longer cache lifetimes.
+func AddrTTL(ttl uint32) ServerOption {
+	return func(o *serverOpts) {
+		o.addrTTL = ttl
+	}
+}
+
+// RestrictANY makes the server ignore questions of type ANY. Only questions
+// for specific record types are answered, which keeps the full record set of
+// a service from being disclosed with a single query.
+func RestrictANY() ServerOption {
+	return func(o *serverOpts) {
+		o.restrictANY = true
+	}
+}
+
+// PrivateResponses keeps the server from multicasting its records: queries
+// are answered by unicast to the querier only, and the services are neither
+// announced nor withdrawn with goodbye packets, so that other hosts on a
+// shared network learn about them only when they ask. If requireQU is set,
+// only questions with the unicast-response bit (QU) and legacy unicast
+// queries are answered. Probes are still multicast to detect name
+// conflicts, and are answered, by unicast, to defend the names.
+func PrivateResponses(requireQU bool) ServerOption {
+	return func(o *serverOpts) {
+		o.private = true
+		o.requireQU = requireQU
+	}
+}
+
+// SRVTarget points the SRV record at the given host instead of the
+// responder's own hostname. The host may live outside the service domain and
+// no A/AAAA records are published for it, which suits proxy and redirector
+// setups where the target is resolved by other means.
+func SRVTarget(host string) ServerOption {
+	return func(o *serverOpts) {
+		o.srvTarget = host
+	}
+}
+
+// WithAddrFilter controls which of the discovered interface addresses get
+// published. Only addresses for which keep returns true are advertised, e.g.
+// to exclude CGNAT, VPN or unique local IPv6 addresses. Addresses passed to
+// RegisterProxy explicitly are not filtered.
+func WithAddrFilter(keep func(net.IP) bool) ServerOption {
+	return func(o *serverOpts) {
+		o.addrFilter = keep
+	}
+}
+
+// AllowSources only answers queries sent from addresses within the given
+// prefixes, e.g. on a host attached to a trusted LAN and an untrusted segment
+// where the service must not be revealed. Packets from other sources are
+// ignored, and the answers are sent by unicast to the querier only. Probes,
+// announcements and goodbyes are multicast on the interfaces with an address
+// within the prefixes only. The option may be repeated; without it, all
+// sources are allowed.
+func AllowSources(prefixes ...*net.IPNet) ServerOption {
+	return func(o *serverOpts) {
+		o.allowSources = append(o.allowSources, prefixes...)
+	}
+}
+
+// DenySources ignores packets sent from addresses within the given
+// prefixes. It takes precedence over AllowSources.
+func DenySources(prefixes ...*net.IPNet) ServerOption {
+	return func(o *serverOpts) {
+		o.denySources = append(o.denySources, prefixes...)
+	}
+}
+
+// ResponseRateLimit caps the multicast responses sent for received queries
+// to perSecond on average, allowing bursts of up to burst responses. This
+// protects low-power devices from being induced to saturate their uplink by
+// misbehaving queriers. Probes, announcements and goodbyes are not limited.
+// Non-positive rates are ignored.
+func ResponseRateLimit(perSecond float64, burst int) ServerOption {
+	return func(o *serverOpts) {
+		if perSecond > 0 {
+			o.rateLimit = newTokenBucket(perSecond, burst)
+		}
+	}
+}
 
-	if entry.Instance == "" {
-		return nil, fmt.Errorf("missing service instance name")
+// IncludePointToPoint makes the server listen on point-to-point interfaces
+// without multicast flag as well, e.g. PPP or WireGuard links, if no
+// interfaces are given explicitly.
+func IncludePointToPoint() ServerOption {
+	return func(o *serverOpts) {
+		o.pointToPoint = true
 	}
-	if entry.Service == "" {
-		return nil, fmt.Errorf("missing service name")
+}
+
+// LoopbackOnly makes the server bind, multicast and publish addresses on the
+// loopback interface only, ignoring the given interfaces. Together with the
+// SelectLoopback client option, this allows end-to-end tests on machines
+// without a usable network.
+func LoopbackOnly() ServerOption {
+	return func(o *serverOpts) {
+		o.loopback = true
 	}
-	if entry.Domain == "" {
-		entry.Domain = "local."
+}
+
+// DSCP marks outgoing packets with the given DSCP value (0-63), so that
+// latency-sensitive deployments can prioritize mDNS traffic according to
+// their QoS policies.
+func DSCP(dscp uint8) ServerOption {
+	return func(o *serverOpts) {
+		o.dscp = &dscp
 	}
-	if entry.Port == 0 {
-		return nil, fmt.Errorf("missing port")
+}
+
+// ProbeCount sets the number of probes sent before a service is announced,
+// 3 by default. More probes make conflict detection more reliable on lossy
+// links at the cost of a later announcement. Non-positive values are ignored.
+func ProbeCount(n int) ServerOption {
+	return func(o *serverOpts) {
+		if n > 0 {
+			o.probeCount = n
+		}
 	}
+}
+
+// ProbeInterval sets the time between probes, 250 milliseconds by default.
+// Links with high latency may need a longer interval to receive conflicting
+// answers in time. Non-positive values are ignored.
+func ProbeInterval(interval time.Duration) ServerOption {
+	return func(o *serverOpts) {
+		if interval > 0 {
+			o.probeInterval = interval
+		}
+	}
+}
+
+// ServerCapture records the packets of a server to the capture, see
+// NewCapture.
+func ServerCapture(c *Capture) ServerOption {
+	return func(o *serverOpts) {
+		o.capture = c
+	}
+}
+
+// Register a service by given arguments. This call will take the system's hostname
+// and lookup IP by that hostname.
+func Register(instance, service, domain string, port int, text []string, ifaces []net.Interface, opts ...ServerOption) (*Server, error) {
+	service = normalizeServiceType(service, applyServerOpts(opts...).typeWarning)
+	entry, err := NewService(instance, service).Domain(domain).Port(port).Text(text...).Build()
+	if err != nil {
+		return nil, err
+	}
+	return RegisterEntry(entry, ifaces, opts...)
+}
+
+// RegisterEntry registers a service built with NewService. Unless the entry
+// has a host name, the system's hostname is used. The addresses are those of
+// the interfaces.
+func RegisterEntry(entry *ServiceEntry, ifaces []net.Interface, opts ...ServerOption) (*Server, error) {
+	if entry == nil {
+		return nil, fmt.Errorf("missing service entry")
+	}
+	conf := applyServerOpts(opts...)
 
 	var err error
+	systemHost := entry.HostName == "" && conf.srvTarget == ""
 	if entry.HostName == "" {
 		entry.HostName, err = os.Hostname()
 		if err != nil {
@@ -78,30 +270,39 @@ func Register(instance, service, domain string, port int, text []string, ifaces
 		}
 	}
 
-	if !strings.HasSuffix(trimDot(entry.HostName), entry.Domain) {
+	if !hasNameSuffix(trimDot(entry.HostName), trimDot(entry.Domain)) {
 		entry.HostName = fmt.Sprintf("%s.%s.", trimDot(entry.HostName), trimDot(entry.Domain))
 	}
+	entry.HostName = presentationName(entry.HostName)
 
-	if len(ifaces) == 0 {
-		ifaces = listMulticastInterfaces()
+	if conf.loopback {
+		ifaces = listLoopbackInterfaces()
+	} else if len(ifaces) == 0 {
+		ifaces = listMulticastInterfaces(conf.pointToPoint)
 	}
 
-	for _, iface := range ifaces {
-		v4, v6 := addrsForInterface(&iface)
+	if conf.srvTarget != "" {
+		entry.HostName = dns.Fqdn(conf.srvTarget)
+	} else {
+		v4, v6 := hostAddrs(ifaces, conf.loopback, conf.addrFilter)
 		entry.AddrIPv4 = append(entry.AddrIPv4, v4...)
 		entry.AddrIPv6 = append(entry.AddrIPv6, v6...)
-	}
 
-	if entry.AddrIPv4 == nil && entry.AddrIPv6 == nil {
-		return nil, fmt.Errorf("could not determine host IP addresses")
+		if entry.AddrIPv4 == nil && entry.AddrIPv6 == nil {
+			return nil, fmt.Errorf("could not determine host IP addresses")
+		}
 	}
 
-	s, err := newServer(ifaces, applyServerOpts(opts...))
+	s, err := newServer(ifaces, conf)
 	if err != nil {
 		return nil, err
 	}
+	s.interfaceAddrs = conf.srvTarget == ""
 
-	s.service = entry
+	if conf.watchHostname && systemHost {
+		s.hostDomain = entry.Domain
+	}
+	s.addRegistration(newRegistration(entry))
 	s.start()
 
 	return s, nil
@@ -110,30 +311,25 @@ func Register(instance, service, domain string, port int, text []string, ifaces
 // RegisterProxy registers a service proxy. This call will skip the hostname/IP lookup and
 // will use the provided values.
 func RegisterProxy(instance, service, domain string, port int, host string, ips []string, text []string, ifaces []net.Interface, opts ...ServerOption) (*Server, error) {
-	entry := newServiceEntry(instance, service, domain)
-	entry.Port = port
-	entry.Text = text
-	entry.HostName = host
-
-	if entry.Instance == "" {
-		return nil, fmt.Errorf("missing service instance name")
-	}
-	if entry.Service == "" {
-		return nil, fmt.Errorf("missing service name")
-	}
-	if entry.HostName == "" {
+	if host == "" {
 		return nil, fmt.Errorf("missing host name")
 	}
-	if entry.Domain == "" {
-		entry.Domain = "local"
+	if domain == "" {
+		domain = "local"
 	}
-	if entry.Port == 0 {
-		return nil, fmt.Errorf("missing port")
+	conf := applyServerOpts(opts...)
+	service = normalizeServiceType(service, conf.typeWarning)
+	entry, err := NewService(instance, service).Domain(domain).Host(host).Port(port).Text(text...).Build()
+	if err != nil {
+		return nil, err
 	}
 
-	if !strings.HasSuffix(trimDot(entry.HostName), entry.Domain) {
+	if conf.srvTarget != "" {
+		entry.HostName = dns.Fqdn(conf.srvTarget)
+	} else if !hasNameSuffix(trimDot(entry.HostName), trimDot(entry.Domain)) {
 		entry.HostName = fmt.Sprintf("%s.%s.", trimDot(entry.HostName), trimDot(entry.Domain))
 	}
+	entry.HostName = presentationName(entry.HostName)
 
 	for _, ip := range ips {
 		ipAddr := net.ParseIP(ip)
@@ -148,16 +344,18 @@ func RegisterProxy(instance, service, domain string, port int, host string, ips
 		}
 	}
 
-	if len(ifaces) == 0 {
-		ifaces = listMulticastInterfaces()
+	if conf.loopback {
+		ifaces = listLoopbackInterfaces()
+	} else if len(ifaces) == 0 {
+		ifaces = listMulticastInterfaces(conf.pointToPoint)
 	}
 
-	s, err := newServer(ifaces, applyServerOpts(opts...))
+	s, err := newServer(ifaces, conf)
 	if err != nil {
 		return nil, err
 	}
 
-	s.service = entry
+	s.addRegistration(newRegistration(entry))
 	s.start()
 
 	return s, nil
@@ -169,25 +367,67 @@ const (
 
 // Server structure encapsulates both IPv4/IPv6 UDP connections
 type Server struct {
-	service  *ServiceEntry
-	ipv4conn *ipv4.PacketConn
-	ipv6conn *ipv6.PacketConn
-	ifaces   []net.Interface
+	services     atomic.Pointer[serviceSet]
+	servicesLock sync.Mutex           // serializes updates of the services
+	senders      map[int]*ifaceSender // by interface index
+	switchLock   sync.Mutex           // guards the multicast interface setting
+	ifaceTable   ifaceTable
+	ipv4conn     *ipv4.PacketConn
+	ipv6conn     *ipv6.PacketConn
+	ifaces       []net.Interface
+	ipv4ifaces   []net.Interface
+	ipv6ifaces   []net.Interface
 
 	shouldShutdown chan struct{}
+	done           chan struct{}
+	ready          chan struct{}
+	readyOnce      sync.Once
 	shutdownLock   sync.Mutex
 	refCount       sync.WaitGroup
 	isShutdown     bool
+	goodbyeLock    sync.RWMutex // guards goodbyeSent, see announceLate
+	goodbyeSent    bool
 	ttl            uint32
+	addrTTL        uint32
+	restrictANY    bool
+	private        bool
+	requireQU      bool
+	publishAddrs   bool
+	interfaceAddrs bool // the addresses of the services are those of the interfaces, see Resume
+	loopback       bool // loopback addresses are published, see LoopbackOnly
+	addrFilter     func(net.IP) bool
+	sent           *packetFilter
+	rateLimit      *tokenBucket
+	throttle       *recordThrottle
+	answered       atomic.Uint64
+	sendErrors     atomic.Uint64
+	rateLimited    atomic.Uint64
+	capture        *Capture
+	queryLog       *queryLog
+	queriers       *querierTracker
+	onConflict     func(Conflict)
+	onSendError    func(iface net.Interface, err error)
+	cacheGoodbye   bool
+	textProvider   func(e *ServiceEntry, from net.Addr, ifIndex int) []string
+	allowSources   []*net.IPNet
+	denySources    []*net.IPNet
+	trusted        atomic.Pointer[map[int]bool] // interfaces with an allowed address, nil if all are
+	typeWarning    func(given, normalized string)
+	goodbyePackets atomic.Pointer[[]goodbyePacket]
+	probeCount     int
+	probeInterval  time.Duration
+	host           *ServiceEntry // primary service before Unregister, guarded by servicesLock
+	hostDomain     string        // domain of the host name following the system's hostname, if watched
+	resumeOnWake   bool          // see WatchSleep
 }
 
 // Constructs server structure
 func newServer(ifaces []net.Interface, opts serverOpts) (*Server, error) {
-	ipv4conn, err4 := joinUdp4Multicast(ifaces)
+	ipv4conn, ipv4ifaces, err4 := joinUdp4Multicast(ifaces)
 	if err4 != nil {
 		log.Printf("[zeroconf] no suitable IPv4 interface: %s", err4.Error())
 	}
-	ipv6conn, err6 := joinUdp6Multicast(ifaces)
+	ipv6conn, ipv6ifaces, err6 := joinUdp6Multicast(ifaces)
 	if err6 != nil {
 		log.Printf("[zeroconf] no suitable IPv6 interface: %s", err6.Error())
 	}
@@ -195,19 +435,51 @@ func newServer(ifaces []net.Interface, opts serverOpts) (*Server, error) {
 		// No supported interface left.
 		return nil, fmt.Errorf("no supported interface")
 	}
+	if opts.dscp != nil {
+		setDSCP(ipv4conn, ipv6conn, *opts.dscp)
+	}
 
 	s := &Server{
 		ipv4conn:       ipv4conn,
 		ipv6conn:       ipv6conn,
 		ifaces:         ifaces,
+		ipv4ifaces:     ipv4ifaces,
+		ipv6ifaces:     ipv6ifaces,
 		ttl:            opts.ttl,
+		addrTTL:        opts.addrTTL,
+		restrictANY:    opts.restrictANY,
+		private:        opts.private,
+		requireQU:      opts.requireQU,
+		publishAddrs:   opts.srvTarget == "",
+		addrFilter:     opts.addrFilter,
+		rateLimit:      opts.rateLimit,
+		throttle:       newRecordThrottle(),
+		capture:        opts.capture,
+		queryLog:       opts.queryLog,
+		queriers:       opts.queriers,
+		onConflict:     opts.onConflict,
+		onSendError:    opts.onSendError,
+		resumeOnWake:   opts.watchSleep,
+		cacheGoodbye:   opts.cacheGoodbye,
+		textProvider:   opts.textProvider,
+		allowSources:   opts.allowSources,
+		denySources:    opts.denySources,
+		typeWarning:    opts.typeWarning,
+		probeCount:     opts.probeCount,
+		probeInterval:  opts.probeInterval,
 		shouldShutdown: make(chan struct{}),
+		done:           make(chan struct{}),
+		ready:          make(chan struct{}),
+		sent:           newPacketFilter(ifaces),
+		loopback:       opts.loopback,
 	}
+	s.refreshTrusted()
 
 	return s, nil
 }
 
 func (s *Server) start() {
+	s.startSenders()
 	if s.ipv4conn != nil {
 		s.refCount.Add(1)
 		go s.recv4(s.ipv4conn)
@@ -217,13 +489,85 @@ func (s *Server) start() {
 		go s.recv6(s.ipv6conn)
 	}
 	s.refCount.Add(1)
-	go s.probe()
+	go s.probe(s.primary())
+	if s.hostDomain != "" {
+		go s.watchHostname()
+	}
+	if s.resumeOnWake {
+		go s.watchSleep()
+	}
+}
+
+// Service returns a copy of the entry advertised for the service the server
+// was created with, i.e. with the qualified host name and the addresses
+// discovered on the interfaces. It returns nil after Unregister until the
+// next Reregister.
+func (s *Server) Service() *ServiceEntry {
+	r := s.primary()
+	if r == nil {
+		return nil
+	}
+	return cloneEntry(r.entry())
+}
+
+// Services returns copies of the entries of all services published by the
+// server, starting with the one it was created with.
+func (s *Server) Services() []*ServiceEntry {
+	regs := s.registrations()
+	entries := make([]*ServiceEntry, 0, len(regs))
+	for _, r := range regs {
+		entries = append(entries, cloneEntry(r.entry()))
+	}
+	return entries
+}
+
+// cloneEntry returns a deep copy of an entry, which callers may modify.
+func cloneEntry(e *ServiceEntry) *ServiceEntry {
+	c := *e
+	c.Subtypes = append([]string(nil), e.Subtypes...)
+	c.Text = append([]string(nil), e.Text...)
+	c.TextSets = nil
+	for _, set := range e.TextSets {
+		c.TextSets = append(c.TextSets, append([]string(nil), set...))
+	}
+	c.Targets = append([]SRVRecord(nil), e.Targets...)
+	c.AddrIPv4 = cloneIPs(e.AddrIPv4)
+	c.AddrIPv6 = cloneIPs(e.AddrIPv6)
+	c.canonicalSubtypes = append([]string(nil), e.canonicalSubtypes...)
+	return &c
+}
+
+// cloneIPs copies the addresses, including their bytes.
+func cloneIPs(ips []net.IP) []net.IP {
+	if ips == nil {
+		return nil
+	}
+	c := make([]net.IP, len(ips))
+	for i, ip := range ips {
+		c[i] = append(net.IP(nil), ip...)
+	}
+	return c
 }
 
-// SetText updates and announces the TXT records
+// SetText updates and announces the TXT records. It has no effect while the
+// server is unregistered or shut down.
 func (s *Server) SetText(text []string) {
-	s.service.Text = text
-	s.announceText()
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if s.isShutdown {
+		return
+	}
+
+	s.servicesLock.Lock()
+	r := s.primary()
+	if r == nil {
+		s.servicesLock.Unlock()
+		return
+	}
+	r.update(func(e *ServiceEntry) { e.Text = text })
+	s.refreshGoodbye()
+	s.servicesLock.Unlock()
+	s.announceUpdate(r)
 }
 
 // TTL sets the TTL for DNS replies
@@ -241,6 +585,11 @@ func (s *Server) Shutdown() {
 		return
 	}
 
+	// Wait for the announcements in progress, and keep later ones from
+	// following the goodbyes.
+	s.goodbyeLock.Lock()
+	s.goodbyeSent = true
+	s.goodbyeLock.Unlock()
 	if err := s.unregister(); err != nil {
 		log.Printf("failed to unregister: %s", err)
 	}
@@ -257,6 +606,23 @@ func (s *Server) Shutdown() {
 	// Wait for connection and routines to be closed
 	s.refCount.Wait()
 	s.isShutdown = true
+	close(s.done)
+}
+
+// Done returns a channel that is closed once the server has shut down, i.e.
+// the goodbye packets are sent and all goroutines have exited. It allows to
+// wait for the completion of a Shutdown called elsewhere.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Ready returns a channel that is closed once the service the server was
+// created with has been probed and its announcement was sent on at least one
+// interface, i.e. other hosts can discover it. Send errors are logged and
+// counted in Status; while the announcements fail on all interfaces, the
+// channel stays open. It is never closed if the server shuts down before.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
 }
 
 // recv4 is a long running routine to receive packets from an interface
@@ -279,6 +645,7 @@ func (s *Server) recv4(c *ipv4.PacketConn) {
 			if cm != nil {
 				ifIndex = cm.IfIndex
 			}
+			s.capture.received(buf[:n], ifIndex, from)
 			_ = s.parsePacket(buf[:n], ifIndex, from)
 		}
 	}
@@ -304,13 +671,28 @@ func (s *Server) recv6(c *ipv6.PacketConn) {
 			if cm != nil {
 				ifIndex = cm.IfIndex
 			}
+			s.capture.received(buf[:n], ifIndex, from)
 			_ = s.parsePacket(buf[:n], ifIndex, from)
 		}
 	}
 }
 
+// newResponse creates an unsolicited response message. RFC 6762 section 18
+// requires the QR and AA bits to be set and the ID, Opcode and RD to be zero.
+func newResponse() *dns.Msg {
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Authoritative = true
+	resp.RecursionDesired = false
+	return resp
+}
+
 // parsePacket is used to parse an incoming packet
 func (s *Server) parsePacket(packet []byte, ifIndex int, from net.Addr) error {
+	// Skip our own multicast packets looped back by the kernel.
+	if s.sent.isOwn(packet, from) {
+		return nil
+	}
 	var msg dns.Msg
 	if err := msg.Unpack(packet); err != nil {
 		// log.Printf("[ERR] zeroconf: Failed to unpack packet: %v", err)
@@ -321,14 +703,36 @@ func (s *Server) parsePacket(packet []byte, ifIndex int, from net.Addr) error {
 
 // handleQuery is used to handle an incoming query
 func (s *Server) handleQuery(query *dns.Msg, ifIndex int, from net.Addr) error {
-	// Ignore questions with authoritative section for now
-	if len(query.Ns) > 0 {
+	s.queryLog.add(query, false, from, ifIndex, nil)
+	if !s.allowedSource(from) {
 		return nil
 	}
+	s.checkConflicts(query, from)
+
+	// Probes carry the proposed records in the authority section. Of their
+	// questions, only those for the instance names of announced services
+	// are answered, so that the prober detects the conflict.
+	probe := len(query.Ns) > 0
+	if !probe && s.queriers != nil && s.queriesServices(query, ifIndex) {
+		s.queriers.observe(from, time.Now())
+	}
+
+	// Queries not sent from the mDNS port come from simple resolvers, e.g.
+	// dig or one-shot queriers, which expect a unicast DNS response.
+	legacy := isLegacyQuery(from)
 
 	// Handle each question
 	var err error
 	for _, q := range query.Question {
+		if probe && !s.defends(q, ifIndex) {
+			continue
+		}
+		// In private mode, all answers are unicast, see PrivateResponses,
+		// as are those to allowed sources, see AllowSources.
+		unicast := isUnicastQuestion(q) || s.private || len(s.allowSources) > 0
+		if s.requireQU && !legacy && !probe && !isUnicastQuestion(q) {
+			continue
+		}
 		resp := dns.Msg{}
 		resp.SetReply(query)
 		resp.Compress = true
@@ -337,24 +741,51 @@ func (s *Server) handleQuery(query *dns.Msg, ifIndex int, from net.Addr) error {
 		resp.Question = nil // RFC6762 section 6 "responses MUST NOT contain any questions"
 		resp.Answer = []dns.RR{}
 		resp.Extra = []dns.RR{}
-		if err = s.handleQuestion(q, &resp, query, ifIndex); err != nil {
-			// log.Printf("[ERR] zeroconf: failed to handle question %v: %v", q, err)
+		if e := s.handleQuestion(q, &resp, query, ifIndex, from); e != nil {
+			// log.Printf("[ERR] zeroconf: failed to handle question %v: %v", q, e)
+			err = errors.Join(err, e)
 			continue
 		}
+		// Probes are answered right away, RFC6762 section 6.
+		throttled := !legacy && !probe && !unicast
+		if throttled {
+			s.throttle.filter(&resp, ifIndex, time.Now())
+		}
 		// Check if there is an answer
 		if len(resp.Answer) == 0 {
 			continue
 		}
+		if legacy {
+			legacyResponse(&resp, q)
+		}
+		if opt := query.IsEdns0(); opt != nil {
+			limitResponseSize(&resp, opt.UDPSize())
+		}
 
-		if isUnicastQuestion(q) {
+		if legacy {
+			s.answered.Add(1)
+			if e := s.unicastResponse(&resp, ifIndex, from); e != nil {
+				err = errors.Join(err, e)
+			}
+			continue
+		}
+		if !unicast && !s.rateLimit.allow() {
+			s.rateLimited.Add(1)
+			continue
+		}
+		s.answered.Add(1)
+		if unicast {
 			// Send unicast
 			if e := s.unicastResponse(&resp, ifIndex, from); e != nil {
-				err = e
+				err = errors.Join(err, e)
 			}
 		} else {
 			// Send mulicast
-			if e := s.multicastResponse(&resp, ifIndex); e != nil {
-				err = e
+			if e := s.multicastResponse(&resp, ifIndex, IPv4AndIPv6); e != nil {
+				err = errors.Join(err, e)
+			}
+			if throttled {
+				s.throttle.add(&resp, ifIndex, time.Now())
 			}
 		}
 	}
@@ -362,6 +793,114 @@ func (s *Server) handleQuery(query *dns.Msg, ifIndex int, from net.Addr) error {
 	return err
 }
 
+// refreshTrusted finds the interfaces with an allowed address, see
+// AllowSources.
+func (s *Server) refreshTrusted() {
+	if trusted := trustedIfaces(s.ifaces, s.allowSources); trusted != nil {
+		s.trusted.Store(&trusted)
+	}
+}
+
+// trustedIfaces returns the interfaces with an address within the prefixes,
+// or nil if there are no prefixes.
+func trustedIfaces(ifaces []net.Interface, prefixes []*net.IPNet) map[int]bool {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	trusted := make(map[int]bool)
+	for _, intf := range ifaces {
+		addrs, err := intf.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			for _, p := range prefixes {
+				if p.Contains(ipnet.IP) {
+					trusted[intf.Index] = true
+				}
+			}
+		}
+	}
+	return trusted
+}
+
+// multicastsOn reports whether unsolicited packets may be multicast on the
+// interface, see AllowSources.
+func (s *Server) multicastsOn(ifIndex int) bool {
+	trusted := s.trusted.Load()
+	return trusted == nil || (*trusted)[ifIndex]
+}
+
+// allowedSource reports whether packets from the address are handled
+// according to the AllowSources and DenySources options.
+func (s *Server) allowedSource(from net.Addr) bool {
+	if len(s.allowSources) == 0 && len(s.denySources) == 0 {
+		return true
+	}
+	addr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return len(s.allowSources) == 0
+	}
+	for _, p := range s.denySources {
+		if p.Contains(addr.IP) {
+			return false
+		}
+	}
+	if len(s.allowSources) == 0 {
+		return true
+	}
+	for _, p := range s.allowSources {
+		if p.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLegacyQuery reports whether a query was sent from a port other than the
+// mDNS port, RFC6762 section 6.7.
+func isLegacyQuery(from net.Addr) bool {
+	addr, ok := from.(*net.UDPAddr)
+	return ok && addr.Port != ipv4Addr.Port
+}
+
+// legacyResponse turns a response into one for a legacy unicast query: it
+// repeats the question, caps the TTLs and clears the cache flush bits, which
+// a conventional resolver would take for an unknown class.
+func legacyResponse(resp *dns.Msg, q dns.Question) {
+	resp.Question = []dns.Question{q}
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > legacyTTL {
+				hdr.Ttl = legacyTTL
+			}
+			hdr.Class &^= qClassCacheFlush
+		}
+	}
+}
+
+// limitResponseSize honors the UDP payload size advertised by the querier
+// via EDNS0. The response carries an OPT record itself and records which do
+// not fit are dropped, setting the TC bit.
+func limitResponseSize(resp *dns.Msg, udpSize uint16) {
+	if udpSize < dns.MinMsgSize {
+		udpSize = dns.MinMsgSize
+	}
+	if udpSize > maxMessageSize {
+		udpSize = maxMessageSize
+	}
+	resp.SetEdns0(udpSize, false)
+	resp.Truncate(int(udpSize))
+}
+
 // RFC6762 7.1. Known-Answer Suppression
 func isKnownAnswer(resp *dns.Msg, query *dns.Msg) bool {
 	if len(resp.Answer) == 0 || len(query.Answer) == 0 {
@@ -379,7 +918,7 @@ func isKnownAnswer(resp *dns.Msg, query *dns.Msg) bool {
 			continue
 		}
 		ptr := known.(*dns.PTR)
-		if ptr.Ptr == answer.Ptr && hdr.Ttl >= answer.Hdr.Ttl/2 {
+		if equalNames(ptr.Ptr, answer.Ptr) && hdr.Ttl >= answer.Hdr.Ttl/2 {
 			// log.Printf("skipping known answer: %v", ptr)
 			return true
 		}
@@ -388,84 +927,213 @@ func isKnownAnswer(resp *dns.Msg, query *dns.Msg) bool {
 	return false
 }
 
-// handleQuestion is used to handle an incoming question
-func (s *Server) handleQuestion(q dns.Question, resp *dns.Msg, query *dns.Msg, ifIndex int) error {
-	if s.service == nil {
-		return nil
+// suppressKnownAnswers removes every PTR answer the querier already knows
+// about. Unlike isKnownAnswer it handles responses carrying several PTRs,
+// e.g. for service type enumeration.
+func suppressKnownAnswers(resp *dns.Msg, query *dns.Msg) {
+	if len(query.Answer) == 0 {
+		return
 	}
-
-	switch q.Name {
-	case s.service.ServiceTypeName():
-		s.serviceTypeName(resp, s.ttl)
-		if isKnownAnswer(resp, query) {
-			resp.Answer = nil
+	answers := resp.Answer[:0]
+	for _, rr := range resp.Answer {
+		if ptr, ok := rr.(*dns.PTR); !ok || !isKnownPTR(ptr, query) {
+			answers = append(answers, rr)
 		}
+	}
+	resp.Answer = answers
+}
 
-	case s.service.ServiceName():
-		s.composeBrowsingAnswers(resp, ifIndex)
-		if isKnownAnswer(resp, query) {
-			resp.Answer = nil
+func isKnownPTR(answer *dns.PTR, query *dns.Msg) bool {
+	for _, known := range query.Answer {
+		ptr, ok := known.(*dns.PTR)
+		if !ok || !equalNames(ptr.Hdr.Name, answer.Hdr.Name) {
+			continue
 		}
+		if equalNames(ptr.Ptr, answer.Ptr) && ptr.Hdr.Ttl >= answer.Hdr.Ttl/2 {
+			return true
+		}
+	}
+	return false
+}
 
-	case s.service.ServiceInstanceName():
-		s.composeLookupAnswers(resp, s.ttl, ifIndex, false)
-	default:
-		// handle matching subtype query
-		for _, subtype := range s.service.Subtypes {
-			subtype = fmt.Sprintf("%s._sub.%s", subtype, s.service.ServiceName())
-			if q.Name == subtype {
-				s.composeBrowsingAnswers(resp, ifIndex)
-				if isKnownAnswer(resp, query) {
-					resp.Answer = nil
-				}
+// handleQuestion is used to handle an incoming question
+func (s *Server) handleQuestion(q dns.Question, resp *dns.Msg, query *dns.Msg, ifIndex int, from net.Addr) error {
+	if q.Qtype == dns.TypeANY && s.restrictANY {
+		return nil
+	}
+	isPTR := q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY
+
+	name := dns.CanonicalName(q.Name)
+	regs := s.registrationsFor(name, ifIndex)
+	var enumerated, answeredHost bool
+	for _, r := range regs {
+		e := r.entry()
+		// Compose the answers for each service separately, so that known
+		// answer suppression does not affect the other services.
+		part := dns.Msg{}
+		switch name {
+		case e.canonicalTypeName:
+			if !isPTR || enumerated {
+				break
+			}
+			// All services of this domain are enumerated at once.
+			s.serviceTypeName(&part, s.ttl, e.ServiceTypeName(), regs)
+			suppressKnownAnswers(&part, query)
+			enumerated = true
+
+		case e.canonicalName:
+			if !isPTR {
+				break
+			}
+			s.composeBrowsingAnswers(e, &part, ifIndex)
+			if isKnownAnswer(&part, query) {
+				part.Answer = nil
+			}
+
+		case e.canonicalInstanceName:
+			s.composeInstanceAnswers(e, &part, q.Qtype, ifIndex)
+		case dns.CanonicalName(e.HostName):
+			if answeredHost {
 				break
 			}
+			s.composeHostAnswers(e, &part, q.Qtype, ifIndex)
+			answeredHost = true
+		default:
+			if !isPTR {
+				break
+			}
+			// handle matching subtype query
+			for _, subtype := range e.canonicalSubtypes {
+				if name == subtype {
+					s.composeBrowsingAnswers(e, &part, ifIndex)
+					if isKnownAnswer(&part, query) {
+						part.Answer = nil
+					}
+					break
+				}
+			}
 		}
+		if len(part.Answer) > 0 {
+			s.provideText(e, &part, from, ifIndex)
+			resp.Answer = append(resp.Answer, part.Answer...)
+			resp.Extra = append(resp.Extra, part.Extra...)
+		}
+	}
+	if len(regs) > 1 {
+		// Services of the same host share their address records.
+		resp.Extra = dns.Dedup(resp.Extra, nil)
 	}
 
 	return nil
 }
 
-func (s *Server) composeBrowsingAnswers(resp *dns.Msg, ifIndex int) {
-	ptr := &dns.PTR{
+// composeInstanceAnswers answers a question for the service instance name
+// with the records of the requested type. ANY questions receive the full
+// record set.
+func (s *Server) composeInstanceAnswers(e *ServiceEntry, resp *dns.Msg, qtype uint16, ifIndex int) {
+	txt := txtRecords(e, s.ttl, dns.ClassINET|qClassCacheFlush)
+	switch qtype {
+	case dns.TypeANY:
+		s.composeLookupAnswers(e, resp, s.ttl, ifIndex, false)
+	case dns.TypeSRV:
+		srv := &dns.SRV{
+			Hdr: dns.RR_Header{
+				Name:   e.ServiceInstanceName(),
+				Rrtype: dns.TypeSRV,
+				Class:  dns.ClassINET | qClassCacheFlush,
+				Ttl:    s.ttl,
+			},
+			Priority: uint16(e.Priority),
+			Weight:   uint16(e.Weight),
+			Port:     uint16(e.Port),
+			Target:   e.HostName,
+		}
+		resp.Answer = append(resp.Answer, srv)
+		// RFC6763 12.2: the addresses of the target host are recommended
+		// additional records. The TXT record saves the resolver another query.
+		resp.Extra = append(resp.Extra, txt...)
+		resp.Extra = s.appendAddrs(e, resp.Extra, s.ttl, ifIndex, false)
+	case dns.TypeTXT:
+		resp.Answer = append(resp.Answer, txt...)
+	default:
+		resp.Answer = append(resp.Answer, newNSEC(e.ServiceInstanceName(), s.ttl, dns.TypeTXT, dns.TypeSRV))
+	}
+}
+
+// composeHostAnswers answers a question for the host name of the service
+// with its A and AAAA records. If the requested type is not published, an
+// NSEC record asserts which types exist, so the querier stops retrying.
+func (s *Server) composeHostAnswers(e *ServiceEntry, resp *dns.Msg, qtype uint16, ifIndex int) {
+	addrs := s.appendAddrs(e, nil, s.ttl, ifIndex, true)
+	if len(addrs) == 0 {
+		// The addresses are not ours to publish.
+		return
+	}
+	var types []uint16
+	for _, rr := range addrs {
+		rrtype := rr.Header().Rrtype
+		if qtype == dns.TypeANY || rrtype == qtype {
+			resp.Answer = append(resp.Answer, rr)
+		} else {
+			// RFC6762 6.2: the other address type is added as additional record.
+			resp.Extra = append(resp.Extra, rr)
+		}
+		if len(types) == 0 || types[len(types)-1] != rrtype {
+			types = append(types, rrtype)
+		}
+	}
+	if len(resp.Answer) == 0 {
+		resp.Answer = append(resp.Answer, newNSEC(e.HostName, addrs[0].Header().Ttl, types...))
+	}
+}
+
+// newNSEC creates a record asserting that name owns records of the given
+// types only (RFC6762 section 6.1). The types have to be in ascending order.
+func newNSEC(name string, ttl uint32, types ...uint16) *dns.NSEC {
+	return &dns.NSEC{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceName(),
-			Rrtype: dns.TypePTR,
-			Class:  dns.ClassINET,
-			Ttl:    s.ttl,
+			Name:   name,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET | qClassCacheFlush,
+			Ttl:    ttl,
 		},
-		Ptr: s.service.ServiceInstanceName(),
+		NextDomain: name,
+		TypeBitMap: types,
 	}
-	resp.Answer = append(resp.Answer, ptr)
+}
 
-	txt := &dns.TXT{
+func (s *Server) composeBrowsingAnswers(e *ServiceEntry, resp *dns.Msg, ifIndex int) {
+	ptr := &dns.PTR{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
-			Rrtype: dns.TypeTXT,
+			Name:   e.ServiceName(),
+			Rrtype: dns.TypePTR,
 			Class:  dns.ClassINET,
 			Ttl:    s.ttl,
 		},
-		//Txt: s.service.Text,
-		Txt: s.service.TxtRecords(),
+		Ptr: e.ServiceInstanceName(),
 	}
+	resp.Answer = append(resp.Answer, ptr)
+
+	txt := txtRecords(e, s.ttl, dns.ClassINET)
 	srv := &dns.SRV{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
+			Name:   e.ServiceInstanceName(),
 			Rrtype: dns.TypeSRV,
 			Class:  dns.ClassINET,
 			Ttl:    s.ttl,
 		},
-		Priority: 0,
-		Weight:   0,
-		Port:     uint16(s.service.Port),
-		Target:   s.service.HostName,
+		Priority: uint16(e.Priority),
+		Weight:   uint16(e.Weight),
+		Port:     uint16(e.Port),
+		Target:   e.HostName,
 	}
-	resp.Extra = append(resp.Extra, srv, txt)
+	resp.Extra = append(resp.Extra, srv)
+	resp.Extra = append(resp.Extra, txt...)
 
-	resp.Extra = s.appendAddrs(resp.Extra, s.ttl, ifIndex, false)
+	resp.Extra = s.appendAddrs(e, resp.Extra, s.ttl, ifIndex, false)
 }
 
-func (s *Server) composeLookupAnswers(resp *dns.Msg, ttl uint32, ifIndex int, flushCache bool) {
+func (s *Server) composeLookupAnswers(e *ServiceEntry, resp *dns.Msg, ttl uint32, ifIndex int, flushCache bool) {
 	// From RFC6762
 	//    The most significant bit of the rrclass for a record in the Answer
 	//    Section of a response message is the Multicast DNS cache-flush bit
@@ -473,47 +1141,40 @@ func (s *Server) composeLookupAnswers(resp *dns.Msg, ttl uint32, ifIndex int, fl
 	//    to Flush Outdated Cache Entries".
 	ptr := &dns.PTR{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceName(),
+			Name:   e.ServiceName(),
 			Rrtype: dns.TypePTR,
 			Class:  dns.ClassINET,
 			Ttl:    ttl,
 		},
-		Ptr: s.service.ServiceInstanceName(),
+		Ptr: e.ServiceInstanceName(),
 	}
 	srv := &dns.SRV{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
+			Name:   e.ServiceInstanceName(),
 			Rrtype: dns.TypeSRV,
 			Class:  dns.ClassINET | qClassCacheFlush,
 			Ttl:    ttl,
 		},
-		Priority: 0,
-		Weight:   0,
-		Port:     uint16(s.service.Port),
-		Target:   s.service.HostName,
-	}
-	txt := &dns.TXT{
-		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
-			Rrtype: dns.TypeTXT,
-			Class:  dns.ClassINET | qClassCacheFlush,
-			Ttl:    ttl,
-		},
-		//Txt: s.service.Text,
-		Txt: s.service.TxtRecords(),
+		Priority: uint16(e.Priority),
+		Weight:   uint16(e.Weight),
+		Port:     uint16(e.Port),
+		Target:   e.HostName,
 	}
+	txt := txtRecords(e, ttl, dns.ClassINET|qClassCacheFlush)
 	dnssd := &dns.PTR{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceTypeName(),
+			Name:   e.ServiceTypeName(),
 			Rrtype: dns.TypePTR,
 			Class:  dns.ClassINET,
 			Ttl:    ttl,
 		},
-		Ptr: s.service.ServiceName(),
+		Ptr: e.ServiceName(),
 	}
-	resp.Answer = append(resp.Answer, srv, txt, ptr, dnssd)
+	resp.Answer = append(resp.Answer, srv)
+	resp.Answer = append(resp.Answer, txt...)
+	resp.Answer = append(resp.Answer, ptr, dnssd)
 
-	for _, subtype := range s.service.Subtypes {
+	for _, subtype := range e.Subtypes {
 		resp.Answer = append(resp.Answer,
 			&dns.PTR{
 				Hdr: dns.RR_Header{
@@ -522,14 +1183,14 @@ func (s *Server) composeLookupAnswers(resp *dns.Msg, ttl uint32, ifIndex int, fl
 					Class:  dns.ClassINET,
 					Ttl:    ttl,
 				},
-				Ptr: s.service.ServiceInstanceName(),
+				Ptr: e.ServiceInstanceName(),
 			})
 	}
 
-	resp.Answer = s.appendAddrs(resp.Answer, ttl, ifIndex, flushCache)
+	resp.Answer = s.appendAddrs(e, resp.Answer, ttl, ifIndex, flushCache)
 }
 
-func (s *Server) serviceTypeName(resp *dns.Msg, ttl uint32) {
+func (s *Server) serviceTypeName(resp *dns.Msg, ttl uint32, typeName string, regs []*registration) {
 	// From RFC6762
 	// 9.  Service Type Enumeration
 	//
@@ -538,50 +1199,55 @@ func (s *Server) serviceTypeName(resp *dns.Msg, ttl uint32) {
 	//    set of PTR records, where the rdata of each PTR record is the two-
 	//    label <Service> name, plus the same domain, e.g.,
 	//    "_http._tcp.<Domain>".
-	dnssd := &dns.PTR{
-		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceTypeName(),
-			Rrtype: dns.TypePTR,
-			Class:  dns.ClassINET,
-			Ttl:    ttl,
-		},
-		Ptr: s.service.ServiceName(),
+	//
+	// Subtype names are advertised as well, so that browsers enumerating the
+	// network learn about them without knowing them in advance.
+	seen := make(map[string]bool)
+	for _, r := range regs {
+		if !matchName(r.entry().canonicalTypeName, typeName) {
+			continue
+		}
+		for _, name := range append([]string{r.entry().ServiceName()}, r.entry().Subtypes...) {
+			if seen[dns.CanonicalName(name)] {
+				continue
+			}
+			seen[dns.CanonicalName(name)] = true
+			resp.Answer = append(resp.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{
+					Name:   typeName,
+					Rrtype: dns.TypePTR,
+					Class:  dns.ClassINET,
+					Ttl:    ttl,
+				},
+				Ptr: name,
+			})
+		}
 	}
-	resp.Answer = append(resp.Answer, dnssd)
 }
 
 // Perform probing & announcement
-// TODO: implement a proper probing & conflict resolution
-func (s *Server) probe() {
+// TODO: resolve host name conflicts and tiebreak simultaneous probes
+func (s *Server) probe(r *registration) {
+	e := r.entry()
 	defer s.refCount.Done()
 
 	q := new(dns.Msg)
-	q.SetQuestion(s.service.ServiceInstanceName(), dns.TypePTR)
+	q.SetQuestion(e.ServiceInstanceName(), dns.TypeANY)
 	q.RecursionDesired = false
 
 	srv := &dns.SRV{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
+			Name:   e.ServiceInstanceName(),
 			Rrtype: dns.TypeSRV,
 			Class:  dns.ClassINET,
 			Ttl:    s.ttl,
 		},
-		Priority: 0,
-		Weight:   0,
-		Port:     uint16(s.service.Port),
-		Target:   s.service.HostName,
-	}
-	txt := &dns.TXT{
-		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
-			Rrtype: dns.TypeTXT,
-			Class:  dns.ClassINET,
-			Ttl:    s.ttl,
-		},
-		//Txt: s.service.Text,
-		Txt: s.service.TxtRecords(),
+		Priority: uint16(e.Priority),
+		Weight:   uint16(e.Weight),
+		Port:     uint16(e.Port),
+		Target:   e.HostName,
 	}
-	q.Ns = []dns.RR{srv, txt}
+	q.Ns = append([]dns.RR{srv}, txtRecords(e, s.ttl, dns.ClassINET)...)
 
 	// Wait for a random duration uniformly distributed between 0 and 250 ms
 	// before sending the first probe packet.
@@ -591,16 +1257,23 @@ func (s *Server) probe() {
 	case <-timer.C:
 	case <-s.shouldShutdown:
 		return
+	case <-r.withdrawn:
+		return
 	}
-	for i := 0; i < 3; i++ {
-		if err := s.multicastResponse(q, 0); err != nil {
-			log.Println("[ERR] zeroconf: failed to send probe:", err.Error())
+	for i := 0; i < s.probeCount; i++ {
+		if err := s.multicastVisible(r, q); err != nil {
+			logSendError("probe", err)
 		}
-		timer.Reset(250 * time.Millisecond)
+		timer.Reset(s.probeInterval)
 		select {
 		case <-timer.C:
 		case <-s.shouldShutdown:
 			return
+		case <-r.withdrawn:
+			return
+		case peer := <-r.conflict:
+			s.resolveConflict(r, peer)
+			return
 		}
 	}
 
@@ -610,80 +1283,193 @@ func (s *Server) probe() {
 	//    packet loss, a responder MAY send up to eight unsolicited responses,
 	//    provided that the interval between unsolicited responses increases by
 	//    at least a factor of two with every response sent.
+	r.progress.setState(ServiceAnnouncing)
 	timeout := time.Second
 	for i := 0; i < multicastRepetitions; i++ {
-		for _, intf := range s.ifaces {
-			resp := new(dns.Msg)
-			resp.MsgHdr.Response = true
-			// TODO: make response authoritative if we are the publisher
-			resp.Compress = true
-			resp.Answer = []dns.RR{}
-			resp.Extra = []dns.RR{}
-			s.composeLookupAnswers(resp, s.ttl, intf.Index, true)
-			if err := s.multicastResponse(resp, intf.Index); err != nil {
-				log.Println("[ERR] zeroconf: failed to send announcement:", err.Error())
+		if i > 0 {
+			timer.Reset(timeout)
+			select {
+			case <-timer.C:
+			case <-s.shouldShutdown:
+				return
+			case <-r.withdrawn:
+				return
 			}
+			timeout *= 2
 		}
-		timer.Reset(timeout)
-		select {
-		case <-timer.C:
-		case <-s.shouldShutdown:
-			return
+		sent := false
+		if s.announceLate(r, func() { sent = s.announce(r) }) && sent {
+			s.markReady(r)
 		}
-		timeout *= 2
 	}
+	r.progress.setState(ServiceAnnounced)
 }
 
-// announceText sends a Text announcement with cache flush enabled
-func (s *Server) announceText() {
-	resp := new(dns.Msg)
-	resp.MsgHdr.Response = true
+// markReady closes the channel returned by Ready once the service the server
+// was created with is announced.
+func (s *Server) markReady(r *registration) {
+	if r == s.primary() {
+		s.readyOnce.Do(func() { close(s.ready) })
+	}
+}
 
-	/*
-		txt := &dns.TXT{
-			Hdr: dns.RR_Header{
-				Name:   s.service.ServiceInstanceName(),
-				Rrtype: dns.TypeTXT,
-				Class:  dns.ClassINET | qClassCacheFlush,
-				Ttl:    s.ttl,
-			},
-			//Txt: s.service.Text,
-			Txt: s.service.TxtRecords(),
+// announce sends an unsolicited response with the current records of a
+// service, with cache flush enabled, on each interface it is visible on, and
+// reports whether it was sent on at least one of them. Announcements failing
+// for a transient reason are retried, see retryAnnouncement. Private servers
+// only record the announcement.
+func (s *Server) announce(r *registration) bool {
+	sent := s.private
+	for _, intf := range s.ifaces {
+		if !r.visibleOn(intf.Index) || s.private {
+			continue
+		}
+		err := s.announceOn(r, intf, IPv4AndIPv6)
+		if !errors.Is(err, errNotSent) {
+			sent = true
+		}
+		if err == nil {
+			continue
 		}
+		// Sends right after resuming from sleep fail until the network is
+		// back, the announcement is repeated then with the protocols which
+		// failed, e.g. IPv4 while IPv6 already works.
+		for _, ipType := range []IPType{IPv4, IPv6} {
+			if transientProtocols(err)&ipType != 0 {
+				s.retryAnnouncement(r, intf, ipType)
+			}
+		}
+		logSendError("announcement", err)
+	}
+	r.progress.announced(time.Now())
+	return sent
+}
+
+// announceOn sends an unsolicited response with the current records of a
+// service on the interface, with the given protocols.
+func (s *Server) announceOn(r *registration, intf net.Interface, ipType IPType) error {
+	resp := newResponse()
+	resp.Compress = true
+	resp.Answer = []dns.RR{}
+	resp.Extra = []dns.RR{}
+	s.composeLookupAnswers(r.entry(), resp, s.ttl, intf.Index, true)
+	return s.multicastResponse(resp, intf.Index, ipType)
+}
 
-		resp.Answer = s.appendAddrs([]dns.RR{txt}, s.ttl, 0, true)
-	*/
+// txtRecords returns the TXT records of the entry: the one of Text, which is
+// always present, followed by one per further set of TextSets. An empty set
+// is published as a single empty string, as TXT records must not have empty
+// rdata, RFC6763 section 6.1.
+func txtRecords(e *ServiceEntry, ttl uint32, class uint16) []dns.RR {
+	hdr := dns.RR_Header{
+		Name:   e.ServiceInstanceName(),
+		Rrtype: dns.TypeTXT,
+		Class:  class,
+		Ttl:    ttl,
+	}
+	txtRecord := func(txt []string) dns.RR {
+		if len(txt) == 0 {
+			txt = []string{""}
+		}
+		return &dns.TXT{Hdr: hdr, Txt: txt}
+	}
+	rrs := []dns.RR{txtRecord(e.TxtRecords())}
+	for _, set := range e.TextSets {
+		var txt []string
+		for _, t := range set {
+			txt = append(txt, chunks(t, 255)...)
+		}
+		rrs = append(rrs, txtRecord(txt))
+	}
+	return rrs
+}
 
-	s.composeBrowsingAnswers(resp, 0)
+// announceUpdate announces the changed records of a service like a new
+// one, RFC6762 section 8.4: the full record set is sent with cache flush
+// enabled twice, one second apart, so that caches replace the outdated TXT
+// records and keep the addresses. A further change within the second
+// supersedes the repetition.
+func (s *Server) announceUpdate(r *registration) {
+	if s.private {
+		return
+	}
+	s.announce(r)
+	update := r.updates.Add(1)
+	s.refCount.Add(1)
+	go func() {
+		defer s.refCount.Done()
+		timer := time.NewTimer(time.Second)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-s.shouldShutdown:
+			return
+		case <-r.withdrawn:
+			return
+		}
+		if r.updates.Load() == update {
+			s.announceLate(r, func() { s.announce(r) })
+		}
+	}()
+}
 
-	s.multicastResponse(resp, 0)
+// announceLate runs send, which announces the service from a routine of the
+// server, unless the service is withdrawn or Shutdown sent the goodbyes, so
+// that the goodbyes are not followed by an announcement. It reports whether
+// send ran.
+func (s *Server) announceLate(r *registration, send func()) bool {
+	s.goodbyeLock.RLock()
+	defer s.goodbyeLock.RUnlock()
+	select {
+	case <-r.withdrawn:
+		return false
+	default:
+	}
+	if s.goodbyeSent {
+		return false
+	}
+	send()
+	return true
 }
 
 func (s *Server) unregister() error {
-	resp := new(dns.Msg)
-	resp.MsgHdr.Response = true
-	resp.Answer = []dns.RR{}
-	resp.Extra = []dns.RR{}
-	s.composeLookupAnswers(resp, 0, 0, true)
-	return s.multicastResponse(resp, 0)
+	return s.goodbye(s.registrations())
 }
 
-func (s *Server) appendAddrs(list []dns.RR, ttl uint32, ifIndex int, flushCache bool) []dns.RR {
-	v4 := s.service.AddrIPv4
-	v6 := s.service.AddrIPv6
-	if len(v4) == 0 && len(v6) == 0 {
-		iface, _ := net.InterfaceByIndex(ifIndex)
-		if iface != nil {
-			a4, a6 := addrsForInterface(iface)
-			v4 = append(v4, a4...)
-			v6 = append(v6, a6...)
+// goodbye sends goodbye packets, responses with a TTL of zero, for the
+// services, unless the server is private.
+func (s *Server) goodbye(regs []*registration) error {
+	if s.private {
+		return nil
+	}
+	var err error
+	for _, r := range regs {
+		resp := newResponse()
+		resp.Answer = []dns.RR{}
+		resp.Extra = []dns.RR{}
+		s.composeLookupAnswers(r.entry(), resp, 0, 0, true)
+		if e := s.multicastVisible(r, resp); e != nil {
+			err = errors.Join(err, e)
 		}
 	}
+	return err
+}
+
+func (s *Server) appendAddrs(e *ServiceEntry, list []dns.RR, ttl uint32, ifIndex int, flushCache bool) []dns.RR {
+	if !s.publishAddrs {
+		// The SRV target is not ours to publish addresses for.
+		return list
+	}
+	v4 := e.AddrIPv4
+	v6 := e.AddrIPv6
+	if len(v4) == 0 && len(v6) == 0 {
+		a4, a6 := s.ifaceTable.lookup(ifIndex)
+		v4 = filterAddrs(a4, s.addrFilter)
+		v6 = filterAddrs(a6, s.addrFilter)
+	}
 	if ttl > 0 {
-		// RFC6762 Section 10 says A/AAAA records SHOULD
-		// use TTL of 120s, to account for network interface
-		// and IP address changes.
-		ttl = 120
+		// Address records have their own TTL, see AddrTTL.
+		ttl = s.addrTTL
 	}
 	var cacheFlushBit uint16
 	if flushCache {
@@ -692,7 +1478,7 @@ func (s *Server) appendAddrs(list []dns.RR, ttl uint32, ifIndex int, flushCache
 	for _, ipv4 := range v4 {
 		a := &dns.A{
 			Hdr: dns.RR_Header{
-				Name:   s.service.HostName,
+				Name:   e.HostName,
 				Rrtype: dns.TypeA,
 				Class:  dns.ClassINET | cacheFlushBit,
 				Ttl:    ttl,
@@ -704,7 +1490,7 @@ func (s *Server) appendAddrs(list []dns.RR, ttl uint32, ifIndex int, flushCache
 	for _, ipv6 := range v6 {
 		aaaa := &dns.AAAA{
 			Hdr: dns.RR_Header{
-				Name:   s.service.HostName,
+				Name:   e.HostName,
 				Rrtype: dns.TypeAAAA,
 				Class:  dns.ClassINET | cacheFlushBit,
 				Ttl:    ttl,
@@ -716,16 +1502,28 @@ func (s *Server) appendAddrs(list []dns.RR, ttl uint32, ifIndex int, flushCache
 	return list
 }
 
-func addrsForInterface(iface *net.Interface) ([]net.IP, []net.IP) {
+// hostAddrs returns the addresses of the interfaces to be published.
+func hostAddrs(ifaces []net.Interface, loopback bool, filter func(net.IP) bool) (v4, v6 []net.IP) {
+	for _, iface := range ifaces {
+		a4, a6 := addrsForInterface(&iface, loopback)
+		v4 = append(v4, filterAddrs(a4, filter)...)
+		v6 = append(v6, filterAddrs(a6, filter)...)
+	}
+	return v4, v6
+}
+
+// addrsForInterface returns the IPv4 and IPv6 addresses of an interface to
+// be published. Loopback addresses are skipped unless requested.
+func addrsForInterface(iface *net.Interface, loopback bool) ([]net.IP, []net.IP) {
 	var v4, v6, v6local []net.IP
 	addrs, _ := iface.Addrs()
 	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+		if ipnet, ok := address.(*net.IPNet); ok && (loopback || !ipnet.IP.IsLoopback()) {
 			if ipnet.IP.To4() != nil {
 				v4 = append(v4, ipnet.IP)
 			} else {
 				switch ip := ipnet.IP.To16(); ip != nil {
-				case ip.IsGlobalUnicast():
+				case ip.IsGlobalUnicast(), ip.IsLoopback():
 					v6 = append(v6, ipnet.IP)
 				case ip.IsLinkLocalUnicast():
 					v6local = append(v6local, ipnet.IP)
@@ -739,136 +1537,136 @@ func addrsForInterface(iface *net.Interface) ([]net.IP, []net.IP) {
 	return v4, v6
 }
 
+// filterAddrs returns the addresses accepted by keep. A nil filter accepts
+// all addresses.
+func filterAddrs(ips []net.IP, keep func(net.IP) bool) []net.IP {
+	if keep == nil {
+		return ips
+	}
+	var kept []net.IP
+	for _, ip := range ips {
+		if keep(ip) {
+			kept = append(kept, ip)
+		}
+	}
+	return kept
+}
+
 // unicastResponse is used to send a unicast response packet
 func (s *Server) unicastResponse(resp *dns.Msg, ifIndex int, from net.Addr) error {
 	buf, err := resp.Pack()
 	if err != nil {
 		return err
 	}
+	s.sent.add(buf)
 	addr := from.(*net.UDPAddr)
+	defer func() { s.queryLog.add(resp, true, addr, ifIndex, err) }()
 	if addr.IP.To4() != nil {
-		if ifIndex != 0 {
-			var wcm ipv4.ControlMessage
-			wcm.IfIndex = ifIndex
-			_, err = s.ipv4conn.WriteTo(buf, &wcm, addr)
+		if err = (ipv4GroupConn{s.ipv4conn}).writeTo(buf, ifIndex, addr); err != nil {
+			s.sendFailed(ifIndex, fmt.Errorf("udp4: %w", err))
 		} else {
-			_, err = s.ipv4conn.WriteTo(buf, nil, addr)
+			s.capture.sent(buf, ifIndex, addr)
 		}
 		return err
 	} else {
-		if ifIndex != 0 {
-			var wcm ipv6.ControlMessage
-			wcm.IfIndex = ifIndex
-			_, err = s.ipv6conn.WriteTo(buf, &wcm, addr)
+		if err = (ipv6GroupConn{s.ipv6conn}).writeTo(buf, ifIndex, addr); err != nil {
+			s.sendFailed(ifIndex, fmt.Errorf("udp6: %w", err))
 		} else {
-			_, err = s.ipv6conn.WriteTo(buf, nil, addr)
+			s.capture.sent(buf, ifIndex, addr)
 		}
 		return err
 	}
 }
 
-// multicastResponse is used to send a multicast response packet
-func (s *Server) multicastResponse(msg *dns.Msg, ifIndex int) error {
-	buf, err := msg.Pack()
-	if err != nil {
-		return fmt.Errorf("failed to pack msg %v: %w", msg, err)
+// multicastResponse is used to send a multicast response packet with the
+// given protocols on the given interface, or on all interfaces if ifIndex is
+// 0.
+func (s *Server) multicastResponse(msg *dns.Msg, ifIndex int, ipType IPType) error {
+	if ifIndex == 0 {
+		return s.multicastOn(msg, s.ifaces, 0, ipType)
 	}
-	if s.ipv4conn != nil {
-		// See https://pkg.go.dev/golang.org/x/net/ipv4#pkg-note-BUG
-		// As of Golang 1.18.4
-		// On Windows, the ControlMessage for ReadFrom and WriteTo methods of PacketConn is not implemented.
-		var wcm ipv4.ControlMessage
-		if ifIndex != 0 {
-			switch runtime.GOOS {
-			case "darwin", "ios", "linux":
-				wcm.IfIndex = ifIndex
-			case "windows":
-				iface, _ := net.InterfaceByIndex(ifIndex)
-				if iface.Name == "Teredo Tunneling Pseudo-Interface" {
-					//log.Println("Skipping Teredo interface on windows")
-				} else {
-					if err := s.ipv4conn.SetMulticastInterface(iface); err != nil {
-						log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", iface.Name, err)
-					}
-				}
-			default:
-				iface, _ := net.InterfaceByIndex(ifIndex)
-				if err := s.ipv4conn.SetMulticastInterface(iface); err != nil {
-					log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", iface.Name, err)
-				}
-			}
-			s.ipv4conn.WriteTo(buf, &wcm, ipv4Addr)
-		} else {
-			for _, intf := range s.ifaces {
-				switch runtime.GOOS {
-				case "darwin", "ios", "linux":
-					wcm.IfIndex = intf.Index
-				case "windows":
-					if intf.Name == "Teredo Tunneling Pseudo-Interface" {
-						//log.Println("Skipping Teredo interface on windows")
-					} else {
-						if err := s.ipv4conn.SetMulticastInterface(&intf); err != nil {
-							log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", intf.Name, err)
-						}
-					}
-				default:
-					if err := s.ipv4conn.SetMulticastInterface(&intf); err != nil {
-						log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", intf.Name, err)
-					}
-				}
-				s.ipv4conn.WriteTo(buf, &wcm, ipv4Addr)
-			}
+	for _, intf := range s.ifaces {
+		if intf.Index == ifIndex {
+			return s.multicastOn(msg, []net.Interface{intf}, ifIndex, ipType)
 		}
 	}
+	return errors.Join(fmt.Errorf("no sender for interface %d", ifIndex), errNotSent)
+}
 
-	if s.ipv6conn != nil {
-		// See https://pkg.go.dev/golang.org/x/net/ipv6#pkg-note-BUG
-		// As of Golang 1.18.4
-		// On Windows, the ControlMessage for ReadFrom and WriteTo methods of PacketConn is not implemented.
-		var wcm ipv6.ControlMessage
-		if ifIndex != 0 {
-			switch runtime.GOOS {
-			case "darwin", "ios", "linux":
-				wcm.IfIndex = ifIndex
-			case "windows":
-				iface, _ := net.InterfaceByIndex(ifIndex)
-				if iface.Name == "Teredo Tunneling Pseudo-Interface" {
-					//log.Println("Skipping Teredo interface on windows")
-				} else {
-					if err := s.ipv4conn.SetMulticastInterface(iface); err != nil {
-						log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", iface.Name, err)
-					}
-				}
-			default:
-				iface, _ := net.InterfaceByIndex(ifIndex)
-				if err := s.ipv6conn.SetMulticastInterface(iface); err != nil {
-					log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", iface.Name, err)
-				}
-			}
-			s.ipv6conn.WriteTo(buf, &wcm, ipv6Addr)
-		} else {
-			for _, intf := range s.ifaces {
-				switch runtime.GOOS {
-				case "darwin", "ios", "linux":
-					wcm.IfIndex = intf.Index
-				case "windows":
-					if intf.Name == "Teredo Tunneling Pseudo-Interface" {
-						//log.Println("Skipping Teredo interface on windows")
-					} else {
-						if err := s.ipv4conn.SetMulticastInterface(&intf); err != nil {
-							log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", intf.Name, err)
-						}
-					}
-				default:
-					if err := s.ipv6conn.SetMulticastInterface(&intf); err != nil {
-						log.Printf("[WARN] mdns: Failed to set multicast interface %s: %v", intf.Name, err)
-					}
-				}
-				s.ipv6conn.WriteTo(buf, &wcm, ipv6Addr)
+// multicastVisible sends a multicast message on all interfaces the
+// registration is visible on.
+func (s *Server) multicastVisible(r *registration, msg *dns.Msg) error {
+	if r.ifaces == nil {
+		return s.multicastOn(msg, s.ifaces, 0, IPv4AndIPv6)
+	}
+	var ifaces []net.Interface
+	for _, intf := range s.ifaces {
+		if r.visibleOn(intf.Index) {
+			ifaces = append(ifaces, intf)
+		}
+	}
+	ifIndex := 0
+	if len(ifaces) == 1 {
+		ifIndex = ifaces[0].Index
+	}
+	return s.multicastOn(msg, ifaces, ifIndex, IPv4AndIPv6)
+}
+
+// logSendError logs a failure to send a packet, as an error if the packet
+// was sent nowhere and as a warning if it was sent on some interfaces or
+// with one protocol only.
+func logSendError(kind string, err error) {
+	if errors.Is(err, errNotSent) {
+		log.Printf("[ERR] zeroconf: failed to send %s: %v", kind, err)
+		return
+	}
+	log.Printf("[WARN] zeroconf: failed to send %s on some interfaces: %v", kind, err)
+}
+
+// errNotSent marks the errors of multicast packets which were sent on no
+// interface at all, so that the service stays invisible.
+var errNotSent = errors.New("packet not sent")
+
+// multicastOn hands the packet to the senders of the interfaces, for the
+// given protocols. The returned error joins the failures of each interface
+// and protocol: a packet sent on some of them only still returns an error,
+// and if it was sent on none, the error matches errNotSent. The message is
+// logged with ifIndex. Interfaces without an allowed address are skipped,
+// see AllowSources.
+func (s *Server) multicastOn(msg *dns.Msg, ifaces []net.Interface, ifIndex int, ipType IPType) error {
+	if s.trusted.Load() != nil {
+		var allowed []net.Interface
+		for _, intf := range ifaces {
+			if s.multicastsOn(intf.Index) {
+				allowed = append(allowed, intf)
 			}
 		}
+		if len(allowed) == 0 {
+			// Nothing is revealed on untrusted interfaces.
+			return nil
+		}
+		ifaces = allowed
 	}
-	return nil
+	buf, err := msg.Pack()
+	if err != nil {
+		return fmt.Errorf("failed to pack msg %v: %w", msg, err)
+	}
+	s.sent.add(buf)
+	defer func() { s.queryLog.add(msg, true, nil, ifIndex, err) }()
+	var errs []error
+	sent := false
+	for _, intf := range ifaces {
+		ok, err := s.senders[intf.Index].send(buf, ipType)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", intf.Name, err))
+		}
+		sent = sent || ok
+	}
+	if !sent {
+		errs = append(errs, errNotSent)
+	}
+	err = errors.Join(errs...)
+	return err
 }
 
 func isUnicastQuestion(q dns.Question) bool {
@@ -3,8 +3,13 @@ package zeroconf
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 // ServiceRecord contains the basic description of a service, which contains instance name, service type & domain
@@ -18,6 +23,12 @@ type ServiceRecord struct {
 	serviceName         string
 	serviceInstanceName string
 	serviceTypeName     string
+
+	// canonical (lower case) names for matching received names
+	canonicalName         string
+	canonicalInstanceName string
+	canonicalTypeName     string
+	canonicalSubtypes     []string
 }
 
 // ServiceName returns a complete service name (e.g. _foobar._tcp.local.), which is composed
@@ -53,7 +64,7 @@ func newServiceRecord(instance, service string, domain string) *ServiceRecord {
 
 	// Cache service instance name
 	if instance != "" {
-		s.serviceInstanceName = fmt.Sprintf("%s.%s", trimDot(s.Instance), s.ServiceName())
+		s.serviceInstanceName = fmt.Sprintf("%s.%s", escapeLabel(s.Instance), s.ServiceName())
 	}
 
 	// Cache service type name domain
@@ -63,28 +74,101 @@ func newServiceRecord(instance, service string, domain string) *ServiceRecord {
 	}
 	s.serviceTypeName = fmt.Sprintf("_services._dns-sd._udp.%s.", typeNameDomain)
 
+	s.canonicalName = dns.CanonicalName(s.serviceName)
+	s.canonicalTypeName = dns.CanonicalName(s.serviceTypeName)
+	if s.serviceInstanceName != "" {
+		s.canonicalInstanceName = dns.CanonicalName(s.serviceInstanceName)
+	}
+	for _, subtype := range s.Subtypes {
+		s.canonicalSubtypes = append(s.canonicalSubtypes, dns.CanonicalName(subtype))
+	}
+
 	return s
 }
 
+// ServiceFQDN returns the fully qualified name of a service type, e.g.
+// "_http._tcp.local." for "_http._tcp" in the domain "local", which is the
+// default. It is the owner name of the PTR records of the instances.
+func ServiceFQDN(service, domain string) string {
+	return newServiceRecord("", fqdnServiceType(service), fqdnDomain(domain)).ServiceName()
+}
+
+// InstanceFQDN returns the fully qualified name of a service instance, e.g.
+// "My\ Printer._ipp._tcp.local." for "My Printer" of "_ipp._tcp" in the
+// domain "local", which is the default. The instance label is escaped as in
+// the names of received records. It is the owner name of the SRV and TXT
+// records of the instance.
+func InstanceFQDN(instance, service, domain string) string {
+	return newServiceRecord(instance, fqdnServiceType(service), fqdnDomain(domain)).ServiceInstanceName()
+}
+
+// SubtypeFQDN returns the fully qualified name of a subtype of a service
+// type, e.g. "_printer._sub._http._tcp.local." for "_printer" of "_http._tcp"
+// in the domain "local", which is the default. Browsing it finds the
+// instances announced for the subtype.
+func SubtypeFQDN(subtype, service, domain string) string {
+	return newServiceRecord("", fqdnServiceType(service)+","+subtype, fqdnDomain(domain)).Subtypes[0]
+}
+
+// ServiceTypeEnumName returns the name queried to enumerate the service
+// types of the domain, "_services._dns-sd._udp.local." by default, RFC 6763
+// section 9.
+func ServiceTypeEnumName(domain string) string {
+	return newServiceRecord("", fqdnServiceType(""), fqdnDomain(domain)).ServiceTypeName()
+}
+
+// fqdnServiceType drops the subtypes of a service type passed to the name
+// helpers, which expect the type without domain like the other functions.
+func fqdnServiceType(service string) string {
+	service, _ = parseSubtypes(service)
+	return service
+}
+
+func fqdnDomain(domain string) string {
+	if trimDot(domain) == "" {
+		return "local"
+	}
+	return domain
+}
+
 // lookupParams contains configurable properties to create a service discovery request
 type lookupParams struct {
 	ServiceRecord
 	Entries chan<- *ServiceEntry // Entries Channel
 
-	isBrowsing  bool
+	isBrowsing bool
+	// Closed once a lookup is resolved, replaced after a network change
+	probingLock sync.Mutex
 	stopProbing chan struct{}
-	once        sync.Once
+	probing     bool
+	// Signal a network change to the query scheduler and the main loop
+	restart    chan struct{}
+	flushCache chan struct{}
+	// Shared cache of a Resolver, if any
+	cache *entryCache
+	// Called for entries removed by a goodbye, if set
+	removed func(e *ServiceEntry)
+	// Set once a record of the lookup is received
+	answered atomic.Bool
+	// Passive browse of all service types, see Promiscuous
+	promiscuous bool
 }
 
-// newLookupParams constructs a lookupParams.
+// newLookupParams constructs a lookupParams. The domain defaults to "local".
 func newLookupParams(instance, service, domain string, isBrowsing bool, entries chan<- *ServiceEntry) *lookupParams {
+	if domain == "" {
+		domain = "local"
+	}
 	p := &lookupParams{
 		ServiceRecord: *newServiceRecord(instance, service, domain),
 		Entries:       entries,
 		isBrowsing:    isBrowsing,
+		restart:       make(chan struct{}, 1),
+		flushCache:    make(chan struct{}, 1),
 	}
 	if !isBrowsing {
 		p.stopProbing = make(chan struct{})
+		p.probing = true
 	}
 	return p
 }
@@ -96,7 +180,55 @@ func (l *lookupParams) done() {
 }
 
 func (l *lookupParams) disableProbing() {
-	l.once.Do(func() { close(l.stopProbing) })
+	l.probingLock.Lock()
+	defer l.probingLock.Unlock()
+	if l.probing {
+		l.probing = false
+		close(l.stopProbing)
+	}
+}
+
+// probingStopped returns the channel closed once the lookup is resolved.
+func (l *lookupParams) probingStopped() <-chan struct{} {
+	l.probingLock.Lock()
+	defer l.probingLock.Unlock()
+	return l.stopProbing
+}
+
+// resumeProbing makes a resolved lookup query again until it is resolved
+// anew.
+func (l *lookupParams) resumeProbing() {
+	l.probingLock.Lock()
+	defer l.probingLock.Unlock()
+	if l.stopProbing != nil && !l.probing {
+		l.stopProbing = make(chan struct{})
+		l.probing = true
+	}
+}
+
+// networkChanged makes the main loop forget the delivered entries, so that
+// the answers on the new network are delivered again, and restarts the query
+// schedule.
+func (l *lookupParams) networkChanged() {
+	l.forget()
+	l.resumeProbing()
+	l.restartQueries()
+}
+
+// forget makes the main loop forget the delivered entries.
+func (l *lookupParams) forget() {
+	select {
+	case l.flushCache <- struct{}{}:
+	default:
+	}
+}
+
+// restartQueries restarts the query schedule.
+func (l *lookupParams) restartQueries() {
+	select {
+	case l.restart <- struct{}{}:
+	default:
+	}
 }
 
 // ServiceEntry represents a browse/lookup result for client API.
@@ -104,13 +236,18 @@ func (l *lookupParams) disableProbing() {
 // used to answer multicast queries.
 type ServiceEntry struct {
 	ServiceRecord
-	HostName   string    `json:"hostname"` // Host machine DNS name
-	Port       int       `json:"port"`     // Service Port
-	Text       []string  `json:"text"`     // Service info served as a TXT record
-	Expiry     time.Time `json:"expiry"`   // Expiry of the service entry, will be converted to a TTL value
-	AddrIPv4   []net.IP  `json:"-"`        // Host machine IPv4 address
-	AddrIPv6   []net.IP  `json:"-"`        // Host machine IPv6 address
-	CacheFlush bool      `json:"-"`
+	HostName   string      `json:"hostname"`           // Host machine DNS name
+	Port       int         `json:"port"`               // Service Port
+	Priority   int         `json:"priority,omitempty"` // SRV priority of HostName and Port, lower is preferred
+	Weight     int         `json:"weight,omitempty"`   // SRV weight of HostName and Port among the same priority
+	Targets    []SRVRecord `json:"targets,omitempty"`  // Further SRV records received for the instance, see SRVRecords
+	Text       []string    `json:"text"`               // Service info served as a TXT record
+	TextSets   [][]string  `json:"textSets,omitempty"` // Further TXT records of the instance, one per set
+	Expiry     time.Time   `json:"expiry"`             // Expiry of the service entry, will be converted to a TTL value
+	AddrIPv4   []net.IP    `json:"-"`                  // Host machine IPv4 address
+	AddrIPv6   []net.IP    `json:"-"`                  // Host machine IPv6 address
+	CacheFlush bool        `json:"-"`
+	Cached     bool        `json:"-"` // Delivered from the cache of a Resolver
 }
 
 func (s *ServiceEntry) TxtRecords() []string {
@@ -124,6 +261,43 @@ func (s *ServiceEntry) TxtRecords() []string {
 	return txtRecords
 }
 
+// maxStringTXT is the number of TXT strings shown by ServiceEntry.String.
+const maxStringTXT = 4
+
+// String describes the entry in one line for logging, e.g.
+//
+//	My printer._ipp._tcp.local. at printer.local.:631 [192.168.1.20] txt=[rp=printers/1 ty=Laser]
+func (s *ServiceEntry) String() string {
+	var b strings.Builder
+	b.WriteString(s.ServiceInstanceName())
+	if s.ServiceInstanceName() == "" {
+		b.WriteString(s.ServiceName())
+	}
+	if s.HostName != "" {
+		fmt.Fprintf(&b, " at %s", net.JoinHostPort(s.HostName, strconv.Itoa(s.Port)))
+	}
+	addrs := make([]string, 0, len(s.AddrIPv4)+len(s.AddrIPv6))
+	for _, ip := range s.AddrIPv4 {
+		addrs = append(addrs, ip.String())
+	}
+	for _, ip := range s.AddrIPv6 {
+		addrs = append(addrs, ip.String())
+	}
+	if len(addrs) > 0 {
+		fmt.Fprintf(&b, " [%s]", strings.Join(addrs, " "))
+	}
+	if len(s.Text) > 0 {
+		text := s.Text
+		more := ""
+		if len(text) > maxStringTXT {
+			more = fmt.Sprintf(" +%d", len(text)-maxStringTXT)
+			text = text[:maxStringTXT]
+		}
+		fmt.Fprintf(&b, " txt=[%s%s]", strings.Join(text, " "), more)
+	}
+	return b.String()
+}
+
 // newServiceEntry constructs a ServiceEntry.
 func newServiceEntry(instance, service string, domain string) *ServiceEntry {
 	return &ServiceEntry{
@@ -2,9 +2,19 @@ package zeroconf
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 var (
@@ -191,3 +201,908 @@ func TestSubtype(t *testing.T) {
 		}
 	})
 }
+
+func TestLoopback(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0", "lo=1", "la=2"}, nil, LoopbackOnly())
+	if err != nil {
+		t.Fatalf("error while registering mdns service: %s", err)
+	}
+	t.Cleanup(server.Shutdown)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	entries := make(chan *ServiceEntry, 100)
+	if err := Browse(ctx, mdnsService, mdnsDomain, entries, SelectLoopback()); err != nil {
+		t.Fatalf("Expected browse success, but got %v", err)
+	}
+	<-ctx.Done()
+
+	if len(entries) == 0 {
+		t.Fatalf("Expected service entries, but got none")
+	}
+	result := <-entries
+	if result.Instance != mdnsName {
+		t.Fatalf("Expected instance is %s, but got %s", mdnsName, result.Instance)
+	}
+	for _, ip := range append(result.AddrIPv4, result.AddrIPv6...) {
+		if !ip.IsLoopback() {
+			t.Fatalf("Expected loopback addresses only, but got %s", ip)
+		}
+	}
+}
+
+func TestPeriodicQuery(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil, LoopbackOnly(), QueryLog(100))
+	if err != nil {
+		t.Fatalf("error while registering mdns service: %s", err)
+	}
+	t.Cleanup(server.Shutdown)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	entries := make(chan *ServiceEntry, 100)
+	if err := Browse(ctx, mdnsService, mdnsDomain, entries, SelectLoopback(), SelectIPTraffic(IPv4), PeriodicQuery(), QueryInterval(100*time.Millisecond)); err != nil {
+		t.Fatalf("Expected browse success, but got %v", err)
+	}
+	<-ctx.Done()
+
+	question := mdnsService + "." + mdnsDomain + " PTR"
+	var times []time.Time
+	for _, e := range server.RecentQueries() {
+		if !e.Sent && !e.Response && len(e.Records) == 1 && e.Records[0] == question {
+			times = append(times, e.Time)
+		}
+	}
+	// The first query, then the scheduled ones after 100ms, 200-250ms and
+	// 400-625ms.
+	if len(times) < 4 {
+		t.Fatalf("Expected at least 4 browse queries, but got %d", len(times))
+	}
+	for i := 2; i < len(times); i++ {
+		prev, gap := times[i-1].Sub(times[i-2]), times[i].Sub(times[i-1])
+		if gap < 2*prev-50*time.Millisecond {
+			t.Fatalf("Expected query interval %d to at least double %v, but got %v", i, prev, gap)
+		}
+	}
+}
+
+func TestAllowSources(t *testing.T) {
+	querier := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5353}
+	tests := []struct {
+		name      string
+		allow     string
+		multicast bool // the loopback interface, 127.0.0.1, is trusted
+		answered  bool // the querier is allowed
+	}{
+		{name: "allowed querier", allow: "127.0.0.2/32", multicast: false, answered: true},
+		{name: "ignored querier", allow: "127.0.0.1/32", multicast: true, answered: false},
+		{name: "trusted network", allow: "127.0.0.0/8", multicast: true, answered: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, allow, _ := net.ParseCIDR(tt.allow)
+			server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil, LoopbackOnly(), AllowSources(allow), QueryLog(100))
+			if err != nil {
+				t.Fatalf("error while registering mdns service: %s", err)
+			}
+			t.Cleanup(server.Shutdown)
+			time.Sleep(500 * time.Millisecond) // let the server probe
+
+			query := new(dns.Msg)
+			query.SetQuestion(mdnsService+"."+mdnsDomain, dns.TypePTR)
+			query.RecursionDesired = false
+			if err := server.handleQuery(query, server.ifaces[0].Index, querier); err != nil {
+				t.Logf("handling the query: %v", err)
+			}
+
+			var multicast, unicast int
+			for _, e := range server.RecentQueries() {
+				switch {
+				case e.Sent && e.Addr == nil:
+					multicast++
+				case e.Sent:
+					unicast++
+				}
+			}
+			if tt.multicast != (multicast > 0) {
+				t.Fatalf("Expected multicast %v, but got %d packets", tt.multicast, multicast)
+			}
+			if tt.answered != (unicast > 0) {
+				t.Fatalf("Expected a unicast answer %v, but got %d", tt.answered, unicast)
+			}
+		})
+	}
+}
+
+func TestRecordThrottle(t *testing.T) {
+	rr := func(name string, rrtype uint16) dns.RR {
+		return &dns.ANY{Hdr: dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: 120}}
+	}
+	instance := mdnsName + "." + mdnsService + "." + mdnsDomain
+	start := time.Now()
+	throttle := newRecordThrottle()
+	sent := new(dns.Msg)
+	sent.Answer = []dns.RR{rr(mdnsService+"."+mdnsDomain, dns.TypePTR)}
+	sent.Extra = []dns.RR{rr(instance, dns.TypeSRV)}
+	throttle.add(sent, 1, start)
+
+	tests := []struct {
+		name    string
+		ifIndex int
+		after   time.Duration
+		kept    int
+	}{
+		{name: "within the interval", ifIndex: 1, after: 500 * time.Millisecond, kept: 1},
+		{name: "other interface", ifIndex: 2, after: 500 * time.Millisecond, kept: 3},
+		{name: "after the interval", ifIndex: 1, after: multicastRecordInterval, kept: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := new(dns.Msg)
+			resp.Answer = []dns.RR{rr(instance, dns.TypeSRV), rr(instance, dns.TypeTXT)}
+			resp.Extra = []dns.RR{rr(mdnsService+"."+mdnsDomain, dns.TypePTR)}
+			throttle.filter(resp, tt.ifIndex, start.Add(tt.after))
+			if kept := len(resp.Answer) + len(resp.Extra); kept != tt.kept {
+				t.Fatalf("Expected %d records to be kept, but got %d", tt.kept, kept)
+			}
+			if tt.kept == 1 && resp.Answer[0].Header().Rrtype != dns.TypeTXT {
+				t.Fatalf("Expected the TXT record not sent before to be kept, but got %v", resp.Answer[0])
+			}
+		})
+	}
+}
+
+func TestNextInstanceName(t *testing.T) {
+	tests := []struct {
+		name, next string
+	}{
+		{"My Printer", "My Printer (2)"},
+		{"My Printer (2)", "My Printer (3)"},
+		{"My Printer (9)", "My Printer (10)"},
+		{"My Printer(2)", "My Printer(2) (2)"},
+		{"(2)", "(2) (2)"},
+	}
+	for _, tt := range tests {
+		if next := nextInstanceName(tt.name); next != tt.next {
+			t.Fatalf("Expected %q to be renamed to %q, but got %q", tt.name, tt.next, next)
+		}
+	}
+}
+
+func TestOnConflict(t *testing.T) {
+	holder, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, LoopbackOnly())
+	if err != nil {
+		t.Fatalf("error while registering mdns service: %s", err)
+	}
+	t.Cleanup(holder.Shutdown)
+	<-holder.Ready()
+
+	conflicts := make(chan Conflict, 1)
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort+1, nil, nil, LoopbackOnly(),
+		OnConflict(func(c Conflict) { conflicts <- c }))
+	if err != nil {
+		t.Fatalf("error while registering mdns service: %s", err)
+	}
+	t.Cleanup(server.Shutdown)
+
+	renamed := escapeLabel(mdnsName+" (2)") + "." + mdnsService + "." + mdnsDomain
+	select {
+	case c := <-conflicts:
+		if c.OldName != mdnsName+"."+mdnsService+"."+mdnsDomain || c.NewName != renamed || c.Peer == nil {
+			t.Fatalf("Expected the rename to %s, but got %+v", renamed, c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the name conflict to be detected")
+	}
+	<-server.Ready()
+	if instance := server.Services()[0].Instance; instance != mdnsName+" (2)" {
+		t.Fatalf("Expected the renamed service to be announced, but got %s", instance)
+	}
+}
+
+func TestTextProvider(t *testing.T) {
+	var querier atomic.Value
+	provider := func(e *ServiceEntry, from net.Addr, ifIndex int) []string {
+		querier.Store(from.String())
+		return []string{"txtv=0", "load=7"}
+	}
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0", "load=0"}, nil, LoopbackOnly(), TextProvider(provider))
+	if err != nil {
+		t.Fatalf("error while registering mdns service: %s", err)
+	}
+	t.Cleanup(server.Shutdown)
+	<-server.Ready()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	entries := make(chan *ServiceEntry, 100)
+	go func() {
+		if err := Lookup(ctx, mdnsName, mdnsService, mdnsDomain, entries, SelectLoopback()); err != nil {
+			t.Errorf("Expected lookup success, but got %v", err)
+		}
+	}()
+
+	// The announcements carry the registered text, the answers to the
+	// lookup the provided one.
+	provided := false
+	for e := range entries {
+		if len(e.Text) == 2 && e.Text[1] == "load=7" {
+			provided = true
+			cancel()
+		}
+	}
+	if !provided {
+		t.Fatalf("Expected the provided TXT strings")
+	}
+	if querier.Load() == nil {
+		t.Fatalf("Expected the provider to receive the querier")
+	}
+}
+
+func TestLookupRetransmission(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil, LoopbackOnly(), QueryLog(100))
+	if err != nil {
+		t.Fatalf("error while registering mdns service: %s", err)
+	}
+	t.Cleanup(server.Shutdown)
+	<-server.Ready()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	for _, instance := range []string{mdnsName, "absent"} {
+		go Lookup(ctx, instance, mdnsService, mdnsDomain, make(chan *ServiceEntry, 16), SelectLoopback(), SelectIPTraffic(IPv4))
+	}
+	<-ctx.Done()
+
+	queries := func(instance string) []time.Time {
+		question := escapeLabel(instance) + "." + mdnsService + "." + mdnsDomain + " SRV"
+		var times []time.Time
+		for _, e := range server.RecentQueries() {
+			if !e.Sent && !e.Response && len(e.Records) > 0 && e.Records[0] == question {
+				times = append(times, e.Time)
+			}
+		}
+		return times
+	}
+	// The first query after 20-120ms, the retransmissions after about 1 and
+	// 2 more seconds.
+	absent := queries("absent")
+	if len(absent) != 3 {
+		t.Fatalf("Expected 3 queries of the absent instance, but got %d", len(absent))
+	}
+	if first := absent[0].Sub(start); first < minFirstQueryDelay || first > maxFirstQueryDelay+100*time.Millisecond {
+		t.Fatalf("Expected the first query to be delayed by %v to %v, but got %v", minFirstQueryDelay, maxFirstQueryDelay, first)
+	}
+	for i, want := range []time.Duration{resolveInterval, 2 * resolveInterval} {
+		if gap := absent[i+1].Sub(absent[i]); gap < want || gap > want+maxFirstQueryDelay+100*time.Millisecond {
+			t.Fatalf("Expected retransmission %d after %v, but got %v", i+1, want, gap)
+		}
+	}
+	// A resolved lookup is not retransmitted.
+	if resolved := queries(mdnsName); len(resolved) != 1 {
+		t.Fatalf("Expected a single query of the resolved instance, but got %d", len(resolved))
+	}
+}
+
+func TestLookupLossyLink(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0", "lo=1", "la=2"}, nil, LoopbackOnly())
+	if err != nil {
+		t.Fatalf("error while registering mdns service: %s", err)
+	}
+	t.Cleanup(server.Shutdown)
+	<-server.Ready()
+
+	// A third of the packets is lost, retransmitted queries have to make
+	// up for it. Duplicated and reordered responses must not be delivered
+	// twice.
+	link := newLinkConditions(1)
+	link.Loss = 0.3
+	link.Duplicate = 0.3
+	link.Reorder = 0.3
+	link.Delay = 20 * time.Millisecond
+	link.Jitter = 100 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	entries := make(chan *ServiceEntry, 100)
+	go func() {
+		if err := Lookup(ctx, mdnsName, mdnsService, mdnsDomain, entries, SelectLoopback(), withLinkConditions(link)); err != nil {
+			t.Errorf("Expected lookup success, but got %v", err)
+		}
+	}()
+
+	var resolved *ServiceEntry
+	for e := range entries {
+		if e.HostName != "" && e.Text != nil && len(e.AddrIPv4)+len(e.AddrIPv6) > 0 {
+			resolved = e
+			cancel()
+		}
+	}
+	if resolved == nil {
+		t.Fatalf("Expected the instance to be resolved despite the losses")
+	}
+	if resolved.Port != mdnsPort {
+		t.Fatalf("Expected port %d, but got %d", mdnsPort, resolved.Port)
+	}
+	for _, ip := range resolved.AddrIPv4 {
+		if seen := countIP(resolved.AddrIPv4, ip); seen != 1 {
+			t.Fatalf("Expected address %s once, but got it %d times", ip, seen)
+		}
+	}
+}
+
+func countIP(ips []net.IP, ip net.IP) int {
+	n := 0
+	for _, other := range ips {
+		if other.Equal(ip) {
+			n++
+		}
+	}
+	return n
+}
+
+// responseAllocBudget caps the allocations of answering a browse query,
+// from the received packet to the sent response. Lower it when an
+// optimization lands.
+const responseAllocBudget = 40
+
+// startResponder registers the test service and returns it with the query
+// source, a socket whose responses are discarded. Queries from it are
+// answered by unicast as legacy queries.
+func startResponder(tb testing.TB) (*Server, net.Addr, []byte) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0", "lo=1", "la=2"}, nil, LoopbackOnly())
+	if err != nil {
+		tb.Fatalf("error while registering mdns service: %s", err)
+	}
+	tb.Cleanup(server.Shutdown)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	query := new(dns.Msg)
+	query.SetQuestion(ServiceFQDN(mdnsService, mdnsDomain), dns.TypePTR)
+	buf, err := query.Pack()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return server, conn.LocalAddr(), buf
+}
+
+func TestResponseAllocs(t *testing.T) {
+	server, from, query := startResponder(t)
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := server.parsePacket(query, 0, from); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > responseAllocBudget {
+		t.Fatalf("Answering a query takes %.0f allocations, the budget is %d", allocs, responseAllocBudget)
+	}
+}
+
+// BenchmarkQueryResponse measures a received browse query from parsing the
+// packet to sending the response.
+func BenchmarkQueryResponse(b *testing.B) {
+	server, from, query := startResponder(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := server.parsePacket(query, 0, from); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var (
+	soakDuration = flag.Duration("soak", 0, "run TestSoak for the given duration, e.g. -soak=10m")
+	soakServers  = flag.Int("soak.servers", 200, "number of responders of TestSoak")
+)
+
+// Load of TestSoak: -soak.servers hosts with soakServices services each
+// answer soakQueriesPerHost queries per second for their instances, at
+// twice their rate limit, while a Resolver browses them. Every soakChurn,
+// one host is replaced by a new one with new instances.
+const (
+	soakServices       = 20
+	soakRateLimit      = 5
+	soakQueriesPerHost = 2 * soakRateLimit
+	soakChurn          = 5 * time.Second
+)
+
+// TestSoak validates the response rate limit, the eviction of the
+// resolver's cache and the stability of the memory under sustained load
+// over the loopback interface. It is meant to run before releases and is
+// skipped unless the -soak flag is given.
+func TestSoak(t *testing.T) {
+	if *soakDuration <= 0 {
+		t.Skip("run with -soak=<duration>")
+	}
+	service := "_soak._tcp"
+	type host struct {
+		server  *Server
+		started time.Time
+		names   []string
+	}
+	generation := 0
+	startHost := func() *host {
+		generation++
+		h := &host{started: time.Now()}
+		for i := 0; i < soakServices; i++ {
+			instance := fmt.Sprintf("soak-%d-%d", generation, i)
+			var err error
+			if i == 0 {
+				h.server, err = Register(instance, service, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil,
+					LoopbackOnly(), ResponseRateLimit(soakRateLimit, soakRateLimit))
+			} else {
+				err = h.server.RegisterService(instance, service, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil)
+			}
+			if err != nil {
+				t.Fatalf("error while registering mdns service: %s", err)
+			}
+			h.names = append(h.names, InstanceFQDN(instance, service, mdnsDomain))
+		}
+		return h
+	}
+	hosts := make([]*host, *soakServers)
+	for i := range hosts {
+		hosts[i] = startHost()
+	}
+	defer func() {
+		for _, h := range hosts {
+			h.server.Shutdown()
+		}
+	}()
+	var names atomic.Pointer[[]string]
+	publish := func() {
+		var all []string
+		for _, h := range hosts {
+			all = append(all, h.names...)
+		}
+		names.Store(&all)
+	}
+	publish()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *soakDuration)
+	defer cancel()
+	resolver, err := NewResolver(SelectLoopback(), SelectIPTraffic(IPv4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	entries := make(chan *ServiceEntry, 100)
+	go resolver.Browse(ctx, service, mdnsDomain, entries)
+	go func() {
+		for range entries {
+		}
+	}()
+
+	// Query the instances round-robin, asking for different record types so
+	// that the record throttle lets the rate limit do its work.
+	querier, err := newClient(applyOpts(SelectLoopback(), SelectIPTraffic(IPv4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.shutdown()
+	go func() {
+		const tick = 10 * time.Millisecond
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		types := []uint16{dns.TypeSRV, dns.TypeTXT, dns.TypeANY}
+		n := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			all := *names.Load()
+			for i := 0; i < *soakServers*soakQueriesPerHost*int(tick)/int(time.Second); i++ {
+				m := new(dns.Msg)
+				m.SetQuestion(all[n%len(all)], types[n/len(all)%len(types)])
+				m.RecursionDesired = false
+				querier.sendQuery(m)
+				n++
+			}
+		}
+	}()
+
+	var baseHeap uint64
+	baseGoroutines := 0
+	churn := time.NewTicker(soakChurn)
+	defer churn.Stop()
+	for rounds := 0; ; rounds++ {
+		select {
+		case <-ctx.Done():
+		case <-churn.C:
+			i := rounds % len(hosts)
+			hosts[i].server.Shutdown()
+			hosts[i] = startHost()
+			publish()
+			if rounds == 0 {
+				baseHeap, baseGoroutines = heapInUse(), runtime.NumGoroutine()
+				t.Logf("baseline: heap %d KiB, %d goroutines", baseHeap>>10, baseGoroutines)
+			}
+			continue
+		}
+		break
+	}
+
+	var rateLimited uint64
+	for _, h := range hosts {
+		status := h.server.Status()
+		rateLimited += status.RateLimited
+		// Probes of the other hosts are answered as well, within the limit.
+		allowed := uint64(time.Since(h.started).Seconds()*soakRateLimit) + soakRateLimit
+		if status.AnsweredQueries > allowed {
+			t.Errorf("Expected at most %d responses of a host, but got %d", allowed, status.AnsweredQueries)
+		}
+	}
+	if rateLimited == 0 {
+		t.Errorf("Expected responses to be rate limited")
+	}
+	// The instances of the replaced hosts are evicted by their goodbyes.
+	cached := len(resolver.CachedEntries(service))
+	t.Logf("%d responses rate limited, %d entries cached", rateLimited, cached)
+	if cached > *soakServers*soakServices {
+		t.Errorf("Expected at most %d cached entries, but got %d", *soakServers*soakServices, cached)
+	}
+	if baseHeap > 0 {
+		heap, goroutines := heapInUse(), runtime.NumGoroutine()
+		t.Logf("end: heap %d KiB, %d goroutines", heap>>10, goroutines)
+		if heap > 2*baseHeap+16<<20 {
+			t.Errorf("Heap grew from %d KiB to %d KiB", baseHeap>>10, heap>>10)
+		}
+		if goroutines > baseGoroutines+*soakServers*soakServices {
+			t.Errorf("Goroutines grew from %d to %d", baseGoroutines, goroutines)
+		}
+	}
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+func TestSendErrors(t *testing.T) {
+	var failed atomic.Int32
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, LoopbackOnly(),
+		OnServerSendError(func(iface net.Interface, err error) { failed.Add(1) }))
+	if err != nil {
+		t.Fatalf("error while registering mdns service: %s", err)
+	}
+	t.Cleanup(server.Shutdown)
+	<-server.Ready()
+
+	if err := server.multicastResponse(newResponse(), -1, IPv4AndIPv6); !errors.Is(err, errNotSent) {
+		t.Fatalf("Expected a packet for an unknown interface not to be sent, but got %v", err)
+	}
+	server.ipv4conn.Close()
+	if server.ipv6conn != nil {
+		server.ipv6conn.Close()
+	}
+	before := failed.Load()
+	if err := server.multicastResponse(newResponse(), 0, IPv4AndIPv6); !errors.Is(err, errNotSent) {
+		t.Fatalf("Expected the packet not to be sent, but got %v", err)
+	}
+	if failed.Load() == before || server.Status().SendErrors == 0 {
+		t.Fatalf("Expected the failed writes to be reported")
+	}
+	// Ready is only closed for announcements sent on some interface.
+	if server.announce(server.primary()) {
+		t.Fatalf("Expected the announcement not to be sent")
+	}
+}
+
+func TestTransientProtocols(t *testing.T) {
+	unreachable := &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendmsg", syscall.ENETUNREACH)}
+	refused := &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendmsg", syscall.EPERM)}
+	tests := []struct {
+		name string
+		err  error
+		want IPType
+	}{
+		{"none", nil, 0},
+		{"ipv4 unreachable", &protocolError{IPv4, unreachable}, IPv4},
+		{"ipv4 unreachable with ipv6 sent", fmt.Errorf("eth0: %w", errors.Join(&protocolError{IPv4, unreachable})), IPv4},
+		{"both unreachable", errors.Join(&protocolError{IPv4, unreachable}, &protocolError{IPv6, unreachable}, errNotSent), IPv4AndIPv6},
+		{"ipv6 refused", errors.Join(&protocolError{IPv4, unreachable}, &protocolError{IPv6, refused}), IPv4},
+		{"windows", &protocolError{IPv6, syscall.Errno(10051)}, IPv6},
+		{"unmarked", unreachable, 0},
+	}
+	for _, tt := range tests {
+		if got := transientProtocols(tt.err); got != tt.want {
+			t.Fatalf("%s: expected transient protocols %d, but got %d", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, LoopbackOnly(), ProbeInterval(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("error while registering mdns service: %s", err)
+	}
+	t.Cleanup(server.Shutdown)
+	<-server.Ready()
+
+	// The address the host had before sleeping.
+	stale := net.IPv4(192, 0, 2, 99)
+	server.primary().update(func(e *ServiceEntry) { e.AddrIPv4 = []net.IP{stale} })
+	if err := server.Resume(); err != nil {
+		t.Fatalf("Expected resume success, but got %v", err)
+	}
+	if state := server.Status().Services[0].State; state != ServiceProbing {
+		t.Fatalf("Expected the service to be probed again, but it is %s", state)
+	}
+	resumed := server.primary()
+	if addrs := resumed.entry().AddrIPv4; len(addrs) == 0 || addrs[0].Equal(stale) {
+		t.Fatalf("Expected the addresses to be read again, but got %v", addrs)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	entries := make(chan *ServiceEntry, 10)
+	go func() {
+		if err := Lookup(ctx, mdnsName, mdnsService, mdnsDomain, entries, SelectLoopback()); err != nil {
+			t.Errorf("Expected lookup success, but got %v", err)
+		}
+	}()
+	select {
+	case <-entries:
+		cancel()
+	case <-ctx.Done():
+		t.Fatalf("Expected the resumed service to be found")
+	}
+
+	server.Shutdown()
+	if err := server.Resume(); err == nil {
+		t.Fatalf("Expected resume to fail after shutdown")
+	}
+	if server.announceLate(resumed, func() {}) {
+		t.Fatalf("Expected no announcement after the goodbyes")
+	}
+}
+
+func TestResolverStore(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"v=1"}, nil, LoopbackOnly())
+	if err != nil {
+		t.Fatalf("error while registering mdns service: %s", err)
+	}
+	t.Cleanup(server.Shutdown)
+	<-server.Ready()
+
+	resolver, err := NewResolver(SelectLoopback())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	store, err := resolver.NewStore(ctx, mdnsService, mdnsDomain)
+	if err != nil {
+		t.Fatalf("Expected store success, but got %v", err)
+	}
+	initial, events := store.Subscribe(ctx)
+
+	// Waits for an event of the instance of the change, skipping the
+	// updates while the records of the instance arrive.
+	await := func(change StoreChange, done func(e *ServiceEntry) bool) {
+		t.Helper()
+		for ev := range events {
+			if ev.Entry.Instance == mdnsName && ev.Change == change && done(ev.Entry) {
+				return
+			}
+		}
+		t.Fatalf("Expected the instance to be %s", change)
+	}
+	hasText := func(txt string) func(e *ServiceEntry) bool {
+		return func(e *ServiceEntry) bool { return len(e.Text) == 1 && e.Text[0] == txt }
+	}
+	if len(initial) == 0 {
+		await(StoreAdded, func(*ServiceEntry) bool { return true })
+	}
+	if snapshot := store.Snapshot(); len(snapshot) != 1 || snapshot[0].Instance != mdnsName {
+		t.Fatalf("Expected the instance in the snapshot, but got %v", snapshot)
+	}
+	server.SetText([]string{"v=2"})
+	await(StoreUpdated, hasText("v=2"))
+	server.Shutdown()
+	await(StoreRemoved, func(*ServiceEntry) bool { return true })
+	if snapshot := store.Snapshot(); len(snapshot) != 0 {
+		t.Fatalf("Expected no instances after the goodbye, but got %v", snapshot)
+	}
+
+	cancel()
+	<-store.Done()
+	if err := store.Err(); err != nil {
+		t.Fatalf("Expected the browse to end without error, but got %v", err)
+	}
+}
+
+func TestStoreSlowSubscriber(t *testing.T) {
+	s := &Store{
+		entries: make(map[string]*ServiceEntry),
+		subs:    make(map[*storeSub]struct{}),
+		done:    make(chan struct{}),
+	}
+	entries := make(chan *ServiceEntry)
+	go func() {
+		s.follow(entries)
+		close(s.done)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, slow := s.Subscribe(ctx)
+	_, fast := s.Subscribe(ctx)
+
+	const updates = 100
+	go func() {
+		for i := 0; i < updates; i++ {
+			e := newServiceEntry(mdnsName, mdnsService, mdnsDomain)
+			e.Text = []string{fmt.Sprintf("v=%d", i)}
+			e.Expiry = time.Now().Add(time.Minute)
+			entries <- e
+		}
+		close(entries)
+	}()
+	// The slow subscriber holds up neither the store nor the fast one.
+	latest := fmt.Sprintf("v=%d", updates-1)
+	for ev := range fast {
+		if ev.Entry.Text[0] == latest {
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("Expected the fast subscriber to receive the latest update")
+	}
+
+	var last StoreEvent
+	n := 0
+	for ev := range slow {
+		last = ev
+		n++
+	}
+	if n >= updates {
+		t.Fatalf("Expected the events of the slow subscriber to be coalesced, but got %d", n)
+	}
+	if last.Change == StoreRemoved || len(last.Entry.Text) != 1 || last.Entry.Text[0] != latest {
+		t.Fatalf("Expected the latest update, but got %s %v", last.Change, last.Entry.Text)
+	}
+}
+
+func TestEmptyTXT(t *testing.T) {
+	e, err := NewService(mdnsName, mdnsService).Port(mdnsPort).TextSet().Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrs := txtRecords(e, 120, dns.ClassINET)
+	if len(rrs) != 2 {
+		t.Fatalf("Expected a TXT record for the text and the set, but got %v", rrs)
+	}
+	for _, rr := range rrs {
+		buf := make([]byte, 512)
+		off, err := dns.PackRR(rr, buf, 0, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A single empty string in the rdata, RFC6763 section 6.1.
+		if rdlength := int(buf[off-3])<<8 | int(buf[off-2]); rdlength != 1 || buf[off-1] != 0 {
+			t.Fatalf("Expected the rdata of %v to be one empty string, but got %x", rr, buf[:off])
+		}
+	}
+}
+
+func TestServiceTypeWarning(t *testing.T) {
+	tests := []struct {
+		given, want string
+		warned      bool
+	}{
+		{"_http._tcp", "_http._tcp", false},
+		{"_http._tcp.", "_http._tcp", false},
+		{"_http._tcp.local.", "_http._tcp", true},
+		{"_http._tcp.local,_printer", "_http._tcp,_printer", true},
+	}
+	for _, tt := range tests {
+		warned := false
+		got := normalizeServiceType(tt.given, func(given, normalized string) {
+			if given != tt.given || normalized != tt.want {
+				t.Fatalf("Expected the warning for %q to %q, but got %q to %q", tt.given, tt.want, given, normalized)
+			}
+			warned = true
+		})
+		if got != tt.want || warned != tt.warned {
+			t.Fatalf("Expected %q to be normalized to %q, warned %v, but got %q, warned %v", tt.given, tt.want, tt.warned, got, warned)
+		}
+	}
+
+	var warnings []string
+	server, err := Register(mdnsName, mdnsService+"."+mdnsDomain, mdnsDomain, mdnsPort, nil, nil, LoopbackOnly(),
+		OnServerServiceTypeWarning(func(given, normalized string) { warnings = append(warnings, normalized) }))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	if len(warnings) != 1 || warnings[0] != mdnsService {
+		t.Fatalf("Expected one warning for the registered type, but got %v", warnings)
+	}
+}
+
+func TestCloneEntry(t *testing.T) {
+	e, err := NewService(mdnsName, mdnsService+",_printer").Port(mdnsPort).Text("a=1").TextSet("b=2").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.AddrIPv4 = []net.IP{net.IPv4(192, 0, 2, 1).To4()}
+	e.AddrIPv6 = []net.IP{net.ParseIP("fe80::1")}
+	subtype := e.Subtypes[0]
+	c := cloneEntry(e)
+	c.Subtypes[0] = "_changed"
+	c.Text[0] = "a=2"
+	c.TextSets[0][0] = "b=3"
+	c.AddrIPv4[0][3] = 99
+	c.AddrIPv6[0][15] = 99
+	if e.Subtypes[0] != subtype || e.Text[0] != "a=1" || e.TextSets[0][0] != "b=2" ||
+		!e.AddrIPv4[0].Equal(net.IPv4(192, 0, 2, 1)) || !e.AddrIPv6[0].Equal(net.ParseIP("fe80::1")) {
+		t.Fatalf("Expected the entry to be unchanged by its copy, but got %+v", e)
+	}
+}
+
+func TestGoodbyePackets(t *testing.T) {
+	lo := listLoopbackInterfaces()
+	if len(lo) == 0 {
+		t.Skip("no loopback interface")
+	}
+	conn, err := ListenMulticast(IPv4, lo)
+	if err != nil {
+		t.Skipf("Failed to join the group on the loopback interface: %v", err)
+	}
+	defer conn.Close()
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, LoopbackOnly(), CacheGoodbye())
+	if err != nil {
+		t.Fatalf("error while registering mdns service: %s", err)
+	}
+	defer server.Shutdown()
+	if err := server.RegisterService("other", mdnsService, mdnsDomain, mdnsPort, nil, lo[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := *server.goodbyePackets.Load()
+	if len(packets) != 2 || !packets[0].visibleOn(lo[0].Index) || !packets[1].visibleOn(lo[0].Index) || packets[1].visibleOn(-1) {
+		t.Fatalf("Expected the goodbyes with the interfaces of their services, but got %+v", packets)
+	}
+	server.sendGoodbyePackets()
+	timeout := time.AfterFunc(3*time.Second, func() { conn.Close() })
+	defer timeout.Stop()
+	for goodbyes := 0; goodbyes < len(packets); {
+		p, err := conn.ReadPacket()
+		if err != nil {
+			t.Fatalf("Expected the goodbyes on the loopback interface, but got %d: %v", goodbyes, err)
+		}
+		msg := new(dns.Msg)
+		if msg.Unpack(p.Data) == nil && msg.Response && len(msg.Answer) > 0 && msg.Answer[0].Header().Ttl == 0 {
+			goodbyes++
+		}
+	}
+}
+
+func TestResponseRateLimitRate(t *testing.T) {
+	for _, rate := range []float64{0, -1} {
+		if conf := applyServerOpts(ResponseRateLimit(rate, 1)); conf.rateLimit != nil {
+			t.Fatalf("Expected rate %v to be ignored", rate)
+		}
+	}
+	if conf := applyServerOpts(ResponseRateLimit(1, 1)); !conf.rateLimit.allow() || conf.rateLimit.allow() {
+		t.Fatalf("Expected one response within the burst")
+	}
+}
@@ -0,0 +1,146 @@
+package zeroconf
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// sleepCheckInterval is the interval in which the clocks are compared
+	// to detect that the system slept.
+	sleepCheckInterval = 5 * time.Second
+	// sleepThreshold is how far the wall clock has to run ahead of the
+	// monotonic clock between two checks to be taken for a sleep.
+	sleepThreshold = 5 * time.Second
+)
+
+// WatchSleep makes a server detect that the system was suspended and Resume
+// it after waking up. A sleep shows as the wall clock running ahead of the
+// monotonic clock, which stands still while the system is suspended on Linux,
+// macOS and the BSDs. On platforms where both clocks keep running, and in
+// applications receiving the power events of the platform, call Resume
+// instead. A large step of the wall clock, e.g. by NTP, is taken for a sleep
+// as well, which costs an extra probe and announcement of the services.
+func WatchSleep() ServerOption {
+	return func(o *serverOpts) {
+		o.watchSleep = true
+	}
+}
+
+// watchSleep compares the clocks until the server shuts down. It is not
+// tracked by refCount, as Resume waits for a concurrent Shutdown.
+func (s *Server) watchSleep() {
+	ticker := time.NewTicker(sleepCheckInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-s.shouldShutdown:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		slept := sleptBetween(last, now)
+		last = now
+		if !slept {
+			continue
+		}
+		log.Printf("[WARN] mdns: system woke up from sleep, publishing the services again")
+		if err := s.Resume(); err != nil {
+			return
+		}
+	}
+}
+
+// sleptBetween reports whether the wall clock ran ahead of the monotonic
+// clock between the times, which both have to carry a monotonic reading.
+func sleptBetween(last, now time.Time) bool {
+	wall := now.Round(0).Sub(last.Round(0))
+	return wall-now.Sub(last) > sleepThreshold
+}
+
+// Resume publishes the services again after the system woke up from sleep,
+// when the memberships of the multicast groups may be lost, the addresses of
+// the interfaces may have changed and other hosts may have claimed the names
+// in the meantime: the groups are joined again on the interfaces the server
+// listens on, the addresses published for them are read again and the
+// services are probed and announced as after Register. Interfaces which
+// appeared in the meantime are not used; create a new server for them.
+// Applications receiving the power events of the platform call it on
+// wake-up, see also WatchSleep.
+func (s *Server) Resume() error {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if s.isShutdown {
+		return fmt.Errorf("server is shut down")
+	}
+
+	s.rejoinGroups()
+	s.ifaceTable.refresh()
+	s.refreshTrusted()
+	var v4, v6 []net.IP
+	if s.interfaceAddrs {
+		v4, v6 = hostAddrs(s.ifaces, s.loopback, s.addrFilter)
+	}
+
+	s.servicesLock.Lock()
+	regs := s.withdraw()
+	if s.host != nil {
+		// Kept for Reregister.
+		s.host = withAddrs(s.host, v4, v6)
+	}
+	resumed := make([]*registration, 0, len(regs))
+	for _, old := range regs {
+		r := newRegistration(withAddrs(old.entry(), v4, v6))
+		r.ifaces = old.ifaces
+		s.addRegistration(r)
+		resumed = append(resumed, r)
+	}
+	s.servicesLock.Unlock()
+
+	for _, r := range resumed {
+		s.refCount.Add(1)
+		go s.probe(r)
+	}
+	return nil
+}
+
+// withAddrs returns a copy of the entry with the addresses, or the entry if
+// there are none, e.g. while the network is not back yet.
+func withAddrs(e *ServiceEntry, v4, v6 []net.IP) *ServiceEntry {
+	if len(v4) == 0 && len(v6) == 0 {
+		return e
+	}
+	c := *e
+	c.AddrIPv4, c.AddrIPv6 = v4, v6
+	return &c
+}
+
+// rejoinGroups leaves and joins the multicast groups on the joined
+// interfaces, so that the memberships are reported to the network again,
+// e.g. to switches which dropped them while the system slept.
+func (s *Server) rejoinGroups() {
+	if s.ipv4conn != nil {
+		group := &net.UDPAddr{IP: mdnsGroupIPv4}
+		for i := range s.ipv4ifaces {
+			iface := &s.ipv4ifaces[i]
+			// Leaving fails if the membership is lost already.
+			_ = s.ipv4conn.LeaveGroup(iface, group)
+			if err := s.ipv4conn.JoinGroup(iface, group); err != nil {
+				log.Printf("[WARN] mdns: Failed to join the IPv4 group on %s: %v", iface.Name, err)
+			}
+		}
+	}
+	if s.ipv6conn != nil {
+		group := &net.UDPAddr{IP: mdnsGroupIPv6}
+		for i := range s.ipv6ifaces {
+			iface := &s.ipv6ifaces[i]
+			_ = s.ipv6conn.LeaveGroup(iface, group)
+			if err := s.ipv6conn.JoinGroup(iface, group); err != nil {
+				log.Printf("[WARN] mdns: Failed to join the IPv6 group on %s: %v", iface.Name, err)
+			}
+		}
+	}
+}
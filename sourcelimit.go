@@ -0,0 +1,156 @@
+package zeroconf
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SourceRecordLimit caps the records a single source address may have
+// cached at once to max, so that a malicious or buggy peer announcing
+// thousands of fake instances cannot blow up the entries of a browse. A
+// record counts until its TTL expires; records exceeding the limit are
+// dropped from the received messages. onDrop, if not nil, is called with
+// the source and the number of records dropped from a message, e.g. to
+// update a metric; otherwise a warning is logged when a source first exceeds
+// the limit. Non-positive limits are ignored.
+func SourceRecordLimit(max int, onDrop func(source net.IP, dropped int)) ClientOption {
+	return func(o *clientOpts) {
+		if max > 0 {
+			o.sourceLimit = &sourceLimit{max: max, onDrop: onDrop, sources: make(map[string]*sourceRecords)}
+		}
+	}
+}
+
+// sourceLimit tracks the records received from each source address. It is
+// shared by the receiving routines of a client. A nil limit passes all
+// records.
+type sourceLimit struct {
+	max    int
+	onDrop func(source net.IP, dropped int)
+
+	mu      sync.Mutex
+	sources map[string]*sourceRecords
+}
+
+type sourceRecords struct {
+	expiry   map[recordKey]time.Time
+	exceeded bool // logged the source exceeding the limit
+}
+
+// recordKey identifies a record regardless of its TTL. Pointer records of
+// a service differ by their target only.
+type recordKey struct {
+	name   string
+	rrtype uint16
+	target string
+}
+
+// filter removes the records of the message from the source exceeding the
+// limit.
+func (l *sourceLimit) filter(msg *dns.Msg, src net.Addr, now time.Time) {
+	if l == nil {
+		return
+	}
+	addr, ok := src.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	l.mu.Lock()
+	source := l.sources[addr.IP.String()]
+	if source == nil {
+		source = &sourceRecords{expiry: make(map[recordKey]time.Time)}
+		l.sources[addr.IP.String()] = source
+	}
+	dropped := 0
+	keep := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			if source.accept(rr, l.max, now) {
+				kept = append(kept, rr)
+			} else {
+				dropped++
+			}
+		}
+		return kept
+	}
+	msg.Answer = keep(msg.Answer)
+	msg.Ns = keep(msg.Ns)
+	msg.Extra = keep(msg.Extra)
+	if len(source.expiry) == 0 {
+		delete(l.sources, addr.IP.String())
+	}
+	logged := source.exceeded
+	if dropped > 0 {
+		source.exceeded = true
+	}
+	l.mu.Unlock()
+
+	if dropped == 0 {
+		return
+	}
+	if l.onDrop != nil {
+		l.onDrop(addr.IP, dropped)
+	} else if !logged {
+		log.Printf("[WARN] mdns: %s exceeds the limit of %d records, dropping records", addr.IP, l.max)
+	}
+}
+
+// expire forgets the expired records of the sources and the sources
+// without records. It is called by the cache sweeps of the browses, so that
+// sources staying below the limit do not remain in the map forever.
+func (l *sourceLimit) expire(now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, source := range l.sources {
+		for k, t := range source.expiry {
+			if !t.After(now) {
+				delete(source.expiry, k)
+			}
+		}
+		if len(source.expiry) == 0 {
+			delete(l.sources, ip)
+		}
+	}
+}
+
+// accept counts the record and reports whether it is within the limit.
+// Records already counted are refreshed, goodbye records uncounted.
+func (s *sourceRecords) accept(rr dns.RR, max int, now time.Time) bool {
+	hdr := rr.Header()
+	if hdr.Rrtype == dns.TypeOPT {
+		return true
+	}
+	key := recordKey{name: dns.CanonicalName(hdr.Name), rrtype: hdr.Rrtype}
+	if ptr, ok := rr.(*dns.PTR); ok {
+		key.target = dns.CanonicalName(ptr.Ptr)
+	}
+	if hdr.Ttl == 0 {
+		delete(s.expiry, key)
+		return true
+	}
+	expiry := now.Add(time.Duration(hdr.Ttl) * time.Second)
+	if _, found := s.expiry[key]; found {
+		s.expiry[key] = expiry
+		return true
+	}
+	if len(s.expiry) >= max {
+		for k, t := range s.expiry {
+			if !t.After(now) {
+				delete(s.expiry, k)
+			}
+		}
+		if len(s.expiry) >= max {
+			return false
+		}
+		s.exceeded = false
+	}
+	s.expiry[key] = expiry
+	return true
+}
@@ -0,0 +1,115 @@
+package zeroconf
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// SRVRecord is an SRV record of a service instance.
+type SRVRecord struct {
+	HostName string `json:"hostname"`
+	Port     int    `json:"port"`
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+}
+
+// SRVRecords returns the SRV records of the entry, the one of HostName and
+// Port first, followed by Targets.
+func (s *ServiceEntry) SRVRecords() []SRVRecord {
+	targets := make([]SRVRecord, 0, 1+len(s.Targets))
+	if s.HostName != "" {
+		targets = append(targets, SRVRecord{HostName: s.HostName, Port: s.Port, Priority: s.Priority, Weight: s.Weight})
+	}
+	return append(targets, s.Targets...)
+}
+
+// OrderTargets returns the targets in the order to try them according to
+// RFC 2782: by ascending priority, and within a priority in a random order
+// with the chance of a target to come first proportional to its weight.
+// Targets with the same priority and weight zero keep their order, so the
+// result is stable for unweighted records.
+func OrderTargets(targets []SRVRecord) []SRVRecord {
+	ordered := make([]SRVRecord, 0, len(targets))
+	for _, i := range weightedOrder(len(targets), func(i int) (int, int) {
+		return targets[i].Priority, targets[i].Weight
+	}) {
+		ordered = append(ordered, targets[i])
+	}
+	return ordered
+}
+
+// OrderEntries returns the entries, e.g. the instances of a service type
+// published by several hosts, in the order of their Priority and Weight as
+// OrderTargets does for the targets of an instance. Entries with the same
+// priority and weight zero are sorted by instance name.
+func OrderEntries(entries []*ServiceEntry) []*ServiceEntry {
+	sorted := append([]*ServiceEntry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return dns.CanonicalName(sorted[i].ServiceInstanceName()) < dns.CanonicalName(sorted[j].ServiceInstanceName())
+	})
+	ordered := make([]*ServiceEntry, 0, len(sorted))
+	for _, i := range weightedOrder(len(sorted), func(i int) (int, int) {
+		return sorted[i].Priority, sorted[i].Weight
+	}) {
+		ordered = append(ordered, sorted[i])
+	}
+	return ordered
+}
+
+// weightedOrder returns the indexes of n records ordered by the selection
+// algorithm of RFC 2782. Within a priority, the records of weight zero are
+// placed first, then a record is picked repeatedly by comparing a random
+// number up to the sum of the remaining weights with their running sum.
+func weightedOrder(n int, srv func(i int) (priority, weight int)) []int {
+	indexes := make([]int, n)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(a, b int) bool {
+		pa, wa := srv(indexes[a])
+		pb, wb := srv(indexes[b])
+		if pa != pb {
+			return pa < pb
+		}
+		return wa == 0 && wb != 0
+	})
+
+	ordered := make([]int, 0, n)
+	for start := 0; start < n; {
+		priority, _ := srv(indexes[start])
+		end := start
+		for end < n {
+			if p, _ := srv(indexes[end]); p != priority {
+				break
+			}
+			end++
+		}
+		group := append([]int(nil), indexes[start:end]...)
+		for len(group) > 0 {
+			sum := 0
+			for _, i := range group {
+				_, w := srv(i)
+				sum += w
+			}
+			pick := 0
+			if sum > 0 {
+				r := rand.Intn(sum + 1)
+				running := 0
+				for k, i := range group {
+					_, w := srv(i)
+					running += w
+					if running >= r {
+						pick = k
+						break
+					}
+				}
+			}
+			ordered = append(ordered, group[pick])
+			group = append(group[:pick], group[pick+1:]...)
+		}
+		start = end
+	}
+	return ordered
+}
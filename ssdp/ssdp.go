@@ -0,0 +1,323 @@
+// Package ssdp announces the services of a zeroconf.Server over SSDP, for
+// smart TVs and DLNA clients discovering devices with UPnP instead of mDNS.
+// A Bridge multicasts ssdp:alive and ssdp:byebye notifications and answers
+// M-SEARCH requests with the services of the server. It is IPv4 only.
+//
+// The bridge does not serve UPnP device descriptions: the LOCATION of a
+// service points to the URL given by Config.Location, by default the HTTP
+// root of the service.
+package ssdp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdanielm/zeroconf"
+	"github.com/kdanielm/zeroconf/internal/bridge"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// defaultMaxAge is the lifetime of the announcements. They are repeated
+	// at half of it.
+	defaultMaxAge = 1800 * time.Second
+	// maxSearchDelay caps the MX delay of M-SEARCH responses, UPnP Device
+	// Architecture 2.0 section 1.3.3.
+	maxSearchDelay = 5 * time.Second
+	rootDevice     = "upnp:rootdevice"
+)
+
+var groupAddr = &net.UDPAddr{IP: bridge.GroupIPv4, Port: 1900}
+
+// Config configures how services are announced. The zero value announces
+// every service as a root device with its HTTP root as location.
+type Config struct {
+	// Types returns the device and service types of a service, e.g.
+	// "urn:schemas-upnp-org:device:MediaRenderer:1". Each service is
+	// announced as a root device and by its UUID in addition. If nil, no
+	// further types are announced.
+	Types func(e *zeroconf.ServiceEntry) []string
+	// Location returns the LOCATION URL of a service for an address of the
+	// server. If nil, the URL is http://addr:port/ with the path of the
+	// "path" TXT key, if any. Returning "" skips the service.
+	Location func(e *zeroconf.ServiceEntry, addr net.IP) string
+	// MaxAge is the lifetime of the announcements, 30 minutes if zero.
+	MaxAge time.Duration
+	// Interfaces to listen and send on. If empty, all multicast interfaces
+	// are used.
+	Interfaces []net.Interface
+}
+
+// Bridge answers SSDP requests for the services of a server.
+type Bridge struct {
+	server *zeroconf.Server
+	config Config
+	conn   *ipv4.PacketConn
+	ifaces []net.Interface
+	agent  string
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Start joins the SSDP multicast group, announces the services of the server
+// and answers searches until the bridge is closed or the server is shut
+// down. The announcements are repeated before they expire.
+func Start(server *zeroconf.Server, config Config) (*Bridge, error) {
+	if config.MaxAge <= 0 {
+		config.MaxAge = defaultMaxAge
+	}
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: groupAddr.Port})
+	if err != nil {
+		return nil, err
+	}
+	conn := ipv4.NewPacketConn(udp)
+	ifaces := config.Interfaces
+	if len(ifaces) == 0 {
+		ifaces = bridge.MulticastInterfaces(false)
+	}
+	var joined []net.Interface
+	for _, iface := range ifaces {
+		if err := conn.JoinGroup(&iface, &net.UDPAddr{IP: groupAddr.IP}); err == nil {
+			joined = append(joined, iface)
+		}
+	}
+	if len(joined) == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("could not join the ssdp group on any interface")
+	}
+	conn.SetMulticastLoopback(true)
+	conn.SetMulticastTTL(2) // UPnP Device Architecture recommends 2
+	if err := conn.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		log.Printf("[WARN] ssdp: failed to enable control messages: %v", err)
+	}
+
+	b := &Bridge{
+		server: server,
+		config: config,
+		conn:   conn,
+		ifaces: joined,
+		agent:  fmt.Sprintf("%s/1.0 UPnP/1.1 zeroconf/1.0", runtime.GOOS),
+		closed: make(chan struct{}),
+	}
+	go b.recv()
+	go b.run()
+	b.Announce()
+	return b, nil
+}
+
+func (b *Bridge) run() {
+	ticker := time.NewTicker(b.config.MaxAge / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.server.Done():
+			b.Close()
+			return
+		case <-b.closed:
+			return
+		case <-ticker.C:
+			b.Announce()
+		}
+	}
+}
+
+// Announce multicasts ssdp:alive notifications for the services, e.g. after
+// a service has been registered on the server.
+func (b *Bridge) Announce() {
+	b.notify("ssdp:alive")
+}
+
+// Close multicasts ssdp:byebye notifications for the services and stops
+// answering.
+func (b *Bridge) Close() {
+	b.closeOnce.Do(func() {
+		b.notify("ssdp:byebye")
+		close(b.closed)
+		b.conn.Close()
+	})
+}
+
+func (b *Bridge) notify(nts string) {
+	for i := range b.ifaces {
+		iface := &b.ifaces[i]
+		addr := interfaceAddr(iface)
+		if err := b.conn.SetMulticastInterface(iface); err != nil {
+			continue
+		}
+		for _, e := range b.server.Services() {
+			location := b.location(e, addr)
+			if location == "" {
+				continue
+			}
+			for _, nt := range b.types(e) {
+				var buf bytes.Buffer
+				buf.WriteString("NOTIFY * HTTP/1.1\r\n")
+				fmt.Fprintf(&buf, "HOST: %s\r\n", groupAddr)
+				fmt.Fprintf(&buf, "NT: %s\r\n", nt)
+				fmt.Fprintf(&buf, "NTS: %s\r\n", nts)
+				fmt.Fprintf(&buf, "USN: %s\r\n", usn(e, nt))
+				if nts == "ssdp:alive" {
+					fmt.Fprintf(&buf, "CACHE-CONTROL: max-age=%d\r\n", int(b.config.MaxAge/time.Second))
+					fmt.Fprintf(&buf, "LOCATION: %s\r\n", location)
+					fmt.Fprintf(&buf, "SERVER: %s\r\n", b.agent)
+				}
+				buf.WriteString("\r\n")
+				if _, err := b.conn.WriteTo(buf.Bytes(), nil, groupAddr); err != nil {
+					log.Printf("[WARN] ssdp: failed to notify on %s: %v", iface.Name, err)
+				}
+			}
+		}
+	}
+}
+
+func (b *Bridge) recv() {
+	buf := make([]byte, 8192)
+	for {
+		n, cm, from, err := b.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-b.closed:
+				return
+			default:
+			}
+			continue
+		}
+		ifIndex := 0
+		if cm != nil {
+			ifIndex = cm.IfIndex
+		}
+		b.handle(buf[:n], ifIndex, from)
+	}
+}
+
+// handle answers an M-SEARCH request after a random delay of up to MX
+// seconds, as required to spread the responses of many devices.
+func (b *Bridge) handle(buf []byte, ifIndex int, from net.Addr) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf)))
+	if err != nil || req.Method != "M-SEARCH" || strings.Trim(req.Header.Get("MAN"), `"`) != "ssdp:discover" {
+		return
+	}
+	st := req.Header.Get("ST")
+	if st == "" {
+		return
+	}
+	delay := time.Duration(0)
+	if mx, err := strconv.Atoi(req.Header.Get("MX")); err == nil && mx > 0 {
+		max := time.Duration(mx) * time.Second
+		if max > maxSearchDelay {
+			max = maxSearchDelay
+		}
+		delay = time.Duration(rand.Int63n(int64(max)))
+	}
+
+	var addr net.IP
+	var cm *ipv4.ControlMessage
+	if ifIndex != 0 {
+		cm = &ipv4.ControlMessage{IfIndex: ifIndex}
+		if iface, err := net.InterfaceByIndex(ifIndex); err == nil {
+			addr = interfaceAddr(iface)
+		}
+	}
+	var responses [][]byte
+	for _, e := range b.server.Services() {
+		location := b.location(e, addr)
+		if location == "" {
+			continue
+		}
+		for _, nt := range b.types(e) {
+			if st != "ssdp:all" && st != nt {
+				continue
+			}
+			var buf bytes.Buffer
+			buf.WriteString("HTTP/1.1 200 OK\r\n")
+			fmt.Fprintf(&buf, "CACHE-CONTROL: max-age=%d\r\n", int(b.config.MaxAge/time.Second))
+			fmt.Fprintf(&buf, "DATE: %s\r\n", time.Now().UTC().Format(http.TimeFormat))
+			buf.WriteString("EXT:\r\n")
+			fmt.Fprintf(&buf, "LOCATION: %s\r\n", location)
+			fmt.Fprintf(&buf, "SERVER: %s\r\n", b.agent)
+			fmt.Fprintf(&buf, "ST: %s\r\n", nt)
+			fmt.Fprintf(&buf, "USN: %s\r\n", usn(e, nt))
+			buf.WriteString("\r\n")
+			responses = append(responses, buf.Bytes())
+		}
+	}
+	if len(responses) == 0 {
+		return
+	}
+	time.AfterFunc(delay, func() {
+		for _, resp := range responses {
+			if _, err := b.conn.WriteTo(resp, cm, from); err != nil {
+				select {
+				case <-b.closed:
+				default:
+					log.Printf("[WARN] ssdp: failed to answer %s: %v", from, err)
+				}
+				return
+			}
+		}
+	})
+}
+
+// types returns the notification types of a service: the root device, its
+// UUID and the configured types.
+func (b *Bridge) types(e *zeroconf.ServiceEntry) []string {
+	types := []string{rootDevice, deviceUUID(e)}
+	if b.config.Types != nil {
+		types = append(types, b.config.Types(e)...)
+	}
+	return types
+}
+
+func (b *Bridge) location(e *zeroconf.ServiceEntry, addr net.IP) string {
+	if addr == nil && len(e.AddrIPv4) > 0 {
+		addr = e.AddrIPv4[0]
+	}
+	if addr == nil {
+		return ""
+	}
+	if b.config.Location != nil {
+		return b.config.Location(e, addr)
+	}
+	return fmt.Sprintf("http://%s%s", net.JoinHostPort(addr.String(), strconv.Itoa(e.Port)), bridge.Path(e.Text))
+}
+
+// usn returns the unique service name of a notification type of a service.
+func usn(e *zeroconf.ServiceEntry, nt string) string {
+	id := deviceUUID(e)
+	if nt == id {
+		return id
+	}
+	return id + "::" + nt
+}
+
+// deviceUUID derives a stable UUID from the instance name, see
+// bridge.NameUUID.
+func deviceUUID(e *zeroconf.ServiceEntry) string {
+	u := bridge.NameUUID(e.ServiceInstanceName())
+	return fmt.Sprintf("uuid:%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// interfaceAddr returns the first IPv4 address of the interface.
+func interfaceAddr(iface *net.Interface) net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4()
+		}
+	}
+	return nil
+}
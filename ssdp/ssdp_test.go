@@ -0,0 +1,103 @@
+package ssdp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kdanielm/zeroconf"
+)
+
+func loopbackInterface(t *testing.T) net.Interface {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return iface
+		}
+	}
+	t.Skip("no loopback interface")
+	return net.Interface{}
+}
+
+// search sends an M-SEARCH request for the search target to the bridge and
+// returns the responses received within half a second.
+func search(t *testing.T, st string) []*http.Response {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\nHOST: %s\r\nMAN: \"ssdp:discover\"\r\nMX: 0\r\nST: %s\r\n\r\n", groupAddr, st)
+	if _, err := conn.WriteTo([]byte(req), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: groupAddr.Port}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	var responses []*http.Response
+	buf := make([]byte, 8192)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return responses
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			t.Fatalf("Expected an HTTP response, but got %v", err)
+		}
+		responses = append(responses, resp)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	lo := loopbackInterface(t)
+	const renderer = "urn:schemas-upnp-org:device:MediaRenderer:1"
+	server, err := zeroconf.Register("Speaker", "_http._tcp", "local.", 8080, []string{"path=/description.xml"}, nil, zeroconf.LoopbackOnly())
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	bridge, err := Start(server, Config{
+		Types:      func(e *zeroconf.ServiceEntry) []string { return []string{renderer} },
+		Interfaces: []net.Interface{lo},
+	})
+	if err != nil {
+		t.Fatalf("Expected the bridge to start, but got %v", err)
+	}
+	defer bridge.Close()
+
+	id := deviceUUID(server.Services()[0])
+	tests := []struct {
+		st   string
+		usns []string
+	}{
+		{st: "ssdp:all", usns: []string{id + "::" + rootDevice, id, id + "::" + renderer}},
+		{st: rootDevice, usns: []string{id + "::" + rootDevice}},
+		{st: id, usns: []string{id}},
+		{st: renderer, usns: []string{id + "::" + renderer}},
+		{st: "urn:schemas-upnp-org:device:Printer:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.st, func(t *testing.T) {
+			responses := search(t, tt.st)
+			if len(responses) != len(tt.usns) {
+				t.Fatalf("Expected %d responses, but got %d", len(tt.usns), len(responses))
+			}
+			for i, resp := range responses {
+				if usn := resp.Header.Get("USN"); usn != tt.usns[i] {
+					t.Fatalf("Expected USN %s, but got %s", tt.usns[i], usn)
+				}
+				if location := resp.Header.Get("LOCATION"); location != "http://127.0.0.1:8080/description.xml" {
+					t.Fatalf("Expected the location of the service, but got %s", location)
+				}
+			}
+		})
+	}
+}
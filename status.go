@@ -0,0 +1,153 @@
+package zeroconf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceState describes the progress of publishing a service.
+type ServiceState int
+
+// States of a published service.
+const (
+	// ServiceProbing is the state while probes are sent for the service.
+	ServiceProbing ServiceState = iota
+	// ServiceAnnouncing is the state while the initial announcements are sent.
+	ServiceAnnouncing
+	// ServiceAnnounced is the state once all initial announcements are sent.
+	ServiceAnnounced
+)
+
+func (s ServiceState) String() string {
+	switch s {
+	case ServiceProbing:
+		return "probing"
+	case ServiceAnnouncing:
+		return "announcing"
+	case ServiceAnnounced:
+		return "announced"
+	}
+	return fmt.Sprintf("ServiceState(%d)", int(s))
+}
+
+// ServerStatus is a snapshot of the state of a Server.
+type ServerStatus struct {
+	IPv4Interfaces  []string        // Interfaces joined to the IPv4 multicast group
+	IPv6Interfaces  []string        // Interfaces joined to the IPv6 multicast group
+	Services        []ServiceStatus // Published services
+	AnsweredQueries uint64          // Number of responses sent for received queries
+	SendErrors      uint64          // Number of failed packet writes and interface selections
+	RateLimited     uint64          // Number of responses dropped by the rate limit
+}
+
+// ServiceStatus is the state of a single service published by a Server.
+type ServiceStatus struct {
+	Instance         string       // Service instance name
+	State            ServiceState // Probing & announcement state
+	LastAnnouncement time.Time    // Time of the last announcement, zero if none was sent yet
+}
+
+// String summarizes the status in one line for logging.
+func (s ServerStatus) String() string {
+	services := make([]string, 0, len(s.Services))
+	for _, svc := range s.Services {
+		services = append(services, svc.String())
+	}
+	return fmt.Sprintf("ipv4=[%s] ipv6=[%s] services=[%s] answered=%d send-errors=%d rate-limited=%d",
+		strings.Join(s.IPv4Interfaces, " "), strings.Join(s.IPv6Interfaces, " "),
+		strings.Join(services, ", "), s.AnsweredQueries, s.SendErrors, s.RateLimited)
+}
+
+func (s ServiceStatus) String() string {
+	if s.LastAnnouncement.IsZero() {
+		return fmt.Sprintf("%s (%s)", s.Instance, s.State)
+	}
+	return fmt.Sprintf("%s (%s, last announced %s)", s.Instance, s.State, s.LastAnnouncement.Format(time.RFC3339))
+}
+
+// serviceProgress tracks the publishing state of a registration.
+type serviceProgress struct {
+	mu               sync.Mutex
+	state            ServiceState
+	lastAnnouncement time.Time
+}
+
+func (p *serviceProgress) setState(state ServiceState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = state
+}
+
+func (p *serviceProgress) probing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state == ServiceProbing
+}
+
+func (p *serviceProgress) announced(t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastAnnouncement = t
+}
+
+// Status reports the joined interfaces, publishing state of the services and
+// counters of the server.
+func (s *Server) Status() ServerStatus {
+	status := ServerStatus{
+		IPv4Interfaces:  interfaceNames(s.ipv4ifaces),
+		IPv6Interfaces:  interfaceNames(s.ipv6ifaces),
+		AnsweredQueries: s.answered.Load(),
+		SendErrors:      s.sendErrors.Load(),
+		RateLimited:     s.rateLimited.Load(),
+	}
+	for _, r := range s.registrations() {
+		r.progress.mu.Lock()
+		status.Services = append(status.Services, ServiceStatus{
+			Instance:         r.entry().ServiceInstanceName(),
+			State:            r.progress.state,
+			LastAnnouncement: r.progress.lastAnnouncement,
+		})
+		r.progress.mu.Unlock()
+	}
+	return status
+}
+
+// OnServerSendError sets a function called for each failed write of a
+// response, announcement, probe or goodbye on an interface, including
+// failures to select the interface, e.g. to report interfaces which need
+// attention. The failures are counted in ServerStatus.SendErrors either way.
+// The function is called from the sending routines of the server and must
+// not block.
+func OnServerSendError(fn func(iface net.Interface, err error)) ServerOption {
+	return func(o *serverOpts) {
+		o.onSendError = fn
+	}
+}
+
+// sendFailed counts a failed packet write on an interface and reports it to
+// the OnServerSendError hook.
+func (s *Server) sendFailed(ifIndex int, err error) {
+	s.sendErrors.Add(1)
+	if s.onSendError == nil {
+		return
+	}
+	iface := net.Interface{Index: ifIndex}
+	for _, intf := range s.ifaces {
+		if intf.Index == ifIndex {
+			iface = intf
+			break
+		}
+	}
+	s.onSendError(iface, err)
+}
+
+func interfaceNames(ifaces []net.Interface) []string {
+	var names []string
+	for _, iface := range ifaces {
+		names = append(names, iface.Name)
+	}
+	return names
+}
@@ -0,0 +1,348 @@
+package zeroconf
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// StoreChange is the kind of a StoreEvent.
+type StoreChange int
+
+// Changes of the instances of a Store.
+const (
+	// StoreAdded is reported for an instance found by the browse.
+	StoreAdded StoreChange = iota
+	// StoreUpdated is reported when the records of a known instance change.
+	StoreUpdated
+	// StoreRemoved is reported when an instance sends a goodbye or its
+	// records expire.
+	StoreRemoved
+)
+
+func (c StoreChange) String() string {
+	switch c {
+	case StoreAdded:
+		return "added"
+	case StoreUpdated:
+		return "updated"
+	case StoreRemoved:
+		return "removed"
+	}
+	return fmt.Sprintf("StoreChange(%d)", int(c))
+}
+
+// StoreEvent reports a change of the instances of a Store.
+type StoreEvent struct {
+	Change StoreChange
+	// Entry is the current entry of the instance, or the last one for
+	// StoreRemoved.
+	Entry *ServiceEntry
+}
+
+// storeExpiryInterval is the interval in which the instances of a Store are
+// checked for expired records.
+const storeExpiryInterval = time.Second
+
+// Store keeps the live instances of a service type, found by a single browse
+// of a Resolver, so that several components of an application share the
+// discovery state instead of each running a Browse. Components read the
+// current instances with Snapshot or follow them with Subscribe. The
+// entries handed out are copies, which callers may modify.
+type Store struct {
+	mu      sync.Mutex
+	entries map[string]*ServiceEntry // by canonical instance name
+	subs    map[*storeSub]struct{}
+
+	done chan struct{}
+	err  error
+}
+
+// storeSub is a subscriber of a Store. The changes for it are queued and
+// coalesced per instance, and passed on by its own routine, which closes the
+// events channel.
+type storeSub struct {
+	ctx    context.Context
+	events chan StoreEvent
+	wake   chan struct{}
+
+	mu      sync.Mutex
+	order   []string              // canonical instance names of the pending events
+	pending map[string]StoreEvent // by canonical instance name
+}
+
+// NewStore starts a browse for the service type in the domain, which feeds
+// a new Store until the context is done or the resolver is closed.
+func (r *Resolver) NewStore(ctx context.Context, service, domain string) (*Store, error) {
+	service = normalizeServiceType(service, r.c.typeWarning)
+	if err := ValidateServiceType(service); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		entries: make(map[string]*ServiceEntry),
+		subs:    make(map[*storeSub]struct{}),
+		done:    make(chan struct{}),
+	}
+	entries := make(chan *ServiceEntry, 32)
+	params := newLookupParams("", service, domain, true, entries)
+	// Goodbyes are passed as expired entries on the same channel, so that
+	// they keep their order with the entries received before.
+	params.removed = func(e *ServiceEntry) {
+		select {
+		case entries <- e:
+		case <-ctx.Done():
+		}
+	}
+	var err error
+	browsed := make(chan struct{})
+	go func() {
+		defer close(browsed)
+		if err = r.run(ctx, params); err != nil {
+			log.Printf("[WARN] mdns: Failed to browse %s for a store: %v", params.ServiceName(), err)
+		}
+	}()
+	go func() {
+		s.follow(entries)
+		<-browsed
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.done)
+	}()
+	return s, nil
+}
+
+// Snapshot returns the current instances, ordered by instance name.
+func (s *Store) Snapshot() []*ServiceEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot()
+}
+
+// snapshot copies the instances. The caller holds mu.
+func (s *Store) snapshot() []*ServiceEntry {
+	entries := make([]*ServiceEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, cloneEntry(e))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Instance < entries[j].Instance })
+	return entries
+}
+
+// Subscribe returns the current instances and a channel of the changes
+// since, which is closed when the context is done or the store ends. A
+// subscriber receiving slowly does not hold up the store: its pending
+// changes are coalesced, so that it receives the latest change of each
+// instance.
+func (s *Store) Subscribe(ctx context.Context) ([]*ServiceEntry, <-chan StoreEvent) {
+	sub := &storeSub{
+		ctx:     ctx,
+		events:  make(chan StoreEvent, 16),
+		wake:    make(chan struct{}, 1),
+		pending: make(map[string]StoreEvent),
+	}
+	s.mu.Lock()
+	snapshot := s.snapshot()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		close(sub.events)
+		return snapshot, sub.events
+	default:
+	}
+	s.subs[sub] = struct{}{}
+	s.mu.Unlock()
+
+	go func() {
+		sub.run(s.done)
+		s.mu.Lock()
+		delete(s.subs, sub)
+		s.mu.Unlock()
+		close(sub.events)
+	}()
+	return snapshot, sub.events
+}
+
+// Done returns a channel which is closed when the browse of the store has
+// ended. The instances are kept, but no longer updated.
+func (s *Store) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error the browse of the store failed with, if any, once
+// Done is closed.
+func (s *Store) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// follow applies the entries of the browse to the store until the entries
+// channel is closed. Expired entries are goodbyes.
+func (s *Store) follow(entries <-chan *ServiceEntry) {
+	ticker := time.NewTicker(storeExpiryInterval)
+	defer ticker.Stop()
+	for {
+		var events []StoreEvent
+		var subs []*storeSub
+		select {
+		case e, ok := <-entries:
+			if !ok {
+				return
+			}
+			events, subs = s.apply(e, time.Now())
+		case now := <-ticker.C:
+			events, subs = s.expire(now)
+		}
+		for _, ev := range events {
+			for _, sub := range subs {
+				sub.queue(ev)
+			}
+		}
+	}
+}
+
+// apply stores or removes the entry and returns the resulting events with
+// the subscribers to send them to.
+func (s *Store) apply(e *ServiceEntry, now time.Time) ([]StoreEvent, []*storeSub) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := dns.CanonicalName(e.ServiceInstanceName())
+	prev, found := s.entries[k]
+	var ev StoreEvent
+	switch {
+	case !e.Expiry.After(now):
+		if !found {
+			return nil, nil
+		}
+		delete(s.entries, k)
+		ev = StoreEvent{Change: StoreRemoved, Entry: prev}
+	case !found:
+		s.entries[k] = e
+		ev = StoreEvent{Change: StoreAdded, Entry: e}
+	default:
+		s.entries[k] = e
+		if entryHash(e) == entryHash(prev) {
+			// Refreshed only.
+			return nil, nil
+		}
+		ev = StoreEvent{Change: StoreUpdated, Entry: e}
+	}
+	return []StoreEvent{ev}, s.subscribers()
+}
+
+// expire removes the instances whose records expired and returns the
+// resulting events with the subscribers to send them to.
+func (s *Store) expire(now time.Time) ([]StoreEvent, []*storeSub) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var events []StoreEvent
+	for k, e := range s.entries {
+		if !e.Expiry.After(now) {
+			delete(s.entries, k)
+			events = append(events, StoreEvent{Change: StoreRemoved, Entry: e})
+		}
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+	return events, s.subscribers()
+}
+
+// subscribers lists the subscribers. The caller holds mu.
+func (s *Store) subscribers() []*storeSub {
+	subs := make([]*storeSub, 0, len(s.subs))
+	for sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// queue adds a copy of the event to the pending events of the subscriber,
+// merged with the pending event of the instance, if any.
+func (sub *storeSub) queue(ev StoreEvent) {
+	ev.Entry = cloneEntry(ev.Entry)
+	k := dns.CanonicalName(ev.Entry.ServiceInstanceName())
+	sub.mu.Lock()
+	if prev, found := sub.pending[k]; !found {
+		sub.order = append(sub.order, k)
+		sub.pending[k] = ev
+	} else if merged, ok := coalesceEvents(prev, ev); ok {
+		sub.pending[k] = merged
+	} else {
+		delete(sub.pending, k)
+		for i, o := range sub.order {
+			if o == k {
+				sub.order = append(sub.order[:i], sub.order[i+1:]...)
+				break
+			}
+		}
+	}
+	sub.mu.Unlock()
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+// coalesceEvents merges two consecutive events of an instance into one, as
+// seen by a subscriber which received neither. It returns false if they
+// cancel out.
+func coalesceEvents(prev, ev StoreEvent) (StoreEvent, bool) {
+	switch {
+	case prev.Change == StoreAdded && ev.Change == StoreRemoved:
+		return StoreEvent{}, false
+	case prev.Change == StoreAdded:
+		ev.Change = StoreAdded
+	case prev.Change == StoreRemoved && ev.Change == StoreAdded:
+		ev.Change = StoreUpdated
+	}
+	return ev, true
+}
+
+// next removes and returns the oldest pending event.
+func (sub *storeSub) next() (StoreEvent, bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if len(sub.order) == 0 {
+		return StoreEvent{}, false
+	}
+	k := sub.order[0]
+	sub.order = sub.order[1:]
+	ev := sub.pending[k]
+	delete(sub.pending, k)
+	return ev, true
+}
+
+// run passes the pending events to the subscriber until its context is done,
+// or the store is done and the remaining events are passed.
+func (sub *storeSub) run(storeDone <-chan struct{}) {
+	ended := false
+	for {
+		ev, ok := sub.next()
+		if !ok {
+			if ended {
+				return
+			}
+			select {
+			case <-sub.wake:
+			case <-storeDone:
+				// The store queues no more events.
+				ended = true
+			case <-sub.ctx.Done():
+				return
+			}
+			continue
+		}
+		select {
+		case sub.events <- ev:
+		case <-sub.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package zeroconf
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// TextProvider makes the server ask fn for the TXT strings of a service each
+// time a query is answered with its TXT record, so that values like the load,
+// the free capacity or a nonce are current for every querier without a
+// SetText announcement per change. fn receives the entry, the address of the
+// querier and the interface the query was received on; it must not modify
+// the entry and may be called concurrently. If it returns nil, the Text of
+// the entry is used. Announcements always carry the Text, and further TXT
+// sets of TextSets are not affected.
+func TextProvider(fn func(e *ServiceEntry, from net.Addr, ifIndex int) []string) ServerOption {
+	return func(o *serverOpts) {
+		o.textProvider = fn
+	}
+}
+
+// provideText replaces the TXT record of Text of the entry in the answers
+// composed for it with the strings of the TextProvider. The provider is
+// asked once per message.
+func (s *Server) provideText(e *ServiceEntry, m *dns.Msg, from net.Addr, ifIndex int) {
+	if s.textProvider == nil {
+		return
+	}
+	name := e.ServiceInstanceName()
+	var txt []string
+	asked := false
+	for _, rrs := range [][]dns.RR{m.Answer, m.Extra} {
+		// The record of Text precedes those of TextSets, see txtRecords.
+		for i, rr := range rrs {
+			t, ok := rr.(*dns.TXT)
+			if !ok || t.Hdr.Name != name {
+				continue
+			}
+			if !asked {
+				text := s.textProvider(e, from, ifIndex)
+				if text == nil {
+					return
+				}
+				txt = make([]string, 0, len(text))
+				for _, t := range text {
+					txt = append(txt, chunks(t, 255)...)
+				}
+				if len(txt) == 0 {
+					// No empty rdata, see txtRecords.
+					txt = []string{""}
+				}
+				asked = true
+			}
+			rrs[i] = &dns.TXT{Hdr: t.Hdr, Txt: txt}
+			break
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package zeroconf
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// multicastRecordInterval is the minimum time between multicasts of the
+// same record on an interface, RFC6762 section 6.
+const multicastRecordInterval = time.Second
+
+// multicastKey identifies a record multicast on an interface.
+type multicastKey struct {
+	name    string // canonical name
+	rrtype  uint16
+	ifIndex int
+}
+
+// recordThrottle remembers the records multicast recently. RFC6762 section 6
+// forbids multicasting a record on an interface again within one second, so
+// a record asked for again, e.g. by aggressive scanners or several browsers
+// starting at once, is dropped from the next multicast response, while the
+// records not sent recently are still answered.
+type recordThrottle struct {
+	mu     sync.Mutex
+	sent   map[multicastKey]time.Time
+	pruned time.Time
+}
+
+func newRecordThrottle() *recordThrottle {
+	return &recordThrottle{sent: make(map[multicastKey]time.Time)}
+}
+
+// filter drops the records multicast on the interface within the interval
+// from the answer and additional sections of the response.
+func (t *recordThrottle) filter(resp *dns.Msg, ifIndex int, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keep := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			at, found := t.sent[newMulticastKey(rr, ifIndex)]
+			if !found || now.Sub(at) >= multicastRecordInterval || rr.Header().Rrtype == dns.TypeOPT {
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+	resp.Answer = keep(resp.Answer)
+	resp.Extra = keep(resp.Extra)
+}
+
+// add records that the records of the response were multicast on the
+// interface.
+func (t *recordThrottle) add(resp *dns.Msg, ifIndex int, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				t.sent[newMulticastKey(rr, ifIndex)] = now
+			}
+		}
+	}
+	if now.Sub(t.pruned) < multicastRecordInterval {
+		return
+	}
+	t.pruned = now
+	for k, at := range t.sent {
+		if now.Sub(at) >= multicastRecordInterval {
+			delete(t.sent, k)
+		}
+	}
+}
+
+func newMulticastKey(rr dns.RR, ifIndex int) multicastKey {
+	return multicastKey{dns.CanonicalName(rr.Header().Name), rr.Header().Rrtype, ifIndex}
+}
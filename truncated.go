@@ -0,0 +1,79 @@
+package zeroconf
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// truncatedResponseWindow is the time the records of a truncated response
+// are held for continuation packets of the same source, the upper bound of
+// the known answer interval of RFC6762 section 7.2.
+const truncatedResponseWindow = 500 * time.Millisecond
+
+// responseAssembly merges responses with the TC bit set with the responses
+// following from the same source. RFC6762 section 18.5 wants the bit to be
+// ignored on multicast responses, but some responders split large answers
+// this way; handling the first packet alone would deliver incomplete
+// entries. A response without the TC bit completes the merged response,
+// which is otherwise delivered once the window expires.
+type responseAssembly struct {
+	mu      sync.Mutex
+	pending map[string]*partialResponse // by source address
+	deliver func(*dns.Msg)
+}
+
+type partialResponse struct {
+	msg   *dns.Msg
+	timer *time.Timer
+}
+
+func newResponseAssembly(deliver func(*dns.Msg)) *responseAssembly {
+	return &responseAssembly{pending: make(map[string]*partialResponse), deliver: deliver}
+}
+
+// add returns the message to handle now, or nil if it is held back for the
+// continuation packets of its source.
+func (a *responseAssembly) add(msg *dns.Msg, src net.Addr) *dns.Msg {
+	if !msg.Response || src == nil {
+		return msg
+	}
+	key := src.String()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p := a.pending[key]
+	if p == nil {
+		if !msg.Truncated {
+			return msg
+		}
+		p = &partialResponse{msg: msg}
+		p.timer = time.AfterFunc(truncatedResponseWindow, func() { a.flush(key, p) })
+		a.pending[key] = p
+		return nil
+	}
+	p.msg.Answer = append(p.msg.Answer, msg.Answer...)
+	p.msg.Ns = append(p.msg.Ns, msg.Ns...)
+	p.msg.Extra = append(p.msg.Extra, msg.Extra...)
+	if msg.Truncated {
+		return nil
+	}
+	p.timer.Stop()
+	delete(a.pending, key)
+	p.msg.Truncated = false
+	return p.msg
+}
+
+// flush delivers a merged response whose continuation did not arrive in
+// time.
+func (a *responseAssembly) flush(key string, p *partialResponse) {
+	a.mu.Lock()
+	if a.pending[key] != p {
+		a.mu.Unlock()
+		return
+	}
+	delete(a.pending, key)
+	a.mu.Unlock()
+	a.deliver(p.msg)
+}
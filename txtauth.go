@@ -0,0 +1,70 @@
+package zeroconf
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+)
+
+// txtSignaturePrefix starts the TXT string carrying the signature.
+const txtSignaturePrefix = "hmac="
+
+// SignText returns the TXT strings with a signature appended, an HMAC-SHA256
+// of the strings and the port under the key shared by a closed fleet of
+// peers. A signature in text is replaced. Clients holding the key check
+// received entries with VerifyText to tell announcements of the fleet from
+// spoofed ones on open networks, e.g.
+//
+//	server, err := zeroconf.Register(instance, service, domain, port, zeroconf.SignText(key, port, text), nil)
+//
+// The instance and host names are not covered, so that the signature
+// survives renames; a peer replaying a signed record under another name still
+// points to the signed port, but may redirect clients to its own host.
+func SignText(key []byte, port int, text []string) []string {
+	signed := make([]string, 0, len(text)+1)
+	for _, txt := range text {
+		if !strings.HasPrefix(txt, txtSignaturePrefix) {
+			signed = append(signed, txt)
+		}
+	}
+	sig := textSignature(key, port, signed)
+	return append(signed, txtSignaturePrefix+base64.RawURLEncoding.EncodeToString(sig))
+}
+
+// VerifyText reports whether the TXT strings of the entry carry a valid
+// signature of SignText under the key.
+func VerifyText(key []byte, e *ServiceEntry) bool {
+	var text []string
+	var sig []byte
+	for _, txt := range e.Text {
+		if !strings.HasPrefix(txt, txtSignaturePrefix) {
+			text = append(text, txt)
+			continue
+		}
+		if sig != nil {
+			return false
+		}
+		var err error
+		if sig, err = base64.RawURLEncoding.DecodeString(strings.TrimPrefix(txt, txtSignaturePrefix)); err != nil {
+			return false
+		}
+	}
+	return sig != nil && hmac.Equal(sig, textSignature(key, e.Port, text))
+}
+
+// textSignature computes the HMAC of the port and the length-prefixed
+// strings, so that strings cannot be split or joined without notice.
+func textSignature(key []byte, port int, text []string) []byte {
+	mac := hmac.New(sha256.New, key)
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(port))
+	mac.Write(n[:])
+	for _, txt := range text {
+		binary.BigEndian.PutUint32(n[:], uint32(len(txt)))
+		mac.Write(n[:])
+		mac.Write([]byte(txt))
+	}
+	return mac.Sum(nil)
+}
@@ -1,6 +1,11 @@
 package zeroconf
 
-import "strings"
+import (
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
 
 func parseSubtypes(service string) (string, []string) {
 	subtypes := strings.Split(service, ",")
@@ -12,6 +17,145 @@ func trimDot(s string) string {
 	return strings.Trim(s, ".")
 }
 
+// equalNames reports whether two domain names are equal. DNS names are
+// compared case-insensitively, as some stacks randomize the case of queries.
+func equalNames(a, b string) bool {
+	return dns.CanonicalName(a) == dns.CanonicalName(b)
+}
+
+// matchName reports whether a received name equals a precomputed canonical
+// name. Fully qualified names are compared without allocating.
+func matchName(canonical, name string) bool {
+	if !strings.HasSuffix(name, ".") {
+		return canonical == dns.CanonicalName(name)
+	}
+	return strings.EqualFold(canonical, name)
+}
+
+// hasNameSuffix is the case-insensitive counterpart of strings.HasSuffix for
+// domain names.
+func hasNameSuffix(name, suffix string) bool {
+	return strings.HasSuffix(strings.ToLower(name), strings.ToLower(suffix))
+}
+
+// trimNameSuffix removes the suffix from a domain name, ignoring case. The
+// name is returned unchanged if it does not end with the suffix.
+func trimNameSuffix(name, suffix string) string {
+	if !hasNameSuffix(name, suffix) {
+		return name
+	}
+	return name[:len(name)-len(suffix)]
+}
+
+// SplitInstanceName returns the instance of a service instance name as
+// received, e.g. "My Printer" for "My\ Printer._ipp._tcp.local." and the
+// service name "_ipp._tcp.local.". The name is compared with the service
+// name label by label, ignoring case, so that an instance containing the
+// service name, e.g. "x_ipp._tcp", is returned intact, and the instance is
+// unescaped from the presentation format. ok is false unless the name is a
+// single label followed by the service name.
+func SplitInstanceName(name, service string) (instance string, ok bool) {
+	labels := dns.SplitDomainName(name)
+	suffix := dns.SplitDomainName(service)
+	if len(labels) != len(suffix)+1 {
+		return "", false
+	}
+	for i, label := range suffix {
+		if !strings.EqualFold(unescapeLabel(labels[i+1]), unescapeLabel(label)) {
+			return "", false
+		}
+	}
+	return unescapeLabel(labels[0]), true
+}
+
+// splitServiceName splits a service name, e.g. "_http._tcp.local.", into
+// the service type "_http._tcp" and the domain "local". ok is false for
+// other names, such as subtype names or the service type enumeration.
+func splitServiceName(name string) (service, domain string, ok bool) {
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 3 || !strings.HasPrefix(labels[0], "_") {
+		return "", "", false
+	}
+	if proto := strings.ToLower(labels[1]); proto != "_tcp" && proto != "_udp" {
+		return "", "", false
+	}
+	return labels[0] + "." + labels[1], strings.Join(labels[2:], "."), true
+}
+
+// presentationName writes a domain name given by the user in the
+// presentation format of received names, escaping the special and non-ASCII
+// bytes of each label, so that UTF-8 names compare equal to the received
+// ones. Escaped names are kept.
+func presentationName(name string) string {
+	labels := dns.SplitDomainName(name)
+	if labels == nil {
+		return name
+	}
+	for i, label := range labels {
+		labels[i] = escapeLabel(unescapeLabel(label))
+	}
+	escaped := strings.Join(labels, ".")
+	if strings.HasSuffix(name, ".") {
+		escaped += "."
+	}
+	return escaped
+}
+
+// escapeLabel escapes a label for use in a domain name in presentation
+// format, as the dns package prints received names: special characters are
+// preceded by a backslash, other bytes outside printable ASCII are written
+// as \DDD.
+func escapeLabel(label string) string {
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		switch {
+		case strings.IndexByte(`. '@;()"\`, c) >= 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			b.WriteByte('\\')
+			b.WriteString(strconv.Itoa(int(c) + 1000)[1:])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unescapeLabel is the inverse of escapeLabel.
+func unescapeLabel(label string) string {
+	if strings.IndexByte(label, '\\') < 0 {
+		return label
+	}
+	b := make([]byte, 0, len(label))
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if c != '\\' || i+1 == len(label) {
+			b = append(b, c)
+			continue
+		}
+		if i+3 < len(label) && isDigits(label[i+1:i+4]) {
+			n, _ := strconv.Atoi(label[i+1 : i+4])
+			b = append(b, byte(n))
+			i += 3
+			continue
+		}
+		b = append(b, label[i+1])
+		i++
+	}
+	return string(b)
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
 func chunks(s string, chunkSize int) []string {
 	if len(s) == 0 {
 		return nil
@@ -0,0 +1,123 @@
+package zeroconf
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// maxServiceNameLength is the limit of a service name, RFC 6335 section 5.1.
+const maxServiceNameLength = 15
+
+// serviceTypeEnumeration is the service type of DNS-SD service type
+// enumeration, RFC 6763 section 9.
+const serviceTypeEnumeration = "_services._dns-sd._udp"
+
+// ValidateServiceType checks the syntax of a service type like "_http._tcp"
+// and explains the problem found. Subtypes appended with commas are checked
+// as well. A type that does not pass is likely never answered.
+func ValidateServiceType(service string) error {
+	service, subtypes := parseSubtypes(service)
+	if err := validateServiceType(service); err != nil {
+		return err
+	}
+	for _, subtype := range subtypes {
+		if err := validateLabels("subtype", subtype); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateServiceType(service string) error {
+	service = trimDot(service)
+	if service == "" {
+		return fmt.Errorf("missing service name")
+	}
+	if strings.EqualFold(service, serviceTypeEnumeration) {
+		return nil
+	}
+	labels := strings.Split(service, ".")
+	if len(labels) != 2 {
+		return fmt.Errorf("service type %q must consist of two labels like _http._tcp", service)
+	}
+	name, proto := labels[0], labels[1]
+	if !strings.HasPrefix(name, "_") {
+		return fmt.Errorf("service type %q: missing leading underscore in %q", service, name)
+	}
+	if proto != "_tcp" && proto != "_udp" {
+		return fmt.Errorf("service type %q: protocol must be _tcp or _udp, not %q", service, proto)
+	}
+	name = name[1:]
+	if name == "" {
+		return fmt.Errorf("service type %q: empty service name", service)
+	}
+	if len(name) > maxServiceNameLength {
+		return fmt.Errorf("service type %q: type label too long, %q exceeds %d characters", service, name, maxServiceNameLength)
+	}
+	if name[0] == '-' || name[len(name)-1] == '-' {
+		return fmt.Errorf("service type %q: service name must not begin or end with a hyphen", service)
+	}
+	hasLetter := false
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			hasLetter = true
+		case c >= '0' && c <= '9', c == '-':
+		default:
+			return fmt.Errorf("service type %q: service name may only contain letters, digits and hyphens", service)
+		}
+	}
+	if !hasLetter {
+		return fmt.Errorf("service type %q: service name must contain a letter", service)
+	}
+	return nil
+}
+
+// OnServiceTypeWarning sets the function called when a domain is stripped
+// from a service type passed to Browse, Lookup or the other functions and
+// methods of the client, e.g. "_http._tcp.local." becomes "_http._tcp". By
+// default, a warning is logged.
+func OnServiceTypeWarning(fn func(given, normalized string)) ClientOption {
+	return func(o *clientOpts) {
+		o.typeWarning = fn
+	}
+}
+
+// OnServerServiceTypeWarning is the server counterpart of
+// OnServiceTypeWarning, for the service types passed to Register,
+// RegisterProxy and Server.RegisterService. NewService has no options and
+// always logs the warning.
+func OnServerServiceTypeWarning(fn func(given, normalized string)) ServerOption {
+	return func(o *serverOpts) {
+		o.typeWarning = fn
+	}
+}
+
+// normalizeServiceType strips a trailing domain and dots from a service type,
+// which would otherwise result in doubled domains. Subtypes are kept. A
+// stripped domain is reported to warn, or logged if it is nil.
+func normalizeServiceType(service string, warn func(given, normalized string)) string {
+	typ, subtypes := parseSubtypes(service)
+	normalized := trimDot(typ)
+	labels := strings.Split(normalized, ".")
+	switch {
+	case len(labels) > 3 && strings.EqualFold(strings.Join(labels[:3], "."), serviceTypeEnumeration):
+		normalized = strings.Join(labels[:3], ".")
+	case len(labels) > 2 && (labels[1] == "_tcp" || labels[1] == "_udp"):
+		normalized = strings.Join(labels[:2], ".")
+	}
+	if normalized == typ {
+		return service
+	}
+	result := strings.Join(append([]string{normalized}, subtypes...), ",")
+	if normalized != trimDot(typ) {
+		// Only a stripped domain is worth a warning, trailing dots are common.
+		if warn != nil {
+			warn(service, result)
+		} else {
+			log.Printf("[WARN] zeroconf: service type %q normalized to %q", service, result)
+		}
+	}
+	return result
+}
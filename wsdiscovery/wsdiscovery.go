@@ -0,0 +1,376 @@
+// Package wsdiscovery mirrors the services of a zeroconf.Server as
+// WS-Discovery target services, for Windows and ONVIF clients discovering
+// devices with WS-Discovery instead of mDNS. A Bridge multicasts Hello and
+// Bye messages and answers Probe and Resolve messages with the services of
+// the server. It is IPv4 only.
+package wsdiscovery
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdanielm/zeroconf"
+	"github.com/kdanielm/zeroconf/internal/bridge"
+	"golang.org/x/net/ipv4"
+)
+
+// Namespaces and actions of WS-Discovery 2005/04, as used by ONVIF.
+const (
+	nsSOAP       = "http://www.w3.org/2003/05/soap-envelope"
+	nsAddressing = "http://schemas.xmlsoap.org/ws/2004/08/addressing"
+	nsDiscovery  = "http://schemas.xmlsoap.org/ws/2005/04/discovery"
+	toDiscovery  = "urn:schemas-xmlsoap-org:ws:2005:04:discovery"
+	toAnonymous  = nsAddressing + "/role/anonymous"
+
+	actionHello          = nsDiscovery + "/Hello"
+	actionBye            = nsDiscovery + "/Bye"
+	actionProbe          = nsDiscovery + "/Probe"
+	actionProbeMatches   = nsDiscovery + "/ProbeMatches"
+	actionResolve        = nsDiscovery + "/Resolve"
+	actionResolveMatches = nsDiscovery + "/ResolveMatches"
+)
+
+// DevicesProfileNamespace is the namespace of the Devices Profile for Web
+// Services, used for the default type "wsdp:Device".
+const DevicesProfileNamespace = "http://schemas.xmlsoap.org/ws/2006/02/devprof"
+
+var groupAddr = &net.UDPAddr{IP: bridge.GroupIPv4, Port: 3702}
+
+// Config configures how services are mirrored. The zero value mirrors all
+// services as "wsdp:Device" without scopes.
+type Config struct {
+	// Types returns the qualified type names of a service, e.g.
+	// "dn:NetworkVideoTransmitter" for ONVIF cameras. Services without
+	// types are not mirrored. If nil, every service is a "wsdp:Device".
+	Types func(e *zeroconf.ServiceEntry) []string
+	// Scopes returns the scope URIs of a service. If nil, services have no
+	// scopes.
+	Scopes func(e *zeroconf.ServiceEntry) []string
+	// Namespaces maps the prefixes used by Types to namespace URIs. The
+	// "wsdp" prefix is predefined.
+	Namespaces map[string]string
+	// Interfaces to listen and send on. If empty, all multicast interfaces
+	// are used.
+	Interfaces []net.Interface
+}
+
+// Bridge answers WS-Discovery messages for the services of a server.
+type Bridge struct {
+	server *zeroconf.Server
+	config Config
+	conn   *ipv4.PacketConn
+	ifaces []net.Interface
+
+	instanceID int64
+	mu         sync.Mutex
+	messageNum int
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Start joins the WS-Discovery multicast group, sends Hello messages for the
+// services of the server and answers probes until the bridge is closed or
+// the server is shut down.
+func Start(server *zeroconf.Server, config Config) (*Bridge, error) {
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: groupAddr.Port})
+	if err != nil {
+		return nil, err
+	}
+	conn := ipv4.NewPacketConn(udp)
+	ifaces := config.Interfaces
+	if len(ifaces) == 0 {
+		ifaces = bridge.MulticastInterfaces(false)
+	}
+	var joined []net.Interface
+	for _, iface := range ifaces {
+		if err := conn.JoinGroup(&iface, &net.UDPAddr{IP: groupAddr.IP}); err == nil {
+			joined = append(joined, iface)
+		}
+	}
+	if len(joined) == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("could not join the ws-discovery group on any interface")
+	}
+	conn.SetMulticastLoopback(true)
+	if err := conn.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		// Answers are sent without choosing the interface.
+		log.Printf("[WARN] wsdiscovery: failed to enable control messages: %v", err)
+	}
+
+	b := &Bridge{
+		server:     server,
+		config:     config,
+		conn:       conn,
+		ifaces:     joined,
+		instanceID: time.Now().Unix(),
+		closed:     make(chan struct{}),
+	}
+	go b.recv()
+	go func() {
+		select {
+		case <-server.Done():
+			b.Close()
+		case <-b.closed:
+		}
+	}()
+	b.Announce()
+	return b, nil
+}
+
+// Announce multicasts a Hello message for each service, e.g. after a service
+// has been registered on the server.
+func (b *Bridge) Announce() {
+	for _, e := range b.server.Services() {
+		if t, ok := b.target(e); ok {
+			b.multicast(b.message(actionHello, toDiscovery, "", "<d:Hello>"+t.body()+"</d:Hello>"))
+		}
+	}
+}
+
+// Close multicasts a Bye message for each service and stops answering.
+func (b *Bridge) Close() {
+	b.closeOnce.Do(func() {
+		for _, e := range b.server.Services() {
+			if t, ok := b.target(e); ok {
+				b.multicast(b.message(actionBye, toDiscovery, "", "<d:Bye>"+t.reference()+"</d:Bye>"))
+			}
+		}
+		close(b.closed)
+		b.conn.Close()
+	})
+}
+
+func (b *Bridge) recv() {
+	buf := make([]byte, 65536)
+	for {
+		n, cm, from, err := b.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-b.closed:
+				return
+			default:
+			}
+			continue
+		}
+		ifIndex := 0
+		if cm != nil {
+			ifIndex = cm.IfIndex
+		}
+		b.handle(buf[:n], ifIndex, from)
+	}
+}
+
+// envelope is the part of a received message the bridge looks at.
+type envelope struct {
+	Header struct {
+		Action    string `xml:"Action"`
+		MessageID string `xml:"MessageID"`
+	} `xml:"Header"`
+	Body struct {
+		Probe *struct {
+			Types  string `xml:"Types"`
+			Scopes string `xml:"Scopes"`
+		} `xml:"Probe"`
+		Resolve *struct {
+			Address string `xml:"EndpointReference>Address"`
+		} `xml:"Resolve"`
+	} `xml:"Body"`
+}
+
+func (b *Bridge) handle(buf []byte, ifIndex int, from net.Addr) {
+	var env envelope
+	if err := xml.Unmarshal(buf, &env); err != nil {
+		return
+	}
+	var matches []string
+	var action, element string
+	switch {
+	case strings.TrimSpace(env.Header.Action) == actionProbe && env.Body.Probe != nil:
+		action, element = actionProbeMatches, "ProbeMatch"
+		for _, e := range b.server.Services() {
+			if t, ok := b.target(e); ok && t.matches(env.Body.Probe.Types, env.Body.Probe.Scopes) {
+				matches = append(matches, t.body())
+			}
+		}
+	case strings.TrimSpace(env.Header.Action) == actionResolve && env.Body.Resolve != nil:
+		action, element = actionResolveMatches, "ResolveMatch"
+		for _, e := range b.server.Services() {
+			if t, ok := b.target(e); ok && t.address == strings.TrimSpace(env.Body.Resolve.Address) {
+				matches = append(matches, t.body())
+			}
+		}
+	default:
+		return
+	}
+	if len(matches) == 0 {
+		return
+	}
+	var body strings.Builder
+	fmt.Fprintf(&body, "<d:%ses>", element)
+	for _, m := range matches {
+		fmt.Fprintf(&body, "<d:%s>%s</d:%s>", element, m, element)
+	}
+	fmt.Fprintf(&body, "</d:%ses>", element)
+
+	msg := b.message(action, toAnonymous, strings.TrimSpace(env.Header.MessageID), body.String())
+	var cm *ipv4.ControlMessage
+	if ifIndex != 0 {
+		cm = &ipv4.ControlMessage{IfIndex: ifIndex}
+	}
+	if _, err := b.conn.WriteTo(msg, cm, from); err != nil {
+		log.Printf("[WARN] wsdiscovery: failed to answer %s: %v", from, err)
+	}
+}
+
+func (b *Bridge) multicast(msg []byte) {
+	for i := range b.ifaces {
+		if err := b.conn.SetMulticastInterface(&b.ifaces[i]); err != nil {
+			continue
+		}
+		if _, err := b.conn.WriteTo(msg, nil, groupAddr); err != nil {
+			log.Printf("[WARN] wsdiscovery: failed to multicast on %s: %v", b.ifaces[i].Name, err)
+		}
+	}
+}
+
+// message returns a SOAP envelope with the addressing headers and the body.
+func (b *Bridge) message(action, to, relatesTo, body string) []byte {
+	b.mu.Lock()
+	b.messageNum++
+	num := b.messageNum
+	b.mu.Unlock()
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	fmt.Fprintf(&buf, `<s:Envelope xmlns:s="%s" xmlns:a="%s" xmlns:d="%s" xmlns:wsdp="%s"`,
+		nsSOAP, nsAddressing, nsDiscovery, DevicesProfileNamespace)
+	for prefix, ns := range b.config.Namespaces {
+		fmt.Fprintf(&buf, ` xmlns:%s="%s"`, prefix, escape(ns))
+	}
+	buf.WriteString(`><s:Header>`)
+	fmt.Fprintf(&buf, `<a:Action>%s</a:Action><a:MessageID>%s</a:MessageID>`, action, randomURN())
+	if relatesTo != "" {
+		fmt.Fprintf(&buf, `<a:RelatesTo>%s</a:RelatesTo>`, escape(relatesTo))
+	}
+	fmt.Fprintf(&buf, `<a:To>%s</a:To>`, to)
+	fmt.Fprintf(&buf, `<d:AppSequence InstanceId="%d" MessageNumber="%d"/>`, b.instanceID, num)
+	buf.WriteString(`</s:Header><s:Body>`)
+	buf.WriteString(body)
+	buf.WriteString(`</s:Body></s:Envelope>`)
+	return buf.Bytes()
+}
+
+// target is a service as seen by WS-Discovery.
+type target struct {
+	address string // Endpoint reference, stable for the service instance
+	types   []string
+	scopes  []string
+	xaddrs  []string
+}
+
+func (b *Bridge) target(e *zeroconf.ServiceEntry) (target, bool) {
+	t := target{address: instanceURN(e.ServiceInstanceName()), types: []string{"wsdp:Device"}}
+	if b.config.Types != nil {
+		t.types = b.config.Types(e)
+	}
+	if len(t.types) == 0 {
+		return t, false
+	}
+	if b.config.Scopes != nil {
+		t.scopes = b.config.Scopes(e)
+	}
+	path := bridge.Path(e.Text)
+	for _, ip := range e.AddrIPv4 {
+		t.xaddrs = append(t.xaddrs, fmt.Sprintf("http://%s%s", net.JoinHostPort(ip.String(), fmt.Sprint(e.Port)), path))
+	}
+	return t, true
+}
+
+func (t target) reference() string {
+	return "<a:EndpointReference><a:Address>" + t.address + "</a:Address></a:EndpointReference>"
+}
+
+func (t target) body() string {
+	var b strings.Builder
+	b.WriteString(t.reference())
+	fmt.Fprintf(&b, "<d:Types>%s</d:Types>", escape(strings.Join(t.types, " ")))
+	if len(t.scopes) > 0 {
+		fmt.Fprintf(&b, "<d:Scopes>%s</d:Scopes>", escape(strings.Join(t.scopes, " ")))
+	}
+	if len(t.xaddrs) > 0 {
+		fmt.Fprintf(&b, "<d:XAddrs>%s</d:XAddrs>", escape(strings.Join(t.xaddrs, " ")))
+	}
+	b.WriteString("<d:MetadataVersion>1</d:MetadataVersion>")
+	return b.String()
+}
+
+// matches reports whether the target matches the types and scopes of a
+// probe. Types are compared by local name, as the prefixes of the probe are
+// not resolved. Scopes match by prefix, the default rule of the
+// specification.
+func (t target) matches(types, scopes string) bool {
+	for _, want := range strings.Fields(types) {
+		found := false
+		for _, have := range t.types {
+			if localName(have) == localName(want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, want := range strings.Fields(scopes) {
+		found := false
+		for _, have := range t.scopes {
+			if strings.HasPrefix(have, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func localName(qname string) string {
+	if i := strings.LastIndex(qname, ":"); i >= 0 {
+		return qname[i+1:]
+	}
+	return qname
+}
+
+// instanceURN derives a stable UUID URN from the instance name, see
+// bridge.NameUUID.
+func instanceURN(name string) string {
+	return formatURN(bridge.NameUUID(name))
+}
+
+func randomURN() string {
+	u := make([]byte, 16)
+	rand.Read(u)
+	u[6] = u[6]&0x0f | 0x40 // version 4
+	u[8] = u[8]&0x3f | 0x80
+	return formatURN(u)
+}
+
+func formatURN(u []byte) string {
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
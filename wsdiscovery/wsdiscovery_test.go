@@ -0,0 +1,131 @@
+package wsdiscovery
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kdanielm/zeroconf"
+)
+
+func loopbackInterface(t *testing.T) net.Interface {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return iface
+		}
+	}
+	t.Skip("no loopback interface")
+	return net.Interface{}
+}
+
+// exchange sends the message to the bridge and returns the answer, or ""
+// if there is none.
+func exchange(t *testing.T, msg string) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.WriteTo([]byte(msg), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: groupAddr.Port}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, 65536)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func request(action, body string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>`+
+		`<s:Envelope xmlns:s="%s" xmlns:a="%s" xmlns:d="%s" xmlns:dn="http://www.onvif.org/ver10/network/wsdl">`+
+		`<s:Header><a:Action>%s</a:Action><a:MessageID>urn:uuid:0d1e</a:MessageID><a:To>%s</a:To></s:Header>`+
+		`<s:Body>%s</s:Body></s:Envelope>`, nsSOAP, nsAddressing, nsDiscovery, action, toDiscovery, body)
+}
+
+func TestBridge(t *testing.T) {
+	lo := loopbackInterface(t)
+	server, err := zeroconf.Register("Camera", "_http._tcp", "local.", 8080, []string{"path=/onvif/device_service"}, nil, zeroconf.LoopbackOnly())
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	bridge, err := Start(server, Config{
+		Types:      func(e *zeroconf.ServiceEntry) []string { return []string{"dn:NetworkVideoTransmitter"} },
+		Scopes:     func(e *zeroconf.ServiceEntry) []string { return []string{"onvif://www.onvif.org/location/kitchen"} },
+		Namespaces: map[string]string{"dn": "http://www.onvif.org/ver10/network/wsdl"},
+		Interfaces: []net.Interface{lo},
+	})
+	if err != nil {
+		t.Fatalf("Expected the bridge to start, but got %v", err)
+	}
+	defer bridge.Close()
+
+	address := instanceURN("Camera._http._tcp.local.")
+	tests := []struct {
+		name  string
+		msg   string
+		match string // expected element of the answer, "" for no answer
+	}{
+		{
+			name:  "probe",
+			msg:   request(actionProbe, "<d:Probe><d:Types>dn:NetworkVideoTransmitter</d:Types></d:Probe>"),
+			match: "<d:ProbeMatch>",
+		},
+		{
+			name:  "probe by scope",
+			msg:   request(actionProbe, "<d:Probe><d:Scopes>onvif://www.onvif.org/location</d:Scopes></d:Probe>"),
+			match: "<d:ProbeMatch>",
+		},
+		{
+			name: "probe for another type",
+			msg:  request(actionProbe, "<d:Probe><d:Types>dn:Printer</d:Types></d:Probe>"),
+		},
+		{
+			name:  "resolve",
+			msg:   request(actionResolve, "<d:Resolve><a:EndpointReference><a:Address>"+address+"</a:Address></a:EndpointReference></d:Resolve>"),
+			match: "<d:ResolveMatch>",
+		},
+		{
+			name: "resolve another address",
+			msg:  request(actionResolve, "<d:Resolve><a:EndpointReference><a:Address>urn:uuid:0d1e</a:Address></a:EndpointReference></d:Resolve>"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer := exchange(t, tt.msg)
+			if tt.match == "" {
+				if answer != "" {
+					t.Fatalf("Expected no answer, but got %s", answer)
+				}
+				return
+			}
+			for _, want := range []string{tt.match, address, "<a:RelatesTo>urn:uuid:0d1e</a:RelatesTo>", "http://127.0.0.1:8080/onvif/device_service"} {
+				if !strings.Contains(answer, want) {
+					t.Fatalf("Expected %s in the answer, but got %q", want, answer)
+				}
+			}
+		})
+	}
+}
+
+func TestInstanceURN(t *testing.T) {
+	a, b := instanceURN("Camera._http._tcp.local."), instanceURN("camera._HTTP._tcp.local.")
+	if a != b {
+		t.Fatalf("Expected the URN to ignore the case of the name, but got %s and %s", a, b)
+	}
+	// Version 5 and the RFC 4122 variant.
+	if len(a) != len("urn:uuid:")+36 || a[len("urn:uuid:")+14] != '5' || !strings.ContainsRune("89ab", rune(a[len("urn:uuid:")+19])) {
+		t.Fatalf("Expected a version 5 UUID, but got %s", a)
+	}
+}